@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AlertConfig raises an alert on the matched devices, all by default, while Expr is above or
+// below a threshold for at least For. Expr is a field or expression as in derived metrics.
+// With Per the threshold applies to how much Expr changes per Per instead, e.g.
+// {"expr": "temperature", "per": "1m", "above": 5} for a temperature rising faster than
+// 5°C a minute.
+//
+// Count and Aggregate turn the rule into one alert for the node, evaluated over the latest
+// value of every matched device. With Count it fires while at least Count devices cross the
+// threshold, with Aggregate (avg, min, max or sum) while the aggregate of their values does.
+type AlertConfig struct {
+	Name      string   `json:"name"`
+	Match     []string `json:"match"`
+	Expr      string   `json:"expr"`
+	Per       Duration `json:"per"`
+	Above     *float64 `json:"above"`
+	Below     *float64 `json:"below"`
+	For       Duration `json:"for"`
+	Count     int      `json:"count"`
+	Aggregate string   `json:"aggregate"`
+}
+
+// alertAggregates are the functions a node alert can aggregate device values with.
+var alertAggregates = []string{"avg", "min", "max", "sum"}
+
+// alertNode is the index of node alert events, which belong to no single device.
+const alertNode = -1
+
+type alertPoint struct {
+	timestamp time.Time
+	value     float64
+}
+
+type alertState struct {
+	// history holds the values within Per of the newest, plus the one before as the base
+	history []alertPoint
+	// since is when the condition started to hold, zero while it does not
+	since  time.Time
+	firing bool
+}
+
+type alertRule struct {
+	AlertConfig
+	expr   expr
+	states map[int]*alertState
+	// Node alerts keep the latest value of every device and their own state
+	values map[int]float64
+	node   alertState
+	// builtin rules are default alerts, matching the devices of one model
+	builtin bool
+}
+
+// Alerts evaluates the alert rules against every sample. It is only used from the main loop
+// and needs no locking.
+type Alerts struct {
+	rules    []*alertRule
+	defaults *DefaultAlertsConfig
+}
+
+func NewAlerts(configs []AlertConfig, defaults *DefaultAlertsConfig) (*Alerts, error) {
+	if err := defaults.validate(); err != nil {
+		return nil, err
+	}
+	a := &Alerts{defaults: defaults}
+	for i, ac := range configs {
+		if ac.Name == "" {
+			return nil, fmt.Errorf("alerts[%d]: name must not be empty", i)
+		}
+		e, err := parseExpr(ac.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("alerts[%d]: invalid expression %q: %v", i, ac.Expr, err)
+		}
+		if ac.Above == nil && ac.Below == nil {
+			return nil, fmt.Errorf("alerts[%d]: above or below must be set", i)
+		}
+		if ac.Per.Duration < 0 || ac.For.Duration < 0 {
+			return nil, fmt.Errorf("alerts[%d]: per and for must not be negative", i)
+		}
+		if ac.Count < 0 {
+			return nil, fmt.Errorf("alerts[%d]: count must not be negative", i)
+		}
+		if ac.Aggregate != "" && !slices.Contains(alertAggregates, ac.Aggregate) {
+			return nil, fmt.Errorf("alerts[%d]: unknown aggregate %q, expected one of %s", i, ac.Aggregate, strings.Join(alertAggregates, ", "))
+		}
+		if ac.Count > 0 && ac.Aggregate != "" {
+			return nil, fmt.Errorf("alerts[%d]: count and aggregate are mutually exclusive", i)
+		}
+		if err := validatePatterns(ac.Match); err != nil {
+			return nil, fmt.Errorf("alerts[%d]: %v", i, err)
+		}
+		a.rules = append(a.rules, &alertRule{AlertConfig: ac, expr: e, states: make(map[int]*alertState), values: make(map[int]float64)})
+	}
+	return a, nil
+}
+
+// Observe evaluates the rules matching the sample's device and returns an alert_firing or
+// alert_resolved event for every alert that changed.
+func (a *Alerts) Observe(s Sample) []DeviceEvent {
+	if a == nil || len(a.rules) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("Unable to marshal sample for alerts: %v", err)
+		return nil
+	}
+	var record map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&record); err != nil {
+		log.Printf("Unable to decode sample for alerts: %v", err)
+		return nil
+	}
+	lookup := func(name string) (float64, bool) {
+		return recordNumber(record, name)
+	}
+
+	d := Device{Index: s.Index, UUID: s.UUID}
+	var events []DeviceEvent
+	for _, rule := range a.rules {
+		if len(rule.Match) > 0 && !matchDevice(rule.Match, d) {
+			continue
+		}
+		state, ok := rule.states[s.Index]
+		if !ok {
+			state = &alertState{}
+			rule.states[s.Index] = state
+		}
+		if s.Suspended != 0 {
+			// A rate across the suspend would be meaningless
+			state.history = nil
+		}
+		v, err := rule.expr.eval(lookup)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		value, ok := rule.value(state, s.Timestamp, v)
+		if !ok {
+			continue
+		}
+		if rule.Count == 0 && rule.Aggregate == "" {
+			if e, ok := rule.update(state, s.Timestamp, value, d); ok {
+				events = append(events, e)
+			}
+			continue
+		}
+		rule.values[s.Index] = value
+		if e, ok := rule.update(&rule.node, s.Timestamp, rule.nodeValue(), Device{Index: alertNode}); ok {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// update moves the alert of state on with the latest value and returns the event if it
+// started firing or resolved.
+func (r *alertRule) update(state *alertState, t time.Time, value float64, d Device) (DeviceEvent, bool) {
+	holds := r.crosses(value)
+	if r.Count > 0 {
+		holds = value >= float64(r.Count)
+	}
+	switch {
+	case holds && !state.firing:
+		if state.since.IsZero() {
+			state.since = t
+		}
+		if t.Sub(state.since) >= r.For.Duration {
+			state.firing = true
+			log.Printf("Alert %s firing for %s at %g", r.Name, alertSubject(d), value)
+			return r.event("alert_firing", d, value), true
+		}
+	case !holds:
+		state.since = time.Time{}
+		if state.firing {
+			state.firing = false
+			log.Printf("Alert %s resolved for %s at %g", r.Name, alertSubject(d), value)
+			return r.event("alert_resolved", d, value), true
+		}
+	}
+	return DeviceEvent{}, false
+}
+
+func (r *alertRule) crosses(value float64) bool {
+	return (r.Above != nil && value > *r.Above) || (r.Below != nil && value < *r.Below)
+}
+
+// nodeValue returns how many devices cross the threshold for Count, or the aggregate of the
+// device values.
+func (r *alertRule) nodeValue() float64 {
+	var count, sum float64
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range r.values {
+		if r.crosses(v) {
+			count++
+		}
+		sum += v
+		lo, hi = min(lo, v), max(hi, v)
+	}
+	switch {
+	case r.Count > 0:
+		return count
+	case r.Aggregate == "avg":
+		return sum / float64(len(r.values))
+	case r.Aggregate == "min":
+		return lo
+	case r.Aggregate == "max":
+		return hi
+	}
+	return sum
+}
+
+func alertSubject(d Device) string {
+	if d.Index == alertNode {
+		return "the node"
+	}
+	return fmt.Sprintf("device %d", d.Index)
+}
+
+// value returns the value the thresholds apply to, v itself or its rate of change per Per.
+// A rate needs values spanning at least Per, until then it returns false.
+func (r *alertRule) value(state *alertState, t time.Time, v float64) (float64, bool) {
+	per := r.Per.Duration
+	if per == 0 {
+		return v, true
+	}
+	state.history = append(state.history, alertPoint{timestamp: t, value: v})
+	for len(state.history) > 2 && t.Sub(state.history[1].timestamp) >= per {
+		state.history = state.history[1:]
+	}
+	base := state.history[0]
+	elapsed := t.Sub(base.timestamp)
+	if len(state.history) < 2 || elapsed < per {
+		return 0, false
+	}
+	return (v - base.value) / elapsed.Seconds() * per.Seconds(), true
+}
+
+func (r *alertRule) event(name string, d Device, value float64) DeviceEvent {
+	e := newDeviceEvent(name, d, nil)
+	e.Alert = r.Name
+	e.Value = &value
+	return e
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// annotationDefaultDuration is how long the labels of an annotation without a duration
+	// are attached to samples
+	annotationDefaultDuration = 24 * time.Hour
+	annotationMaxBody         = 64 << 10
+)
+
+// AnnotationsConfig serves POST /annotations on Listen. Requests must carry Token as a
+// bearer token when it is set.
+type AnnotationsConfig struct {
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+// Annotation is posted by external systems such as CI or schedulers, e.g.
+// {"text": "training run 42 started", "labels": {"run": "42"}, "duration": "12h"}.
+// Its labels are attached to the samples of the matched devices, all by default, until the
+// duration has passed. A later annotation overrides a label, an empty value removes it.
+type Annotation struct {
+	Event     string            `json:"event"`
+	Epoch     int64             `json:"epoch"`
+	Timestamp time.Time         `json:"timestamp"`
+	Text      string            `json:"text"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Match     []string          `json:"match,omitempty"`
+	Duration  Duration          `json:"duration"`
+}
+
+// Annotations stores the annotations whose labels are still attached to samples. It is shared
+// by the pollers and the HTTP handler.
+type Annotations struct {
+	mu     sync.Mutex
+	active []Annotation
+	token  string
+	// received passes new annotations to the main loop, which emits them as events
+	received chan<- Annotation
+}
+
+func NewAnnotations(cfg AnnotationsConfig, received chan<- Annotation) *Annotations {
+	return &Annotations{token: cfg.Token, received: received}
+}
+
+// Add stores a and returns it as it will be emitted.
+func (a *Annotations) Add(an Annotation) Annotation {
+	an.Event = "annotation"
+	an.Epoch = epoch
+	an.Timestamp = time.Now()
+	if an.Duration.Duration == 0 {
+		an.Duration.Duration = annotationDefaultDuration
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire(an.Timestamp)
+	if len(an.Labels) > 0 {
+		a.active = append(a.active, an)
+	}
+	return an
+}
+
+func (a *Annotations) expire(now time.Time) {
+	active := a.active[:0]
+	for _, an := range a.active {
+		if now.Sub(an.Timestamp) < an.Duration.Duration {
+			active = append(active, an)
+		}
+	}
+	a.active = active
+}
+
+// Labels returns the labels of the annotations currently attached to the device.
+func (a *Annotations) Labels(d Device) map[string]string {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire(time.Now())
+	var labels map[string]string
+	for _, an := range a.active {
+		if len(an.Match) > 0 && !matchDevice(an.Match, d) {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		maps.Copy(labels, an.Labels)
+	}
+	maps.DeleteFunc(labels, func(_, v string) bool { return v == "" })
+	return labels
+}
+
+func (a *Annotations) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var an Annotation
+	dec := json.NewDecoder(io.LimitReader(r.Body, annotationMaxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&an); err != nil {
+		http.Error(w, fmt.Sprintf("invalid annotation: %v", err), http.StatusBadRequest)
+		return
+	}
+	if an.Text == "" && len(an.Labels) == 0 {
+		http.Error(w, "invalid annotation: text or labels must be set", http.StatusBadRequest)
+		return
+	}
+	if err := validatePatterns(an.Match); err != nil {
+		http.Error(w, fmt.Sprintf("invalid annotation: %v", err), http.StatusBadRequest)
+		return
+	}
+	if an.Duration.Duration < 0 {
+		http.Error(w, "invalid annotation: duration must not be negative", http.StatusBadRequest)
+		return
+	}
+	an = a.Add(an)
+	a.received <- an
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(an)
+}
+
+// serveAnnotations serves /annotations on addr to the operator role. It never returns.
+func serveAnnotations(addr string, a *Annotations, auth *Authorizer) {
+	mux := http.NewServeMux()
+	mux.Handle("/annotations", auth.Require("operator", a))
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	log.Fatalf("Unable to serve annotations: %v", server.ListenAndServe())
+}
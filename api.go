@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// MetricsAPI keeps the latest sample of every device, and with history the last samples, for
+// node-local agents to query on /api/v1/metrics.
+type MetricsAPI struct {
+	history int
+	mu      sync.Mutex
+	devices map[int]*apiDevice
+}
+
+type apiDevice struct {
+	latest Sample
+	// ring holds the last samples once full, next is the slot the next sample goes to
+	ring []Sample
+	next int
+}
+
+// apiMetrics is the state of a device served by the API, oldest sample first in History.
+type apiMetrics struct {
+	Index   int      `json:"index"`
+	UUID    string   `json:"uuid"`
+	Latest  Sample   `json:"latest"`
+	History []Sample `json:"history,omitempty"`
+}
+
+// NewMetricsAPI keeps the last history samples of every device, only the latest without.
+func NewMetricsAPI(history int) *MetricsAPI {
+	return &MetricsAPI{history: history, devices: make(map[int]*apiDevice)}
+}
+
+// Observe records the device's latest sample.
+func (a *MetricsAPI) Observe(s Sample) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d, ok := a.devices[s.Index]
+	if !ok {
+		d = &apiDevice{}
+		a.devices[s.Index] = d
+	}
+	d.latest = s
+	if a.history == 0 {
+		return
+	}
+	if len(d.ring) < a.history {
+		d.ring = append(d.ring, s)
+		return
+	}
+	d.ring[d.next] = s
+	d.next = (d.next + 1) % a.history
+}
+
+// Forget drops a device, e.g. one that fell off the bus.
+func (a *MetricsAPI) Forget(index int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.devices, index)
+}
+
+// ServeHTTP serves the devices ordered by index. ?device= limits them to the devices matching
+// the index or UUID pattern, ?history=true adds the recent samples.
+func (a *MetricsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("device")
+	if err := validatePatterns([]string{pattern}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	history := r.URL.Query().Get("history") == "true"
+
+	a.mu.Lock()
+	metrics := make([]apiMetrics, 0, len(a.devices))
+	for index, d := range a.devices {
+		if pattern != "" && !matchDevice([]string{pattern}, Device{Index: index, UUID: d.latest.UUID}) {
+			continue
+		}
+		m := apiMetrics{Index: index, UUID: d.latest.UUID, Latest: d.latest}
+		if history {
+			m.History = append(slices.Clone(d.ring[d.next:]), d.ring[:d.next]...)
+		}
+		metrics = append(metrics, m)
+	}
+	a.mu.Unlock()
+	slices.SortFunc(metrics, func(a, b apiMetrics) int { return a.Index - b.Index })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
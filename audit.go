@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditConfig appends a record of every change to GPU state to the file at Path. Loki also
+// pushes the records to a Loki server.
+type AuditConfig struct {
+	Path string      `json:"path"`
+	Loki *LokiConfig `json:"loki"`
+}
+
+// LokiConfig pushes audit records to URL, e.g. http://loki:3100, as one stream with Labels.
+type LokiConfig struct {
+	URL     string            `json:"url"`
+	Labels  map[string]string `json:"labels"`
+	Headers map[string]string `json:"headers"`
+}
+
+// AuditRecord describes one management action. User is the account the agent runs as and
+// Actor the policy that asked for the change.
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Host      string    `json:"host"`
+	User      string    `json:"user"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Index     int       `json:"index"`
+	UUID      string    `json:"uuid"`
+	Previous  float64   `json:"previous,omitempty"`
+	New       float64   `json:"new"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditLog is set once at startup, like readOnly. Device methods that change GPU state
+// record to it, so no action can bypass the audit log.
+var auditLog *AuditLog
+
+// AuditLog writes audit records to an append-only file, synced after every record.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	host string
+	user string
+	loki *lokiPusher
+}
+
+func NewAuditLog(cfg AuditConfig) (*AuditLog, error) {
+	file, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %v", err)
+	}
+	a := &AuditLog{file: file, user: strconv.Itoa(os.Getuid())}
+	a.host = hostName()
+	if u, err := user.Current(); err == nil {
+		a.user = u.Username
+	}
+	if cfg.Loki != nil {
+		a.loki = newLokiPusher(*cfg.Loki)
+		go a.loki.Run()
+	}
+	return a, nil
+}
+
+// Record appends r to the log, failures are logged since the action already happened.
+func (a *AuditLog) Record(r AuditRecord) {
+	if a == nil {
+		return
+	}
+	r.Timestamp = time.Now()
+	r.Host = a.host
+	r.User = a.user
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Unable to marshal audit record: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Unable to write audit record: %v", err)
+	} else if err := a.file.Sync(); err != nil {
+		log.Printf("Unable to sync audit log: %v", err)
+	}
+	a.loki.Send(r.Timestamp, line)
+}
+
+type lokiEntry struct {
+	timestamp time.Time
+	line      []byte
+}
+
+// lokiPusher delivers audit records in the background, like a webhook.
+type lokiPusher struct {
+	url     string
+	labels  map[string]string
+	headers map[string]string
+	client  *http.Client
+	queue   chan lokiEntry
+}
+
+func newLokiPusher(cfg LokiConfig) *lokiPusher {
+	labels := map[string]string{"job": "gpumon-go"}
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	return &lokiPusher{
+		url:     strings.TrimSuffix(cfg.URL, "/") + "/loki/api/v1/push",
+		labels:  labels,
+		headers: cfg.Headers,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan lokiEntry, webhookQueueSize),
+	}
+}
+
+func (l *lokiPusher) Send(ts time.Time, line []byte) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.queue <- lokiEntry{timestamp: ts, line: line}:
+	default:
+		log.Printf("Loki %s is not keeping up, dropped an audit record", l.url)
+	}
+}
+
+// Run pushes queued records. It never returns.
+func (l *lokiPusher) Run() {
+	for e := range l.queue {
+		var err error
+		for attempt := 0; attempt < webhookAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = l.push(e); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to push audit record to %s: %v", l.url, err)
+		}
+	}
+}
+
+func (l *lokiPusher) push(e lokiEntry) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	body, err := json.Marshal(map[string][]stream{"streams": {{
+		Stream: l.labels,
+		Values: [][2]string{{strconv.FormatInt(e.timestamp.UnixNano(), 10), string(e.line)}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range l.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
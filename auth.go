@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// apiRoles are the roles API tokens can have, each allowed everything the ones before it are.
+var apiRoles = []string{"viewer", "operator", "admin"}
+
+// APITokenConfig grants requests carrying Token as a bearer token a role on the HTTP
+// endpoints: viewer reads /api/v1, operator also posts annotations and admin may do anything.
+type APITokenConfig struct {
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// Authorizer checks the bearer tokens of requests to the HTTP endpoints. Without tokens every
+// request is allowed.
+type Authorizer struct {
+	tokens []APITokenConfig
+}
+
+func NewAuthorizer(configs []APITokenConfig) (*Authorizer, error) {
+	tokens := make(map[string]bool)
+	for i, tc := range configs {
+		if tc.Token == "" {
+			return nil, fmt.Errorf("api_tokens[%d]: token must not be empty", i)
+		}
+		if !slices.Contains(apiRoles, tc.Role) {
+			return nil, fmt.Errorf("api_tokens[%d]: role must be one of %s", i, strings.Join(apiRoles, ", "))
+		}
+		if tokens[tc.Token] {
+			return nil, fmt.Errorf("api_tokens[%d]: duplicate token", i)
+		}
+		tokens[tc.Token] = true
+	}
+	return &Authorizer{tokens: configs}, nil
+}
+
+// Require only passes requests to next whose bearer token has role or a higher one.
+func (a *Authorizer) Require(role string, next http.Handler) http.Handler {
+	if a == nil || len(a.tokens) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		granted, ok := a.role(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gpumon"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if slices.Index(apiRoles, granted) < slices.Index(apiRoles, role) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// role returns the role of the request's bearer token. Every token is compared in constant
+// time, so the response time does not tell which one nearly matched.
+func (a *Authorizer) role(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	var role string
+	for _, tc := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tc.Token)) == 1 {
+			role = tc.Role
+		}
+	}
+	return role, role != ""
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizerRequire(t *testing.T) {
+	tokens := []APITokenConfig{
+		{Token: "view", Role: "viewer"},
+		{Token: "operate", Role: "operator"},
+		{Token: "administer", Role: "admin"},
+	}
+	tests := []struct {
+		name   string
+		tokens []APITokenConfig
+		role   string
+		header string
+		want   int
+	}{
+		{name: "no tokens configured", role: "operator", want: http.StatusOK},
+		{name: "missing token", tokens: tokens, role: "viewer", want: http.StatusUnauthorized},
+		{name: "unknown token", tokens: tokens, role: "viewer", header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "not a bearer token", tokens: tokens, role: "viewer", header: "Basic view", want: http.StatusUnauthorized},
+		{name: "viewer reads", tokens: tokens, role: "viewer", header: "Bearer view", want: http.StatusOK},
+		{name: "viewer cannot annotate", tokens: tokens, role: "operator", header: "Bearer view", want: http.StatusForbidden},
+		{name: "operator annotates", tokens: tokens, role: "operator", header: "Bearer operate", want: http.StatusOK},
+		{name: "operator reads", tokens: tokens, role: "viewer", header: "Bearer operate", want: http.StatusOK},
+		{name: "operator is not admin", tokens: tokens, role: "admin", header: "Bearer operate", want: http.StatusForbidden},
+		{name: "admin may do anything", tokens: tokens, role: "operator", header: "Bearer administer", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := NewAuthorizer(tt.tokens)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := auth.Require(tt.role, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/metrics", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAuthorizerErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []APITokenConfig
+	}{
+		{name: "empty token", tokens: []APITokenConfig{{Role: "viewer"}}},
+		{name: "unknown role", tokens: []APITokenConfig{{Token: "x", Role: "root"}}},
+		{name: "duplicate token", tokens: []APITokenConfig{{Token: "x", Role: "viewer"}, {Token: "x", Role: "admin"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAuthorizer(tt.tokens); err == nil {
+				t.Errorf("NewAuthorizer() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// awsMaxResponse bounds the responses read by awsAPI.
+const awsMaxResponse = 1 << 20
+
+// awsAPI sends SigV4 signed requests to the AWS services this module has no SDK client for.
+type awsAPI struct {
+	cfg    aws.Config
+	client *http.Client
+	signer *v4.Signer
+}
+
+func newAWSAPI(cfg aws.Config) *awsAPI {
+	return &awsAPI{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}, signer: v4.NewSigner()}
+}
+
+// awsServiceIDs are the service IDs of the endpoint prefixes, as they appear in the
+// AWS_ENDPOINT_URL_<ID> variables.
+var awsServiceIDs = map[string]string{
+	"monitoring": "CLOUDWATCH",
+	"logs":       "CLOUDWATCH_LOGS",
+	"s3":         "S3",
+	"sns":        "SNS",
+	"ssm":        "SSM",
+}
+
+// awsPartitions are the DNS suffixes of the partitions other than aws, by region prefix.
+var awsPartitions = []struct {
+	prefix string
+	suffix string
+}{
+	{"cn-", "amazonaws.com.cn"},
+	{"us-isob-", "sc2s.sgov.gov"},
+	{"us-isof-", "csp.hci.ic.gov"},
+	{"us-iso-", "c2s.ic.gov"},
+	{"eu-isoe-", "cloud.adc-e.uk"},
+	{"eusc-", "amazonaws.eu"},
+}
+
+// awsDNSSuffix returns the DNS suffix of the partition the region is in.
+func awsDNSSuffix(region string) string {
+	for _, p := range awsPartitions {
+		if strings.HasPrefix(region, p.prefix) {
+			return p.suffix
+		}
+	}
+	return "amazonaws.com"
+}
+
+// configuredEndpoint returns the endpoint set for the service with AWS_ENDPOINT_URL_<ID>, or
+// for all services with AWS_ENDPOINT_URL, like the SDK clients resolve it.
+func (a *awsAPI) configuredEndpoint(service string) (string, bool) {
+	if os.Getenv("AWS_IGNORE_CONFIGURED_ENDPOINT_URLS") == "true" {
+		return "", false
+	}
+	if id, ok := awsServiceIDs[service]; ok {
+		if endpoint := os.Getenv("AWS_ENDPOINT_URL_" + id); endpoint != "" {
+			return endpoint, true
+		}
+	}
+	if a.cfg.BaseEndpoint != nil {
+		return *a.cfg.BaseEndpoint, true
+	}
+	return "", false
+}
+
+// endpoint returns the regional endpoint of the service in the partition of the region, its
+// FIPS endpoint in FIPS builds, or the configured endpoint.
+func (a *awsAPI) endpoint(service, region string) string {
+	if endpoint, ok := a.configuredEndpoint(service); ok {
+		return endpoint
+	}
+	if fipsBuild {
+		service += "-fips"
+	}
+	return "https://" + service + "." + region + "." + awsDNSSuffix(region) + "/"
+}
+
+// loadAWSConfig loads the AWS config from the environment like config.LoadDefaultConfig, with
+// the FIPS endpoints in FIPS builds.
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if fipsBuild {
+		opts = append(opts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if offline {
+		opts = append(opts, config.WithHTTPClient(offlineAWSClient()))
+	}
+	return config.LoadDefaultConfig(ctx, opts...)
+}
+
+// do signs and sends the request and returns the body of a successful response.
+func (a *awsAPI) do(req *http.Request, payload []byte, service, region string, optFns ...func(*v4.SignerOptions)) ([]byte, *http.Response, error) {
+	creds, err := a.cfg.Credentials.Retrieve(req.Context())
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get AWS credentials: %v", err)
+	}
+	hash := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if err := a.signer.SignHTTP(req.Context(), creds, req, payloadHash, service, region, time.Now(), optFns...); err != nil {
+		return nil, nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, awsMaxResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return body, resp, nil
+}
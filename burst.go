@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// BurstConfig takes Samples readings of the power and GPU utilization per poll, Spacing
+// (default 100ms) apart, so short spikes between polls show up in the min and max.
+type BurstConfig struct {
+	// Samples counts the reading of the sample itself, at least 2
+	Samples int      `json:"samples"`
+	Spacing Duration `json:"spacing"`
+}
+
+// BurstStats summarizes the readings of a metric within a poll.
+type BurstStats struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// Burst is the summary of the readings taken within a poll. Samples is how many of them
+// succeeded, including the reading of the sample itself.
+type Burst struct {
+	Samples  int        `json:"samples"`
+	Power    BurstStats `json:"power"`
+	GpuUsage BurstStats `json:"gpu_usage"`
+}
+
+// collectBurst reads the power and GPU utilization of the device until it has cfg.Samples
+// readings, starting from the ones in metrics. Failed readings are left out.
+func collectBurst(d Device, cfg BurstConfig, metrics Metrics) Burst {
+	spacing := cfg.Spacing.Duration
+	if spacing == 0 {
+		spacing = 100 * time.Millisecond
+	}
+	power := []float64{float64(metrics.Power)}
+	usage := []float64{float64(metrics.GpuUsage)}
+	for i := 1; i < cfg.Samples; i++ {
+		time.Sleep(spacing)
+		p, err := d.GetPower()
+		if err != nil {
+			continue
+		}
+		u, _, _, err := d.GetUtilization()
+		if err != nil {
+			continue
+		}
+		power = append(power, float64(p))
+		usage = append(usage, float64(u))
+	}
+	return Burst{Samples: len(power), Power: burstStats(power), GpuUsage: burstStats(usage)}
+}
+
+func burstStats(values []float64) BurstStats {
+	s := BurstStats{Min: values[0], Max: values[0]}
+	for _, v := range values {
+		s.Min = min(s.Min, v)
+		s.Max = max(s.Max, v)
+		s.Avg += v
+	}
+	s.Avg /= float64(len(values))
+	return s
+}
+
+// statisticValues returns the readings as a CloudWatch statistic set.
+func (s BurstStats) statisticValues(samples int) *types.StatisticSet {
+	return &types.StatisticSet{
+		Minimum:     aws.Float64(s.Min),
+		Maximum:     aws.Float64(s.Max),
+		Sum:         aws.Float64(s.Avg * float64(samples)),
+		SampleCount: aws.Float64(float64(samples)),
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// Capabilities lists which metrics and management features a device supports. A query that
+// fails for any reason, including missing permissions, counts as unsupported.
+type Capabilities struct {
+	Index int    `json:"index"`
+	UUID  string `json:"uuid"`
+	Name  string `json:"name"`
+	// Metrics
+	Temperature    bool `json:"temperature"`
+	Power          bool `json:"power"`
+	Utilization    bool `json:"utilization"`
+	Memory         bool `json:"memory"`
+	PcieThroughput bool `json:"pcie_throughput"`
+	Processes      bool `json:"processes"`
+	Clocks         bool `json:"clocks"`
+	FanSpeed       bool `json:"fan_speed"`
+	Encoder        bool `json:"encoder"`
+	Throttle       bool `json:"throttle"`
+	Display        bool `json:"display"`
+	// Features
+	NVLink     bool `json:"nvlink"`
+	MIG        bool `json:"mig"`
+	ECC        bool `json:"ecc"`
+	GPM        bool `json:"gpm"`
+	FanControl bool `json:"fan_control"`
+}
+
+// deviceModel returns the model name of the device, empty when it is unknown.
+func deviceModel(d Device) string {
+	if d.Handle == nil {
+		name, _ := d.Sensors.Name()
+		return name
+	}
+	name, _ := d.Handle.GetName()
+	return name
+}
+
+// ProbeCapabilities queries every capability of the device once.
+func ProbeCapabilities(d Device) Capabilities {
+	c := Capabilities{Index: d.Index, UUID: d.UUID}
+	if d.Handle == nil {
+		// Other backends only read the core metrics
+		c.Name, _ = d.Sensors.Name()
+		_, err := d.GetTemperature()
+		c.Temperature = err == nil
+		_, err = d.GetPower()
+		c.Power = err == nil
+		_, _, _, err = d.GetUtilization()
+		c.Utilization, c.Memory = err == nil, err == nil
+		return c
+	}
+	c.Name, _ = d.Handle.GetName()
+	_, ret := d.Handle.GetTemperature(nvml.TEMPERATURE_GPU)
+	c.Temperature = ret == nvml.SUCCESS
+	_, ret = d.Handle.GetPowerUsage()
+	c.Power = ret == nvml.SUCCESS
+	_, ret = d.Handle.GetUtilizationRates()
+	c.Utilization = ret == nvml.SUCCESS
+	_, ret = d.Handle.GetMemoryInfo()
+	c.Memory = ret == nvml.SUCCESS
+	_, ret = d.Handle.GetPcieThroughput(nvml.PCIE_UTIL_RX_BYTES)
+	c.PcieThroughput = ret == nvml.SUCCESS
+	_, ret = d.Handle.GetComputeRunningProcesses()
+	c.Processes = ret == nvml.SUCCESS
+	_, ret = d.Handle.GetClockInfo(nvml.CLOCK_SM)
+	c.Clocks = ret == nvml.SUCCESS
+	_, ret = d.Handle.GetFanSpeed()
+	c.FanSpeed = ret == nvml.SUCCESS
+	_, _, ret = d.Handle.GetEncoderUtilization()
+	c.Encoder = ret == nvml.SUCCESS
+	pstate, ret := d.Handle.GetPerformanceState()
+	c.Throttle = ret == nvml.SUCCESS && pstate != nvml.PSTATE_UNKNOWN
+	_, ret = d.Handle.GetDisplayMode()
+	c.Display = ret == nvml.SUCCESS
+
+	for link := 0; link < nvml.NVLINK_MAX_LINKS && !c.NVLink; link++ {
+		state, ret := d.Handle.GetNvLinkState(link)
+		c.NVLink = ret == nvml.SUCCESS && state == nvml.FEATURE_ENABLED
+	}
+	_, _, ret = d.Handle.GetMigMode()
+	c.MIG = ret == nvml.SUCCESS
+	_, _, ret = d.Handle.GetEccMode()
+	c.ECC = ret == nvml.SUCCESS
+	gpm, ret := d.Handle.GpmQueryDeviceSupport()
+	c.GPM = ret == nvml.SUCCESS && gpm.IsSupportedDevice != 0
+	if fans, ret := d.Handle.GetNumFans(); ret == nvml.SUCCESS && fans > 0 {
+		_, ret = d.Handle.GetFanControlPolicy_v2(0)
+		c.FanControl = ret == nvml.SUCCESS
+	}
+	return c
+}
+
+// capabilitiesCommand implements the capabilities subcommand and returns the exit code.
+func capabilitiesCommand(args []string) int {
+	fs := flag.NewFlagSet("capabilities", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print capabilities as JSON")
+	fs.Parse(args)
+
+	loaded, err := gpumon.Init()
+	if err != nil {
+		log.Fatalf("Unable to load NVML: %v", err)
+	}
+	var devices []Device
+	if loaded {
+		defer nvml.Shutdown()
+		if devices, err = gpumon.GetDevices(); err != nil {
+			log.Fatalf("Unable to get devices: %v", err)
+		}
+	}
+	caps := make([]Capabilities, len(devices))
+	for i, d := range devices {
+		caps[i] = ProbeCapabilities(d)
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(caps); err != nil {
+			log.Fatalf("Unable to marshal capabilities to JSON: %v", err)
+		}
+		return 0
+	}
+	mark := func(ok bool) string {
+		if ok {
+			return "yes"
+		}
+		return "-"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GPU\tNAME\tTEMP\tPOWER\tUTIL\tMEMORY\tPCIE\tPROCESSES\tCLOCKS\tFAN\tENCODER\tTHROTTLE\tDISPLAY\tNVLINK\tMIG\tECC\tGPM\tFAN CONTROL")
+	for _, c := range caps {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Index, c.Name,
+			mark(c.Temperature), mark(c.Power), mark(c.Utilization), mark(c.Memory), mark(c.PcieThroughput), mark(c.Processes),
+			mark(c.Clocks), mark(c.FanSpeed), mark(c.Encoder), mark(c.Throttle), mark(c.Display), mark(c.NVLink), mark(c.MIG), mark(c.ECC), mark(c.GPM), mark(c.FanControl))
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// clockJumpTolerance is how far the wall clock may drift from the monotonic clock between
+	// two samples before it is treated as a jump (NTP step, suspend/resume, manual change).
+	clockJumpTolerance = time.Second
+
+	// CloudWatch rejects datums older than two weeks or more than two hours in the future.
+	cloudwatchMaxAge    = 14 * 24 * time.Hour
+	cloudwatchMaxFuture = 2 * time.Hour
+)
+
+// clockJump returns how much the wall clock moved relative to the monotonic clock between
+// prev and now, or zero when the difference is within clockJumpTolerance. Both times must
+// come from time.Now so they carry a monotonic reading. The wall clock moving on by the
+// time suspended is not a jump.
+func clockJump(prev, now time.Time, suspended time.Duration) time.Duration {
+	wall := now.Round(0).Sub(prev.Round(0))
+	jump := wall - now.Sub(prev) - suspended
+	if jump < clockJumpTolerance && jump > -clockJumpTolerance {
+		return 0
+	}
+	return jump
+}
+
+// bootTime returns the time since boot including time spent suspended, from /proc/uptime.
+func bootTime() (time.Duration, error) {
+	uptime, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, fmt.Errorf("unable to read uptime: %v", err)
+	}
+	seconds, err := strconv.ParseFloat(strings.Fields(string(uptime))[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse uptime: %v", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// suspendedTime returns how long the system was suspended between prev and now, given the
+// boot times read alongside them, or zero when it is within clockJumpTolerance. Go's
+// monotonic clock stops while the system is suspended, the boot time keeps counting.
+func suspendedTime(prevBoot, boot time.Duration, prev, now time.Time) time.Duration {
+	suspended := boot - prevBoot - now.Sub(prev)
+	if suspended < clockJumpTolerance {
+		return 0
+	}
+	return suspended
+}
+
+// reanchor moves ts onto the current wall clock using the monotonic time elapsed since it
+// was taken, so buffered samples keep their true age even if the clock jumped meanwhile.
+// Timestamps without a monotonic reading are returned unchanged.
+func reanchor(ts, now time.Time) time.Time {
+	return now.Round(0).Add(-now.Sub(ts))
+}
+
+// cloudwatchTimestamp re-anchors ts and clamps it to the window CloudWatch accepts.
+func cloudwatchTimestamp(ts, now time.Time) time.Time {
+	ts = reanchor(ts, now)
+	wall := now.Round(0)
+	if oldest := wall.Add(-cloudwatchMaxAge); ts.Before(oldest) {
+		return oldest
+	}
+	if newest := wall.Add(cloudwatchMaxFuture); ts.After(newest) {
+		return newest
+	}
+	return ts
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// clockSlowdownMask are the throttle reasons that hold the clocks below what the load asks
+// for, power capping and thermal or hardware slowdowns.
+const clockSlowdownMask = nvml.ClocksEventReasonSwPowerCap | nvml.ClocksThrottleReasonHwSlowdown |
+	nvml.ClocksEventReasonSwThermalSlowdown | nvml.ClocksThrottleReasonHwThermalSlowdown |
+	nvml.ClocksThrottleReasonHwPowerBrakeSlowdown
+
+// ClockStabilityConfig scores how steady the SM clock of every device is over a sliding
+// Window (default 5m). It needs the clocks extended group.
+type ClockStabilityConfig struct {
+	Window Duration `json:"window"`
+}
+
+// ClockStability describes the SM clock of a device while it was busy within the window.
+// SMClockCV is the coefficient of variation of the clock, and ThrottledFraction the fraction
+// of busy polls with a power or thermal slowdown active, 0 without the throttle extended
+// group. Score is 100 for a steady, unthrottled clock and drops with either.
+type ClockStability struct {
+	MeanSMClock       float64 `json:"mean_sm_clock"`
+	SMClockCV         float64 `json:"sm_clock_cv"`
+	ThrottledFraction float64 `json:"throttled_fraction"`
+	Score             float64 `json:"score"`
+}
+
+type clockPoint struct {
+	at        time.Time
+	smClock   float64
+	throttled bool
+}
+
+// ClockStabilityTracker keeps the window of every device. It is shared by the pollers.
+type ClockStabilityTracker struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	devices map[int][]clockPoint
+}
+
+func NewClockStabilityTracker(cfg ClockStabilityConfig) *ClockStabilityTracker {
+	t := &ClockStabilityTracker{window: cfg.Window.Duration, devices: make(map[int][]clockPoint)}
+	if t.window == 0 {
+		t.window = 5 * time.Minute
+	}
+	return t
+}
+
+// Observe adds the SM clock read at now to the device's window and returns its stability.
+// Idle polls are left out since the clocks drop on purpose without load, so ok is false
+// until the device was busy within the window.
+func (t *ClockStabilityTracker) Observe(index int, usage uint, extended ExtendedMetrics, now time.Time) (ClockStability, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	points := t.devices[index]
+	if usage > 0 && extended.SMClock != nil {
+		point := clockPoint{at: now, smClock: float64(*extended.SMClock)}
+		if extended.ThrottleMask != nil {
+			point.throttled = *extended.ThrottleMask&clockSlowdownMask != 0
+		}
+		points = append(points, point)
+	}
+	points = slices.DeleteFunc(points, func(p clockPoint) bool { return now.Sub(p.at) > t.window })
+	t.devices[index] = points
+	if len(points) == 0 {
+		return ClockStability{}, false
+	}
+
+	var s ClockStability
+	throttled := 0
+	for _, p := range points {
+		s.MeanSMClock += p.smClock
+		if p.throttled {
+			throttled++
+		}
+	}
+	s.MeanSMClock /= float64(len(points))
+	var variance float64
+	for _, p := range points {
+		variance += (p.smClock - s.MeanSMClock) * (p.smClock - s.MeanSMClock)
+	}
+	variance /= float64(len(points))
+	if s.MeanSMClock > 0 {
+		s.SMClockCV = math.Sqrt(variance) / s.MeanSMClock
+	}
+	s.ThrottledFraction = float64(throttled) / float64(len(points))
+	s.Score = 100 * (1 - math.Min(s.SMClockCV, 1)) * (1 - s.ThrottledFraction)
+	return s, true
+}
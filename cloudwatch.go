@@ -0,0 +1,938 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	// cloudwatchMaxDatums is the most datums PutMetricData accepts in one request
+	cloudwatchMaxDatums = 1000
+	// cloudwatchMaxPayload stays below the 1 MB PutMetricData request limit, leaving room
+	// for the action, version and namespace parameters
+	cloudwatchMaxPayload = 1022 * 1024
+	// cloudwatchMaxBackoff is the longest wait between retries while CloudWatch fails
+	cloudwatchMaxBackoff = 5 * time.Minute
+	// cloudwatchFlushTimeout bounds a flush, so a hanging request cannot stall the publisher
+	cloudwatchFlushTimeout = time.Minute
+)
+
+// cloudwatchAttributes are the instance attributes that can become dimensions, in the order
+// the dimensions are added.
+var cloudwatchAttributes = []string{"instance_id", "instance_type"}
+
+// cloudwatchDeviceAttributes are the device attributes added after the instance dimensions.
+var cloudwatchDeviceAttributes = []string{"index", "uuid"}
+
+// legacyInstanceIDDimension is the misspelled dimension name older releases published.
+const legacyInstanceIDDimension = "InstancesId"
+
+// cloudwatchMetrics are the metrics published to CloudWatch, in the order they are published.
+var cloudwatchMetrics = []string{"gpu_usage", "memory_used", "memory_used_percent", "temperature", "power"}
+
+// CloudwatchMetric is the CloudWatch name and unit of a metric. Metrics without a matching
+// CloudWatch unit use None and carry the unit in their name so alarms stay readable.
+// Aggregate overrides the aggregation window of the metric.
+type CloudwatchMetric struct {
+	Name      string   `json:"name"`
+	Unit      string   `json:"unit"`
+	Aggregate Duration `json:"aggregate"`
+}
+
+var defaultCloudwatchMetrics = map[string]CloudwatchMetric{
+	"gpu_usage": {Name: "GPU Usage", Unit: string(types.StandardUnitPercent)},
+	// GetUtilization converts memory to GiB
+	"memory_used":         {Name: "Memory Used", Unit: string(types.StandardUnitGigabytes)},
+	"memory_used_percent": {Name: "Memory Used Percent", Unit: string(types.StandardUnitPercent)},
+	"temperature":         {Name: "Temperature (C)", Unit: string(types.StandardUnitNone)},
+	"power":               {Name: "Power (W)", Unit: string(types.StandardUnitNone)},
+}
+
+// CloudwatchConfig configures the CloudWatch exporter.
+type CloudwatchConfig struct {
+	// Metrics overrides the name or unit of metrics, keyed by their JSON field name
+	Metrics map[string]CloudwatchMetric `json:"metrics"`
+	// Dimensions maps instance attributes to dimension names, an empty name omits the attribute
+	Dimensions map[string]string `json:"dimensions"`
+	// LegacyDimensions publishes the instance ID as InstancesId for existing dashboards
+	LegacyDimensions bool   `json:"legacy_dimensions"`
+	Namespace        string `json:"namespace"`
+	// Resolution is the storage resolution in seconds, 1 for high resolution or 60
+	Resolution int32 `json:"resolution"`
+	// Processes also publishes the memory and SM usage of the processes on each device
+	Processes bool `json:"processes"`
+	// Events publishes a count of every NVML event, e.g. Xid errors, to alarm on
+	Events bool `json:"events"`
+	// Buffer is the most datums kept while CloudWatch fails or throttles, the oldest are
+	// dropped beyond it
+	Buffer int `json:"buffer"`
+	// Aggregate publishes the minimum, maximum, sum and count of the samples of every window,
+	// e.g. 60s, as a statistic set instead of every sample
+	Aggregate Duration `json:"aggregate"`
+	// Tuning overrides how datums are batched and retried
+	Tuning SinkTuning `json:"tuning"`
+	// Output is put_metric_data (default), or emf to write Embedded Metric Format log records
+	// that CloudWatch extracts the metrics from
+	Output string `json:"output"`
+	// EMF sends the EMF records to CloudWatch Logs instead of stdout
+	EMF *EMFConfig `json:"emf"`
+}
+
+// tuning returns the batching of the publisher: full requests, flushed once per storage
+// resolution period but at most every 10s, one at a time and retried for a day.
+func (c CloudwatchConfig) tuning() SinkTuning {
+	return c.Tuning.withDefaults(SinkTuning{
+		FlushSize:     cloudwatchMaxDatums,
+		FlushInterval: Duration{max(time.Duration(c.Resolution)*time.Second, 10*time.Second)},
+		MaxInFlight:   1,
+		MaxRetry:      Duration{24 * time.Hour},
+	})
+}
+
+// DimensionNames returns the dimension name of every instance attribute, "" when omitted.
+func (c CloudwatchConfig) DimensionNames() map[string]string {
+	names := map[string]string{"instance_id": "InstanceId", "instance_type": "InstanceType", "index": "GPUIndex", "uuid": "UUID"}
+	if c.LegacyDimensions {
+		names["instance_id"] = legacyInstanceIDDimension
+	}
+	for attr, name := range c.Dimensions {
+		names[attr] = name
+	}
+	return names
+}
+
+// MetricMapping returns the name, unit and aggregation window of every published metric.
+func (c CloudwatchConfig) MetricMapping() map[string]CloudwatchMetric {
+	mapping := make(map[string]CloudwatchMetric, len(defaultCloudwatchMetrics))
+	for key, metric := range defaultCloudwatchMetrics {
+		metric.Aggregate = c.Aggregate
+		if override, ok := c.Metrics[key]; ok {
+			if override.Name != "" {
+				metric.Name = override.Name
+			}
+			if override.Unit != "" {
+				metric.Unit = override.Unit
+			}
+			if override.Aggregate.Duration != 0 {
+				metric.Aggregate = override.Aggregate
+			}
+		}
+		mapping[key] = metric
+	}
+	return mapping
+}
+
+// Validate checks the namespace and resolution and that only known attributes and metrics are
+// mapped.
+func (c CloudwatchConfig) Validate() error {
+	if c.Namespace == "" {
+		return fmt.Errorf("cloudwatch: namespace must not be empty")
+	}
+	if c.Resolution != 1 && c.Resolution != 60 {
+		return fmt.Errorf("cloudwatch: resolution must be 1 or 60")
+	}
+	if c.Buffer <= 0 {
+		return fmt.Errorf("cloudwatch: buffer must be positive")
+	}
+	if c.Aggregate.Duration < 0 {
+		return fmt.Errorf("cloudwatch: aggregate must not be negative")
+	}
+	if err := c.Tuning.validate("cloudwatch"); err != nil {
+		return err
+	}
+	if c.Tuning.FlushSize > cloudwatchMaxDatums {
+		return fmt.Errorf("cloudwatch: tuning flush_size must be at most %d", cloudwatchMaxDatums)
+	}
+	if c.Output != "" && c.Output != "put_metric_data" && c.Output != "emf" {
+		return fmt.Errorf("cloudwatch: output must be put_metric_data or emf")
+	}
+	if c.EMF != nil && c.Output != "emf" {
+		return fmt.Errorf("cloudwatch: emf requires output emf")
+	}
+	if c.EMF != nil && c.EMF.LogGroup == "" {
+		return fmt.Errorf("cloudwatch: emf log_group must not be empty")
+	}
+	if c.Output == "emf" {
+		// EMF has no statistic sets, CloudWatch aggregates the records itself
+		for _, metric := range c.MetricMapping() {
+			if metric.Aggregate.Duration > 0 {
+				return fmt.Errorf("cloudwatch: aggregate is not supported with output emf")
+			}
+		}
+	}
+	for key, metric := range c.Metrics {
+		if !slices.Contains(cloudwatchMetrics, key) {
+			return fmt.Errorf("cloudwatch: unknown metric %q, expected one of %s", key, strings.Join(cloudwatchMetrics, ", "))
+		}
+		if metric.Unit != "" && !slices.Contains(types.StandardUnit("").Values(), types.StandardUnit(metric.Unit)) {
+			return fmt.Errorf("cloudwatch: metric %s has unknown unit %q", key, metric.Unit)
+		}
+		if metric.Aggregate.Duration < 0 {
+			return fmt.Errorf("cloudwatch: metric %s must not have a negative aggregate", key)
+		}
+	}
+	for attr := range c.Dimensions {
+		if !slices.Contains(cloudwatchAttributes, attr) && !slices.Contains(cloudwatchDeviceAttributes, attr) {
+			return fmt.Errorf("cloudwatch: unknown dimension attribute %q, expected one of %s", attr, strings.Join(append(slices.Clone(cloudwatchAttributes), cloudwatchDeviceAttributes...), ", "))
+		}
+	}
+	return nil
+}
+
+// CloudwatchDimensions builds the dimensions attached to every datum from the instance
+// attributes. They are built once since they do not change while the agent runs.
+func (c CloudwatchConfig) CloudwatchDimensions(attrs map[string]string) []types.Dimension {
+	names := c.DimensionNames()
+	var dimensions []types.Dimension
+	for _, attr := range cloudwatchAttributes {
+		if names[attr] == "" {
+			continue
+		}
+		dimensions = append(dimensions, types.Dimension{Name: aws.String(names[attr]), Value: aws.String(attrs[attr])})
+	}
+	return dimensions
+}
+
+// DeviceDimensions adds the dimensions identifying a device to the instance dimensions, so
+// every GPU of a multi-GPU instance gets its own metrics.
+func (c CloudwatchConfig) DeviceDimensions(instance []types.Dimension, index int, uuid string) []types.Dimension {
+	names := c.DimensionNames()
+	attrs := map[string]string{"index": strconv.Itoa(index), "uuid": uuid}
+	dimensions := slices.Clip(instance)
+	for _, attr := range cloudwatchDeviceAttributes {
+		if names[attr] == "" {
+			continue
+		}
+		dimensions = append(dimensions, types.Dimension{Name: aws.String(names[attr]), Value: aws.String(attrs[attr])})
+	}
+	return dimensions
+}
+
+// chunkMetricData splits datums into batches of at most maxDatums that fit in a single
+// PutMetricData request. Sizes are estimated from the query encoding the SDK sends.
+func chunkMetricData(data []types.MetricDatum, maxDatums int) [][]types.MetricDatum {
+	var chunks [][]types.MetricDatum
+	var chunk []types.MetricDatum
+	size := 0
+	for _, datum := range data {
+		n := datumSize(datum, len(chunk)+1)
+		if len(chunk) > 0 && (len(chunk) == maxDatums || size+n > cloudwatchMaxPayload) {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+			n = datumSize(datum, 1)
+		}
+		chunk = append(chunk, datum)
+		size += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// datumSize estimates the encoded size of a datum at the given 1-based position in a request.
+func datumSize(d types.MetricDatum, member int) int {
+	prefix := "MetricData.member." + strconv.Itoa(member) + "."
+	size := 0
+	param := func(name, value string) {
+		// &name=value
+		size += 2 + len(url.QueryEscape(prefix+name)) + len(url.QueryEscape(value))
+	}
+	param("MetricName", aws.ToString(d.MetricName))
+	if d.Unit != "" {
+		param("Unit", string(d.Unit))
+	}
+	if d.StorageResolution != nil {
+		param("StorageResolution", strconv.Itoa(int(*d.StorageResolution)))
+	}
+	if d.Timestamp != nil {
+		param("Timestamp", d.Timestamp.UTC().Format("2006-01-02T15:04:05.999Z"))
+	}
+	if d.Value != nil {
+		param("Value", strconv.FormatFloat(*d.Value, 'g', -1, 64))
+	}
+	for i, dim := range d.Dimensions {
+		dimPrefix := "Dimensions.member." + strconv.Itoa(i+1) + "."
+		param(dimPrefix+"Name", aws.ToString(dim.Name))
+		param(dimPrefix+"Value", aws.ToString(dim.Value))
+	}
+	for i, v := range d.Values {
+		param("Values.member."+strconv.Itoa(i+1), strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	for i, c := range d.Counts {
+		param("Counts.member."+strconv.Itoa(i+1), strconv.FormatFloat(c, 'g', -1, 64))
+	}
+	if s := d.StatisticValues; s != nil {
+		param("StatisticValues.Maximum", strconv.FormatFloat(aws.ToFloat64(s.Maximum), 'g', -1, 64))
+		param("StatisticValues.Minimum", strconv.FormatFloat(aws.ToFloat64(s.Minimum), 'g', -1, 64))
+		param("StatisticValues.SampleCount", strconv.FormatFloat(aws.ToFloat64(s.SampleCount), 'g', -1, 64))
+		param("StatisticValues.Sum", strconv.FormatFloat(aws.ToFloat64(s.Sum), 'g', -1, 64))
+	}
+	return size
+}
+
+// errNotSent marks chunks skipped after a transient failure of another chunk.
+var errNotSent = errors.New("not sent")
+
+// putMetricData publishes datums in as many requests of at most maxDatums as needed, inFlight
+// at a time. Chunks CloudWatch rejects as invalid are dropped without stopping the others. At
+// the first transient failure, e.g. throttling, it stops starting requests and returns the
+// datums not sent yet for a retry. The errors of every failed chunk are returned together.
+// Every attempt of every request, the SDK retries included, is traced under span.
+func putMetricData(ctx context.Context, client *cloudwatch.Client, limiter *RateLimiter, namespace string, data []types.MetricDatum, maxDatums, inFlight int, span *Span) ([]types.MetricDatum, error) {
+	var errs []error
+	var unsent []types.MetricDatum
+	chunks := chunkMetricData(data, maxDatums)
+	var failing atomic.Bool
+	results := sendConcurrently(len(chunks), inFlight, func(i int) error {
+		if failing.Load() {
+			return errNotSent
+		}
+		err := limiter.Wait(ctx)
+		if err == nil {
+			input := &cloudwatch.PutMetricDataInput{
+				MetricData: chunks[i],
+				Namespace:  aws.String(namespace),
+			}
+			_, err = client.PutMetricData(ctx, input, traceAttempts(span, "cloudwatch PutMetricData", map[string]string{
+				"chunk":  strconv.Itoa(i),
+				"datums": strconv.Itoa(len(chunks[i])),
+			}))
+		}
+		if err != nil && cloudwatchRetryable(err) {
+			failing.Store(true)
+		}
+		return err
+	})
+	for i, err := range results {
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errNotSent) {
+			errs = append(errs, fmt.Errorf("chunk %d (%d datums): %v", i, len(chunks[i]), err))
+		}
+		if errors.Is(err, errNotSent) || cloudwatchRetryable(err) {
+			unsent = append(unsent, chunks[i]...)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return unsent, fmt.Errorf("Unable to publish metrics to CloudWatch: %v", err)
+	}
+	return nil, nil
+}
+
+// traceAttempts records every attempt of an SDK call as a child span of span, with the attrs,
+// the number of the retry and the HTTP status.
+func traceAttempts(span *Span, name string, attrs map[string]string) func(*cloudwatch.Options) {
+	return func(o *cloudwatch.Options) {
+		if span == nil {
+			return
+		}
+		retries := 0
+		trace := middleware.FinalizeMiddlewareFunc("TraceAttempt", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			attempt := span.Child(name)
+			for k, v := range attrs {
+				attempt.SetAttr(k, v)
+			}
+			attempt.SetAttr("retry", strconv.Itoa(retries))
+			retries++
+			out, metadata, err := next.HandleFinalize(ctx, in)
+			var re *awshttp.ResponseError
+			if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+				attempt.SetAttr("http.status_code", strconv.Itoa(resp.StatusCode))
+			} else if errors.As(err, &re) {
+				attempt.SetAttr("http.status_code", strconv.Itoa(re.HTTPStatusCode()))
+			}
+			attempt.SetError(err)
+			attempt.End()
+			return out, metadata, err
+		})
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			// After the retry middleware it runs once for every attempt
+			return stack.Finalize.Insert(trace, "Retry", middleware.After)
+		})
+	}
+}
+
+// cloudwatchRetryable reports whether a failed request may succeed later. Only requests
+// CloudWatch rejected as malformed are not, throttling also returns 400 but is retried.
+func cloudwatchRetryable(err error) bool {
+	if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary {
+		return true
+	}
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		code := re.HTTPStatusCode()
+		return code != http.StatusBadRequest && code != http.StatusRequestEntityTooLarge
+	}
+	return true
+}
+
+// cloudwatchQueueSize bounds the samples waiting for the next flush.
+const cloudwatchQueueSize = 1000
+
+// CloudwatchPublisher batches samples and publishes them with as few PutMetricData requests
+// as possible, by default once per storage resolution period but at most every 10s. While
+// CloudWatch fails or throttles the datums are buffered and retried with exponential backoff.
+type CloudwatchPublisher struct {
+	client     *cloudwatch.Client
+	limiter    *RateLimiter
+	tracer     *Tracer
+	cfg        CloudwatchConfig
+	dimensions []types.Dimension
+	mapping    map[string]CloudwatchMetric
+	tuning     SinkTuning
+	// windows are the aggregation windows of the aggregated metrics, by CloudWatch name
+	windows map[string]time.Duration
+	// emf writes the datums as EMF records instead of calling PutMetricData when set
+	emf   *emfWriter
+	queue chan Sample
+	// datums holds the datums not built from samples, NVML events and heartbeats, until the
+	// next flush
+	datums chan types.MetricDatum
+}
+
+// errNoRegion means the agent is neither configured for an AWS region nor running on EC2.
+var errNoRegion = errors.New("no AWS region configured and the instance metadata service is unreachable")
+
+// NewCloudwatchPublisher loads the AWS config from the environment and discovers the instance
+// ID, type and region from the instance metadata service. Off EC2 the hostname stands in for
+// the instance ID, and without a configured region errNoRegion is returned.
+func NewCloudwatchPublisher(ctx context.Context, cfg CloudwatchConfig, limiter *RateLimiter, tracer *Tracer) (*CloudwatchPublisher, error) {
+	awsCfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %v", err)
+	}
+	attrs, region := instanceAttributes(ctx, newIMDSClient(&awsCfg))
+	if awsCfg.Region == "" {
+		awsCfg.Region = region
+	}
+	// EMF records on stdout are the only output not calling AWS
+	if awsCfg.Region == "" && (cfg.Output != "emf" || cfg.EMF != nil) {
+		return nil, errNoRegion
+	}
+	var emf *emfWriter
+	if cfg.Output == "emf" {
+		emf = newEMFWriter(cfg.EMF, awsCfg, limiter, attrs["instance_id"])
+	}
+	mapping := cfg.MetricMapping()
+	windows := make(map[string]time.Duration)
+	for _, metric := range mapping {
+		if metric.Aggregate.Duration > 0 {
+			windows[metric.Name] = metric.Aggregate.Duration
+		}
+	}
+	return &CloudwatchPublisher{
+		client:     cloudwatch.NewFromConfig(awsCfg),
+		limiter:    limiter,
+		tracer:     tracer,
+		cfg:        cfg,
+		dimensions: cfg.CloudwatchDimensions(attrs),
+		mapping:    mapping,
+		tuning:     cfg.tuning(),
+		windows:    windows,
+		emf:        emf,
+		queue:      make(chan Sample, cloudwatchQueueSize),
+		datums:     make(chan types.MetricDatum, cloudwatchQueueSize),
+	}, nil
+}
+
+// instanceAttributes returns the instance attributes and region from the instance metadata
+// service, with placeholders when it cannot be reached or the agent is offline (a nil client).
+func instanceAttributes(ctx context.Context, client *imds.Client) (map[string]string, string) {
+	if client == nil {
+		return map[string]string{"instance_id": hostName(), "instance_type": "unknown"}, ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	doc, err := client.GetInstanceIdentityDocument(ctx, &imds.GetInstanceIdentityDocumentInput{})
+	if err != nil {
+		log.Printf("Unable to get instance identity, using the hostname as instance ID: %v", err)
+		return map[string]string{"instance_id": hostName(), "instance_type": "unknown"}, ""
+	}
+	return map[string]string{"instance_id": doc.InstanceID, "instance_type": doc.InstanceType}, doc.Region
+}
+
+// Send queues the sample for the next flush without blocking the caller.
+func (p *CloudwatchPublisher) Send(s Sample) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.queue <- s:
+	default:
+		log.Printf("CloudWatch is not keeping up, dropped sample of device %d", s.Index)
+	}
+}
+
+// SendEvent queues a count of the event when events are enabled. Xid errors are published
+// as "XID Errors" with the code as the Xid dimension, the other NVML events as "GPU Events"
+// with the event name as the Event dimension.
+func (p *CloudwatchPublisher) SendEvent(e DeviceEvent) {
+	if p == nil || !p.cfg.Events || !isNVMLEvent(e) {
+		return
+	}
+	name, dimension := "GPU Events", types.Dimension{Name: aws.String("Event"), Value: aws.String(e.Event)}
+	if e.Event == "xid" {
+		name, dimension = "XID Errors", types.Dimension{Name: aws.String("Xid"), Value: aws.String(strconv.FormatUint(e.Xid, 10))}
+	}
+	datum := types.MetricDatum{
+		MetricName:        aws.String(name),
+		Dimensions:        append(p.cfg.DeviceDimensions(p.dimensions, e.Index, e.UUID), dimension),
+		Unit:              types.StandardUnitCount,
+		StorageResolution: aws.Int32(p.cfg.Resolution),
+		Timestamp:         aws.Time(e.Timestamp),
+		Value:             aws.Float64(1),
+	}
+	select {
+	case p.datums <- datum:
+	default:
+		log.Printf("CloudWatch is not keeping up, dropped %s event of device %d", e.Event, e.Index)
+	}
+}
+
+// SendHeartbeat queues the heartbeat as "Agent Heartbeat" with only the instance dimensions.
+// The version is left out of them so absence alarms keep working across upgrades.
+func (p *CloudwatchPublisher) SendHeartbeat(h Heartbeat) {
+	if p == nil {
+		return
+	}
+	datum := types.MetricDatum{
+		MetricName:        aws.String("Agent Heartbeat"),
+		Dimensions:        p.dimensions,
+		Unit:              types.StandardUnitCount,
+		StorageResolution: aws.Int32(p.cfg.Resolution),
+		Timestamp:         aws.Time(h.Timestamp),
+		Value:             aws.Float64(float64(h.Heartbeat)),
+	}
+	select {
+	case p.datums <- datum:
+	default:
+		log.Printf("CloudWatch is not keeping up, dropped heartbeat")
+	}
+}
+
+// SendGroup queues the aggregate of a group under the names of the device metrics, with the
+// instance dimensions and a Group dimension in place of the device ones.
+func (p *CloudwatchPublisher) SendGroup(g GroupSample) {
+	if p == nil {
+		return
+	}
+	dimensions := append(p.dimensions[:len(p.dimensions):len(p.dimensions)], types.Dimension{Name: aws.String("Group"), Value: aws.String(g.Group)})
+	values := map[string]float64{
+		"gpu_usage":           float64(g.GpuUsage),
+		"memory_used":         float64(g.MemoryUsed),
+		"memory_used_percent": float64(g.MemoryUsedPercent),
+		"temperature":         float64(g.Temperature),
+		"power":               float64(g.Power),
+	}
+	for _, key := range cloudwatchMetrics {
+		datum := types.MetricDatum{
+			MetricName:        aws.String(p.mapping[key].Name),
+			Dimensions:        dimensions,
+			Unit:              types.StandardUnit(p.mapping[key].Unit),
+			StorageResolution: aws.Int32(p.cfg.Resolution),
+			Timestamp:         aws.Time(g.Timestamp),
+			Value:             aws.Float64(values[key]),
+		}
+		select {
+		case p.datums <- datum:
+		default:
+			log.Printf("CloudWatch is not keeping up, dropped aggregate of group %s", g.Group)
+			return
+		}
+	}
+}
+
+// Run publishes the buffered datums on every flush, and as soon as a full request is
+// buffered. After a failed flush the next attempt waits for a backoff that doubles up to
+// cloudwatchMaxBackoff, with jitter so a fleet does not retry in lockstep, and the buffer is
+// dropped once CloudWatch failed for the max retry duration. Aggregated metrics join the
+// buffer once their window ends. A flush gives up after cloudwatchFlushTimeout or once ctx is
+// cancelled, then it publishes the buffer and the open windows one last time, within
+// shutdownTimeout, and returns.
+func (p *CloudwatchPublisher) Run(ctx context.Context) {
+	interval := p.tuning.FlushInterval.Duration
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var buffer []types.MetricDatum
+	// retries counts the failed flushes of the buffer in a row
+	retries := 0
+	var backoff time.Duration
+	var retryAt, failingSince time.Time
+	dropped := 0
+	send := func(now time.Time) {
+		if now.Before(retryAt) {
+			return
+		}
+		flushCtx, cancel := context.WithTimeout(ctx, cloudwatchFlushTimeout)
+		buffer = p.flush(flushCtx, buffer, retries)
+		cancel()
+		if len(buffer) == 0 {
+			backoff, failingSince, retries = 0, time.Time{}, 0
+			return
+		}
+		retries++
+		if failingSince.IsZero() {
+			failingSince = now
+		}
+		if now.Sub(failingSince) >= p.tuning.MaxRetry.Duration {
+			log.Printf("Dropped %d datums CloudWatch did not accept for %v", len(buffer), p.tuning.MaxRetry.Duration)
+			buffer, backoff, failingSince, retries = nil, 0, time.Time{}, 0
+			return
+		}
+		backoff = min(max(2*backoff, interval), cloudwatchMaxBackoff)
+		retryAt = now.Add(backoff/2 + rand.N(backoff/2))
+		log.Printf("Retrying %d datums in %v", len(buffer), retryAt.Sub(now).Round(time.Second))
+	}
+	add := func(data ...types.MetricDatum) {
+		buffer = append(buffer, data...)
+		if over := len(buffer) - p.cfg.Buffer; over > 0 {
+			buffer = slices.Delete(buffer, 0, over)
+			dropped += over
+		}
+	}
+	sets := newStatisticSets()
+	reported := make(map[string]ExporterStatus)
+	addSample := func(s Sample) {
+		for _, datum := range p.metricData(s) {
+			if window := p.windows[aws.ToString(datum.MetricName)]; window > 0 {
+				sets.Add(datum, window)
+				continue
+			}
+			add(datum)
+		}
+	}
+	for {
+		select {
+		case s := <-p.queue:
+			addSample(s)
+			if len(buffer) >= p.tuning.FlushSize {
+				send(time.Now())
+			}
+		case datum := <-p.datums:
+			add(datum)
+		case now := <-ticker.C:
+			add(sets.Flush(now, false)...)
+			add(p.exporterData(exporterStats.Snapshot(), reported, now)...)
+			if dropped > 0 {
+				log.Printf("CloudWatch buffer is full, dropped the %d oldest datums", dropped)
+				dropped = 0
+			}
+			send(now)
+		case <-ctx.Done():
+			for len(p.queue) > 0 {
+				addSample(<-p.queue)
+			}
+			for len(p.datums) > 0 {
+				add(<-p.datums)
+			}
+			add(sets.Flush(time.Now(), true)...)
+			flushCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if unsent := p.flush(flushCtx, buffer, retries); len(unsent) > 0 {
+				log.Printf("Dropped %d datums CloudWatch did not accept before shutdown", len(unsent))
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+func (p *CloudwatchPublisher) metricData(s Sample) []types.MetricDatum {
+	dimensions := p.cfg.DeviceDimensions(p.dimensions, s.Index, s.UUID)
+	if len(s.Pods) > 0 {
+		namespace, pod, container := podLabels(s.Pods)
+		dimensions = append(dimensions,
+			types.Dimension{Name: aws.String("Namespace"), Value: aws.String(namespace)},
+			types.Dimension{Name: aws.String("Pod"), Value: aws.String(pod)},
+			types.Dimension{Name: aws.String("Container"), Value: aws.String(container)})
+	}
+	data := cloudwatchMetricData(s.Metrics, dimensions, p.mapping, p.cfg.Resolution, s.Timestamp)
+	if s.Burst != nil {
+		// The readings within the poll go out as a statistic set in place of the single value,
+		// still one datum per metric
+		for i, key := range cloudwatchMetrics {
+			switch key {
+			case "power":
+				data[i].Value, data[i].StatisticValues = nil, s.Burst.Power.statisticValues(s.Burst.Samples)
+			case "gpu_usage":
+				data[i].Value, data[i].StatisticValues = nil, s.Burst.GpuUsage.statisticValues(s.Burst.Samples)
+			}
+		}
+	}
+	if s.dropped != nil {
+		kept := data[:0]
+		for i, key := range cloudwatchMetrics {
+			if s.exports(key) {
+				kept = append(kept, data[i])
+			}
+		}
+		data = kept
+	}
+	for _, d := range s.derived {
+		data = append(data, types.MetricDatum{
+			MetricName:        aws.String(d.name),
+			Dimensions:        dimensions,
+			Unit:              types.StandardUnitNone,
+			StorageResolution: aws.Int32(p.cfg.Resolution),
+			Timestamp:         aws.Time(s.Timestamp),
+			Value:             aws.Float64(d.value),
+		})
+	}
+	data = append(data, cloudwatchMigData(s.MIG, dimensions, p.cfg.Resolution, s.Timestamp)...)
+	if s.ComputeProcesses != nil {
+		data = append(data, types.MetricDatum{
+			MetricName:        aws.String("Compute Processes"),
+			Dimensions:        dimensions,
+			Unit:              types.StandardUnitCount,
+			StorageResolution: aws.Int32(p.cfg.Resolution),
+			Timestamp:         aws.Time(s.Timestamp),
+			Value:             aws.Float64(float64(*s.ComputeProcesses)),
+		})
+	}
+	if s.Extended != nil && s.Extended.EncoderStats != nil {
+		stats := s.Extended.EncoderStats
+		for _, m := range []struct {
+			name  string
+			unit  types.StandardUnit
+			value float64
+		}{
+			{"Encoder Sessions", types.StandardUnitCount, float64(stats.Sessions)},
+			{"Encoder FPS", types.StandardUnitCountSecond, float64(stats.FPS)},
+			{"Encoder Latency", types.StandardUnitMicroseconds, float64(stats.Latency)},
+		} {
+			data = append(data, types.MetricDatum{
+				MetricName:        aws.String(m.name),
+				Dimensions:        dimensions,
+				Unit:              m.unit,
+				StorageResolution: aws.Int32(p.cfg.Resolution),
+				Timestamp:         aws.Time(s.Timestamp),
+				Value:             aws.Float64(m.value),
+			})
+		}
+	}
+	if s.Extended != nil && s.Extended.Display != nil {
+		// Mode is a metric rather than a dimension so switching modes keeps the device's series
+		graphics := 0.0
+		if s.Extended.Display.Mode == "graphics" {
+			graphics = 1
+		}
+		attached := 0.0
+		if s.Extended.Display.Attached {
+			attached = 1
+		}
+		data = append(data, types.MetricDatum{
+			MetricName:        aws.String("Display Attached"),
+			Dimensions:        dimensions,
+			Unit:              types.StandardUnitNone,
+			StorageResolution: aws.Int32(p.cfg.Resolution),
+			Timestamp:         aws.Time(s.Timestamp),
+			Value:             aws.Float64(attached),
+		}, types.MetricDatum{
+			MetricName:        aws.String("Graphics Mode"),
+			Dimensions:        dimensions,
+			Unit:              types.StandardUnitNone,
+			StorageResolution: aws.Int32(p.cfg.Resolution),
+			Timestamp:         aws.Time(s.Timestamp),
+			Value:             aws.Float64(graphics),
+		})
+	}
+	if s.ClockStability != nil {
+		data = append(data, types.MetricDatum{
+			MetricName:        aws.String("Clock Stability"),
+			Dimensions:        dimensions,
+			Unit:              types.StandardUnitNone,
+			StorageResolution: aws.Int32(p.cfg.Resolution),
+			Timestamp:         aws.Time(s.Timestamp),
+			Value:             aws.Float64(s.ClockStability.Score),
+		})
+	}
+	if s.TimeInState != nil {
+		data = append(data, cloudwatchTimeInStateData(*s.TimeInState, dimensions, p.cfg.Resolution, s.Timestamp)...)
+	}
+	if p.cfg.Processes {
+		data = append(data, cloudwatchProcessData(s.Processes, dimensions, p.cfg.Resolution, s.Timestamp)...)
+	}
+	return data
+}
+
+// cloudwatchTimeInStateData builds the "Utilization Band Time" datums of a sample with the
+// band as the Band dimension, and "P-State Time" with the performance state as PState.
+func cloudwatchTimeInStateData(states TimeInState, dimensions []types.Dimension, resolution int32, timestamp time.Time) []types.MetricDatum {
+	ts := aws.Time(timestamp)
+	datum := func(name, dimension, value string, seconds float64) types.MetricDatum {
+		return types.MetricDatum{
+			MetricName:        aws.String(name),
+			Dimensions:        append(slices.Clip(dimensions), types.Dimension{Name: aws.String(dimension), Value: aws.String(value)}),
+			Unit:              types.StandardUnitSeconds,
+			StorageResolution: aws.Int32(resolution),
+			Timestamp:         ts,
+			Value:             aws.Float64(seconds),
+		}
+	}
+	var data []types.MetricDatum
+	for _, band := range utilizationBands {
+		data = append(data, datum("Utilization Band Time", "Band", band.name, states.Utilization[band.name]))
+	}
+	for _, pstate := range states.pstateNames() {
+		data = append(data, datum("P-State Time", "PState", pstate, states.PStates[pstate]))
+	}
+	return data
+}
+
+// cloudwatchMigData builds the datums of the MIG slices of a sample, identified by their GPU
+// instance ID and profile.
+func cloudwatchMigData(mig []MigMetrics, dimensions []types.Dimension, resolution int32, timestamp time.Time) []types.MetricDatum {
+	ts := aws.Time(timestamp)
+	var data []types.MetricDatum
+	for _, m := range mig {
+		migDimensions := append(slices.Clip(dimensions),
+			types.Dimension{Name: aws.String("GPUInstanceId"), Value: aws.String(strconv.Itoa(m.GPUInstanceID))},
+			types.Dimension{Name: aws.String("MIGProfile"), Value: aws.String(m.Profile)})
+		data = append(data, types.MetricDatum{
+			MetricName:        aws.String("MIG Memory Used"),
+			Dimensions:        migDimensions,
+			Unit:              types.StandardUnitGigabytes,
+			StorageResolution: aws.Int32(resolution),
+			Timestamp:         ts,
+			Value:             aws.Float64(float64(m.MemoryUsed)),
+		})
+		if m.GpuUsage != nil {
+			data = append(data, types.MetricDatum{
+				MetricName:        aws.String("MIG Usage"),
+				Dimensions:        migDimensions,
+				Unit:              types.StandardUnitPercent,
+				StorageResolution: aws.Int32(resolution),
+				Timestamp:         ts,
+				Value:             aws.Float64(*m.GpuUsage),
+			})
+		}
+	}
+	return data
+}
+
+// flush publishes data and returns the datums to retry. It is traced as its own span, with
+// how many flushes of the buffer failed before.
+func (p *CloudwatchPublisher) flush(ctx context.Context, data []types.MetricDatum, retries int) []types.MetricDatum {
+	if len(data) == 0 {
+		return nil
+	}
+	span := p.tracer.Start("cloudwatch flush")
+	span.SetAttr("datums", strconv.Itoa(len(data)))
+	span.SetAttr("retry", strconv.Itoa(retries))
+	defer span.End()
+	// Timestamps are re-anchored and clamped when sent so CloudWatch does not reject them
+	// after a wall clock jump
+	now := time.Now()
+	for i := range data {
+		data[i].Timestamp = aws.Time(cloudwatchTimestamp(*data[i].Timestamp, now))
+	}
+	var unsent []types.MetricDatum
+	var err error
+	if p.emf != nil {
+		if err = p.emf.Write(ctx, emfRecords(p.cfg.Namespace, data), span); err != nil {
+			unsent = data
+		}
+	} else {
+		unsent, err = putMetricData(ctx, p.client, p.limiter, p.cfg.Namespace, data, p.tuning.FlushSize, p.tuning.MaxInFlight, span)
+	}
+	span.SetError(err)
+	exporterStats.Record("cloudwatch", err)
+	if err != nil {
+		log.Print(err)
+	}
+	return unsent
+}
+
+// exporterData builds the "Exporter Successes" and "Exporter Failures" counts of every
+// exporter since the last call, with the exporter as the Exporter dimension. reported holds
+// the statuses of the last call.
+func (p *CloudwatchPublisher) exporterData(statuses []ExporterStatus, reported map[string]ExporterStatus, now time.Time) []types.MetricDatum {
+	var data []types.MetricDatum
+	for _, status := range statuses {
+		last := reported[status.Exporter]
+		reported[status.Exporter] = status
+		dimensions := append(slices.Clip(p.dimensions), types.Dimension{Name: aws.String("Exporter"), Value: aws.String(status.Exporter)})
+		for _, count := range []struct {
+			name  string
+			value uint64
+		}{
+			{"Exporter Successes", status.Successes - last.Successes},
+			{"Exporter Failures", status.Failures - last.Failures},
+		} {
+			data = append(data, types.MetricDatum{
+				MetricName:        aws.String(count.name),
+				Dimensions:        dimensions,
+				Unit:              types.StandardUnitCount,
+				StorageResolution: aws.Int32(p.cfg.Resolution),
+				Timestamp:         aws.Time(now),
+				Value:             aws.Float64(float64(count.value)),
+			})
+		}
+	}
+	return data
+}
+
+// cloudwatchProcessData builds the per-process datums of a sample. Processes are summed by
+// name, since a dimension per PID would create a new metric for every run.
+func cloudwatchProcessData(processes []ProcessMetrics, dimensions []types.Dimension, resolution int32, timestamp time.Time) []types.MetricDatum {
+	var names []string
+	memory := make(map[string]float64)
+	sm := make(map[string]float64)
+	for _, p := range processes {
+		if p.Name == "" {
+			continue
+		}
+		if !slices.Contains(names, p.Name) {
+			names = append(names, p.Name)
+		}
+		memory[p.Name] += float64(p.MemoryUsed)
+		if p.SMUtilization != nil {
+			sm[p.Name] += float64(*p.SMUtilization)
+		}
+	}
+	ts := aws.Time(timestamp)
+	var data []types.MetricDatum
+	for _, name := range names {
+		processDimensions := append(slices.Clip(dimensions), types.Dimension{Name: aws.String("ProcessName"), Value: aws.String(name)})
+		data = append(data, types.MetricDatum{
+			MetricName:        aws.String("Process Memory Used"),
+			Dimensions:        processDimensions,
+			Unit:              types.StandardUnitGigabytes,
+			StorageResolution: aws.Int32(resolution),
+			Timestamp:         ts,
+			Value:             aws.Float64(memory[name]),
+		})
+		if value, ok := sm[name]; ok {
+			data = append(data, types.MetricDatum{
+				MetricName:        aws.String("Process SM Usage"),
+				Dimensions:        processDimensions,
+				Unit:              types.StandardUnitPercent,
+				StorageResolution: aws.Int32(resolution),
+				Timestamp:         ts,
+				Value:             aws.Float64(value),
+			})
+		}
+	}
+	return data
+}
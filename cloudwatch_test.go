@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+func TestDatumSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		datum  types.MetricDatum
+		member int
+		params map[string]string
+	}{
+		{
+			name:   "name only",
+			datum:  types.MetricDatum{MetricName: aws.String("GPU Usage")},
+			member: 1,
+			params: map[string]string{"MetricName": "GPU Usage"},
+		},
+		{
+			name: "every field",
+			datum: types.MetricDatum{
+				MetricName:        aws.String("Temperature"),
+				Unit:              types.StandardUnitNone,
+				StorageResolution: aws.Int32(60),
+				Timestamp:         aws.Time(fixtureTime),
+				Value:             aws.Float64(54.5),
+				Dimensions: []types.Dimension{
+					{Name: aws.String("InstanceId"), Value: aws.String("i-0123456789abcdef0")},
+					{Name: aws.String("UUID"), Value: aws.String("GPU-00000000-1111-2222-3333-444444444444")},
+				},
+			},
+			member: 12,
+			params: map[string]string{
+				"MetricName":                "Temperature",
+				"Unit":                      "None",
+				"StorageResolution":         "60",
+				"Timestamp":                 "2024-01-02T03:04:05Z",
+				"Value":                     "54.5",
+				"Dimensions.member.1.Name":  "InstanceId",
+				"Dimensions.member.1.Value": "i-0123456789abcdef0",
+				"Dimensions.member.2.Name":  "UUID",
+				"Dimensions.member.2.Value": "GPU-00000000-1111-2222-3333-444444444444",
+			},
+		},
+		{
+			name: "statistic set",
+			datum: types.MetricDatum{
+				MetricName: aws.String("Power"),
+				StatisticValues: &types.StatisticSet{
+					Maximum: aws.Float64(300), Minimum: aws.Float64(100), SampleCount: aws.Float64(10), Sum: aws.Float64(2000),
+				},
+			},
+			member: 3,
+			params: map[string]string{
+				"MetricName":                  "Power",
+				"StatisticValues.Maximum":     "300",
+				"StatisticValues.Minimum":     "100",
+				"StatisticValues.SampleCount": "10",
+				"StatisticValues.Sum":         "2000",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{}
+			for name, value := range tt.params {
+				query.Set("MetricData.member."+strconv.Itoa(tt.member)+"."+name, value)
+			}
+			// Every parameter is preceded by a separator, the encoding has one less
+			want := len(query.Encode()) + 1
+			if got := datumSize(tt.datum, tt.member); got != want {
+				t.Errorf("datumSize() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestChunkMetricData(t *testing.T) {
+	datums := func(n int, dimension string) []types.MetricDatum {
+		data := make([]types.MetricDatum, n)
+		for i := range data {
+			data[i] = types.MetricDatum{
+				MetricName: aws.String("GPU Usage"),
+				Timestamp:  aws.Time(time.Unix(0, 0)),
+				Value:      aws.Float64(float64(i)),
+				Dimensions: []types.Dimension{{Name: aws.String("Job"), Value: aws.String(dimension)}},
+			}
+		}
+		return data
+	}
+	tests := []struct {
+		name      string
+		data      []types.MetricDatum
+		maxDatums int
+		want      []int
+	}{
+		{name: "empty", data: nil, maxDatums: 1000, want: nil},
+		{name: "one request", data: datums(5, "a"), maxDatums: 1000, want: []int{5}},
+		{name: "split by count", data: datums(25, "a"), maxDatums: 10, want: []int{10, 10, 5}},
+		// Datums of about 4 kB, 247 of them fill a request
+		{name: "split by size", data: datums(500, strings.Repeat("x", 4000)), maxDatums: 1000, want: []int{247, 247, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkMetricData(tt.data, tt.maxDatums)
+			var got []int
+			for _, chunk := range chunks {
+				got = append(got, len(chunk))
+				size := 0
+				for i, d := range chunk {
+					size += datumSize(d, i+1)
+				}
+				if size > cloudwatchMaxPayload {
+					t.Errorf("chunk of %d datums is %d bytes, more than %d", len(chunk), size, cloudwatchMaxPayload)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("chunk sizes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
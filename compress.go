@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// CompressionConfig compresses the request bodies of an HTTP sink. Algorithm is gzip, the only
+// one supported, and Level is a gzip level from 1 (fastest) to 9 (smallest), 6 when unset.
+type CompressionConfig struct {
+	Algorithm string `json:"algorithm"`
+	Level     int    `json:"level"`
+}
+
+func (c *CompressionConfig) validate(sink string) error {
+	if c == nil {
+		return nil
+	}
+	if c.Algorithm != "gzip" {
+		return fmt.Errorf("%s: unsupported compression algorithm %q, only gzip is supported", sink, c.Algorithm)
+	}
+	if c.Level < 0 || c.Level > gzip.BestCompression {
+		return fmt.Errorf("%s: compression level must be between 1 and 9", sink)
+	}
+	return nil
+}
+
+// compressor builds POST requests with gzip compressed bodies, or plain ones when nil.
+type compressor struct {
+	level int
+}
+
+func newCompressor(cfg *CompressionConfig) *compressor {
+	if cfg == nil {
+		return nil
+	}
+	level := cfg.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return &compressor{level: level}
+}
+
+// newRequest returns a POST request of body to url, compressed and marked with
+// Content-Encoding when c is set.
+func (c *compressor) newRequest(ctx context.Context, url string, body []byte) (*http.Request, error) {
+	if c == nil {
+		return http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	return req, nil
+}
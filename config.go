@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// envPattern matches $$ and ${VAR}, optionally followed by -default, :-default, ?message or
+// :?message as in the shell.
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?[-?])([^}]*))?\}`)
+
+// Duration wraps time.Duration so intervals can be written as "5s" in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+type Config struct {
+	// Interval is the default poll interval for devices without a matching rule
+	Interval Duration       `json:"interval"`
+	Devices  []DeviceConfig `json:"devices"`
+	// DeviceFilter limits the agent to the devices matching one of the patterns, all by default
+	DeviceFilter []string `json:"device_filter"`
+	// Publishers are the sinks samples are written to, stdout and cloudwatch by default
+	Publishers []string `json:"publishers"`
+	// Format is how samples are written to stdout, json or csv
+	Format string        `json:"format"`
+	Groups []GroupConfig `json:"groups"`
+	// Host adds CPU, RAM, NVMe temperature and network throughput of the node to every sample
+	Host bool `json:"host"`
+	// Storage adds GPU PCIe throughput and NVMe read rates with a data loader saturation indicator
+	Storage bool `json:"storage"`
+	// RDMA adds InfiniBand/EFA port throughput and retransmits from sysfs
+	RDMA bool `json:"rdma"`
+	// EnergyBudgets track the energy used per period and can cap power when it runs out
+	EnergyBudgets []EnergyBudgetConfig `json:"energy_budgets"`
+	// PowerSchedule applies power limits in recurring time windows, e.g. during peak tariffs
+	PowerSchedule []PowerScheduleConfig `json:"power_schedule"`
+	// CPUBudget is the agent's CPU budget in percent of one core, polling slows down above it
+	CPUBudget float64 `json:"cpu_budget"`
+	// ProfileNVML reports the time spent in each NVML call at this interval, zero disables it
+	ProfileNVML Duration `json:"profile_nvml"`
+	// Extended enables the NVML metrics beyond the core set, e.g. clocks and ECC errors, per group
+	Extended gpumon.ExtendedOptions `json:"extended"`
+	// NVMLEvents reports Xid errors, ECC errors, power source changes and clock slowdowns as
+	// NVML notifies about them
+	NVMLEvents bool `json:"nvml_events"`
+	// Risk scores each device's likelihood of failing from its memory error counters
+	Risk bool `json:"risk"`
+	// Saturation adds each device's saturation headroom over a sliding window, for autoscalers
+	Saturation *SaturationConfig `json:"saturation"`
+	// TimeInState adds the time each device spent in each utilization band and P-state over a
+	// sliding window
+	TimeInState *TimeInStateConfig `json:"time_in_state"`
+	// ClockStability scores how steady each device's SM clock is over a sliding window, to
+	// catch thermally limited chassis and failing fans
+	ClockStability *ClockStabilityConfig `json:"clock_stability"`
+	// Burst takes several readings of power and utilization per poll and adds their min, max
+	// and average, so spikes between polls are not missed
+	Burst *BurstConfig `json:"burst"`
+	// FailureThreshold is how many consecutive failed polls mark a device degraded
+	FailureThreshold int `json:"failure_threshold"`
+	// DegradedInterval is how often degraded devices are polled until they recover
+	DegradedInterval Duration `json:"degraded_interval"`
+	// DeviceMap is a file mapping GPU UUIDs to stable logical indexes, used in place of the
+	// enumeration order when set
+	DeviceMap string `json:"device_map"`
+	// Identity picks the host name reported by the exporters from config, cloud metadata, the
+	// Kubernetes node name or the OS hostname, which is used alone when unset
+	Identity *IdentityConfig `json:"identity"`
+	// Rescan is how often the devices are enumerated again to start polling new ones, 0 disables it
+	Rescan Duration `json:"rescan"`
+	// Monotonic adds the monotonic collection time and the measured time since the previous sample
+	Monotonic bool `json:"monotonic"`
+	// RateLimits caps outbound API calls across all exporters and per exporter
+	RateLimits RateLimitsConfig `json:"rate_limits"`
+	// Exec streams every sample as NDJSON to the stdin of a program
+	Exec *ExecConfig `json:"exec"`
+	// Webhooks receive device lifecycle events, separately from the metric sinks
+	Webhooks []WebhookConfig `json:"webhooks"`
+	// SNS publishes device lifecycle events such as alerts to SNS topics
+	SNS []SNSConfig `json:"sns"`
+	// Deadman pings a dead man's switch service while the agent collects samples
+	Deadman *DeadmanConfig `json:"deadman"`
+	// Registration registers the Prometheus endpoint in Consul or etcd
+	Registration *RegistrationConfig `json:"registration"`
+	// Plugins are WASM modules run in order over every record before it is written
+	Plugins []PluginConfig `json:"plugins"`
+	// Relabel rules rewrite or drop records before plugins and sinks, they are hot reloaded
+	Relabel []RelabelConfig `json:"relabel"`
+	// Derived metrics are computed from each record before relabeling
+	Derived []DerivedConfig `json:"derived"`
+	// Tenant labels each sample with the tenants of the processes using the device
+	Tenant *TenantConfig `json:"tenant"`
+	// Kubernetes attributes each GPU to the pods it is allocated to, labeling every exporter
+	Kubernetes *KubernetesConfig `json:"kubernetes"`
+	// Processes adds the PID, name, memory and SM utilization of every process on the device
+	Processes bool `json:"processes"`
+	// ComputeProcesses counts the processes with a CUDA context on each device, an idle signal
+	ComputeProcesses bool `json:"compute_processes"`
+	// Experiments adds the MLflow and W&B runs of the processes on each device to samples
+	Experiments bool `json:"experiments"`
+	// Inference scrapes co-located inference servers and adds their throughput to samples
+	Inference []InferenceConfig `json:"inference"`
+	// Jobs adds the Ray, Kubeflow and Volcano jobs owning the processes on each device to samples
+	Jobs bool `json:"jobs"`
+	// Tracing records a trace of every collect and export cycle
+	Tracing *TracingConfig `json:"tracing"`
+	// OTLP configures the OpenTelemetry collector of the otlp publisher
+	OTLP *OTLPConfig `json:"otlp"`
+	// Influx writes samples in InfluxDB line protocol to a server or a local file
+	Influx *InfluxConfig `json:"influx"`
+	// Cloudwatch configures the dimensions published to CloudWatch
+	Cloudwatch CloudwatchConfig `json:"cloudwatch"`
+	// Audit records every change the agent makes to GPU state
+	Audit *AuditConfig `json:"audit"`
+	// ContextFile is a JSON object written by workloads, its keys label samples while it exists
+	ContextFile string `json:"context_file"`
+	// Annotations accepts annotations from external systems and labels samples with them
+	Annotations *AnnotationsConfig `json:"annotations"`
+	// APITokens restrict /api/v1 and /annotations to requests carrying a token of a sufficient role
+	APITokens []APITokenConfig `json:"api_tokens"`
+	// Alerts raise events while a metric or its rate of change crosses a threshold
+	Alerts []AlertConfig `json:"alerts"`
+	// DefaultAlerts adds thermal and power alerts with the thresholds of each GPU model
+	DefaultAlerts *DefaultAlertsConfig `json:"default_alerts"`
+	// History is how many samples of every device /api/v1/metrics keeps, only the latest by default
+	History int `json:"history"`
+	// Heartbeat emits a constant heartbeat to every sink on the default interval, on by default
+	Heartbeat bool `json:"heartbeat"`
+	// Features are flags whose config only applies to the hosts they target
+	Features []FeatureConfig `json:"features"`
+
+	// enabledFeatures are the names of the features applied on this host
+	enabledFeatures []string
+}
+
+// ExecConfig runs Command (program and arguments) as a sink. Buffer bounds the samples queued
+// while the program is busy or restarting.
+type ExecConfig struct {
+	Command      []string `json:"command"`
+	Buffer       int      `json:"buffer"`
+	RestartDelay Duration `json:"restart_delay"`
+}
+
+// RateLimitConfig describes a token bucket allowing Rate calls per second with bursts of Burst.
+type RateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+type RateLimitsConfig struct {
+	Global    *RateLimitConfig           `json:"global"`
+	Exporters map[string]RateLimitConfig `json:"exporters"`
+}
+
+// PluginConfig loads a WASM plugin. Mounts maps guest paths to host directories the plugin may
+// access, MemoryLimit is in MiB and Timeout bounds the processing of a single record.
+type PluginConfig struct {
+	Path        string            `json:"path"`
+	Mounts      map[string]string `json:"mounts"`
+	MemoryLimit int               `json:"memory_limit"`
+	Timeout     Duration          `json:"timeout"`
+}
+
+// DeviceConfig applies settings to every device whose index or UUID matches one of the patterns.
+// Patterns use path.Match syntax, e.g. "0", "GPU-1a2b*" or "*".
+type DeviceConfig struct {
+	Match    []string `json:"match"`
+	Interval Duration `json:"interval"`
+}
+
+// GroupConfig names a set of devices whose samples are aggregated together.
+type GroupConfig struct {
+	Name  string   `json:"name"`
+	Match []string `json:"match"`
+}
+
+// publishers are the sinks that can be enabled with Publishers.
+var publishers = []string{"stdout", "cloudwatch", "otlp", "influx"}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:         Duration{5 * time.Second},
+		Heartbeat:        true,
+		Publishers:       []string{"stdout", "cloudwatch"},
+		Format:           "json",
+		FailureThreshold: 3,
+		DegradedInterval: Duration{time.Minute},
+		Rescan:           Duration{time.Minute},
+		Cloudwatch:       CloudwatchConfig{Namespace: "GPUMonitor", Resolution: 60, Buffer: 50000},
+	}
+}
+
+// ConfigFlags are the settings that can also be given as flags or environment variables.
+// Set fields override the config file, lists are comma separated.
+type ConfigFlags struct {
+	Interval   string
+	Devices    string
+	Format     string
+	Publishers string
+	Namespace  string
+	Resolution string
+	// NoCloudwatch disables the cloudwatch publisher, e.g. for local testing
+	NoCloudwatch bool
+}
+
+// Override applies the set flags over c and validates the result.
+func (c *Config) Override(f ConfigFlags) error {
+	if f.Interval != "" {
+		interval, err := time.ParseDuration(f.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid interval: %v", err)
+		}
+		c.Interval = Duration{interval}
+	}
+	if f.Devices != "" {
+		c.DeviceFilter = strings.Split(f.Devices, ",")
+	}
+	if f.Format != "" {
+		c.Format = f.Format
+	}
+	if f.Publishers != "" {
+		c.Publishers = strings.Split(f.Publishers, ",")
+	}
+	if f.Namespace != "" {
+		c.Cloudwatch.Namespace = f.Namespace
+	}
+	if f.Resolution != "" {
+		resolution, err := strconv.ParseInt(f.Resolution, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid resolution: %v", err)
+		}
+		c.Cloudwatch.Resolution = int32(resolution)
+	}
+	if f.NoCloudwatch {
+		c.Publishers = slices.DeleteFunc(slices.Clone(c.Publishers), func(p string) bool { return p == "cloudwatch" })
+	}
+	return c.Validate()
+}
+
+// LoadConfig reads the config file, S3 object or SSM parameter on top of the named profile.
+// Either may be empty.
+func LoadConfig(name string, profile string) (Config, error) {
+	var data []byte
+	if isRemoteConfig(name) {
+		remote, err := NewRemoteConfig(context.Background(), name)
+		if err != nil {
+			return Config{}, err
+		}
+		if data, _, err = remote.Fetch(context.Background()); err != nil {
+			return Config{}, err
+		}
+	} else if name != "" {
+		var err error
+		if data, err = os.ReadFile(name); err != nil {
+			return Config{}, fmt.Errorf("unable to read config file: %v", err)
+		}
+	}
+	return parseConfig(data, profile, name)
+}
+
+// parseConfig decodes the contents of the config file name over the profile, applies the
+// feature flags targeting this host and validates the result.
+func parseConfig(data []byte, profile string, name string) (Config, error) {
+	cfg, err := ProfileConfig(profile)
+	if err != nil {
+		return Config{}, err
+	}
+	if name != "" {
+		if err := cfg.apply(data, "config file "+name); err != nil {
+			return Config{}, err
+		}
+	}
+	// Inline config lets containers run without a config file, it overrides the file
+	if data := os.Getenv("GPUMON_CONFIG_JSON"); data != "" {
+		if err := cfg.apply([]byte(data), "GPUMON_CONFIG_JSON"); err != nil {
+			return Config{}, err
+		}
+	}
+	err = validateFeatures(cfg.Features)
+	if err == nil && len(cfg.Features) > 0 {
+		err = cfg.applyFeatures(hostAttributes())
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		if name == "" {
+			return Config{}, fmt.Errorf("invalid config: %v", err)
+		}
+		return Config{}, fmt.Errorf("invalid config file %s: %v", name, err)
+	}
+	return cfg, nil
+}
+
+// apply expands environment variables in data and decodes it over c.
+func (c *Config) apply(data []byte, source string) error {
+	data, err := expandEnv(data)
+	if err != nil {
+		return fmt.Errorf("unable to expand %s: %v", source, err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", source, err)
+	}
+	return nil
+}
+
+// expandEnv substitutes environment variables in the raw config text. Inside a string the
+// value is JSON-escaped, so quotes and backslashes in it cannot break out of the string,
+// elsewhere it is inserted verbatim to template numbers and booleans. Defaults are config text
+// and always inserted verbatim. With a colon the default or error applies to empty variables
+// as well as unset ones, $$ escapes a literal $.
+func expandEnv(data []byte) ([]byte, error) {
+	var missing []string
+	var expanded []byte
+	// inString tracks whether the text copied so far ends inside a string literal
+	inString, escaped := false, false
+	scan := func(text []byte) {
+		for _, c := range text {
+			switch {
+			case escaped:
+				escaped = false
+			case inString && c == '\\':
+				escaped = true
+			case c == '"':
+				inString = !inString
+			}
+		}
+	}
+	last := 0
+	for _, loc := range envPattern.FindAllSubmatchIndex(data, -1) {
+		scan(data[last:loc[0]])
+		expanded = append(expanded, data[last:loc[0]]...)
+		last = loc[1]
+		if string(data[loc[0]:loc[1]]) == "$$" {
+			expanded = append(expanded, '$')
+			continue
+		}
+		name := string(data[loc[2]:loc[3]])
+		var op, arg string
+		if loc[4] >= 0 {
+			op, arg = string(data[loc[4]:loc[5]]), string(data[loc[6]:loc[7]])
+		}
+		value, ok := os.LookupEnv(name)
+		unset := !ok || (strings.HasPrefix(op, ":") && value == "")
+		switch strings.TrimPrefix(op, ":") {
+		case "-":
+			if unset {
+				expanded = append(expanded, arg...)
+				continue
+			}
+		case "?":
+			if unset {
+				if arg == "" {
+					arg = "required but not set"
+				}
+				missing = append(missing, name+": "+arg)
+			}
+		}
+		if inString {
+			value = jsonStringContent(value)
+		}
+		expanded = append(expanded, value...)
+	}
+	expanded = append(expanded, data[last:]...)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// jsonStringContent returns s escaped for use inside a JSON string, without the quotes.
+func jsonStringContent(s string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	quoted := strings.TrimSuffix(b.String(), "\n")
+	return quoted[1 : len(quoted)-1]
+}
+
+func (c Config) Validate() error {
+	if c.Interval.Duration <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if c.CPUBudget < 0 {
+		return fmt.Errorf("cpu_budget must not be negative")
+	}
+	if c.ProfileNVML.Duration < 0 {
+		return fmt.Errorf("profile_nvml must not be negative")
+	}
+	if c.History < 0 {
+		return fmt.Errorf("history must not be negative")
+	}
+	if c.FailureThreshold < 1 {
+		return fmt.Errorf("failure_threshold must be at least 1")
+	}
+	if c.DegradedInterval.Duration <= 0 {
+		return fmt.Errorf("degraded_interval must be positive")
+	}
+	if c.Rescan.Duration < 0 {
+		return fmt.Errorf("rescan must not be negative")
+	}
+	if ic := c.Identity; ic != nil {
+		for _, source := range ic.Sources {
+			if !slices.Contains(identitySources, source) {
+				return fmt.Errorf("identity: unknown source %q, must be one of %s", source, strings.Join(identitySources, ", "))
+			}
+		}
+		if slices.Contains(ic.Sources, "config") && ic.Hostname == "" {
+			return fmt.Errorf("identity: the config source requires hostname")
+		}
+		for i, r := range ic.Replace {
+			if _, err := regexp.Compile(r.Pattern); err != nil {
+				return fmt.Errorf("identity: replace[%d]: %v", i, err)
+			}
+		}
+	}
+	if err := validatePatterns(c.DeviceFilter); err != nil {
+		return fmt.Errorf("device_filter: %v", err)
+	}
+	for _, publisher := range c.Publishers {
+		if !slices.Contains(publishers, publisher) {
+			return fmt.Errorf("unknown publisher %q, expected one of %s", publisher, strings.Join(publishers, ", "))
+		}
+	}
+	if slices.Contains(c.Publishers, "otlp") && c.OTLP == nil {
+		return fmt.Errorf("otlp: the otlp publisher needs an endpoint")
+	}
+	if c.OTLP != nil {
+		if u, err := url.Parse(c.OTLP.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("otlp: endpoint must be an http or https URL")
+		}
+		if p := c.OTLP.Protocol; p != "" && p != "http/json" {
+			return fmt.Errorf("otlp: unsupported protocol %q, only http/json is supported", p)
+		}
+		if tc := c.OTLP.TLS; tc != nil && (tc.CertFile == "") != (tc.KeyFile == "") {
+			return fmt.Errorf("otlp: tls cert_file and key_file must be set together")
+		}
+		if tc := c.OTLP.TLS; fipsBuild && tc != nil && tc.InsecureSkipVerify {
+			return fmt.Errorf("otlp: tls insecure_skip_verify is not allowed in FIPS builds")
+		}
+		if err := c.OTLP.Tuning.validate("otlp"); err != nil {
+			return err
+		}
+		if err := c.OTLP.Compression.validate("otlp"); err != nil {
+			return err
+		}
+	}
+	if slices.Contains(c.Publishers, "influx") && c.Influx == nil {
+		return fmt.Errorf("influx: the influx publisher needs a url or file")
+	}
+	if ic := c.Influx; ic != nil {
+		if (ic.URL == "") == (ic.File == nil) {
+			return fmt.Errorf("influx: exactly one of url and file must be set")
+		}
+		if err := ic.Tuning.validate("influx"); err != nil {
+			return err
+		}
+		if err := ic.Compression.validate("influx"); err != nil {
+			return err
+		}
+		if ic.File != nil {
+			if ic.File.Path == "" {
+				return fmt.Errorf("influx: file path must not be empty")
+			}
+			if ic.File.MaxSize < 0 || ic.File.MaxAge.Duration < 0 || ic.File.MaxFiles < 0 {
+				return fmt.Errorf("influx: file max_size, max_age and max_files must not be negative")
+			}
+		} else {
+			if u, err := url.Parse(ic.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("influx: url must be an http or https URL")
+			}
+			if ic.Org == "" || ic.Bucket == "" {
+				return fmt.Errorf("influx: org and bucket must be set with a url")
+			}
+		}
+	}
+	if c.Format != "json" && c.Format != "csv" {
+		return fmt.Errorf("format must be json or csv")
+	}
+	for i, dc := range c.Devices {
+		if len(dc.Match) == 0 {
+			return fmt.Errorf("devices[%d]: match must not be empty", i)
+		}
+		if err := validatePatterns(dc.Match); err != nil {
+			return fmt.Errorf("devices[%d]: %v", i, err)
+		}
+		if dc.Interval.Duration < 0 {
+			return fmt.Errorf("devices[%d]: interval must not be negative", i)
+		}
+	}
+	if rc := c.RateLimits.Global; rc != nil && rc.Rate <= 0 {
+		return fmt.Errorf("rate_limits.global: rate must be positive")
+	}
+	for name, rc := range c.RateLimits.Exporters {
+		if !slices.Contains(rateLimitedExporters, name) {
+			return fmt.Errorf("rate_limits.exporters: unknown exporter %q, expected one of %s", name, strings.Join(rateLimitedExporters, ", "))
+		}
+		if rc.Rate <= 0 {
+			return fmt.Errorf("rate_limits.exporters.%s: rate must be positive", name)
+		}
+	}
+	if c.Exec != nil {
+		if len(c.Exec.Command) == 0 {
+			return fmt.Errorf("exec: command must not be empty")
+		}
+		if c.Exec.Buffer < 0 {
+			return fmt.Errorf("exec: buffer must not be negative")
+		}
+	}
+	if err := c.Cloudwatch.Validate(); err != nil {
+		return err
+	}
+	if c.Tracing != nil && c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("tracing: endpoint must be an http or https URL")
+		}
+	}
+	for i, bc := range c.EnergyBudgets {
+		if bc.Name == "" {
+			return fmt.Errorf("energy_budgets[%d]: name must not be empty", i)
+		}
+		if bc.KWh <= 0 {
+			return fmt.Errorf("energy_budgets[%d]: kwh must be positive", i)
+		}
+		if bc.Period.Duration < 0 || bc.PowerCap < 0 {
+			return fmt.Errorf("energy_budgets[%d]: period and power_cap must not be negative", i)
+		}
+		if err := validatePatterns(bc.Match); err != nil {
+			return fmt.Errorf("energy_budgets[%d]: %v", i, err)
+		}
+	}
+	for i, pc := range c.PowerSchedule {
+		if pc.Name == "" {
+			return fmt.Errorf("power_schedule[%d]: name must not be empty", i)
+		}
+		if _, err := parseCron(pc.Cron); err != nil {
+			return fmt.Errorf("power_schedule[%d]: invalid cron %q: %v", i, pc.Cron, err)
+		}
+		if pc.Duration.Duration <= 0 || pc.Duration.Duration > 7*24*time.Hour {
+			return fmt.Errorf("power_schedule[%d]: duration must be positive and at most 168h", i)
+		}
+		if pc.PowerLimit <= 0 {
+			return fmt.Errorf("power_schedule[%d]: power_limit must be positive", i)
+		}
+		if err := validatePatterns(pc.Match); err != nil {
+			return fmt.Errorf("power_schedule[%d]: %v", i, err)
+		}
+	}
+	if sc := c.Saturation; sc != nil {
+		if sc.Window.Duration < 0 {
+			return fmt.Errorf("saturation: window must not be negative")
+		}
+		if sc.Percentile < 0 || sc.Percentile > 100 {
+			return fmt.Errorf("saturation: percentile must be between 0 and 100")
+		}
+	}
+	if tc := c.TimeInState; tc != nil && tc.Window.Duration < 0 {
+		return fmt.Errorf("time_in_state: window must not be negative")
+	}
+	if cs := c.ClockStability; cs != nil {
+		if cs.Window.Duration < 0 {
+			return fmt.Errorf("clock_stability: window must not be negative")
+		}
+		if !c.Extended.Clocks {
+			return fmt.Errorf("clock_stability: requires the clocks extended group")
+		}
+	}
+	if b := c.Burst; b != nil {
+		if b.Samples < 2 {
+			return fmt.Errorf("burst: samples must be at least 2")
+		}
+		if b.Spacing.Duration < 0 {
+			return fmt.Errorf("burst: spacing must not be negative")
+		}
+		spacing := b.Spacing.Duration
+		if spacing == 0 {
+			spacing = 100 * time.Millisecond
+		}
+		intervals := []time.Duration{c.Interval.Duration}
+		for _, dc := range c.Devices {
+			if dc.Interval.Duration > 0 {
+				intervals = append(intervals, dc.Interval.Duration)
+			}
+		}
+		if burst := time.Duration(b.Samples-1) * spacing; burst >= slices.Min(intervals) {
+			return fmt.Errorf("burst: %d samples %v apart take longer than the poll interval", b.Samples, spacing)
+		}
+	}
+	servers := make(map[string]bool)
+	for i, ic := range c.Inference {
+		if ic.Name == "" {
+			return fmt.Errorf("inference[%d]: name must not be empty", i)
+		}
+		if servers[ic.Name] {
+			return fmt.Errorf("inference[%d]: duplicate name %q", i, ic.Name)
+		}
+		servers[ic.Name] = true
+		if u, err := url.Parse(ic.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("inference[%d]: url must be an http or https URL", i)
+		}
+		if err := validatePatterns(ic.Match); err != nil {
+			return fmt.Errorf("inference[%d]: %v", i, err)
+		}
+	}
+	if c.Annotations != nil && c.Annotations.Listen == "" {
+		return fmt.Errorf("annotations: listen must not be empty")
+	}
+	if c.Annotations != nil && c.Annotations.Token != "" && len(c.APITokens) > 0 {
+		return fmt.Errorf("annotations: token cannot be combined with api_tokens, give it the operator role there")
+	}
+	if _, err := NewAuthorizer(c.APITokens); err != nil {
+		return err
+	}
+	if c.Audit != nil {
+		if c.Audit.Path == "" {
+			return fmt.Errorf("audit: path must not be empty")
+		}
+		if c.Audit.Loki != nil {
+			if u, err := url.Parse(c.Audit.Loki.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("audit: loki url must be an http or https URL")
+			}
+		}
+	}
+	for i, wc := range c.Webhooks {
+		if u, err := url.Parse(wc.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("webhooks[%d]: url must be an http or https URL", i)
+		}
+		if err := wc.Compression.validate(fmt.Sprintf("webhooks[%d]", i)); err != nil {
+			return err
+		}
+		for _, event := range wc.Events {
+			if !slices.Contains(deviceEvents, event) {
+				return fmt.Errorf("webhooks[%d]: unknown event %q, expected one of %s", i, event, strings.Join(deviceEvents, ", "))
+			}
+		}
+	}
+	for i, sc := range c.SNS {
+		if topic, err := arn.Parse(sc.TopicARN); err != nil || topic.Service != "sns" {
+			return fmt.Errorf("sns[%d]: topic_arn must be the ARN of an SNS topic", i)
+		}
+		for _, event := range sc.Events {
+			if !slices.Contains(deviceEvents, event) {
+				return fmt.Errorf("sns[%d]: unknown event %q, expected one of %s", i, event, strings.Join(deviceEvents, ", "))
+			}
+		}
+	}
+	if c.Deadman != nil {
+		if u, err := url.Parse(c.Deadman.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("deadman: url must be an http or https URL")
+		}
+		if u, err := url.Parse(c.Deadman.FailURL); c.Deadman.FailURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+			return fmt.Errorf("deadman: fail_url must be an http or https URL")
+		}
+		if c.Deadman.Interval.Duration < 0 || c.Deadman.Timeout.Duration < 0 {
+			return fmt.Errorf("deadman: interval and timeout must not be negative")
+		}
+	}
+	if rc := c.Registration; rc != nil {
+		if rc.Consul == nil && rc.Etcd == nil {
+			return fmt.Errorf("registration: consul or etcd must be set")
+		}
+		if rc.Consul != nil {
+			if u, err := url.Parse(rc.Consul.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("registration: consul url must be an http or https URL")
+			}
+		}
+		if rc.Etcd != nil {
+			if u, err := url.Parse(rc.Etcd.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("registration: etcd url must be an http or https URL")
+			}
+			if ttl := rc.Etcd.TTL.Duration; ttl != 0 && ttl < 3*time.Second {
+				return fmt.Errorf("registration: etcd ttl must be at least 3s")
+			}
+		}
+		if rc.Timeout.Duration < 0 {
+			return fmt.Errorf("registration: timeout must not be negative")
+		}
+	}
+	for i, pc := range c.Plugins {
+		if pc.Path == "" {
+			return fmt.Errorf("plugins[%d]: path must not be empty", i)
+		}
+		if pc.MemoryLimit < 0 || pc.MemoryLimit > 4096 {
+			return fmt.Errorf("plugins[%d]: memory_limit must be between 0 and 4096 MiB", i)
+		}
+	}
+	if err := validateFeatures(c.Features); err != nil {
+		return err
+	}
+	if _, err := NewRelabeler(c.Relabel); err != nil {
+		return err
+	}
+	if _, err := NewDeriver(c.Derived); err != nil {
+		return err
+	}
+	if _, err := NewAlerts(c.Alerts, c.DefaultAlerts); err != nil {
+		return err
+	}
+	if c.Tenant != nil {
+		if _, err := NewTenantResolver(*c.Tenant); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for i, gc := range c.Groups {
+		if gc.Name == "" {
+			return fmt.Errorf("groups[%d]: name must not be empty", i)
+		}
+		if names[gc.Name] {
+			return fmt.Errorf("groups[%d]: duplicate group name %q", i, gc.Name)
+		}
+		names[gc.Name] = true
+		if len(gc.Match) == 0 {
+			return fmt.Errorf("groups[%d]: match must not be empty", i)
+		}
+		if err := validatePatterns(gc.Match); err != nil {
+			return fmt.Errorf("groups[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (dc DeviceConfig) Matches(d Device) bool {
+	return matchDevice(dc.Match, d)
+}
+
+func matchDevice(patterns []string, d Device) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, strconv.Itoa(d.Index)); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, d.UUID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IntervalFor returns the poll interval of the first rule matching the device.
+func (c Config) IntervalFor(d Device) time.Duration {
+	for _, dc := range c.Devices {
+		if dc.Interval.Duration > 0 && dc.Matches(d) {
+			return dc.Interval.Duration
+		}
+	}
+	return c.Interval.Duration
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("GPUMON_TEST_TOKEN", `se"cr\et`)
+	t.Setenv("GPUMON_TEST_INTERVAL", "10s")
+	t.Setenv("GPUMON_TEST_HOST", "true")
+	t.Setenv("GPUMON_TEST_EMPTY", "")
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "string value", in: `{"interval": "${GPUMON_TEST_INTERVAL}"}`, want: `{"interval": "10s"}`},
+		{name: "boolean outside a string", in: `{"host": ${GPUMON_TEST_HOST}}`, want: `{"host": true}`},
+		{name: "escaped inside a string", in: `{"token": "Bearer ${GPUMON_TEST_TOKEN}"}`, want: `{"token": "Bearer se\"cr\\et"}`},
+		{name: "after an escaped quote", in: `{"token": "\"${GPUMON_TEST_TOKEN}"}`, want: `{"token": "\"se\"cr\\et"}`},
+		{name: "default when unset", in: `{"interval": "${GPUMON_TEST_UNSET:-5s}"}`, want: `{"interval": "5s"}`},
+		{name: "default is config text", in: `{"host": ${GPUMON_TEST_UNSET-false}}`, want: `{"host": false}`},
+		{name: "empty without colon", in: `{"name": "${GPUMON_TEST_EMPTY-x}"}`, want: `{"name": ""}`},
+		{name: "empty with colon", in: `{"name": "${GPUMON_TEST_EMPTY:-x}"}`, want: `{"name": "x"}`},
+		{name: "literal dollar", in: `{"name": "$${GPUMON_TEST_HOST}"}`, want: `{"name": "${GPUMON_TEST_HOST}"}`},
+		{name: "required and set", in: `{"host": ${GPUMON_TEST_HOST:?needed}}`, want: `{"host": true}`},
+		{name: "required and unset", in: `{"token": "${GPUMON_TEST_UNSET:?set a token}"}`, wantErr: true},
+		{name: "required and empty", in: `{"token": "${GPUMON_TEST_EMPTY:?}"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandEnv([]byte(tt.in))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expandEnv() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandEnv() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expandEnv() = %s, want %s", got, tt.want)
+			}
+			if !json.Valid(got) {
+				t.Errorf("expandEnv() = %s, not valid JSON", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	cpuCheckInterval = 10 * time.Second
+	// cpuMaxBackoff is the most the poll intervals are stretched by
+	cpuMaxBackoff = 8
+)
+
+// CPUStatus reports the agent's own CPU usage whenever the poll backoff changes.
+type CPUStatus struct {
+	Epoch     int64     `json:"epoch"`
+	Timestamp time.Time `json:"timestamp"`
+	CPU       float64   `json:"agent_cpu_percent"`
+	Budget    float64   `json:"cpu_budget_percent"`
+	Backoff   int64     `json:"poll_backoff"`
+}
+
+// CPUGuard keeps the agent's CPU usage within a budget, in percent of one core, by stretching
+// every poll interval by a backoff factor. The factor doubles while usage is over budget and
+// halves again once usage is below half of it. A nil CPUGuard never backs off.
+type CPUGuard struct {
+	budget   float64
+	backoff  atomic.Int64
+	lastCPU  time.Duration
+	lastWall time.Time
+}
+
+func NewCPUGuard(budget float64) *CPUGuard {
+	g := &CPUGuard{budget: budget, lastCPU: cpuTime(), lastWall: time.Now()}
+	g.backoff.Store(1)
+	return g
+}
+
+// Backoff returns the factor poll intervals are currently stretched by.
+func (g *CPUGuard) Backoff() int64 {
+	if g == nil {
+		return 1
+	}
+	return g.backoff.Load()
+}
+
+// Check measures the CPU usage since the previous check and adjusts the backoff. It returns
+// true when the backoff changed.
+func (g *CPUGuard) Check() (CPUStatus, bool) {
+	now, cpu := time.Now(), cpuTime()
+	usage := float64(cpu-g.lastCPU) / float64(now.Sub(g.lastWall)) * 100
+	g.lastCPU, g.lastWall = cpu, now
+
+	backoff := g.backoff.Load()
+	next := backoff
+	if usage > g.budget && backoff < cpuMaxBackoff {
+		next = backoff * 2
+	} else if usage < g.budget/2 && backoff > 1 {
+		next = backoff / 2
+	}
+	status := CPUStatus{Epoch: epoch, Timestamp: now, CPU: usage, Budget: g.budget, Backoff: next}
+	if next == backoff {
+		return status, false
+	}
+	g.backoff.Store(next)
+	log.Printf("Agent CPU usage is %.1f%% with a budget of %.1f%%, polling %dx slower than configured", usage, g.budget, next)
+	return status, true
+}
+
+// cpuTime returns the user and system CPU time used by the agent so far.
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
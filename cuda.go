@@ -0,0 +1,133 @@
+package main
+
+/*
+#cgo LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stddef.h>
+#include <stdlib.h>
+#include <time.h>
+
+static void *cudart;
+static int (*p_cudaSetDevice)(int);
+static int (*p_cudaMalloc)(void **, size_t);
+static int (*p_cudaFree)(void *);
+static int (*p_cudaDeviceEnablePeerAccess)(int, unsigned int);
+static int (*p_cudaMemcpyPeer)(void *, int, const void *, int, size_t);
+static int (*p_cudaDeviceSynchronize)(void);
+static const char *(*p_cudaGetErrorString)(int);
+
+static int cudart_open(const char *name) {
+	cudart = dlopen(name, RTLD_NOW | RTLD_LOCAL);
+	if (!cudart) {
+		return -1;
+	}
+	p_cudaSetDevice = dlsym(cudart, "cudaSetDevice");
+	p_cudaMalloc = dlsym(cudart, "cudaMalloc");
+	p_cudaFree = dlsym(cudart, "cudaFree");
+	p_cudaDeviceEnablePeerAccess = dlsym(cudart, "cudaDeviceEnablePeerAccess");
+	p_cudaMemcpyPeer = dlsym(cudart, "cudaMemcpyPeer");
+	p_cudaDeviceSynchronize = dlsym(cudart, "cudaDeviceSynchronize");
+	p_cudaGetErrorString = dlsym(cudart, "cudaGetErrorString");
+	if (!p_cudaSetDevice || !p_cudaMalloc || !p_cudaFree || !p_cudaDeviceEnablePeerAccess ||
+		!p_cudaMemcpyPeer || !p_cudaDeviceSynchronize || !p_cudaGetErrorString) {
+		dlclose(cudart);
+		cudart = NULL;
+		return -2;
+	}
+	return 0;
+}
+
+static void cudart_close(void) {
+	if (cudart) {
+		dlclose(cudart);
+		cudart = NULL;
+	}
+}
+
+static const char *cudart_error_string(int err) {
+	return p_cudaGetErrorString(err);
+}
+
+// Copies bytes from src to dst iterations times after one warm up copy and reports the
+// elapsed wall time of the timed copies. Peer access is enabled on a best effort basis, when
+// it is unavailable the runtime stages the copy through host memory.
+static int cudart_peer_copy(int src, int dst, size_t bytes, int iterations, double *seconds) {
+	void *sbuf = NULL, *dbuf = NULL;
+	struct timespec start, end;
+	int err;
+
+	if ((err = p_cudaSetDevice(src))) goto out;
+	p_cudaDeviceEnablePeerAccess(dst, 0);
+	if ((err = p_cudaMalloc(&sbuf, bytes))) goto out;
+	if ((err = p_cudaSetDevice(dst))) goto out;
+	p_cudaDeviceEnablePeerAccess(src, 0);
+	if ((err = p_cudaMalloc(&dbuf, bytes))) goto out;
+
+	if ((err = p_cudaMemcpyPeer(dbuf, dst, sbuf, src, bytes))) goto out;
+	if ((err = p_cudaDeviceSynchronize())) goto out;
+	clock_gettime(CLOCK_MONOTONIC, &start);
+	for (int i = 0; i < iterations; i++) {
+		if ((err = p_cudaMemcpyPeer(dbuf, dst, sbuf, src, bytes))) goto out;
+	}
+	if ((err = p_cudaDeviceSynchronize())) goto out;
+	clock_gettime(CLOCK_MONOTONIC, &end);
+	*seconds = (double)(end.tv_sec - start.tv_sec) + (double)(end.tv_nsec - start.tv_nsec) / 1e9;
+
+out:
+	if (dbuf) {
+		p_cudaSetDevice(dst);
+		p_cudaFree(dbuf);
+	}
+	if (sbuf) {
+		p_cudaSetDevice(src);
+		p_cudaFree(sbuf);
+	}
+	return err;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// cudaRuntimeNames are tried in order when loading the CUDA runtime.
+var cudaRuntimeNames = []string{"libcudart.so", "libcudart.so.12", "libcudart.so.11.0"}
+
+// openCUDARuntime loads the CUDA runtime at run time so the binary does not link against it.
+func openCUDARuntime(name string) error {
+	// CUDA orders devices fastest first by default, match the PCI bus order NVML uses instead
+	os.Setenv("CUDA_DEVICE_ORDER", "PCI_BUS_ID")
+	names := cudaRuntimeNames
+	if name != "" {
+		names = []string{name}
+	}
+	for _, n := range names {
+		cname := C.CString(n)
+		ret := C.cudart_open(cname)
+		C.free(unsafe.Pointer(cname))
+		switch ret {
+		case 0:
+			return nil
+		case -2:
+			return fmt.Errorf("%s is missing required CUDA runtime symbols", n)
+		}
+	}
+	return fmt.Errorf("unable to load the CUDA runtime (tried %v)", names)
+}
+
+func closeCUDARuntime() {
+	C.cudart_close()
+}
+
+// peerCopyBandwidth measures the achieved copy bandwidth from src to dst in bytes per second.
+func peerCopyBandwidth(src, dst int, size int, iterations int) (float64, error) {
+	var seconds C.double
+	ret := C.cudart_peer_copy(C.int(src), C.int(dst), C.size_t(size), C.int(iterations), &seconds)
+	if ret != 0 {
+		return 0, fmt.Errorf("%s", C.GoString(C.cudart_error_string(ret)))
+	}
+	return float64(size) * float64(iterations) / float64(seconds), nil
+}
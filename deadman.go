@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DeadmanConfig pings a dead man's switch service such as Healthchecks.io on URL while the
+// agent collects samples, at most every Interval (default 1m). FailURL, e.g. the /fail URL
+// of a Healthchecks.io check, is pinged instead once samples stop.
+type DeadmanConfig struct {
+	URL      string   `json:"url"`
+	FailURL  string   `json:"fail_url"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+}
+
+// DeadmanSwitch pings in the background, so a slow service never delays the poll loop. A
+// failed ping is not retried, the next cycle pings again.
+type DeadmanSwitch struct {
+	url      string
+	failURL  string
+	interval time.Duration
+	client   *http.Client
+	queue    chan string
+	// last is when the last ping was queued, and ok whether it reported success
+	last time.Time
+	ok   bool
+}
+
+func NewDeadmanSwitch(cfg DeadmanConfig) *DeadmanSwitch {
+	interval := cfg.Interval.Duration
+	if interval == 0 {
+		interval = time.Minute
+	}
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &DeadmanSwitch{
+		url:      cfg.URL,
+		failURL:  cfg.FailURL,
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+		queue:    make(chan string, 1),
+	}
+}
+
+// Check pings the URL after a successful cycle and the fail URL after a failed one. The
+// first ping after a change goes out right away, repeated ones at most every interval.
+func (d *DeadmanSwitch) Check(now time.Time, ok bool) {
+	if d == nil {
+		return
+	}
+	if ok == d.ok && !d.last.IsZero() && now.Sub(d.last) < d.interval {
+		return
+	}
+	d.last, d.ok = now, ok
+	target := d.url
+	if !ok {
+		if d.failURL == "" {
+			return
+		}
+		target = d.failURL
+	}
+	select {
+	case d.queue <- target:
+	default:
+		log.Printf("Dead man's switch is not keeping up, skipped a ping")
+	}
+}
+
+// Run sends queued pings. It never returns.
+func (d *DeadmanSwitch) Run() {
+	for target := range d.queue {
+		if err := d.ping(target); err != nil {
+			log.Printf("Unable to ping dead man's switch: %v", err)
+		}
+	}
+}
+
+func (d *DeadmanSwitch) ping(target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "gpumon-go/"+buildInfo().Version)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DerivedConfig defines a metric computed from the other fields of a record, e.g.
+// {"name": "memory_free", "expr": "memory_total - memory_used"}.
+// Expressions support + - * / and parentheses over numbers and field names, nested fields
+// are addressed with dots such as host.cpu_usage.
+type DerivedConfig struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+type derivedMetric struct {
+	name string
+	expr expr
+}
+
+// derivedName restricts names to ones every sink accepts as a metric or field name.
+var derivedName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// recordKeys are the top level fields of device and group records. A derived metric of the
+// same name would be exported twice, as a duplicate Prometheus family or InfluxDB field.
+var recordKeys = jsonKeys(make(map[string]bool), reflect.TypeOf(Sample{}), reflect.TypeOf(GroupSample{}))
+
+// jsonKeys adds the JSON names of the fields of the struct types to keys, including the
+// fields of embedded structs.
+func jsonKeys(keys map[string]bool, types ...reflect.Type) map[string]bool {
+	for _, t := range types {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				jsonKeys(keys, field.Type)
+				continue
+			}
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			keys[cmp.Or(name, field.Name)] = true
+		}
+	}
+	return keys
+}
+
+// derivedValue is a derived metric of a sample, exported by the sinks next to the native ones.
+type derivedValue struct {
+	name  string
+	value float64
+}
+
+// Deriver adds derived metrics to records.
+type Deriver struct {
+	metrics []derivedMetric
+}
+
+func NewDeriver(configs []DerivedConfig) (*Deriver, error) {
+	d := &Deriver{}
+	for i, dc := range configs {
+		if dc.Name == "" {
+			return nil, fmt.Errorf("derived[%d]: name must not be empty", i)
+		}
+		if !derivedName.MatchString(dc.Name) {
+			return nil, fmt.Errorf("derived[%d]: name %q must consist of letters, digits and underscores", i, dc.Name)
+		}
+		if recordKeys[dc.Name] {
+			return nil, fmt.Errorf("derived[%d]: name %q is already a field of the records", i, dc.Name)
+		}
+		e, err := parseExpr(dc.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("derived[%d]: invalid expression %q: %v", i, dc.Expr, err)
+		}
+		d.metrics = append(d.metrics, derivedMetric{name: dc.Name, expr: e})
+	}
+	return d, nil
+}
+
+// Apply evaluates every derived metric against the record in order, so later expressions can
+// use earlier results. Metrics whose inputs are missing or that divide by zero are skipped,
+// which keeps e.g. device-only expressions off group aggregates.
+func (d *Deriver) Apply(record map[string]any) {
+	lookup := func(name string) (float64, bool) {
+		return recordNumber(record, name)
+	}
+	for _, m := range d.metrics {
+		v, err := m.expr.eval(lookup)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		record[m.name] = v
+	}
+}
+
+// recordNumber resolves a dotted field name to a number in a decoded JSON record.
+func recordNumber(record map[string]any, name string) (float64, bool) {
+	var v any = record
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return 0, false
+		}
+		if v, ok = obj[part]; !ok {
+			return 0, false
+		}
+	}
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+type expr interface {
+	eval(lookup func(string) (float64, bool)) (float64, error)
+}
+
+type numberExpr float64
+
+func (n numberExpr) eval(func(string) (float64, bool)) (float64, error) {
+	return float64(n), nil
+}
+
+type fieldExpr string
+
+func (f fieldExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	v, ok := lookup(string(f))
+	if !ok {
+		return 0, fmt.Errorf("field %s is not a number", f)
+	}
+	return v, nil
+}
+
+type negExpr struct {
+	x expr
+}
+
+func (n negExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	v, err := n.x.eval(lookup)
+	return -v, err
+}
+
+type binaryExpr struct {
+	op   byte
+	x, y expr
+}
+
+func (b binaryExpr) eval(lookup func(string) (float64, bool)) (float64, error) {
+	x, err := b.x.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	y, err := b.y.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	default:
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	}
+}
+
+// parser is a recursive descent parser for
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/") unary }
+//	unary  = "-" unary | factor
+//	factor = number | field | "(" expr ")"
+type parser struct {
+	src string
+	pos int
+}
+
+func parseExpr(src string) (expr, error) {
+	p := &parser{src: src}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.src[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space byte or zero at the end of input.
+func (p *parser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) expr() (expr, error) {
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) term() (expr, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x: x}, nil
+	}
+	return p.factor()
+}
+
+func (p *parser) factor() (expr, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return numberExpr(v), nil
+	case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		start := p.pos
+		for p.pos < len(p.src) && isFieldByte(p.src[p.pos]) {
+			p.pos++
+		}
+		return fieldExpr(p.src[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", c, p.pos)
+}
+
+func isFieldByte(c byte) bool {
+	return c == '_' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestNewDeriverErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config DerivedConfig
+	}{
+		{name: "empty name", config: DerivedConfig{Expr: "power"}},
+		{name: "invalid name", config: DerivedConfig{Name: "memory-free", Expr: "power"}},
+		{name: "invalid expression", config: DerivedConfig{Name: "x", Expr: "power +"}},
+		{name: "sample metric", config: DerivedConfig{Name: "memory_used_percent", Expr: "memory_used / memory_total"}},
+		{name: "sample label", config: DerivedConfig{Name: "uuid", Expr: "index"}},
+		{name: "embedded metric", config: DerivedConfig{Name: "gpu_usage", Expr: "power"}},
+		{name: "group metric", config: DerivedConfig{Name: "power_total", Expr: "power"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDeriver([]DerivedConfig{tt.config}); err == nil {
+				t.Errorf("NewDeriver() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// defaultDeviceMapPath is where the device-map subcommand looks for the mapping file.
+const defaultDeviceMapPath = "/var/lib/gpumon-go/device-map.json"
+
+// DeviceMap assigns every GPU a logical index by UUID, kept in a JSON file so the exported
+// series stay the same across reboots that enumerate the GPUs in another order.
+type DeviceMap struct {
+	path    string
+	indexes map[string]int
+}
+
+// LoadDeviceMap reads the mapping file, a missing file is an empty mapping.
+func LoadDeviceMap(path string) (*DeviceMap, error) {
+	m := &DeviceMap{path: path, indexes: make(map[string]int)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read device map: %v", err)
+	}
+	if err := json.Unmarshal(data, &m.indexes); err != nil {
+		return nil, fmt.Errorf("unable to parse device map %s: %v", path, err)
+	}
+	seen := make(map[int]string, len(m.indexes))
+	for uuid, index := range m.indexes {
+		if index < 0 {
+			return nil, fmt.Errorf("device map %s: negative index %d for %s", path, index, uuid)
+		}
+		if other, ok := seen[index]; ok {
+			return nil, fmt.Errorf("device map %s: index %d assigned to both %s and %s", path, index, other, uuid)
+		}
+		seen[index] = uuid
+	}
+	return m, nil
+}
+
+// Save writes the mapping file, replacing it atomically.
+func (m *DeviceMap) Save() error {
+	data, err := json.MarshalIndent(m.indexes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal device map: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return fmt.Errorf("unable to write device map: %v", err)
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("unable to write device map: %v", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("unable to write device map: %v", err)
+	}
+	return nil
+}
+
+// Assign replaces the enumeration index of the devices with their logical one and saves the
+// mapping when devices were added to it. A new device keeps its enumeration index when no
+// other device holds it, and gets the lowest free index otherwise. Nothing changes without a
+// mapping.
+func (m *DeviceMap) Assign(devices []Device) {
+	if m == nil {
+		return
+	}
+	used := make(map[int]bool, len(m.indexes))
+	for _, index := range m.indexes {
+		used[index] = true
+	}
+	added := false
+	for i, d := range devices {
+		if index, ok := m.indexes[d.UUID]; ok {
+			devices[i].Index = index
+			continue
+		}
+		index := d.Index
+		if index < 0 || used[index] {
+			for index = 0; used[index]; index++ {
+			}
+		}
+		m.indexes[d.UUID] = index
+		used[index] = true
+		devices[i].Index = index
+		added = true
+		log.Printf("Assigned logical index %d to device %s", index, d.UUID)
+	}
+	if added {
+		if err := m.Save(); err != nil {
+			log.Printf("Unable to save device map: %v", err)
+		}
+	}
+}
+
+// deviceMapCommand implements the device-map subcommand to list and edit the mapping file.
+// The agent reads it at startup, so edits apply when it restarts.
+func deviceMapCommand(args []string) int {
+	fs := flag.NewFlagSet("device-map", flag.ExitOnError)
+	path := fs.String("file", defaultDeviceMapPath, "mapping file, the device_map of the config")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go device-map [-file path] [list | set UUID INDEX | remove UUID]")
+	}
+	fs.Parse(args)
+	m, err := LoadDeviceMap(*path)
+	if err != nil {
+		log.Printf("Unable to load device map: %v", err)
+		return 1
+	}
+	switch fs.Arg(0) {
+	case "", "list":
+		listDeviceMap(m)
+		return 0
+	case "set":
+		if fs.NArg() != 3 {
+			fs.Usage()
+			return 2
+		}
+		uuid := fs.Arg(1)
+		index, err := strconv.Atoi(fs.Arg(2))
+		if err != nil || index < 0 {
+			log.Printf("Invalid index %q", fs.Arg(2))
+			return 2
+		}
+		for other, i := range m.indexes {
+			if i == index && other != uuid {
+				log.Printf("Index %d is assigned to %s, remove it first", index, other)
+				return 1
+			}
+		}
+		m.indexes[uuid] = index
+	case "remove":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return 2
+		}
+		if _, ok := m.indexes[fs.Arg(1)]; !ok {
+			log.Printf("Device %s is not in the map", fs.Arg(1))
+			return 1
+		}
+		delete(m.indexes, fs.Arg(1))
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err := m.Save(); err != nil {
+		log.Printf("Unable to save device map: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// listDeviceMap prints the mapping by logical index, next to the enumeration index of the
+// devices present now.
+func listDeviceMap(m *DeviceMap) {
+	present := make(map[string]int)
+	if backend, devices, err := gpumon.Open(""); err == nil {
+		if backend != nil {
+			defer backend.Shutdown()
+		}
+		for _, d := range devices {
+			present[d.UUID] = d.Index
+		}
+	}
+	uuids := make([]string, 0, len(m.indexes))
+	for uuid := range m.indexes {
+		uuids = append(uuids, uuid)
+	}
+	slices.SortFunc(uuids, func(a, b string) int { return m.indexes[a] - m.indexes[b] })
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tUUID\tENUMERATED")
+	for _, uuid := range uuids {
+		enumerated := "-"
+		if index, ok := present[uuid]; ok {
+			enumerated = strconv.Itoa(index)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.indexes[uuid], uuid, enumerated)
+	}
+	w.Flush()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+const (
+	// doctorTimeout bounds every network check
+	doctorTimeout = 5 * time.Second
+	// doctorMaxSkew is how far the clock may be off before AWS rejects signed requests
+	doctorMaxSkew = 5 * time.Minute
+	// timeError is the adjtimex state of a clock that is not synchronized
+	timeError = 5
+)
+
+// doctorCheck is the result of one check, with how to fix it when it did not pass.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// doctor collects the checks. The results of earlier checks decide which later ones apply.
+type doctor struct {
+	checks []doctorCheck
+	cfg    Config
+	awsCfg *aws.Config
+	// skew is the clock offset measured against an AWS endpoint, when one was reached
+	skew *time.Duration
+}
+
+func (d *doctor) ok(name, detail string) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: "ok", Detail: detail})
+}
+
+func (d *doctor) warn(name, detail, fix string) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: "warn", Detail: detail, Fix: fix})
+}
+
+func (d *doctor) fail(name, detail, fix string) {
+	d.checks = append(d.checks, doctorCheck{Name: name, Status: "fail", Detail: detail, Fix: fix})
+}
+
+// doctorCommand implements the doctor subcommand and returns the exit code, 1 when a check
+// failed.
+func doctorCommand(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("GPUMON_CONFIG"), "config whose exporters are checked ($GPUMON_CONFIG)")
+	profile := fs.String("profile", os.Getenv("GPUMON_PROFILE"), "profile the config is applied over ($GPUMON_PROFILE)")
+	jsonOutput := fs.Bool("json", false, "print the checks as JSON")
+	offlineEnv, _ := strconv.ParseBool(os.Getenv("GPUMON_OFFLINE"))
+	fs.BoolVar(&offline, "offline", offlineEnv, "check the config as an offline agent runs it, without the instance metadata or AWS ($GPUMON_OFFLINE)")
+	fs.Parse(args)
+	enforceOffline()
+
+	d := &doctor{}
+	d.checkGPUs()
+	d.checkConfig(*configPath, *profile)
+	d.checkPrivileges()
+	d.checkIMDS()
+	d.checkCredentials(*configPath)
+	d.checkExporters()
+	d.checkClock()
+
+	failed := slices.ContainsFunc(d.checks, func(c doctorCheck) bool { return c.Status == "fail" })
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d.checks); err != nil {
+			log.Fatalf("Unable to marshal checks to JSON: %v", err)
+		}
+	} else {
+		for _, c := range d.checks {
+			fmt.Printf("%-5s %-18s %s\n", strings.ToUpper(c.Status), c.Name, c.Detail)
+			if c.Fix != "" {
+				fmt.Printf("%24s fix: %s\n", "", c.Fix)
+			}
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// checkGPUs checks that NVML loads and can read every device, and that the device files are
+// accessible.
+func (d *doctor) checkGPUs() {
+	ret := nvml.Init()
+	switch ret {
+	case nvml.SUCCESS:
+		defer nvml.Shutdown()
+	case nvml.ERROR_LIBRARY_NOT_FOUND:
+		if backend, devices, err := gpumon.Open("amdgpu"); err == nil && backend != nil {
+			backend.Shutdown()
+			d.ok("GPU driver", fmt.Sprintf("no NVIDIA driver, %d AMD GPUs found", len(devices)))
+			return
+		}
+		d.fail("NVML", "libnvidia-ml.so.1 not found",
+			"Install the NVIDIA driver. In a container, run it with the NVIDIA container toolkit (--gpus all, or the nvidia runtime class on Kubernetes).")
+		return
+	case nvml.ERROR_DRIVER_NOT_LOADED:
+		d.fail("NVML", "the NVIDIA kernel driver is not loaded",
+			"Load it with modprobe nvidia and check dmesg for errors, e.g. after a kernel upgrade without a rebuilt module.")
+		return
+	case nvml.ERROR_NO_PERMISSION:
+		d.fail("NVML", "no permission to access the GPUs", "Run as root, or give the user read and write access to /dev/nvidia*.")
+		return
+	default:
+		d.fail("NVML", "unable to initialize NVML: "+nvml.ErrorString(ret), "Check dmesg for driver errors and nvidia-smi for the same error.")
+		return
+	}
+
+	driver, _ := nvml.SystemGetDriverVersion()
+	version, _ := nvml.SystemGetNVMLVersion()
+	detail := fmt.Sprintf("NVML %s, driver %s", version, driver)
+	if cuda, ret := nvml.SystemGetCudaDriverVersion(); ret == nvml.SUCCESS {
+		detail += fmt.Sprintf(", CUDA %d.%d", cuda/1000, cuda%1000/10)
+	}
+	d.ok("NVML", detail)
+
+	devices, err := gpumon.GetDevices()
+	switch {
+	case err != nil:
+		d.fail("Devices", err.Error(), "Check nvidia-smi and dmesg for Xid errors.")
+	case len(devices) == 0:
+		d.warn("Devices", "the driver is loaded but reports no GPUs", "Check that the GPUs are visible, e.g. NVIDIA_VISIBLE_DEVICES in containers.")
+	}
+	lost := 0
+	for _, device := range devices {
+		if _, err := device.GetMetrics(); err != nil {
+			fix := "Check nvidia-smi -q -i " + fmt.Sprint(device.Index) + " and dmesg for Xid errors."
+			if errors.Is(err, nvmlError(nvml.ERROR_GPU_IS_LOST)) {
+				lost++
+				fix = "The GPU fell off the bus, look for Xid 79 in dmesg. Reset it with nvidia-smi -r or reboot the node."
+			}
+			d.fail(fmt.Sprintf("GPU %d", device.Index), fmt.Sprintf("unable to read metrics: %v", err), fix)
+		}
+	}
+	if len(devices) > 0 && lost < len(devices) {
+		d.ok("Devices", fmt.Sprintf("%d GPUs found", len(devices)))
+	}
+
+	files, _ := filepath.Glob("/dev/nvidia*")
+	var denied []string
+	for _, name := range files {
+		if info, err := os.Stat(name); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			continue
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			denied = append(denied, name)
+			continue
+		}
+		f.Close()
+	}
+	if len(denied) > 0 {
+		d.warn("Device files", "no read and write access to "+strings.Join(denied, ", "),
+			"Run as root, or add the user to the group owning the device files.")
+	}
+}
+
+func (d *doctor) checkConfig(name, profile string) {
+	cfg, err := LoadConfig(name, profile)
+	if err != nil {
+		d.fail("Config", err.Error(), "Fix the config, gpumon-go config schema prints a JSON Schema to validate it against.")
+		d.cfg = DefaultConfig()
+		return
+	}
+	if offline {
+		applyOffline(&cfg)
+	}
+	d.cfg = cfg
+	if name == "" {
+		d.ok("Config", "no config file, using the defaults")
+		return
+	}
+	d.ok("Config", name+" is valid")
+}
+
+// checkPrivileges warns when the config changes GPU state, which needs root.
+func (d *doctor) checkPrivileges() {
+	changes := len(d.cfg.PowerSchedule) > 0 || slices.ContainsFunc(d.cfg.EnergyBudgets, func(bc EnergyBudgetConfig) bool { return bc.PowerCap > 0 })
+	if !changes || os.Geteuid() == 0 {
+		return
+	}
+	d.warn("Privileges", "the config sets power limits, which needs root",
+		"Run the agent as root, or start it with -read-only to only monitor.")
+}
+
+func (d *doctor) checkIMDS() {
+	client := newIMDSClient(nil)
+	if client == nil {
+		d.ok("Instance metadata", "not queried in offline mode")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	doc, err := client.GetInstanceIdentityDocument(ctx, &imds.GetInstanceIdentityDocumentInput{})
+	if err != nil {
+		d.warn("Instance metadata", fmt.Sprintf("not reachable: %v", err),
+			"Off EC2 this is expected. In a container on EC2, raise the IMDSv2 hop limit to 2 with aws ec2 modify-instance-metadata-options --http-put-response-hop-limit 2.")
+		return
+	}
+	d.ok("Instance metadata", fmt.Sprintf("%s, %s in %s", doc.InstanceID, doc.InstanceType, doc.Region))
+}
+
+// checkCredentials checks the AWS credentials and region when CloudWatch, SNS or a remote
+// config need them.
+func (d *doctor) checkCredentials(configPath string) {
+	if offline || !slices.Contains(d.cfg.Publishers, "cloudwatch") && len(d.cfg.SNS) == 0 && !isRemoteConfig(configPath) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	awsCfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		d.fail("AWS credentials", fmt.Sprintf("unable to load AWS config: %v", err), "Check AWS_PROFILE and ~/.aws/config.")
+		return
+	}
+	if awsCfg.Region == "" {
+		_, awsCfg.Region = instanceAttributes(ctx, newIMDSClient(&awsCfg))
+	}
+	if awsCfg.Region == "" {
+		d.fail("AWS region", "no region configured and none from the instance metadata", "Set AWS_REGION.")
+	}
+	creds, err := awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		d.fail("AWS credentials", fmt.Sprintf("unable to get credentials: %v", err),
+			"Attach an instance profile, use IRSA or EKS Pod Identity on Kubernetes, or set AWS_PROFILE.")
+		return
+	}
+	d.ok("AWS credentials", fmt.Sprintf("from %s in %s", creds.Source, awsCfg.Region))
+	d.awsCfg = &awsCfg
+}
+
+// checkExporters checks that the endpoints of the configured exporters are reachable. Any
+// HTTP response counts, authentication is not checked.
+func (d *doctor) checkExporters() {
+	if slices.Contains(d.cfg.Publishers, "cloudwatch") && d.awsCfg != nil && d.awsCfg.Region != "" {
+		switch {
+		case d.cfg.Cloudwatch.Output != "emf":
+			d.checkEndpoint("CloudWatch", newAWSAPI(*d.awsCfg).endpoint("monitoring", d.awsCfg.Region))
+		case d.cfg.Cloudwatch.EMF != nil:
+			d.checkEndpoint("CloudWatch Logs", newAWSAPI(*d.awsCfg).endpoint("logs", d.awsCfg.Region))
+		}
+	}
+	if slices.Contains(d.cfg.Publishers, "otlp") && d.cfg.OTLP != nil {
+		d.checkEndpoint("OTLP", d.cfg.OTLP.Endpoint)
+	}
+	if slices.Contains(d.cfg.Publishers, "influx") && d.cfg.Influx != nil && d.cfg.Influx.URL != "" {
+		d.checkEndpoint("InfluxDB", d.cfg.Influx.URL)
+	}
+	for _, wc := range d.cfg.Webhooks {
+		d.checkEndpoint("Webhook", wc.URL)
+	}
+	for _, sc := range d.cfg.SNS {
+		if topic, err := arn.Parse(sc.TopicARN); err == nil && d.awsCfg != nil {
+			d.checkEndpoint("SNS", newAWSAPI(*d.awsCfg).endpoint("sns", topic.Region))
+		}
+	}
+	if tc := d.cfg.Tracing; tc != nil && tc.Endpoint != "" {
+		d.checkEndpoint("Tracing", tc.Endpoint)
+	}
+	if ec := d.cfg.Exec; ec != nil {
+		if _, err := exec.LookPath(ec.Command[0]); err != nil {
+			d.fail("Exec", err.Error(), "Install "+ec.Command[0]+" or fix exec.command.")
+		} else {
+			d.ok("Exec", ec.Command[0]+" found")
+		}
+	}
+}
+
+func (d *doctor) checkEndpoint(name, endpoint string) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		d.fail(name, fmt.Sprintf("invalid endpoint %s: %v", endpoint, err), "Fix the endpoint in the config.")
+		return
+	}
+	client := &http.Client{Timeout: doctorTimeout}
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		fix := "Allow egress to " + u.Host + " in security groups and network policies, and set HTTPS_PROXY if the node needs a proxy."
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			fix = "Unable to resolve " + u.Hostname() + ", check the DNS configuration of the node."
+		}
+		d.fail(name, fmt.Sprintf("%s not reachable: %v", u.Host, err), fix)
+		return
+	}
+	resp.Body.Close()
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil && d.skew == nil && strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		skew := time.Until(date)
+		d.skew = &skew
+	}
+	d.ok(name, u.Host+" reachable")
+}
+
+// checkClock checks that the clock is synchronized, and not too far from AWS when an AWS
+// endpoint was reached.
+func (d *doctor) checkClock() {
+	var timex syscall.Timex
+	state, err := syscall.Adjtimex(&timex)
+	if err == nil && state == timeError {
+		d.warn("Clock", "the system clock is not synchronized",
+			"Enable chronyd or systemd-timesyncd. Samples carry the system time and AWS rejects requests signed with a clock more than 5 minutes off.")
+		return
+	}
+	if d.skew != nil && (*d.skew > doctorMaxSkew || *d.skew < -doctorMaxSkew) {
+		d.fail("Clock", fmt.Sprintf("the system clock is %v off from AWS", d.skew.Round(time.Second)),
+			"Synchronize it with chronyd or systemd-timesyncd, AWS rejects requests signed with a clock more than 5 minutes off.")
+		return
+	}
+	detail := "synchronized"
+	if d.skew != nil {
+		detail += fmt.Sprintf(", %v from AWS", d.skew.Round(time.Second))
+	}
+	d.ok("Clock", detail)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+const (
+	// emfMaxMetrics is the most metrics of one EMF record
+	emfMaxMetrics = 100
+	// emfMaxBatchBytes and emfMaxBatchEvents bound a PutLogEvents request, every event counts
+	// 26 bytes on top of its message
+	emfMaxBatchBytes  = 1 << 20
+	emfMaxBatchEvents = 10000
+	emfEventOverhead  = 26
+)
+
+// EMFConfig sends the Embedded Metric Format records of the CloudWatch exporter to a
+// CloudWatch Logs stream instead of stdout.
+type EMFConfig struct {
+	// LogGroup must exist, the stream is created in it when missing
+	LogGroup string `json:"log_group"`
+	// LogStream defaults to the instance ID
+	LogStream string `json:"log_stream"`
+}
+
+// emfRecord is an EMF log record, the datums of one timestamp and dimension set.
+type emfRecord struct {
+	namespace  string
+	timestamp  time.Time
+	dimensions []types.Dimension
+	metrics    []map[string]any
+	values     map[string]float64
+}
+
+// MarshalJSON renders the dimensions and metric values at the top level next to the _aws
+// metadata telling CloudWatch which of them to extract.
+func (r *emfRecord) MarshalJSON() ([]byte, error) {
+	names := make([]string, 0, len(r.dimensions))
+	fields := make(map[string]any, len(r.dimensions)+len(r.values)+1)
+	for _, d := range r.dimensions {
+		names = append(names, aws.ToString(d.Name))
+		fields[aws.ToString(d.Name)] = aws.ToString(d.Value)
+	}
+	for name, value := range r.values {
+		fields[name] = value
+	}
+	fields["_aws"] = map[string]any{
+		"Timestamp": r.timestamp.UnixMilli(),
+		"CloudWatchMetrics": []any{map[string]any{
+			"Namespace":  r.namespace,
+			"Dimensions": [][]string{names},
+			"Metrics":    r.metrics,
+		}},
+	}
+	return json.Marshal(fields)
+}
+
+// emfRecords groups the datums into EMF records by timestamp and dimensions, ordered by
+// timestamp. Datums of the same metric, timestamp and dimensions go into separate records.
+func emfRecords(namespace string, data []types.MetricDatum) []*emfRecord {
+	var records []*emfRecord
+	open := make(map[string]*emfRecord)
+	for _, d := range data {
+		key := emfKey(aws.ToTime(d.Timestamp), d.Dimensions)
+		name := aws.ToString(d.MetricName)
+		r := open[key]
+		if r != nil {
+			if _, ok := r.values[name]; ok || len(r.metrics) == emfMaxMetrics {
+				r = nil
+			}
+		}
+		if r == nil {
+			r = &emfRecord{namespace: namespace, timestamp: aws.ToTime(d.Timestamp), dimensions: d.Dimensions, values: make(map[string]float64)}
+			open[key] = r
+			records = append(records, r)
+		}
+		metric := map[string]any{"Name": name}
+		if d.Unit != "" {
+			metric["Unit"] = string(d.Unit)
+		}
+		if aws.ToInt32(d.StorageResolution) == 1 {
+			metric["StorageResolution"] = 1
+		}
+		r.metrics = append(r.metrics, metric)
+		r.values[name] = aws.ToFloat64(d.Value)
+		if s := d.StatisticValues; s != nil {
+			// EMF has no statistic sets, the average stands in for them
+			r.values[name] = *s.Sum / *s.SampleCount
+		}
+	}
+	slices.SortStableFunc(records, func(a, b *emfRecord) int { return a.timestamp.Compare(b.timestamp) })
+	return records
+}
+
+// emfKey identifies the record of a timestamp and dimension set.
+func emfKey(timestamp time.Time, dimensions []types.Dimension) string {
+	var b strings.Builder
+	b.WriteString(timestamp.Format(time.RFC3339Nano))
+	for _, d := range dimensions {
+		b.WriteString("\x00" + aws.ToString(d.Name) + "=" + aws.ToString(d.Value))
+	}
+	return b.String()
+}
+
+// emfWriter writes EMF records to stdout, or to a CloudWatch Logs stream when api is set.
+type emfWriter struct {
+	out     io.Writer
+	api     *awsAPI
+	limiter *RateLimiter
+	group   string
+	stream  string
+	// created is set once the stream is known to exist
+	created bool
+}
+
+func newEMFWriter(cfg *EMFConfig, awsCfg aws.Config, limiter *RateLimiter, instanceID string) *emfWriter {
+	if cfg == nil {
+		return &emfWriter{out: os.Stdout}
+	}
+	w := &emfWriter{api: newAWSAPI(awsCfg), limiter: limiter, group: cfg.LogGroup, stream: cfg.LogStream}
+	if w.stream == "" {
+		w.stream = instanceID
+	}
+	return w
+}
+
+// Write writes the records, one line each on stdout or in PutLogEvents batches. Every
+// CloudWatch Logs request is traced as a child span of span.
+func (w *emfWriter) Write(ctx context.Context, records []*emfRecord, span *Span) error {
+	lines := make([][]byte, 0, len(records))
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("unable to marshal EMF record: %v", err)
+		}
+		lines = append(lines, line)
+	}
+	if w.api == nil {
+		for _, line := range lines {
+			// A single write per record keeps it from interleaving with the samples on stdout
+			if _, err := w.out.Write(append(line, '\n')); err != nil {
+				return fmt.Errorf("unable to write EMF records: %v", err)
+			}
+		}
+		return nil
+	}
+	if !w.created {
+		if err := w.createStream(ctx, span); err != nil {
+			return err
+		}
+		w.created = true
+	}
+	for len(lines) > 0 {
+		n, size := 0, 0
+		for n < len(lines) && n < emfMaxBatchEvents && size+len(lines[n])+emfEventOverhead <= emfMaxBatchBytes {
+			size += len(lines[n]) + emfEventOverhead
+			n++
+		}
+		// A record never exceeds the batch size on its own
+		n = max(n, 1)
+		if err := w.putLogEvents(ctx, records[:n], lines[:n], span); err != nil {
+			return err
+		}
+		records, lines = records[n:], lines[n:]
+	}
+	return nil
+}
+
+// createStream creates the log stream unless it already exists.
+func (w *emfWriter) createStream(ctx context.Context, span *Span) error {
+	err := w.call(ctx, "CreateLogStream", map[string]any{"logGroupName": w.group, "logStreamName": w.stream}, span)
+	if err != nil && !strings.Contains(err.Error(), "ResourceAlreadyExistsException") {
+		return fmt.Errorf("unable to create log stream %s in %s: %v", w.stream, w.group, err)
+	}
+	return nil
+}
+
+func (w *emfWriter) putLogEvents(ctx context.Context, records []*emfRecord, lines [][]byte, span *Span) error {
+	events := make([]map[string]any, 0, len(lines))
+	for i, line := range lines {
+		events = append(events, map[string]any{"timestamp": records[i].timestamp.UnixMilli(), "message": string(line)})
+	}
+	if err := w.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	err := w.call(ctx, "PutLogEvents", map[string]any{"logGroupName": w.group, "logStreamName": w.stream, "logEvents": events}, span)
+	if err != nil && strings.Contains(err.Error(), "ResourceNotFoundException") {
+		// The stream was deleted, create it again on the next flush
+		w.created = false
+	}
+	if err != nil {
+		return fmt.Errorf("unable to put %d EMF records: %v", len(lines), err)
+	}
+	return nil
+}
+
+// call sends a CloudWatch Logs request, traced as a child span of span. The json/emf format
+// makes CloudWatch extract the metrics of the events.
+func (w *emfWriter) call(ctx context.Context, action string, input map[string]any, span *Span) (err error) {
+	attempt := span.Child("cloudwatch logs " + action)
+	defer func() {
+		attempt.SetError(err)
+		attempt.End()
+	}()
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	region := w.api.cfg.Region
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.api.endpoint("logs", region), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Logs_20140328."+action)
+	req.Header.Set("X-Amzn-Logs-Format", "json/emf")
+	_, resp, err := w.api.do(req, payload, "logs", region)
+	if resp != nil {
+		attempt.SetAttr("http.status_code", strconv.Itoa(resp.StatusCode))
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// energyMaxGap caps the time a single power reading is integrated over, so a device that
+	// stopped reporting is not billed for the whole gap at its last power draw
+	energyMaxGap = 5 * time.Minute
+	// energyMinElapsed is the share of the period observed before usage is extrapolated
+	energyMinElapsed = 0.05
+)
+
+// EnergyBudgetConfig limits the energy used by the matched devices, all by default, within
+// each period. PowerCap in watts is applied to every matched device once the budget is
+// projected to be exceeded and lifted when the next period starts. Without it the budget
+// only raises events.
+type EnergyBudgetConfig struct {
+	Name     string   `json:"name"`
+	Match    []string `json:"match"`
+	KWh      float64  `json:"kwh"`
+	Period   Duration `json:"period"`
+	PowerCap float64  `json:"power_cap"`
+}
+
+// EnergyEvent reports the state of an energy budget.
+type EnergyEvent struct {
+	Event     string    `json:"event"`
+	Budget    string    `json:"budget"`
+	Epoch     int64     `json:"epoch"`
+	Timestamp time.Time `json:"timestamp"`
+	EnergyKWh float64   `json:"energy_kwh"`
+	Projected float64   `json:"projected_kwh"`
+	BudgetKWh float64   `json:"budget_kwh"`
+}
+
+// EnergyBudget integrates the power of its devices over time. It is only used from the main
+// loop and needs no locking.
+type EnergyBudget struct {
+	name     string
+	budget   float64
+	period   time.Duration
+	powerCap float64
+	match    []string
+	members  map[int]Device
+
+	start     time.Time
+	energy    float64
+	last      map[int]time.Time
+	projected bool
+	exceeded  bool
+	// restore holds the power limits in watts to restore when the cap is lifted
+	restore map[int]float64
+}
+
+func NewEnergyBudgets(configs []EnergyBudgetConfig, devices []Device) []*EnergyBudget {
+	budgets := make([]*EnergyBudget, 0, len(configs))
+	for _, bc := range configs {
+		period := bc.Period.Duration
+		if period == 0 {
+			period = 24 * time.Hour
+		}
+		b := &EnergyBudget{
+			name:     bc.Name,
+			budget:   bc.KWh,
+			period:   period,
+			powerCap: bc.PowerCap,
+			match:    bc.Match,
+			members:  make(map[int]Device),
+			start:    time.Now(),
+			last:     make(map[int]time.Time),
+		}
+		for _, d := range devices {
+			b.Discover(d)
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets
+}
+
+// Observe adds the energy used since the device's previous sample and returns the events
+// raised by it.
+func (b *EnergyBudget) Observe(s Sample) []EnergyEvent {
+	if _, ok := b.members[s.Index]; !ok {
+		return nil
+	}
+	var events []EnergyEvent
+	if elapsed := s.Timestamp.Sub(b.start); elapsed >= b.period {
+		b.start = b.start.Add(elapsed.Truncate(b.period))
+		events = append(events, b.event("energy_budget_reset", s.Timestamp, 0))
+		b.lift()
+		b.energy, b.projected, b.exceeded = 0, false, false
+	}
+	if last, ok := b.last[s.Index]; ok && s.Timestamp.After(last) {
+		dt := min(s.Timestamp.Sub(last), energyMaxGap)
+		b.energy += float64(s.Power) * dt.Hours() / 1000
+	}
+	b.last[s.Index] = s.Timestamp
+
+	elapsed := s.Timestamp.Sub(b.start)
+	if elapsed < time.Duration(energyMinElapsed*float64(b.period)) {
+		return events
+	}
+	projected := b.energy * float64(b.period) / float64(elapsed)
+	if !b.projected && projected > b.budget {
+		b.projected = true
+		log.Printf("Energy budget %s is projected to use %.1f of %.1f kWh", b.name, projected, b.budget)
+		events = append(events, b.event("energy_budget_projected", s.Timestamp, projected))
+		b.cap()
+	}
+	if !b.exceeded && b.energy > b.budget {
+		b.exceeded = true
+		log.Printf("Energy budget %s exceeded %.1f kWh", b.name, b.budget)
+		events = append(events, b.event("energy_budget_exceeded", s.Timestamp, projected))
+	}
+	return events
+}
+
+func (b *EnergyBudget) event(name string, t time.Time, projected float64) EnergyEvent {
+	return EnergyEvent{Event: name, Budget: b.name, Epoch: epoch, Timestamp: t, EnergyKWh: b.energy, Projected: projected, BudgetKWh: b.budget}
+}
+
+// cap limits the power of every member, remembering the previous limits.
+func (b *EnergyBudget) cap() {
+	if b.powerCap == 0 || b.restore != nil {
+		return
+	}
+	b.restore = make(map[int]float64)
+	for _, d := range b.members {
+		b.capDevice(d)
+	}
+}
+
+func (b *EnergyBudget) capDevice(d Device) {
+	limit, err := d.GetPowerLimit()
+	if err != nil {
+		log.Printf("Unable to get power limit of device %d: %v", d.Index, err)
+		return
+	}
+	if err := setPowerLimit(d, b.powerCap, "energy_budget "+b.name); err != nil {
+		log.Printf("Unable to cap power of device %d to %.0f W: %v", d.Index, b.powerCap, err)
+		return
+	}
+	b.restore[d.Index] = limit
+	log.Printf("Capped power of device %d to %.0f W for energy budget %s", d.Index, b.powerCap, b.name)
+}
+
+// Discover adds a device found by a rescan to the budget when it matches, capping its power
+// right away while the budget is capped.
+func (b *EnergyBudget) Discover(d Device) {
+	if len(b.match) > 0 && !matchDevice(b.match, d) {
+		return
+	}
+	b.members[d.Index] = d
+	if b.restore != nil {
+		b.capDevice(d)
+	}
+}
+
+// lift restores the power limits changed by cap.
+func (b *EnergyBudget) lift() {
+	for index, limit := range b.restore {
+		if err := setPowerLimit(b.members[index], limit, "energy_budget "+b.name); err != nil {
+			log.Printf("Unable to restore power limit of device %d to %.0f W: %v", index, limit, err)
+			continue
+		}
+		log.Printf("Restored power limit of device %d to %.0f W", index, limit)
+	}
+	b.restore = nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+// DeviceEvent records a change in the state of a device. Events are emitted alongside samples
+// so sinks can tell them apart by the event field.
+type DeviceEvent struct {
+	Event     string    `json:"event"`
+	Index     int       `json:"index"`
+	UUID      string    `json:"uuid"`
+	Epoch     int64     `json:"epoch"`
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error,omitempty"`
+	// Set by power limit events
+	Schedule   string  `json:"schedule,omitempty"`
+	PowerLimit float64 `json:"power_limit,omitempty"`
+	// Set by alert events
+	Alert string   `json:"alert,omitempty"`
+	Value *float64 `json:"value,omitempty"`
+	// Set by NVML events, the Xid error code and its meaning or the active slowdowns
+	Xid         uint64   `json:"xid,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Reasons     []string `json:"reasons,omitempty"`
+}
+
+func newDeviceEvent(event string, d Device, err error) DeviceEvent {
+	e := DeviceEvent{Event: event, Index: d.Index, UUID: d.UUID, Epoch: epoch, Timestamp: time.Now()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
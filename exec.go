@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+const defaultExecBuffer = 1000
+
+// ExecSink streams NDJSON samples to the stdin of a user provided program and restarts it
+// whenever it exits. The pipe blocks while the program is busy, samples queue up in a bounded
+// buffer meanwhile and the newest ones are dropped once it is full.
+type ExecSink struct {
+	command      []string
+	restartDelay time.Duration
+	queue        chan []byte
+	dropped      atomic.Uint64
+}
+
+func NewExecSink(cfg ExecConfig) *ExecSink {
+	buffer := cfg.Buffer
+	if buffer == 0 {
+		buffer = defaultExecBuffer
+	}
+	delay := cfg.RestartDelay.Duration
+	if delay == 0 {
+		delay = time.Second
+	}
+	return &ExecSink{command: cfg.Command, restartDelay: delay, queue: make(chan []byte, buffer)}
+}
+
+// Send queues a JSON encoded value without blocking the caller.
+func (s *ExecSink) Send(data []byte) {
+	line := make([]byte, len(data)+1)
+	copy(line, data)
+	line[len(data)] = '\n'
+	select {
+	case s.queue <- line:
+	default:
+		if n := s.dropped.Add(1); n == 1 || n%1000 == 0 {
+			log.Printf("Exec sink %s is not keeping up, dropped %d samples so far", s.command[0], n)
+		}
+	}
+}
+
+// Run starts the program and keeps it running. It never returns.
+func (s *ExecSink) Run() {
+	var pending []byte
+	for {
+		cmd := exec.Command(s.command[0], s.command[1:]...)
+		// The program's stdout would corrupt our own NDJSON output, so both go to stderr
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			log.Printf("Unable to start exec sink %s: %v", s.command[0], err)
+			time.Sleep(s.restartDelay)
+			continue
+		}
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+		pending = s.pump(stdin, exited, pending)
+		log.Printf("Exec sink %s exited, restarting in %v", s.command[0], s.restartDelay)
+		time.Sleep(s.restartDelay)
+	}
+}
+
+// pump writes queued lines until the program exits. A line that could not be written is
+// returned so it is delivered to the restarted program.
+func (s *ExecSink) pump(stdin io.WriteCloser, exited <-chan error, pending []byte) []byte {
+	for {
+		if pending == nil {
+			select {
+			case pending = <-s.queue:
+			case err := <-exited:
+				if err != nil {
+					log.Printf("Exec sink %s failed: %v", s.command[0], err)
+				}
+				return nil
+			}
+		}
+		if _, err := stdin.Write(pending); err != nil {
+			stdin.Close()
+			if err := <-exited; err != nil {
+				log.Printf("Exec sink %s failed: %v", s.command[0], err)
+			}
+			return pending
+		}
+		pending = nil
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// experimentTrackers are the environment variables holding the run and experiment of each
+// tracker, as set by `mlflow run`, W&B sweep agents or the job launcher.
+var experimentTrackers = []struct {
+	name       string
+	run        string
+	experiment string
+}{
+	{"mlflow", "MLFLOW_RUN_ID", "MLFLOW_EXPERIMENT_ID"},
+	{"wandb", "WANDB_RUN_ID", "WANDB_PROJECT"},
+}
+
+// ExperimentRun is a process on the GPU that belongs to an experiment tracker run.
+type ExperimentRun struct {
+	PID        uint32  `json:"pid"`
+	Tracker    string  `json:"tracker"`
+	RunID      string  `json:"run_id"`
+	Experiment string  `json:"experiment,omitempty"`
+	MemoryUsed float32 `json:"memory_used"`
+}
+
+// ExperimentResolver finds the MLflow and W&B runs of the processes on a device from their
+// environment.
+type ExperimentResolver struct {
+	procRoot string
+}
+
+func NewExperimentResolver() *ExperimentResolver {
+	return &ExperimentResolver{procRoot: "/proc"}
+}
+
+// Runs returns one entry per tracker run of every process, ordered like processes. Processes
+// that exited, belong to no run or whose environment cannot be read are skipped.
+func (r *ExperimentResolver) Runs(processes []gpumon.Process) []ExperimentRun {
+	var runs []ExperimentRun
+	for _, p := range processes {
+		env, err := os.ReadFile(filepath.Join(r.procRoot, strconv.Itoa(int(p.PID)), "environ"))
+		if err != nil {
+			continue
+		}
+		vars := environVars(env)
+		for _, tracker := range experimentTrackers {
+			if id := vars[tracker.run]; id != "" {
+				runs = append(runs, ExperimentRun{PID: p.PID, Tracker: tracker.name, RunID: id, Experiment: vars[tracker.experiment], MemoryUsed: p.MemoryUsed})
+			}
+		}
+	}
+	return runs
+}
+
+// environVars parses the NUL separated KEY=value pairs of /proc/<pid>/environ.
+func environVars(data []byte) map[string]string {
+	vars := make(map[string]string)
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		if key, value, ok := bytes.Cut(entry, []byte("=")); ok {
+			vars[string(key)] = string(value)
+		}
+	}
+	return vars
+}
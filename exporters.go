@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exporterStats collects the outcome of every publish of the exporters. Each exporter
+// publishes the status of all of them, so one working backend is enough to notice another
+// one failing.
+var exporterStats = NewExporterStats()
+
+// ExporterStatus counts the publishes of an exporter, e.g. CloudWatch requests or Prometheus
+// scrapes, that succeeded and failed.
+type ExporterStatus struct {
+	Exporter    string
+	Successes   uint64
+	Failures    uint64
+	LastSuccess time.Time
+	LastError   string
+}
+
+type ExporterStats struct {
+	mu        sync.Mutex
+	exporters map[string]*ExporterStatus
+}
+
+func NewExporterStats() *ExporterStats {
+	return &ExporterStats{exporters: make(map[string]*ExporterStatus)}
+}
+
+// Record counts a publish of the exporter that failed with err, or succeeded without.
+func (s *ExporterStats) Record(exporter string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.exporters[exporter]
+	if !ok {
+		status = &ExporterStatus{Exporter: exporter}
+		s.exporters[exporter] = status
+	}
+	if err != nil {
+		status.Failures++
+		status.LastError = err.Error()
+		return
+	}
+	status.Successes++
+	status.LastSuccess = time.Now()
+}
+
+// Snapshot returns the status of every exporter that published so far, ordered by name.
+func (s *ExporterStats) Snapshot() []ExporterStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]ExporterStatus, 0, len(s.exporters))
+	for _, status := range s.exporters {
+		statuses = append(statuses, *status)
+	}
+	slices.SortFunc(statuses, func(a, b ExporterStatus) int { return strings.Compare(a.Exporter, b.Exporter) })
+	return statuses
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// FeatureConfig is a feature flag. Its config is applied over the rest of the config on the
+// hosts it targets, so new exporters or metrics can be rolled out to part of a fleet first.
+// Hosts and InstanceTypes are patterns, Tags maps tag keys to patterns of their values. Every
+// set criterion has to match, a flag without any targets every host.
+type FeatureConfig struct {
+	Name          string            `json:"name"`
+	Hosts         []string          `json:"hosts"`
+	InstanceTypes []string          `json:"instance_types"`
+	Tags          map[string]string `json:"tags"`
+	Config        map[string]any    `json:"config"`
+}
+
+// HostAttributes are what feature flags target a host by.
+type HostAttributes struct {
+	Hostname     string
+	InstanceType string
+	Tags         map[string]string
+}
+
+// hostAttributes is looked up once, the first time a config has feature flags. Tags are the
+// instance tags when they are exposed in the instance metadata, and GPUMON_TAGS
+// (key=value,key=value) on top. Offline only GPUMON_TAGS applies.
+var hostAttributes = sync.OnceValue(func() HostAttributes {
+	attrs := HostAttributes{Tags: make(map[string]string)}
+	attrs.Hostname, _ = os.Hostname()
+	if client := newIMDSClient(nil); client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if doc, err := client.GetInstanceIdentityDocument(ctx, &imds.GetInstanceIdentityDocumentInput{}); err == nil {
+			attrs.InstanceType = doc.InstanceType
+			// Keys are listed one per line, tags are only exposed when enabled on the instance
+			keys, _ := imdsMetadata(ctx, client, "tags/instance")
+			for _, key := range strings.Fields(keys) {
+				if value, ok := imdsMetadata(ctx, client, "tags/instance/"+key); ok {
+					attrs.Tags[key] = value
+				}
+			}
+		}
+	}
+	for _, tag := range strings.Split(os.Getenv("GPUMON_TAGS"), ",") {
+		if key, value, ok := strings.Cut(tag, "="); ok {
+			attrs.Tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return attrs
+})
+
+// imdsMetadata reads a metadata path, false when it does not exist.
+func imdsMetadata(ctx context.Context, client *imds.Client, name string) (string, bool) {
+	out, err := client.GetMetadata(ctx, &imds.GetMetadataInput{Path: name})
+	if err != nil {
+		return "", false
+	}
+	defer out.Content.Close()
+	data, err := io.ReadAll(out.Content)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Matches reports whether the flag targets the host.
+func (fc FeatureConfig) Matches(host HostAttributes) bool {
+	if len(fc.Hosts) > 0 && !matchAny(fc.Hosts, host.Hostname) {
+		return false
+	}
+	if len(fc.InstanceTypes) > 0 && !matchAny(fc.InstanceTypes, host.InstanceType) {
+		return false
+	}
+	for key, pattern := range fc.Tags {
+		value, ok := host.Tags[key]
+		if !ok || !matchAny([]string{pattern}, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFeatures applies the config of every flag targeting the host over c, in order, and
+// records the names of the enabled flags.
+func (c *Config) applyFeatures(host HostAttributes) error {
+	features := c.Features
+	c.enabledFeatures = nil
+	for _, fc := range features {
+		if !fc.Matches(host) {
+			continue
+		}
+		data, err := json.Marshal(fc.Config)
+		if err != nil {
+			return fmt.Errorf("features: %s: %v", fc.Name, err)
+		}
+		if err := json.Unmarshal(data, c); err != nil {
+			return fmt.Errorf("features: %s: %v", fc.Name, err)
+		}
+		c.enabledFeatures = append(c.enabledFeatures, fc.Name)
+	}
+	c.Features = features
+	return nil
+}
+
+func validateFeatures(features []FeatureConfig) error {
+	names := make(map[string]bool)
+	for i, fc := range features {
+		if fc.Name == "" {
+			return fmt.Errorf("features[%d]: name must not be empty", i)
+		}
+		if names[fc.Name] {
+			return fmt.Errorf("features[%d]: duplicate name %q", i, fc.Name)
+		}
+		names[fc.Name] = true
+		if _, ok := fc.Config["features"]; ok {
+			return fmt.Errorf("features[%d]: config must not contain features", i)
+		}
+		if err := validatePatterns(fc.Hosts); err != nil {
+			return fmt.Errorf("features[%d]: %v", i, err)
+		}
+		if err := validatePatterns(fc.InstanceTypes); err != nil {
+			return fmt.Errorf("features[%d]: %v", i, err)
+		}
+		for _, pattern := range fc.Tags {
+			if err := validatePatterns([]string{pattern}); err != nil {
+				return fmt.Errorf("features[%d]: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
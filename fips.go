@@ -0,0 +1,6 @@
+//go:build !boringcrypto
+
+package main
+
+// fipsBuild is set in binaries built with GOEXPERIMENT=boringcrypto, see fips_boring.go.
+const fipsBuild = false
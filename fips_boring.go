@@ -0,0 +1,12 @@
+//go:build boringcrypto
+
+package main
+
+// Restricts every TLS connection of the agent, to the sinks as well as AWS, to FIPS approved
+// versions, cipher suites and curves.
+import _ "crypto/tls/fipsonly"
+
+// fipsBuild is set in binaries built with GOEXPERIMENT=boringcrypto, which use the FIPS 140
+// validated BoringCrypto module. They send AWS requests to the FIPS endpoints and refuse
+// self-update, whose ed25519 signatures BoringCrypto does not cover.
+const fipsBuild = true
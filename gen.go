@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commands are the subcommands shown in completions and the man page.
+var commands = []struct {
+	name string
+	help string
+}{
+	{"capabilities", "list the metrics and features every GPU supports"},
+	{"config", "print the JSON Schema of the config file"},
+	{"device-map", "list or edit the logical index of every GPU UUID"},
+	{"diff", "compare two snapshots"},
+	{"doctor", "check the driver, permissions, AWS access and exporters and suggest fixes"},
+	{"gen", "generate shell completions and man pages"},
+	{"npd", "run as a node-problem-detector plugin"},
+	{"package", "write the files to build .deb and .rpm packages with nfpm"},
+	{"query", "print one sample of every GPU and exit, or keep printing with -watch"},
+	{"self-update", "replace the binary with a verified release"},
+	{"snapshot", "record the state of every GPU"},
+	{"test", "run the exporters against LocalStack, InfluxDB and Prometheus with simulated GPUs"},
+	{"validate-interconnect", "check NVLink and PCIe links against the expected topology"},
+	{"version", "print the version, commit, build date and backends"},
+}
+
+// genCommand implements the gen subcommand and returns the exit code. The agent's flags are
+// passed in so completions and man pages always match them.
+func genCommand(flags *flag.FlagSet, args []string) int {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	dir := fs.String("dir", "", "write files into this directory instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go gen [-dir dir] bash|zsh|fish|man")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	generators := map[string]struct {
+		file string
+		gen  func(io.Writer, *flag.FlagSet)
+	}{
+		"bash": {"gpumon-go.bash", genBash},
+		"zsh":  {"_gpumon-go", genZsh},
+		"fish": {"gpumon-go.fish", genFish},
+		"man":  {"gpumon-go.1", genMan},
+	}
+	g, ok := generators[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return 2
+	}
+	if *dir == "" {
+		g.gen(os.Stdout, flags)
+		return 0
+	}
+	f, err := os.Create(filepath.Join(*dir, g.file))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create %s: %v\n", g.file, err)
+		return 1
+	}
+	defer f.Close()
+	g.gen(f, flags)
+	return 0
+}
+
+// flagNames returns the names of the flags prefixed with a dash, in lexical order.
+func flagNames(flags *flag.FlagSet) []string {
+	var names []string
+	flags.VisitAll(func(f *flag.Flag) { names = append(names, "-"+f.Name) })
+	return names
+}
+
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	return names
+}
+
+func genBash(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintf(w, `# bash completion for gpumon-go
+_gpumon_go() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+		return
+	fi
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+		return
+	fi
+	COMPREPLY=($(compgen -f -- "$cur"))
+}
+complete -F _gpumon_go gpumon-go
+`, strings.Join(commandNames(), " "), strings.Join(flagNames(flags), " "))
+}
+
+func genZsh(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "#compdef gpumon-go")
+	fmt.Fprintln(w, "_arguments \\")
+	flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "\t'-%s[%s]%s' \\\n", f.Name, zshEscape(f.Usage), zshValue(f))
+	})
+	fmt.Fprintln(w, "\t'1: :->command'")
+	fmt.Fprintln(w, `if [[ $state == command ]]; then`)
+	fmt.Fprintln(w, "\tlocal -a commands=(")
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", c.name, zshEscape(c.help))
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\t_describe command commands")
+	fmt.Fprintln(w, "fi")
+}
+
+// zshValue completes the value of non-boolean flags with files.
+func zshValue(f *flag.Flag) string {
+	if isBoolFlag(f) {
+		return ""
+	}
+	return ":value:_files"
+}
+
+func zshEscape(s string) string {
+	return strings.NewReplacer(`'`, `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+func genFish(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "# fish completion for gpumon-go")
+	for _, c := range commands {
+		fmt.Fprintf(w, "complete -c gpumon-go -n __fish_use_subcommand -f -a %s -d %s\n", c.name, fishQuote(c.help))
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		// Go flags take a single dash, which fish calls old-style options
+		requires := " -r"
+		if isBoolFlag(f) {
+			requires = ""
+		}
+		fmt.Fprintf(w, "complete -c gpumon-go -o %s%s -d %s\n", f.Name, requires, fishQuote(f.Usage))
+	})
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func genMan(w io.Writer, flags *flag.FlagSet) {
+	date := time.Now()
+	// Reproducible builds pin the date
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		date = time.Unix(epoch, 0).UTC()
+	}
+	fmt.Fprintf(w, ".TH GPUMON-GO 1 %q\n", date.Format("2006-01-02"))
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintln(w, `gpumon\-go \- report GPU metrics to stdout, CloudWatch and other sinks`)
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintln(w, `.B gpumon\-go`)
+	fmt.Fprintln(w, `[\fIflags\fR]`)
+	fmt.Fprintln(w, ".br")
+	fmt.Fprintln(w, `.B gpumon\-go`)
+	fmt.Fprintln(w, `\fIcommand\fR [\fIargs\fR]`)
+	fmt.Fprintln(w, ".SH DESCRIPTION")
+	fmt.Fprintln(w, "Polls every GPU on the host and writes its metrics to the configured publishers. Every flag can also be set from the environment variable named in its description.")
+	fmt.Fprintln(w, ".SH OPTIONS")
+	flags.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintln(w, ".TP")
+		fmt.Fprintf(w, `.B \-%s`+"\n", manEscape(f.Name))
+		fmt.Fprintln(w, manEscape(f.Usage))
+	})
+	fmt.Fprintln(w, ".SH COMMANDS")
+	for _, c := range commands {
+		fmt.Fprintln(w, ".TP")
+		fmt.Fprintf(w, ".B %s\n", manEscape(c.name))
+		fmt.Fprintln(w, manEscape(c.help))
+	}
+}
+
+// manEscape escapes backslashes and dashes, and keeps a leading dot from becoming a request.
+func manEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/ethanholz/gpumon-go/internal/golden"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// fixtureTime is the fixed collection time of the golden fixtures.
+var fixtureTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fixtureSamples are fake samples of a two GPU node used to render the golden payloads.
+func fixtureSamples() []Sample {
+	return []Sample{
+		{
+			Index:     0,
+			UUID:      "GPU-00000000-1111-2222-3333-444444444444",
+			Epoch:     fixtureTime.UnixNano(),
+			Seq:       1,
+			Timestamp: fixtureTime,
+			Metrics:   Metrics{Temperature: 54, Power: 231.5, GpuUsage: 97, MemoryTotal: 79.6, MemoryUsed: 61.25, MemoryUsedPercent: 76.94724},
+		},
+		{
+			Index:     1,
+			UUID:      "GPU-55555555-6666-7777-8888-999999999999",
+			Epoch:     fixtureTime.UnixNano(),
+			Seq:       1,
+			Timestamp: fixtureTime,
+			Metrics:   Metrics{Temperature: 38, Power: 61.75, GpuUsage: 0, MemoryTotal: 79.6, MemoryUsed: 0.5, MemoryUsedPercent: 0.6281407},
+		},
+	}
+}
+
+// goldenPayloads renders every exporter wire format for the fixtures, keyed by file name.
+func goldenPayloads() (map[string][]byte, error) {
+	payloads := make(map[string][]byte)
+
+	var ndjson []byte
+	for _, s := range fixtureSamples() {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		ndjson = append(append(ndjson, data...), '\n')
+	}
+	payloads["stdout.ndjson"] = ndjson
+
+	// Default dimension names, so renaming them shows up as a golden diff
+	dimensions := CloudwatchConfig{}.CloudwatchDimensions(map[string]string{
+		"instance_id":   "i-0123456789abcdef0",
+		"instance_type": "p4d.24xlarge",
+	})
+	var datums []types.MetricDatum
+	for _, s := range fixtureSamples() {
+		deviceDimensions := CloudwatchConfig{}.DeviceDimensions(dimensions, s.Index, s.UUID)
+		datums = append(datums, cloudwatchMetricData(s.Metrics, deviceDimensions, CloudwatchConfig{}.MetricMapping(), 1, s.Timestamp)...)
+	}
+	data, err := json.MarshalIndent(datums, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	payloads["cloudwatch.json"] = append(data, '\n')
+	payloads["prometheus.txt"] = prometheusText(fixtureSamples())
+
+	var emf []byte
+	for _, r := range emfRecords("GPUMonitor", datums) {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		emf = append(append(emf, line...), '\n')
+	}
+	payloads["emf.ndjson"] = emf
+
+	influx := &InfluxPublisher{host: "node1"}
+	var lines bytes.Buffer
+	for _, s := range fixtureSamples() {
+		influx.appendSample(&lines, s)
+	}
+	payloads["influx.txt"] = lines.Bytes()
+
+	otlp := &OTLPPublisher{host: []otlpAttribute{
+		otlpString("service.name", "gpumon-go"),
+		otlpString("host.name", "node1"),
+		otlpString("host.id", "i-0123456789abcdef0"),
+		otlpString("host.type", "p4d.24xlarge"),
+	}}
+	data, err = json.MarshalIndent(otlp.otlpPayload(fixtureSamples(), nil, nil, nil), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	payloads["otlp.json"] = append(data, '\n')
+	return payloads, nil
+}
+
+// TestGolden checks every exporter wire format against testdata/golden. After an intentional
+// change run go test -run TestGolden -update and commit the files with the change.
+func TestGolden(t *testing.T) {
+	payloads, err := goldenPayloads()
+	if err != nil {
+		t.Fatalf("unable to render payloads: %v", err)
+	}
+	for name, payload := range payloads {
+		if err := golden.Check(filepath.Join("testdata", "golden", name), payload, *update); err != nil {
+			t.Error(err)
+		}
+	}
+}
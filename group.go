@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path"
+	"time"
+)
+
+// Group is a named set of devices whose latest samples are aggregated together.
+type Group struct {
+	Name    string
+	Members []int
+}
+
+// GroupSample holds the aggregate of a group's latest device samples.
+type GroupSample struct {
+	Group       string  `json:"group"`
+	Devices     int     `json:"devices"`
+	Temperature uint    `json:"temperature_max"`
+	Power       float32 `json:"power_total"`
+	GpuUsage    float32 `json:"gpu_usage_avg"`
+	MemoryTotal float32 `json:"memory_total"`
+	MemoryUsed  float32 `json:"memory_used"`
+	// MemoryUsedPercent is of the group's total memory, not an average of the devices
+	MemoryUsedPercent float32 `json:"memory_used_percent"`
+	// Timestamp is when the aggregate was computed
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewGroups returns the members of every group. It is called again on every rescan, so
+// new devices and MIG slices created since are picked up.
+func NewGroups(configs []GroupConfig, devices []Device) []Group {
+	groups := make([]Group, 0, len(configs))
+	for _, gc := range configs {
+		group := Group{Name: gc.Name}
+		for _, d := range devices {
+			if matchDevice(gc.Match, d) || matchMigParent(gc.Match, d) {
+				group.Members = append(group.Members, d.Index)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// matchMigParent reports whether a pattern matches the UUID of one of the device's MIG
+// slices, which makes the GPU a member.
+func matchMigParent(patterns []string, d Device) bool {
+	migs, err := d.GetMigDevices()
+	if err != nil {
+		return false
+	}
+	for _, m := range migs {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, m.UUID); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Aggregate combines the latest sample of every member that has reported so far, at t.
+// Lost devices are removed from latest, so they drop out. It returns false when no member
+// has reported yet.
+func (g Group) Aggregate(latest map[int]Sample, t time.Time) (GroupSample, bool) {
+	agg := GroupSample{Group: g.Name, Timestamp: t}
+	var usage uint
+	for _, index := range g.Members {
+		s, ok := latest[index]
+		if !ok {
+			continue
+		}
+		agg.Devices++
+		agg.Temperature = max(agg.Temperature, s.Temperature)
+		agg.Power += s.Power
+		agg.MemoryTotal += s.MemoryTotal
+		agg.MemoryUsed += s.MemoryUsed
+		usage += s.GpuUsage
+	}
+	if agg.Devices == 0 {
+		return GroupSample{}, false
+	}
+	agg.GpuUsage = float32(usage) / float32(agg.Devices)
+	if agg.MemoryTotal > 0 {
+		agg.MemoryUsedPercent = agg.MemoryUsed / agg.MemoryTotal * 100
+	}
+	return agg, true
+}
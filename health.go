@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// healthMissedIntervals is how many poll intervals may pass without a sample before the agent
+// reports itself unhealthy.
+const healthMissedIntervals = 3
+
+// Health tracks when the last sample was emitted and serves it for liveness and readiness
+// probes. An agent without devices is healthy as long as it runs.
+type Health struct {
+	started time.Time
+	maxAge  time.Duration
+	devices atomic.Int64
+	last    atomic.Int64
+}
+
+// NewHealth expects a sample at least every interval from each of devices.
+func NewHealth(devices int, interval time.Duration) *Health {
+	h := &Health{started: time.Now(), maxAge: healthMissedIntervals * interval}
+	h.devices.Store(int64(devices))
+	return h
+}
+
+// SetDevices updates the number of devices, e.g. after a rescan found new ones.
+func (h *Health) SetDevices(devices int) {
+	if h == nil {
+		return
+	}
+	h.devices.Store(int64(devices))
+}
+
+// Observe records that a sample was emitted at t.
+func (h *Health) Observe(t time.Time) {
+	h.last.Store(t.UnixNano())
+}
+
+type healthStatus struct {
+	Status     string     `json:"status"`
+	Devices    int        `json:"devices"`
+	LastSample *time.Time `json:"last_sample,omitempty"`
+}
+
+// Stale reports whether no sample was emitted for healthMissedIntervals poll intervals.
+func (h *Health) Stale() bool {
+	since := h.started
+	if last := h.last.Load(); last != 0 {
+		since = time.Unix(0, last)
+	}
+	return h.devices.Load() > 0 && time.Since(since) > h.maxAge
+}
+
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{Status: "ok", Devices: int(h.devices.Load())}
+	if last := h.last.Load(); last != 0 {
+		t := time.Unix(0, last)
+		status.LastSample = &t
+	}
+	code := http.StatusOK
+	if h.Stale() {
+		status.Status = "stale"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// serveHealth serves /healthz, the latest metrics on /api/v1/metrics and the build
+// information on /api/v1/version on addr. The API needs the viewer role, health checks are
+// open to probes. It never returns.
+func serveHealth(addr string, h *Health, metrics *MetricsAPI, auth *Authorizer) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	mux.Handle("/api/v1/metrics", auth.Require("viewer", metrics))
+	mux.Handle("/api/v1/version", auth.Require("viewer", http.HandlerFunc(serveVersion)))
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	log.Fatalf("Unable to serve health checks: %v", server.ListenAndServe())
+}
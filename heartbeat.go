@@ -0,0 +1,17 @@
+package main
+
+import "time"
+
+// Heartbeat is emitted on every tick of the default interval, with or without GPUs, so
+// absence-of-data alerts can tell a dead agent from a removed GPU.
+type Heartbeat struct {
+	// Heartbeat is always 1
+	Heartbeat int       `json:"heartbeat"`
+	Version   string    `json:"version"`
+	Devices   int       `json:"devices"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newHeartbeat(version string, devices int, t time.Time) Heartbeat {
+	return Heartbeat{Heartbeat: 1, Version: version, Devices: devices, Timestamp: t}
+}
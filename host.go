@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostMinInterval stops devices polled at the same moment from computing rates over a tiny window.
+const hostMinInterval = time.Second
+
+// HostMetrics gives GPU samples context about the rest of the node.
+type HostMetrics struct {
+	CPUUsage        float32         `json:"cpu_usage"`
+	MemoryTotal     float32         `json:"memory_total"`
+	MemoryUsed      float32         `json:"memory_used"`
+	NVMeTemperature map[string]uint `json:"nvme_temperature,omitempty"`
+	NetworkRx       float64         `json:"network_rx_bytes_per_second"`
+	NetworkTx       float64         `json:"network_tx_bytes_per_second"`
+}
+
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+type netCounters struct {
+	rx uint64
+	tx uint64
+}
+
+// HostCollector reads host metrics from procfs and sysfs. It is safe for concurrent use by
+// the device pollers and keeps the previous counters to turn them into rates.
+type HostCollector struct {
+	mu       sync.Mutex
+	last     time.Time
+	cached   HostMetrics
+	prevCPU  cpuTimes
+	prevNet  netCounters
+	procRoot string
+	sysRoot  string
+}
+
+func NewHostCollector() *HostCollector {
+	return &HostCollector{procRoot: "/proc", sysRoot: "/sys"}
+}
+
+func (h *HostCollector) Collect() (HostMetrics, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if !h.last.IsZero() && now.Sub(h.last) < hostMinInterval {
+		return h.cached, nil
+	}
+
+	cpu, err := h.readCPU()
+	if err != nil {
+		return HostMetrics{}, err
+	}
+	total, available, err := h.readMemory()
+	if err != nil {
+		return HostMetrics{}, err
+	}
+	net, err := h.readNetwork()
+	if err != nil {
+		return HostMetrics{}, err
+	}
+
+	metrics := HostMetrics{
+		MemoryTotal:     float32(total) / (1 << 30),
+		MemoryUsed:      float32(total-available) / (1 << 30),
+		NVMeTemperature: h.readNVMeTemperatures(),
+	}
+	if !h.last.IsZero() {
+		// iowait, counted as idle, can go down between reads, an interval in which the idle
+		// or total time went backwards has no usage
+		if cpu.total > h.prevCPU.total && cpu.idle >= h.prevCPU.idle {
+			busy, idle := cpu.total-h.prevCPU.total, cpu.idle-h.prevCPU.idle
+			metrics.CPUUsage = 100 * float32(busy-min(idle, busy)) / float32(busy)
+		}
+		// The sums go backwards when an interface goes away or its counters reset, that
+		// interval has no rate
+		if elapsed := now.Sub(h.last).Seconds(); net.rx >= h.prevNet.rx && net.tx >= h.prevNet.tx {
+			metrics.NetworkRx = float64(net.rx-h.prevNet.rx) / elapsed
+			metrics.NetworkTx = float64(net.tx-h.prevNet.tx) / elapsed
+		}
+	}
+
+	h.last = now
+	h.cached = metrics
+	h.prevCPU = cpu
+	h.prevNet = net
+	return metrics, nil
+}
+
+// Reset drops the previous counters, so the next collection reports no usage or rates.
+func (h *HostCollector) Reset() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = time.Time{}
+}
+
+func (h *HostCollector) readCPU() (cpuTimes, error) {
+	f, err := os.Open(filepath.Join(h.procRoot, "stat"))
+	if err != nil {
+		return cpuTimes{}, fmt.Errorf("unable to read cpu stats: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || fields[0] != "cpu" {
+			continue
+		}
+		// user nice system idle iowait irq softirq steal, guest time is already counted in user
+		var times cpuTimes
+		for i, field := range fields[1:9] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuTimes{}, fmt.Errorf("unable to parse cpu stats: %v", err)
+			}
+			times.total += v
+			if i == 3 || i == 4 {
+				times.idle += v
+			}
+		}
+		return times, nil
+	}
+	return cpuTimes{}, fmt.Errorf("unable to find aggregate cpu line in %s", f.Name())
+}
+
+// readMemory returns the total and available memory in bytes.
+func (h *HostCollector) readMemory() (uint64, uint64, error) {
+	f, err := os.Open(filepath.Join(h.procRoot, "meminfo"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to read memory info: %v", err)
+	}
+	defer f.Close()
+	var total, available uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v * 1024
+		case "MemAvailable:":
+			available = v * 1024
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("unable to find MemTotal in %s", f.Name())
+	}
+	return total, available, nil
+}
+
+// readNetwork sums the byte counters of every interface except loopback.
+func (h *HostCollector) readNetwork() (netCounters, error) {
+	f, err := os.Open(filepath.Join(h.procRoot, "net", "dev"))
+	if err != nil {
+		return netCounters{}, fmt.Errorf("unable to read network stats: %v", err)
+	}
+	defer f.Close()
+	var counters netCounters
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, stats, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) == "lo" {
+			continue
+		}
+		fields := strings.Fields(stats)
+		if len(fields) < 9 {
+			continue
+		}
+		rx, _ := strconv.ParseUint(fields[0], 10, 64)
+		tx, _ := strconv.ParseUint(fields[8], 10, 64)
+		counters.rx += rx
+		counters.tx += tx
+	}
+	return counters, nil
+}
+
+// readNVMeTemperatures returns the composite temperature of every NVMe controller in Celsius.
+func (h *HostCollector) readNVMeTemperatures() map[string]uint {
+	matches, _ := filepath.Glob(filepath.Join(h.sysRoot, "class", "nvme", "*", "hwmon*", "temp1_input"))
+	nested, _ := filepath.Glob(filepath.Join(h.sysRoot, "class", "nvme", "*", "device", "hwmon", "hwmon*", "temp1_input"))
+	matches = append(matches, nested...)
+	if len(matches) == 0 {
+		return nil
+	}
+	temps := make(map[string]uint, len(matches))
+	for _, match := range matches {
+		rel, err := filepath.Rel(filepath.Join(h.sysRoot, "class", "nvme"), match)
+		if err != nil {
+			continue
+		}
+		controller, _, _ := strings.Cut(rel, string(filepath.Separator))
+		data, err := os.ReadFile(match)
+		if err != nil {
+			continue
+		}
+		millidegrees, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			continue
+		}
+		temps[controller] = uint(millidegrees / 1000)
+	}
+	return temps
+}
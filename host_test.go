@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHostCollectorCPUUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		prev cpuTimes
+		stat string
+		want float32
+	}{
+		// The stat line sums to idle 300 of total 1000
+		{name: "counters advanced", prev: cpuTimes{idle: 200, total: 600}, stat: "cpu 400 0 200 250 50 50 50 0", want: 75},
+		{name: "no time passed", prev: cpuTimes{idle: 300, total: 1000}, stat: "cpu 400 0 200 250 50 50 50 0"},
+		{name: "iowait went backwards", prev: cpuTimes{idle: 350, total: 900}, stat: "cpu 400 0 200 250 50 50 50 0"},
+		{name: "total went backwards", prev: cpuTimes{idle: 200, total: 1200}, stat: "cpu 400 0 200 250 50 50 50 0"},
+		{name: "idle grew more than total", prev: cpuTimes{idle: 100, total: 950}, stat: "cpu 400 0 200 250 50 50 50 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			files := map[string]string{
+				"stat":    tt.stat + "\n",
+				"meminfo": "MemTotal: 1024 kB\nMemAvailable: 512 kB\n",
+				"net/dev": "",
+			}
+			for name, data := range files {
+				path := filepath.Join(root, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			h := &HostCollector{procRoot: root, sysRoot: root, last: time.Now().Add(-time.Second), prevCPU: tt.prev}
+			metrics, err := h.Collect()
+			if err != nil {
+				t.Fatalf("Collect() error = %v", err)
+			}
+			if metrics.CPUUsage != tt.want {
+				t.Errorf("Collect() cpu_usage = %v, want %v", metrics.CPUUsage, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// identitySources are the sources of the host name, in their default order.
+var identitySources = []string{"config", "cloud", "kubernetes", "hostname"}
+
+// IdentityConfig picks the name the exporters report the host by, so the same labels work on
+// EC2, on-prem and in containers.
+type IdentityConfig struct {
+	// Sources are tried in order until one yields a name, all of identitySources by default
+	Sources []string `json:"sources"`
+	// Hostname is the name of the config source
+	Hostname string `json:"hostname"`
+	// StripDomain drops everything from the first dot, e.g. node1.example.com becomes node1
+	StripDomain bool `json:"strip_domain"`
+	Lowercase   bool `json:"lowercase"`
+	// Replace rewrites the name with regular expressions, in order
+	Replace []IdentityReplace `json:"replace"`
+	// Overrides maps normalized names to the names to report instead
+	Overrides map[string]string `json:"overrides"`
+}
+
+// IdentityReplace replaces the matches of Pattern, Replacement may refer to groups as $1.
+type IdentityReplace struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// identity is the resolved host name. It is set once at startup, before any exporter starts.
+var identity string
+
+// hostName returns the name the host is reported by, the OS hostname unless an identity was
+// resolved.
+func hostName() string {
+	if identity != "" {
+		return identity
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// ResolveIdentity returns the name of the first source that yields one, normalized.
+func ResolveIdentity(ctx context.Context, cfg IdentityConfig) string {
+	sources := cfg.Sources
+	if len(sources) == 0 {
+		sources = identitySources
+	}
+	name, from := "", ""
+	for _, source := range sources {
+		switch source {
+		case "config":
+			name = cfg.Hostname
+		case "cloud":
+			name = cloudInstanceID(ctx)
+		case "kubernetes":
+			// Set from spec.nodeName with the downward API
+			name = os.Getenv("NODE_NAME")
+		case "hostname":
+			name, _ = os.Hostname()
+		}
+		if name != "" {
+			from = source
+			break
+		}
+	}
+	if from == "" {
+		log.Printf("No identity source yielded a host name, using the hostname")
+		name, _ = os.Hostname()
+		from = "hostname"
+	}
+	normalized := cfg.normalize(name)
+	log.Printf("Reporting the host as %s, from the %s source", normalized, from)
+	return normalized
+}
+
+func (c IdentityConfig) normalize(name string) string {
+	if c.StripDomain {
+		name, _, _ = strings.Cut(name, ".")
+	}
+	if c.Lowercase {
+		name = strings.ToLower(name)
+	}
+	for _, r := range c.Replace {
+		name = regexp.MustCompile(r.Pattern).ReplaceAllString(name, r.Replacement)
+	}
+	if override, ok := c.Overrides[name]; ok {
+		name = override
+	}
+	return name
+}
+
+// cloudInstanceID returns the EC2 instance ID, or nothing off EC2 or offline.
+func cloudInstanceID(ctx context.Context) string {
+	client := newIMDSClient(nil)
+	if client == nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	id, _ := imdsMetadata(ctx, client, "instance-id")
+	return strings.TrimSpace(id)
+}
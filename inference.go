@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inferenceCounters are the counters summed across models from the metrics endpoint. Triton
+// and vLLM use different names for the same thing.
+var inferenceCounters = map[string][]string{
+	"requests": {"nv_inference_request_success", "vllm:request_success_total"},
+	"tokens":   {"vllm:generation_tokens_total"},
+}
+
+// InferenceConfig scrapes the Prometheus metrics of a co-located inference server such as
+// Triton or vLLM, e.g. http://localhost:8002/metrics. Match selects the devices it serves
+// from, all by default.
+type InferenceConfig struct {
+	Name  string   `json:"name"`
+	URL   string   `json:"url"`
+	Match []string `json:"match"`
+}
+
+// InferenceMetrics is the throughput of an inference server since its previous scrape.
+// RequestsPerBusySecond divides the requests by the time the GPU was busy, so it shows how
+// much work each unit of GPU time serves.
+type InferenceMetrics struct {
+	RequestsPerSecond     float64 `json:"requests_per_second"`
+	TokensPerSecond       float64 `json:"tokens_per_second,omitempty"`
+	RequestsPerBusySecond float64 `json:"requests_per_busy_second,omitempty"`
+}
+
+// InferenceScraper scrapes an inference server in the background and keeps its latest rates.
+type InferenceScraper struct {
+	cfg    InferenceConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	last   map[string]float64
+	lastAt time.Time
+	rates  *InferenceMetrics
+}
+
+func NewInferenceScraper(cfg InferenceConfig) *InferenceScraper {
+	return &InferenceScraper{cfg: cfg, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// Matches reports whether the server runs on the device.
+func (s *InferenceScraper) Matches(d Device) bool {
+	return len(s.cfg.Match) == 0 || matchDevice(s.cfg.Match, d)
+}
+
+// Rates returns the rates of the latest scrape, with the busy rate for the given GPU
+// utilization, or false before two scrapes succeeded.
+func (s *InferenceScraper) Rates(gpuUsage uint) (InferenceMetrics, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rates == nil {
+		return InferenceMetrics{}, false
+	}
+	rates := *s.rates
+	if gpuUsage > 0 {
+		rates.RequestsPerBusySecond = rates.RequestsPerSecond / (float64(gpuUsage) / 100)
+	}
+	return rates, true
+}
+
+// Run scrapes the server every interval. It never returns.
+func (s *InferenceScraper) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		if err := s.scrape(); err != nil {
+			log.Printf("Unable to scrape inference server %s: %v", s.cfg.Name, err)
+		}
+	}
+}
+
+func (s *InferenceScraper) scrape() error {
+	resp, err := s.client.Get(s.cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	counters, err := sumInferenceCounters(resp.Body)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil {
+		elapsed := now.Sub(s.lastAt).Seconds()
+		// Counters go backwards when the server restarts, skip that interval
+		if counters["requests"] >= s.last["requests"] && counters["tokens"] >= s.last["tokens"] {
+			s.rates = &InferenceMetrics{
+				RequestsPerSecond: (counters["requests"] - s.last["requests"]) / elapsed,
+				TokensPerSecond:   (counters["tokens"] - s.last["tokens"]) / elapsed,
+			}
+		}
+	}
+	s.last, s.lastAt = counters, now
+	return nil
+}
+
+// sumInferenceCounters sums the known counters across all label sets of a Prometheus text
+// exposition.
+func sumInferenceCounters(r io.Reader) (map[string]float64, error) {
+	names := make(map[string]string)
+	for key, metrics := range inferenceCounters {
+		for _, name := range metrics {
+			names[name] = key
+		}
+	}
+	counters := make(map[string]float64, len(inferenceCounters))
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rest, _ := strings.Cut(line, " ")
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			name = line[:i]
+			// Label values may contain spaces, the value follows the closing brace
+			end := strings.LastIndexByte(line, '}')
+			if end < 0 {
+				continue
+			}
+			rest = line[end+1:]
+		}
+		key, ok := names[name]
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %v", name, err)
+		}
+		counters[key] += value
+	}
+	return counters, scanner.Err()
+}
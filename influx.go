@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	influxQueueSize = 1000
+	// influxDefaultMaxSize is the size in MiB a file is rotated at by default
+	influxDefaultMaxSize = 100
+)
+
+// influxTuning writes up to 5000 lines per request every 10s, one request at a time, and
+// retries failed requests for a minute.
+var influxTuning = SinkTuning{FlushSize: 5000, FlushInterval: Duration{10 * time.Second}, MaxInFlight: 1, MaxRetry: Duration{time.Minute}}
+
+// InfluxConfig writes samples in InfluxDB line protocol, either to the bucket of an InfluxDB
+// v2 server at URL, e.g. http://influxdb:8086, or to a local file.
+type InfluxConfig struct {
+	URL     string            `json:"url"`
+	Token   string            `json:"token"`
+	Org     string            `json:"org"`
+	Bucket  string            `json:"bucket"`
+	Timeout Duration          `json:"timeout"`
+	File    *InfluxFileConfig `json:"file"`
+	// Compression gzips the lines written to a server
+	Compression *CompressionConfig `json:"compression"`
+	// Tuning overrides how lines are batched and retried, only the flush size and interval
+	// apply to files
+	Tuning SinkTuning `json:"tuning"`
+}
+
+// InfluxFileConfig appends the line protocol to Path and rotates it once it grows past
+// MaxSize MiB (default 100) or gets older than MaxAge. Rotated files keep the time they were
+// rotated at as suffix, and only the MaxFiles newest are kept when it is set.
+type InfluxFileConfig struct {
+	Path     string   `json:"path"`
+	MaxSize  int      `json:"max_size"`
+	MaxAge   Duration `json:"max_age"`
+	MaxFiles int      `json:"max_files"`
+}
+
+// influxFields are the fields written for every sample, named after their JSON fields.
+var influxFields = []struct {
+	name  string
+	value func(Metrics) string
+}{
+	{"temperature", func(m Metrics) string { return strconv.FormatUint(uint64(m.Temperature), 10) + "i" }},
+	{"power", func(m Metrics) string { return strconv.FormatFloat(float64(m.Power), 'f', -1, 32) }},
+	{"gpu_usage", func(m Metrics) string { return strconv.FormatUint(uint64(m.GpuUsage), 10) + "i" }},
+	{"memory_total", func(m Metrics) string { return strconv.FormatFloat(float64(m.MemoryTotal), 'f', -1, 32) }},
+	{"memory_used", func(m Metrics) string { return strconv.FormatFloat(float64(m.MemoryUsed), 'f', -1, 32) }},
+	{"memory_used_percent", func(m Metrics) string { return strconv.FormatFloat(float64(m.MemoryUsedPercent), 'f', -1, 32) }},
+}
+
+// influxEscaper escapes tag values. Measurements and tag keys are fixed and need no escaping.
+// Backslashes are escaped so a trailing one cannot escape the separator after the value, and
+// line protocol has no escape for line breaks, so they become escaped spaces.
+var influxEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+
+// writeInfluxTags writes the measurement and the tags given as key and value pairs. Tags with
+// an empty value are left out, line protocol does not allow them.
+func writeInfluxTags(b *bytes.Buffer, measurement string, tags ...string) {
+	b.WriteString(measurement)
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] != "" {
+			b.WriteString("," + tags[i] + "=" + influxEscaper.Replace(tags[i+1]))
+		}
+	}
+}
+
+// InfluxPublisher batches samples and writes them as line protocol in the background.
+type InfluxPublisher struct {
+	host       string
+	tuning     SinkTuning
+	queue      chan Sample
+	heartbeats chan Heartbeat
+	groups     chan GroupSample
+	// writeURL and token are set when writing to a server
+	writeURL string
+	token    string
+	client   *http.Client
+	limiter  *RateLimiter
+	tracer   *Tracer
+	compress *compressor
+	// file is set when writing to a local file
+	file *rotatingFile
+}
+
+func NewInfluxPublisher(cfg InfluxConfig, limiter *RateLimiter, tracer *Tracer) (*InfluxPublisher, error) {
+	p := &InfluxPublisher{
+		host:       hostName(),
+		tuning:     cfg.Tuning.withDefaults(influxTuning),
+		queue:      make(chan Sample, influxQueueSize),
+		heartbeats: make(chan Heartbeat, influxQueueSize),
+		groups:     make(chan GroupSample, influxQueueSize),
+	}
+	if cfg.File != nil {
+		file, err := openRotatingFile(*cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		p.file = file
+		return p, nil
+	}
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	query := url.Values{"org": {cfg.Org}, "bucket": {cfg.Bucket}, "precision": {"ns"}}
+	p.writeURL = strings.TrimSuffix(cfg.URL, "/") + "/api/v2/write?" + query.Encode()
+	p.token = cfg.Token
+	p.client = &http.Client{Timeout: timeout}
+	p.limiter = limiter
+	p.tracer = tracer
+	p.compress = newCompressor(cfg.Compression)
+	return p, nil
+}
+
+// Send queues the sample for the next flush without blocking the caller.
+func (p *InfluxPublisher) Send(s Sample) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.queue <- s:
+	default:
+		log.Printf("InfluxDB is not keeping up, dropped sample of device %d", s.Index)
+	}
+}
+
+// SendHeartbeat queues the heartbeat for the next flush without blocking the caller.
+func (p *InfluxPublisher) SendHeartbeat(h Heartbeat) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.heartbeats <- h:
+	default:
+		log.Printf("InfluxDB is not keeping up, dropped heartbeat")
+	}
+}
+
+// SendGroup queues the group aggregate for the next flush without blocking the caller.
+func (p *InfluxPublisher) SendGroup(g GroupSample) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.groups <- g:
+	default:
+		log.Printf("InfluxDB is not keeping up, dropped aggregate of group %s", g.Group)
+	}
+}
+
+// Run writes the queued samples, heartbeats and group aggregates on every flush, and as soon as a full request
+// is queued. Failed requests to a server are retried on the next flushes. When ctx is
+// cancelled it writes the ones queued so far one last time, within shutdownTimeout, and
+// returns.
+func (p *InfluxPublisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.tuning.FlushInterval.Duration)
+	defer ticker.Stop()
+	var lines bytes.Buffer
+	var pending []pendingRequest
+	// queued counts the lines, so a full request is flushed right away
+	queued := 0
+	for {
+		select {
+		case s := <-p.queue:
+			p.appendSample(&lines, s)
+			if queued++; queued >= p.tuning.FlushSize {
+				pending = p.flush(context.Background(), bytes.Clone(lines.Bytes()), pending)
+				lines.Reset()
+				queued = 0
+			}
+		case h := <-p.heartbeats:
+			p.appendHeartbeat(&lines, h)
+			queued++
+		case g := <-p.groups:
+			p.appendGroup(&lines, g)
+			queued++
+		case <-ticker.C:
+			pending = p.flush(context.Background(), bytes.Clone(lines.Bytes()), pending)
+			lines.Reset()
+			queued = 0
+		case <-ctx.Done():
+			for len(p.queue) > 0 {
+				p.appendSample(&lines, <-p.queue)
+			}
+			for len(p.heartbeats) > 0 {
+				p.appendHeartbeat(&lines, <-p.heartbeats)
+			}
+			for len(p.groups) > 0 {
+				p.appendGroup(&lines, <-p.groups)
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if pending = p.flush(flushCtx, bytes.Clone(lines.Bytes()), pending); len(pending) > 0 {
+				log.Printf("Dropped %d requests InfluxDB did not accept before shutdown", len(pending))
+			}
+			cancel()
+			if p.file != nil {
+				p.file.Close()
+			}
+			return
+		}
+	}
+}
+
+// appendSample writes the sample as a gpumon point tagged with the host, GPU index and UUID,
+// the pods of an allocated GPU, and the tenant, user label and job chargeback reports group
+// by, e.g. gpumon,host=node-1,gpu=0,uuid=GPU-1 temperature=45i,power=70.5 1700000000000000000
+func (p *InfluxPublisher) appendSample(b *bytes.Buffer, s Sample) {
+	line := b.Len()
+	tags := []string{"host", p.host, "gpu", strconv.Itoa(s.Index), "uuid", s.UUID}
+	if len(s.Pods) > 0 {
+		namespace, pod, container := podLabels(s.Pods)
+		tags = append(tags, "namespace", namespace, "pod", pod, "container", container)
+	}
+	tags = append(tags, "tenant", s.Tenant, "user", s.Labels["user"], "job", sampleJob(s))
+	writeInfluxTags(b, "gpumon", tags...)
+	b.WriteByte(' ')
+	// Every field is written with a leading comma, the first one is removed below
+	fields := b.Len()
+	for _, f := range influxFields {
+		if s.exports(f.name) {
+			b.WriteString("," + f.name + "=" + f.value(s.Metrics))
+		}
+	}
+	for _, d := range s.derived {
+		b.WriteString("," + d.name + "=" + strconv.FormatFloat(d.value, 'g', -1, 64))
+	}
+	if s.ComputeProcesses != nil {
+		fmt.Fprintf(b, ",compute_processes=%di", *s.ComputeProcesses)
+	}
+	if s.Extended != nil && s.Extended.PState != nil {
+		fmt.Fprintf(b, ",pstate=%di,throttle_mask=%di", *s.Extended.PState, *s.Extended.ThrottleMask)
+	}
+	if s.Extended != nil && s.Extended.EncoderStats != nil {
+		stats := s.Extended.EncoderStats
+		fmt.Fprintf(b, ",encoder_sessions=%di,encoder_fps=%di,encoder_latency_us=%di", stats.Sessions, stats.FPS, stats.Latency)
+	}
+	if s.Extended != nil && s.Extended.Display != nil {
+		display := s.Extended.Display
+		fmt.Fprintf(b, ",display_attached=%t,display_active=%t,mode=%q", display.Attached, display.Active, display.Mode)
+	}
+	if burst := s.Burst; burst != nil {
+		fmt.Fprintf(b, ",power_min=%s,power_max=%s,power_avg=%s", strconv.FormatFloat(burst.Power.Min, 'g', -1, 64), strconv.FormatFloat(burst.Power.Max, 'g', -1, 64), strconv.FormatFloat(burst.Power.Avg, 'g', -1, 64))
+		fmt.Fprintf(b, ",gpu_usage_min=%s,gpu_usage_max=%s,gpu_usage_avg=%s", strconv.FormatFloat(burst.GpuUsage.Min, 'g', -1, 64), strconv.FormatFloat(burst.GpuUsage.Max, 'g', -1, 64), strconv.FormatFloat(burst.GpuUsage.Avg, 'g', -1, 64))
+	}
+	if s.ClockStability != nil {
+		fmt.Fprintf(b, ",clock_stability=%s", strconv.FormatFloat(s.ClockStability.Score, 'g', -1, 64))
+	}
+	if states := s.TimeInState; states != nil {
+		for _, band := range utilizationBands {
+			fmt.Fprintf(b, ",%s_seconds=%s", band.name, strconv.FormatFloat(states.Utilization[band.name], 'g', -1, 64))
+		}
+		for _, pstate := range states.pstateNames() {
+			fmt.Fprintf(b, ",%s_seconds=%s", strings.ToLower(pstate), strconv.FormatFloat(states.PStates[pstate], 'g', -1, 64))
+		}
+	}
+	if b.Len() == fields {
+		// The relabel rules dropped every field, a point needs at least one
+		b.Truncate(line)
+		return
+	}
+	data := b.Bytes()
+	copy(data[fields:], data[fields+1:])
+	b.Truncate(b.Len() - 1)
+	fmt.Fprintf(b, " %d\n", s.Timestamp.UnixNano())
+}
+
+func (p *InfluxPublisher) appendHeartbeat(b *bytes.Buffer, h Heartbeat) {
+	writeInfluxTags(b, "gpumon_heartbeat", "host", p.host, "version", h.Version)
+	fmt.Fprintf(b, " value=%di,devices=%di %d\n", h.Heartbeat, h.Devices, h.Timestamp.UnixNano())
+}
+
+// appendGroup writes the group aggregate as a gpumon_group point tagged with the host and group.
+func (p *InfluxPublisher) appendGroup(b *bytes.Buffer, g GroupSample) {
+	writeInfluxTags(b, "gpumon_group", "host", p.host, "group", g.Group)
+	fmt.Fprintf(b, " devices=%di,temperature_max=%di,power_total=%s,gpu_usage_avg=%s,memory_total=%s,memory_used=%s,memory_used_percent=%s %d\n",
+		g.Devices, g.Temperature,
+		strconv.FormatFloat(float64(g.Power), 'f', -1, 32), strconv.FormatFloat(float64(g.GpuUsage), 'f', -1, 32),
+		strconv.FormatFloat(float64(g.MemoryTotal), 'f', -1, 32), strconv.FormatFloat(float64(g.MemoryUsed), 'f', -1, 32),
+		strconv.FormatFloat(float64(g.MemoryUsedPercent), 'f', -1, 32), g.Timestamp.UnixNano())
+}
+
+// appendExporters writes the cumulative publishes of every exporter as gpumon_exporter points.
+func (p *InfluxPublisher) appendExporters(b *bytes.Buffer, statuses []ExporterStatus, now time.Time) {
+	for _, e := range statuses {
+		writeInfluxTags(b, "gpumon_exporter", "host", p.host, "exporter", e.Exporter)
+		fmt.Fprintf(b, " successes=%di,failures=%di", e.Successes, e.Failures)
+		if !e.LastSuccess.IsZero() {
+			fmt.Fprintf(b, ",last_success=%di", e.LastSuccess.UnixNano())
+		}
+		fmt.Fprintf(b, " %d\n", now.UnixNano())
+	}
+}
+
+// flush writes the lines with the exporter statuses appended. A server gets them in requests
+// of at most FlushSize lines along with the pending requests, and the requests to retry are
+// returned.
+func (p *InfluxPublisher) flush(ctx context.Context, lines []byte, pending []pendingRequest) []pendingRequest {
+	if len(lines) == 0 && len(pending) == 0 {
+		return nil
+	}
+	if len(lines) > 0 {
+		b := bytes.NewBuffer(lines)
+		p.appendExporters(b, exporterStats.Snapshot(), time.Now())
+		lines = b.Bytes()
+	}
+	if p.file != nil {
+		err := p.file.Write(lines)
+		exporterStats.Record("influx", err)
+		if err != nil {
+			log.Printf("Unable to write line protocol to %s: %v", p.file.path, err)
+		}
+		return nil
+	}
+	var bodies [][]byte
+	for len(lines) > 0 {
+		end := 0
+		for n := 0; n < p.tuning.FlushSize && end < len(lines); n++ {
+			end += bytes.IndexByte(lines[end:], '\n') + 1
+		}
+		bodies = append(bodies, lines[:end])
+		lines = lines[end:]
+	}
+	span := p.tracer.Start("influx flush")
+	span.SetAttr("requests", strconv.Itoa(len(bodies)))
+	span.SetAttr("pending", strconv.Itoa(len(pending)))
+	defer span.End()
+	retry, expired, err := p.tuning.sendRequests(pending, bodies, span, "influx write", func(body []byte, attempt *Span) error {
+		return p.post(ctx, body, attempt)
+	})
+	span.SetError(err)
+	exporterStats.Record("influx", err)
+	if err != nil {
+		log.Printf("Unable to write to InfluxDB, %d requests to retry: %v", len(retry), err)
+	}
+	if expired > 0 {
+		log.Printf("Dropped %d requests InfluxDB did not accept for %v", expired, p.tuning.MaxRetry.Duration)
+	}
+	return retry
+}
+
+func (p *InfluxPublisher) post(ctx context.Context, lines []byte, span *Span) error {
+	if err := p.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	req, err := p.compress.newRequest(ctx, p.writeURL, lines)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Token "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	span.SetAttr("http.status_code", strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// rotatingFile appends to a file and rotates it by size and age. Every write is synced, so
+// the lines survive a crash or power loss of the node.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	f        *os.File
+	size     int64
+	opened   time.Time
+}
+
+func openRotatingFile(cfg InfluxFileConfig) (*rotatingFile, error) {
+	maxSize := cfg.MaxSize
+	if maxSize == 0 {
+		maxSize = influxDefaultMaxSize
+	}
+	r := &rotatingFile{path: cfg.Path, maxSize: int64(maxSize) << 20, maxAge: cfg.MaxAge.Duration, maxFiles: cfg.MaxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return fmt.Errorf("unable to create directory for %s: %v", r.path, err)
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", r.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to stat %s: %v", r.path, err)
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends lines, which end in a newline, after rotating the file if it is due.
+func (r *rotatingFile) Write(lines []byte) error {
+	if r.size > 0 && (r.size+int64(len(lines)) > r.maxSize || (r.maxAge > 0 && time.Since(r.opened) >= r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(lines)
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return r.f.Sync()
+}
+
+// rotate renames the file with the current time as suffix, opens a new one and removes the
+// oldest rotated files beyond maxFiles.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	rotated := r.path + "." + time.Now().UTC().Format("20060102T150405.000Z")
+	if err := os.Rename(r.path, rotated); err != nil {
+		// Keep appending to the full file rather than losing the lines
+		log.Printf("Unable to rotate %s: %v", r.path, err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.maxFiles <= 0 {
+		return nil
+	}
+	// The suffixes sort by time, so the oldest files come first
+	files, _ := filepath.Glob(r.path + ".[0-9]*")
+	slices.Sort(files)
+	for _, name := range files[:max(len(files)-r.maxFiles, 0)] {
+		if err := os.Remove(name); err != nil {
+			log.Printf("Unable to remove rotated file: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
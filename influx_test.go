@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteInfluxTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		want string
+	}{
+		{name: "plain", tags: []string{"host", "node-1", "gpu", "0"}, want: `gpumon,host=node-1,gpu=0`},
+		{name: "separators", tags: []string{"pod", "a b,c=d"}, want: `gpumon,pod=a\ b\,c\=d`},
+		{name: "trailing backslash", tags: []string{"host", `node\`, "gpu", "0"}, want: `gpumon,host=node\\,gpu=0`},
+		{name: "line breaks", tags: []string{"job", "a\nb\r\nc"}, want: `gpumon,job=a\ b\ \ c`},
+		{name: "empty values are left out", tags: []string{"host", "node-1", "pod", "", "gpu", "0"}, want: `gpumon,host=node-1,gpu=0`},
+		{name: "odd tag is ignored", tags: []string{"host", "node-1", "gpu"}, want: `gpumon,host=node-1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			writeInfluxTags(&b, "gpumon", tt.tags...)
+			if got := b.String(); got != tt.want {
+				t.Errorf("writeInfluxTags() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendSample(t *testing.T) {
+	shared := fixtureSamples()[1]
+	shared.Pods = []PodAllocation{
+		{Namespace: "ml", Pod: "train-0", Container: "main"},
+		{Namespace: "ml", Pod: "eval 1", Container: "main"},
+	}
+	tests := []struct {
+		name   string
+		sample Sample
+		want   string
+	}{
+		{
+			name:   "idle GPU",
+			sample: fixtureSamples()[0],
+			want:   "gpumon,host=node\\ 1,gpu=0,uuid=GPU-00000000-1111-2222-3333-444444444444 temperature=54i,power=231.5,gpu_usage=97i,memory_total=79.6,memory_used=61.25,memory_used_percent=76.94724 1704164645000000000\n",
+		},
+		{
+			name:   "pods sharing a GPU",
+			sample: shared,
+			want:   "gpumon,host=node\\ 1,gpu=1,uuid=GPU-55555555-6666-7777-8888-999999999999,namespace=ml,pod=train-0\\,eval\\ 1,container=main temperature=38i,power=61.75,gpu_usage=0i,memory_total=79.6,memory_used=0.5,memory_used_percent=0.6281407 1704164645000000000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			(&InfluxPublisher{host: "node 1"}).appendSample(&b, tt.sample)
+			if got := b.String(); got != tt.want {
+				t.Errorf("appendSample() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
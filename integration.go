@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// integrationRun identifies the devices and series of one integration run, so the results of
+// earlier runs against the same containers are not counted.
+type integrationRun struct {
+	id      string
+	devices []Device
+	samples []Sample
+}
+
+// testCommand implements the test subcommand, whose only mode is integration.
+func testCommand(args []string) int {
+	if len(args) == 0 || args[0] != "integration" {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go test integration [flags]")
+		return 2
+	}
+	return integrationCommand(args[1:])
+}
+
+// integrationCommand publishes samples of simulated GPUs through the real exporters to
+// LocalStack, InfluxDB and Prometheus, e.g. the containers of testdata/integration, and reads
+// them back. An empty endpoint skips its exporter. It exits with 1 when a check fails.
+func integrationCommand(args []string) int {
+	fs := flag.NewFlagSet("test integration", flag.ExitOnError)
+	localstack := fs.String("localstack", "http://localhost:4566", "LocalStack endpoint for CloudWatch, empty skips CloudWatch")
+	influxURL := fs.String("influx", "http://localhost:8086", "InfluxDB URL, empty skips InfluxDB")
+	influxToken := fs.String("influx-token", "gpumon-integration", "InfluxDB token")
+	influxOrg := fs.String("influx-org", "gpumon", "InfluxDB organization")
+	influxBucket := fs.String("influx-bucket", "gpumon", "InfluxDB bucket")
+	prometheusURL := fs.String("prometheus", "http://localhost:9090", "Prometheus URL, empty skips Prometheus")
+	listen := fs.String("listen", ":9400", "address Prometheus scrapes the simulated GPUs on")
+	count := fs.Int("devices", 2, "number of simulated GPUs")
+	polls := fs.Int("samples", 3, "samples taken of every GPU")
+	timeout := fs.Duration("timeout", 2*time.Minute, "time allowed for all checks")
+	fs.Parse(args)
+	if *count < 1 || *polls < 1 {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go test integration [-devices 2] [-samples 3]")
+		return 2
+	}
+
+	run, err := newIntegrationRun(*count, *polls)
+	if err != nil {
+		log.Printf("Unable to simulate devices: %v", err)
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	checks := []struct {
+		name     string
+		endpoint string
+		// health is polled until the service is up, containers take a while after starting
+		health string
+		check  func(context.Context) error
+	}{
+		{"cloudwatch", *localstack, "/_localstack/health", func(ctx context.Context) error { return run.cloudwatch(ctx, *localstack) }},
+		{"influx", *influxURL, "/health", func(ctx context.Context) error {
+			return run.influx(ctx, InfluxConfig{URL: *influxURL, Token: *influxToken, Org: *influxOrg, Bucket: *influxBucket})
+		}},
+		{"prometheus", *prometheusURL, "/-/ready", func(ctx context.Context) error { return run.prometheus(ctx, *prometheusURL, *listen) }},
+	}
+	code := 0
+	for _, c := range checks {
+		if c.endpoint == "" {
+			fmt.Printf("SKIP %s\n", c.name)
+			continue
+		}
+		if err := waitReady(ctx, strings.TrimSuffix(c.endpoint, "/")+c.health); err != nil {
+			fmt.Printf("FAIL %s: not ready: %v\n", c.name, err)
+			code = 1
+			continue
+		}
+		if err := c.check(ctx); err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("PASS %s\n", c.name)
+	}
+	return code
+}
+
+// newIntegrationRun takes the samples of the simulated devices, a second apart.
+func newIntegrationRun(count, polls int) (*integrationRun, error) {
+	run := &integrationRun{id: strconv.FormatInt(time.Now().Unix(), 36)}
+	backend := gpumon.NewSimBackend(count, run.id)
+	devices, err := backend.Devices()
+	if err != nil {
+		return nil, err
+	}
+	run.devices = devices
+	start := time.Now().Add(-time.Duration(polls) * time.Second)
+	for seq := 1; seq <= polls; seq++ {
+		for _, d := range devices {
+			metrics, err := d.GetMetrics()
+			if err != nil {
+				return nil, err
+			}
+			run.samples = append(run.samples, Sample{Index: d.Index, UUID: d.UUID, Epoch: epoch, Seq: uint64(seq), Timestamp: start.Add(time.Duration(seq) * time.Second), Metrics: metrics})
+		}
+	}
+	return run, nil
+}
+
+// publish sends the samples through an exporter and waits for its final flush.
+func (r *integrationRun) publish(ctx context.Context, run func(context.Context), send func(Sample)) {
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(runCtx)
+	}()
+	for _, s := range r.samples {
+		send(s)
+	}
+	stop()
+	<-done
+}
+
+// published returns an error unless the exporter published without failures.
+func published(exporter string) error {
+	for _, status := range exporterStats.Snapshot() {
+		if status.Exporter != exporter {
+			continue
+		}
+		if status.Failures > 0 {
+			return fmt.Errorf("%d publishes failed, the last with: %s", status.Failures, status.LastError)
+		}
+		if status.Successes > 0 {
+			return nil
+		}
+	}
+	return errors.New("nothing was published")
+}
+
+// cloudwatch publishes to a namespace of its own on LocalStack and lists its metrics.
+func (r *integrationRun) cloudwatch(ctx context.Context, endpoint string) error {
+	// The SDK reads the endpoint and credentials from the environment, like on a host
+	os.Setenv("AWS_ENDPOINT_URL", endpoint)
+	os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	for name, value := range map[string]string{"AWS_ACCESS_KEY_ID": "test", "AWS_SECRET_ACCESS_KEY": "test", "AWS_REGION": "us-east-1"} {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, value)
+		}
+	}
+	cfg := DefaultConfig().Cloudwatch
+	cfg.Namespace = "GPUMonitorIntegration/" + r.id
+	p, err := NewCloudwatchPublisher(ctx, cfg, nil, nil)
+	if err != nil {
+		return err
+	}
+	r.publish(ctx, p.Run, p.Send)
+	if err := published("cloudwatch"); err != nil {
+		return err
+	}
+	awsCfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return err
+	}
+	out, err := cloudwatch.NewFromConfig(awsCfg).ListMetrics(ctx, &cloudwatch.ListMetricsInput{Namespace: aws.String(cfg.Namespace)})
+	if err != nil {
+		return fmt.Errorf("unable to list metrics: %v", err)
+	}
+	found := make(map[string]bool)
+	for _, m := range out.Metrics {
+		found[aws.ToString(m.MetricName)] = true
+	}
+	mapping := cfg.MetricMapping()
+	for _, key := range cloudwatchMetrics {
+		if !found[mapping[key].Name] {
+			return fmt.Errorf("metric %q is missing from namespace %s", mapping[key].Name, cfg.Namespace)
+		}
+	}
+	return nil
+}
+
+// influx writes the samples and counts the points of this run's devices with a Flux query.
+func (r *integrationRun) influx(ctx context.Context, cfg InfluxConfig) error {
+	p, err := NewInfluxPublisher(cfg, nil, nil)
+	if err != nil {
+		return err
+	}
+	r.publish(ctx, p.Run, p.Send)
+	if err := published("influx"); err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`from(bucket: %q) |> range(start: -1h) |> filter(fn: (r) => r._measurement == "gpumon" and r._field == "gpu_usage" and r.uuid =~ /^SIM-%s-/) |> group() |> count()`, cfg.Bucket, r.id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(cfg.URL, "/")+"/api/v2/query?org="+url.QueryEscape(cfg.Org), strings.NewReader(query))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+cfg.Token)
+	req.Header.Set("Content-Type", "application/vnd.flux")
+	req.Header.Set("Accept", "application/csv")
+	body, err := integrationGet(req)
+	if err != nil {
+		return fmt.Errorf("unable to query InfluxDB: %v", err)
+	}
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil || len(records) < 2 {
+		return fmt.Errorf("unexpected query result: %q", body)
+	}
+	column := -1
+	for i, name := range records[0] {
+		if name == "_value" {
+			column = i
+		}
+	}
+	if column < 0 || column >= len(records[1]) {
+		return fmt.Errorf("unexpected query result: %q", body)
+	}
+	if got := records[1][column]; got != strconv.Itoa(len(r.samples)) {
+		return fmt.Errorf("found %s points, expected %d", got, len(r.samples))
+	}
+	return nil
+}
+
+// prometheus serves the latest samples on listen and waits for Prometheus to scrape all of
+// this run's devices.
+func (r *integrationRun) prometheus(ctx context.Context, prometheusURL, listen string) error {
+	e := NewPrometheusExporter()
+	for _, s := range r.samples {
+		e.Observe(s)
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", listen, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go server.Serve(ln)
+	defer server.Close()
+
+	query := fmt.Sprintf(`count(gpumon_gpu_utilization_percent{uuid=~"SIM-%s-.*"})`, r.id)
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(prometheusURL, "/")+"/api/v1/query?query="+url.QueryEscape(query), nil)
+		if err != nil {
+			return err
+		}
+		body, err := integrationGet(req)
+		if err == nil {
+			var result struct {
+				Data struct {
+					Result []struct {
+						Value [2]any `json:"value"`
+					} `json:"result"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(body), &result); err == nil && len(result.Data.Result) == 1 && result.Data.Result[0].Value[1] == strconv.Itoa(len(r.devices)) {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("unable to query Prometheus: %v", err)
+			}
+			return fmt.Errorf("Prometheus did not scrape the %d devices on %s in time", len(r.devices), listen)
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitReady polls the health endpoint every second until it answers with 200.
+func waitReady(ctx context.Context, health string) error {
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, health, nil)
+		if err != nil {
+			return err
+		}
+		if _, err = integrationGet(req); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// integrationGet sends the request and returns the body of a successful response.
+func integrationGet(req *http.Request) (string, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
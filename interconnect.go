@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// Unidirectional bandwidth per NVLink link in bytes per second. Only the first generation is
+// slower, every later generation adds links rather than per-link speed.
+const (
+	nvlinkV1LinkBandwidth = 20e9
+	nvlinkLinkBandwidth   = 25e9
+)
+
+// pcieLaneBandwidth is the usable bandwidth of one lane in bytes per second, by generation.
+var pcieLaneBandwidth = map[int]float64{
+	1: 0.25e9,
+	2: 0.5e9,
+	3: 0.985e9,
+	4: 1.969e9,
+	5: 3.938e9,
+	6: 7.563e9,
+}
+
+// PathResult is the outcome of the bandwidth test between two devices.
+type PathResult struct {
+	Source   int     `json:"source"`
+	Dest     int     `json:"dest"`
+	Link     string  `json:"link"`
+	Expected float64 `json:"expected_gbps"`
+	Achieved float64 `json:"achieved_gbps"`
+	Degraded bool    `json:"degraded"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// expectedBandwidth returns the theoretical unidirectional bandwidth between two devices in
+// bytes per second along with a description of the path.
+func expectedBandwidth(src, dst Device) (float64, string, error) {
+	dstPci, ret := dst.Handle.GetPciInfo()
+	if ret != nvml.SUCCESS {
+		return 0, "", nvmlError(ret)
+	}
+	var links int
+	var bandwidth float64
+	for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+		state, ret := src.Handle.GetNvLinkState(link)
+		if ret != nvml.SUCCESS || state != nvml.FEATURE_ENABLED {
+			continue
+		}
+		remote, ret := src.Handle.GetNvLinkRemotePciInfo(link)
+		if ret != nvml.SUCCESS {
+			continue
+		}
+		if remote.Domain != dstPci.Domain || remote.Bus != dstPci.Bus || remote.Device != dstPci.Device {
+			continue
+		}
+		links++
+		if version, ret := src.Handle.GetNvLinkVersion(link); ret == nvml.SUCCESS && version == 1 {
+			bandwidth += nvlinkV1LinkBandwidth
+		} else {
+			bandwidth += nvlinkLinkBandwidth
+		}
+	}
+	if links > 0 {
+		return bandwidth, fmt.Sprintf("NVLink x%d", links), nil
+	}
+
+	// Without a direct NVLink connection the copy is bounded by the slower PCIe link
+	gen, width := 0, 0
+	for i, d := range []Device{src, dst} {
+		g, ret := d.Handle.GetCurrPcieLinkGeneration()
+		if ret != nvml.SUCCESS {
+			return 0, "", nvmlError(ret)
+		}
+		w, ret := d.Handle.GetCurrPcieLinkWidth()
+		if ret != nvml.SUCCESS {
+			return 0, "", nvmlError(ret)
+		}
+		if i == 0 || g < gen {
+			gen = g
+		}
+		if i == 0 || w < width {
+			width = w
+		}
+	}
+	return pcieLaneBandwidth[gen] * float64(width), fmt.Sprintf("PCIe Gen%d x%d", gen, width), nil
+}
+
+// validateInterconnect implements the validate-interconnect subcommand and returns the exit code.
+func validateInterconnect(args []string) int {
+	fs := flag.NewFlagSet("validate-interconnect", flag.ExitOnError)
+	size := fs.Int("size", 256<<20, "bytes copied per transfer")
+	iterations := fs.Int("iterations", 10, "timed transfers per device pair")
+	threshold := fs.Float64("threshold", 0.7, "fraction of the expected bandwidth below which a path is degraded")
+	cudart := fs.String("cudart", "", "path to libcudart.so, searched in the library path by default")
+	jsonOutput := fs.Bool("json", false, "print results as JSON")
+	fs.Parse(args)
+
+	loaded, err := gpumon.Init()
+	if err != nil {
+		log.Fatalf("Unable to load NVML: %v", err)
+	}
+	var devices []Device
+	if loaded {
+		defer nvml.Shutdown()
+		if devices, err = gpumon.GetDevices(); err != nil {
+			log.Fatalf("Unable to get devices: %v", err)
+		}
+	}
+	if len(devices) < 2 {
+		log.Printf("Found %d device(s), at least two are needed to validate the interconnect", len(devices))
+		return 0
+	}
+	if err := openCUDARuntime(*cudart); err != nil {
+		log.Fatalf("Unable to run bandwidth test: %v", err)
+	}
+	defer closeCUDARuntime()
+
+	var results []PathResult
+	degraded := false
+	for _, src := range devices {
+		for _, dst := range devices {
+			if src.Index == dst.Index {
+				continue
+			}
+			result := PathResult{Source: src.Index, Dest: dst.Index}
+			expected, link, err := expectedBandwidth(src, dst)
+			if err != nil {
+				result.Error = err.Error()
+			}
+			result.Link = link
+			result.Expected = expected / 1e9
+			achieved, err := peerCopyBandwidth(src.Index, dst.Index, *size, *iterations)
+			if err != nil {
+				result.Error = err.Error()
+			}
+			result.Achieved = achieved / 1e9
+			result.Degraded = result.Error != "" || achieved < expected*(*threshold)
+			degraded = degraded || result.Degraded
+			results = append(results, result)
+		}
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			log.Fatalf("Unable to marshal results to JSON: %v", err)
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SRC\tDST\tLINK\tEXPECTED GB/s\tACHIEVED GB/s\tSTATUS")
+		for _, r := range results {
+			status := "ok"
+			if r.Error != "" {
+				status = r.Error
+			} else if r.Degraded {
+				status = "DEGRADED"
+			}
+			fmt.Fprintf(w, "%d\t%d\t%s\t%.1f\t%.1f\t%s\n", r.Source, r.Dest, r.Link, r.Expected, r.Achieved, status)
+		}
+		w.Flush()
+	}
+	if degraded {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,48 @@
+// Package golden compares rendered payloads with files checked into testdata so changes to
+// exporter wire formats show up in review.
+package golden
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Check compares got with the golden file at name. With update set the file is written
+// instead, which is how new or intentionally changed formats are recorded.
+func Check(name string, got []byte, update bool) error {
+	if update {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return fmt.Errorf("unable to create golden directory: %v", err)
+		}
+		return os.WriteFile(name, got, 0o644)
+	}
+	want, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("unable to read golden file (run with -update to create it): %v", err)
+	}
+	if bytes.Equal(want, got) {
+		return nil
+	}
+	return fmt.Errorf("%s does not match:\n%s", name, Diff(want, got))
+}
+
+// Diff describes the first line that differs between want and got.
+func Diff(want, got []byte) string {
+	wantLines := bytes.Split(want, []byte("\n"))
+	gotLines := bytes.Split(got, []byte("\n"))
+	for i := 0; i < max(len(wantLines), len(gotLines)); i++ {
+		var w, g []byte
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if !bytes.Equal(w, g) {
+			return fmt.Sprintf("line %d:\n  want: %s\n  got:  %s", i+1, w, g)
+		}
+	}
+	return "files differ only in trailing bytes"
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// kubeflowPodPattern matches the pod names the Kubeflow training operator gives replicas,
+// e.g. bert-worker-3. Pods see their name as HOSTNAME.
+var kubeflowPodPattern = regexp.MustCompile(`^(.+)-(master|worker|chief|ps|evaluator|launcher)-\d+$`)
+
+// volcanoHostsPattern matches the VC_<TASK>_HOSTS variables Volcano sets for every task of a
+// job.
+var volcanoHostsPattern = regexp.MustCompile(`^VC_(.+)_HOSTS$`)
+
+// JobProcess is a process on the GPU owned by a Ray, Kubeflow or Volcano job.
+type JobProcess struct {
+	PID        uint32  `json:"pid"`
+	Scheduler  string  `json:"scheduler"`
+	Job        string  `json:"job,omitempty"`
+	Role       string  `json:"role,omitempty"`
+	Actor      string  `json:"actor,omitempty"`
+	MemoryUsed float32 `json:"memory_used"`
+}
+
+// JobResolver finds the jobs owning the processes on a device from their command line and
+// environment.
+type JobResolver struct {
+	procRoot string
+}
+
+func NewJobResolver() *JobResolver {
+	return &JobResolver{procRoot: "/proc"}
+}
+
+// Jobs returns the job of every process owned by one, ordered like processes.
+func (r *JobResolver) Jobs(processes []gpumon.Process) []JobProcess {
+	var jobs []JobProcess
+	for _, p := range processes {
+		dir := filepath.Join(r.procRoot, strconv.Itoa(int(p.PID)))
+		cmdline, _ := os.ReadFile(filepath.Join(dir, "cmdline"))
+		env, _ := os.ReadFile(filepath.Join(dir, "environ"))
+		if job, ok := processJob(cmdline, environVars(env)); ok {
+			job.PID = p.PID
+			job.MemoryUsed = p.MemoryUsed
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// processJob identifies the job of a process. Ray workers set their process title to
+// ray::<actor or task>, Kubeflow and Volcano replicas are recognized by the variables their
+// operators inject and the job is recovered from the pod name.
+func processJob(cmdline []byte, env map[string]string) (JobProcess, bool) {
+	title, _, _ := bytes.Cut(cmdline, []byte{0})
+	if actor, ok := strings.CutPrefix(string(title), "ray::"); ok {
+		actor, _, _ = strings.Cut(actor, " ")
+		return JobProcess{Scheduler: "ray", Job: env["RAY_JOB_ID"], Actor: actor}, true
+	}
+	hostname := env["HOSTNAME"]
+	if index, ok := env["VC_TASK_INDEX"]; ok {
+		job := JobProcess{Scheduler: "volcano"}
+		for key := range env {
+			match := volcanoHostsPattern.FindStringSubmatch(key)
+			if match == nil {
+				continue
+			}
+			// Volcano upper-cases task names and replaces dashes in the variable names
+			task := strings.ToLower(strings.ReplaceAll(match[1], "_", "-"))
+			if name, ok := strings.CutSuffix(hostname, "-"+task+"-"+index); ok {
+				job.Job, job.Role = name, task
+				break
+			}
+		}
+		return job, true
+	}
+	_, tf := env["TF_CONFIG"]
+	_, pytorch := env["PET_NNODES"]
+	if tf || pytorch {
+		job := JobProcess{Scheduler: "kubeflow"}
+		if match := kubeflowPodPattern.FindStringSubmatch(hostname); match != nil {
+			job.Job, job.Role = match[1], match[2]
+		}
+		return job, true
+	}
+	return JobProcess{}, false
+}
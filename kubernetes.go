@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCheckpoint is where the kubelet records the devices allocated to containers
+	defaultCheckpoint = "/var/lib/kubelet/device-plugins/kubelet_internal_checkpoint"
+	// defaultPodLogs holds a directory named <namespace>_<pod>_<uid> for every pod on the node
+	defaultPodLogs = "/var/log/pods"
+)
+
+// KubernetesConfig attributes every GPU to the pods it is allocated to, for running as a
+// DaemonSet. Allocations are read from the kubelet's device plugin checkpoint, and the names
+// of the pods from their log directories, so both paths must be mounted from the host.
+type KubernetesConfig struct {
+	Checkpoint string `json:"checkpoint"`
+	PodLogs    string `json:"pod_logs"`
+}
+
+// PodAllocation is a container a GPU is allocated to.
+type PodAllocation struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+}
+
+// kubeletCheckpoint is the device plugin checkpoint. DeviceIDs are grouped by NUMA node
+// since Kubernetes 1.20 and a plain list before.
+type kubeletCheckpoint struct {
+	Data struct {
+		PodDeviceEntries []struct {
+			PodUID        string
+			ContainerName string
+			ResourceName  string
+			DeviceIDs     json.RawMessage
+		}
+	}
+}
+
+// PodResolver maps device UUIDs to the pods they are allocated to. The checkpoint is read
+// again whenever the kubelet rewrites it.
+type PodResolver struct {
+	checkpoint string
+	podLogs    string
+	mu         sync.Mutex
+	modTime    time.Time
+	pods       map[string][]PodAllocation
+	// unresolved is set while a pod has no log directory yet, so its name is looked up again
+	unresolved bool
+	failed     bool
+}
+
+func NewPodResolver(cfg KubernetesConfig) *PodResolver {
+	r := &PodResolver{checkpoint: cfg.Checkpoint, podLogs: cfg.PodLogs}
+	if r.checkpoint == "" {
+		r.checkpoint = defaultCheckpoint
+	}
+	if r.podLogs == "" {
+		r.podLogs = defaultPodLogs
+	}
+	return r
+}
+
+// Pods returns the containers the device is allocated to, sorted, or none when it is idle.
+func (r *PodResolver) Pods(uuid string) []PodAllocation {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, err := os.Stat(r.checkpoint)
+	if err == nil && (!info.ModTime().Equal(r.modTime) || r.unresolved) {
+		err = r.load()
+		r.modTime = info.ModTime()
+	}
+	if err != nil {
+		// The checkpoint stays missing until it is mounted, so only log the first failure
+		if !r.failed {
+			log.Printf("Unable to read pod allocations: %v", err)
+		}
+		r.failed = true
+		r.pods, r.modTime = nil, time.Time{}
+		return nil
+	}
+	r.failed = false
+	return r.pods[uuid]
+}
+
+func (r *PodResolver) load() error {
+	data, err := os.ReadFile(r.checkpoint)
+	if err != nil {
+		return err
+	}
+	var checkpoint kubeletCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", r.checkpoint, err)
+	}
+	names := podNames(r.podLogs)
+	pods := make(map[string][]PodAllocation)
+	r.unresolved = false
+	for _, entry := range checkpoint.Data.PodDeviceEntries {
+		name, ok := names[entry.PodUID]
+		if !ok {
+			// The pod is gone or its logs are not mounted, fall back to its UID
+			name = [2]string{"", entry.PodUID}
+			r.unresolved = true
+		}
+		allocation := PodAllocation{Namespace: name[0], Pod: name[1], Container: entry.ContainerName}
+		for _, id := range checkpointDeviceIDs(entry.DeviceIDs) {
+			// Shared GPUs are advertised as replicas, e.g. GPU-<uuid>::3
+			uuid, _, _ := strings.Cut(id, "::")
+			if !slices.Contains(pods[uuid], allocation) {
+				pods[uuid] = append(pods[uuid], allocation)
+			}
+		}
+	}
+	for _, allocations := range pods {
+		slices.SortFunc(allocations, func(a, b PodAllocation) int {
+			return strings.Compare(a.Namespace+"/"+a.Pod+"/"+a.Container, b.Namespace+"/"+b.Pod+"/"+b.Container)
+		})
+	}
+	r.pods = pods
+	return nil
+}
+
+// checkpointDeviceIDs returns the device IDs of an entry in either checkpoint format.
+func checkpointDeviceIDs(raw json.RawMessage) []string {
+	var ids []string
+	if json.Unmarshal(raw, &ids) == nil {
+		return ids
+	}
+	var byNUMA map[string][]string
+	json.Unmarshal(raw, &byNUMA)
+	for _, numa := range byNUMA {
+		ids = append(ids, numa...)
+	}
+	return ids
+}
+
+// podNames returns the namespace and name of every pod with a log directory, by UID.
+// Namespaces and names cannot contain underscores, so the directory name splits cleanly.
+func podNames(dir string) map[string][2]string {
+	entries, _ := os.ReadDir(dir)
+	names := make(map[string][2]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.Split(entry.Name(), "_")
+		if len(parts) == 3 {
+			names[parts[2]] = [2]string{parts[0], parts[1]}
+		}
+	}
+	return names
+}
+
+// podLabels joins the distinct namespaces, pods and containers of a GPU with commas, to
+// label its metrics. They are empty for an idle GPU.
+func podLabels(pods []PodAllocation) (namespace, pod, container string) {
+	var namespaces, names, containers []string
+	for _, p := range pods {
+		if !slices.Contains(namespaces, p.Namespace) {
+			namespaces = append(namespaces, p.Namespace)
+		}
+		if !slices.Contains(names, p.Pod) {
+			names = append(names, p.Pod)
+		}
+		if !slices.Contains(containers, p.Container) {
+			containers = append(containers, p.Container)
+		}
+	}
+	return strings.Join(namespaces, ","), strings.Join(names, ","), strings.Join(containers, ",")
+}
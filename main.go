@@ -1,214 +1,1182 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
 )
 
-type Device struct {
-	Index  int
-	UUID   string
-	Handle nvml.Device
+// processStart anchors the monotonic timestamps reported in samples.
+var processStart = time.Now()
+
+// epoch identifies this agent run. It increases across restarts, so when an old and a new
+// agent overlap during a deploy consumers can keep the samples of the newer epoch.
+var epoch = processStart.UnixNano()
+
+// shutdownTimeout bounds the final flush of the publishers after a signal.
+const shutdownTimeout = 10 * time.Second
+
+// readOnly is set once at startup, before any goroutine runs. Every action that changes GPU
+// state checks it, so a read-only agent cannot change a GPU even if a policy asks it to.
+var readOnly bool
+
+var errReadOnly = errors.New("agent is read-only")
+
+// The agent builds on the collection library, these keep its names short.
+type (
+	Device          = gpumon.Device
+	Metrics         = gpumon.Metrics
+	ExtendedMetrics = gpumon.ExtendedMetrics
+	nvmlError       = gpumon.Error
+)
+
+// Sample is a single reading of a device, tagged with the device it came from. Epoch and Seq
+// identify the sample uniquely, Seq counts up per device from 1 within an epoch.
+// Monotonic and Interval are measured in nanoseconds on the monotonic clock so rates stay
+// correct when the wall clock is adjusted or the poller is scheduled late.
+type Sample struct {
+	Index     int       `json:"index"`
+	UUID      string    `json:"uuid"`
+	Epoch     int64     `json:"epoch"`
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Monotonic int64     `json:"monotonic_ns,omitempty"`
+	Interval  int64     `json:"interval_ns,omitempty"`
+	ClockJump int64     `json:"clock_jump_ns,omitempty"`
+	Suspended int64     `json:"suspended_ns,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	// Pods are the containers the GPU is allocated to in Kubernetes mode
+	Pods []PodAllocation `json:"pods,omitempty"`
+	// Labels come from the run context file and external annotations
+	Labels  map[string]string `json:"labels,omitempty"`
+	TraceID string            `json:"trace_id,omitempty"`
+	Metrics
+	Extended   *ExtendedMetrics    `json:"extended,omitempty"`
+	MIG        []MigMetrics        `json:"mig,omitempty"`
+	Host       *HostMetrics        `json:"host,omitempty"`
+	Storage    *StorageMetrics     `json:"storage,omitempty"`
+	RDMA       map[string]RDMAPort `json:"rdma,omitempty"`
+	Risk       *FailureRisk        `json:"failure_risk,omitempty"`
+	Saturation *Saturation         `json:"saturation,omitempty"`
+	Runs       []ExperimentRun     `json:"runs,omitempty"`
+	Processes  []ProcessMetrics    `json:"processes,omitempty"`
+	Jobs       []JobProcess        `json:"jobs,omitempty"`
+	// Inference is the throughput of the co-located inference servers, keyed by name
+	Inference map[string]InferenceMetrics `json:"inference,omitempty"`
+	// ComputeProcesses is the number of processes with a CUDA context on the device
+	ComputeProcesses *int `json:"compute_processes,omitempty"`
+	// TimeInState is the time spent in each utilization band and performance state
+	TimeInState *TimeInState `json:"time_in_state,omitempty"`
+	// ClockStability is how steady the SM clock was within the window
+	ClockStability *ClockStability `json:"clock_stability,omitempty"`
+	// Burst summarizes the power and utilization readings taken within the poll
+	Burst *Burst `json:"burst,omitempty"`
+
+	// span traces the sample's cycle from collection until it is emitted
+	span *Span
+	// record is the sample after the derived metrics and relabel rules, as stdout prints it,
+	// and dropped are the metric fields the rules removed, nil without rules
+	record  map[string]any
+	dropped map[string]bool
+	// derived are the derived metrics the relabel rules kept, in the order they are defined
+	derived []derivedValue
 }
 
-type Metrics struct {
-	Temperature uint    `json:"temperature"`
-	Power       float32 `json:"power"`
-	GpuUsage    uint    `json:"gpu_usage"`
-	MemoryTotal float32 `json:"memory_total"`
-	MemoryUsed  float32 `json:"memory_used"`
+// MarshalJSON writes the record of a transformed sample, so every consumer of its JSON sees
+// the derived metrics and relabel rules applied.
+func (s Sample) MarshalJSON() ([]byte, error) {
+	if s.record != nil {
+		return json.Marshal(s.record)
+	}
+	type plain Sample
+	return json.Marshal(plain(s))
 }
 
-func (m Metrics) String() string {
-	return fmt.Sprintf("%d,%.2f,%d,%.1f,%.2f", m.Temperature, m.Power, m.GpuUsage, m.MemoryTotal, m.MemoryUsed)
+// exports reports whether the relabel rules kept the metric field of the sample.
+func (s Sample) exports(field string) bool {
+	return !s.dropped[field]
 }
 
-func GetDevice(index int) (Device, error) {
-	count, ret := nvml.DeviceGetCount()
-	if ret != nvml.SUCCESS {
-		log.Fatalf("Unable to get device count: %v", nvml.ErrorString(ret))
+// setPowerLimit sets the power management limit in watts unless the agent is read-only, and
+// records the change in the audit log. Actor names the policy asking for the change.
+func setPowerLimit(d Device, watts float64, actor string) error {
+	record := AuditRecord{Actor: actor, Action: "power_limit", Index: d.Index, UUID: d.UUID, New: watts}
+	record.Previous, _ = d.GetPowerLimit()
+	err := errReadOnly
+	if !readOnly {
+		err = d.SetPowerLimit(watts)
 	}
-	if count <= index-1 {
-		log.Fatalf("Device index out of range")
+	if err != nil {
+		record.Error = err.Error()
 	}
-	device, ret := nvml.DeviceGetHandleByIndex(index)
-	if ret != nvml.SUCCESS {
-		return Device{}, fmt.Errorf("unable to get device at index %d: %v", index, nvml.ErrorString(ret))
+	auditLog.Record(record)
+	return err
+}
+
+// CloudwatchMetricData builds the datums published for the metrics collected at timestamp,
+// named and unitized by mapping.
+func cloudwatchMetricData(m Metrics, dimensions []types.Dimension, mapping map[string]CloudwatchMetric, resolution int32, timestamp time.Time) []types.MetricDatum {
+	values := map[string]float64{
+		"gpu_usage":           float64(m.GpuUsage),
+		"memory_used":         float64(m.MemoryUsed),
+		"memory_used_percent": float64(m.MemoryUsedPercent),
+		"temperature":         float64(m.Temperature),
+		"power":               float64(m.Power),
 	}
-	uuid, ret := device.GetUUID()
-	if ret != nvml.SUCCESS {
-		return Device{}, fmt.Errorf("unable to get uuid of device at index %d: %v", index, nvml.ErrorString(ret))
+	ts := aws.Time(timestamp)
+	data := make([]types.MetricDatum, 0, len(cloudwatchMetrics))
+	for _, key := range cloudwatchMetrics {
+		data = append(data, types.MetricDatum{
+			MetricName:        aws.String(mapping[key].Name),
+			Dimensions:        dimensions,
+			Unit:              types.StandardUnit(mapping[key].Unit),
+			StorageResolution: aws.Int32(resolution),
+			Timestamp:         ts,
+			Value:             aws.Float64(values[key]),
+		})
 	}
-	return Device{Index: index, UUID: uuid, Handle: device}, nil
+	return data
 }
 
-func (d Device) deviceHandleErrorString(ret nvml.Return) error {
-	return fmt.Errorf("%s", nvml.ErrorString(ret))
+// poller holds the optional collectors shared by every device.
+type poller struct {
+	extended    gpumon.ExtendedOptions
+	host        *HostCollector
+	storage     *StorageCollector
+	rdma        *RDMACollector
+	risk        *RiskCollector
+	saturation  *SaturationTracker
+	states      *TimeInStateTracker
+	clocks      *ClockStabilityTracker
+	burst       *BurstConfig
+	tenants     *TenantResolver
+	pods        *PodResolver
+	experiments *ExperimentResolver
+	jobs        *JobResolver
+	processes   bool
+	compute     bool
+	inference   []*InferenceScraper
+	annotations *Annotations
+	context     *RunContext
+	tracer      *Tracer
+	cpu         *CPUGuard
+	monotonic   bool
+	samples     chan<- Sample
+	events      chan<- DeviceEvent
+
+	failureThreshold int
+	degradedInterval time.Duration
 }
 
-func (d Device) GetTemperature() (uint, error) {
-	temp, ret := d.Handle.GetTemperature(nvml.TEMPERATURE_GPU)
-	if ret != nvml.SUCCESS {
-		return 0, d.deviceHandleErrorString(ret)
+// poll collects metrics from the device every interval and sends them to the samples channel.
+// Optional collectors the device does not support are skipped. After failureThreshold failed
+// polls in a row the device is degraded, and a device that fell off the bus is lost at once.
+// Either way it is polled every degradedInterval until it recovers, or comes back from a
+// reset, and only the state changes are reported.
+func (p poller) poll(d Device, interval time.Duration, caps Capabilities) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	extended := extendedOptions(p.extended, caps)
+	var migUtilization *gpumon.MigUtilization
+	if caps.MIG && caps.GPM {
+		migUtilization = gpumon.NewMigUtilization()
+	}
+	var prev time.Time
+	var prevBoot time.Duration
+	var seq uint64
+	// processesSince is when per-process utilization was last read
+	var processesSince time.Time
+	failures := 0
+	resumed := false
+	state := ""
+	backoff := int64(1)
+	for {
+		now := time.Now()
+		span := p.tracer.Start("sample")
+		span.SetAttr("device", strconv.Itoa(d.Index))
+		collect := span.Child("collect")
+		boot, _ := bootTime()
+		var suspended time.Duration
+		if !prev.IsZero() && prevBoot != 0 && boot != 0 {
+			suspended = suspendedTime(prevBoot, boot, prev, now)
+		}
+		if suspended != 0 {
+			log.Printf("Device %d resumed after the system was suspended for %v", d.Index, suspended.Round(time.Second))
+			resumed = true
+		}
+		metrics, err := d.GetMetrics()
+		if err != nil && (resumed || state != "") {
+			// Handles may not survive a suspend or a GPU reset, look the device up again once
+			// after a resume and on every poll while it is degraded or lost
+			if rerr := d.Reacquire(); rerr != nil {
+				if resumed {
+					log.Printf("Unable to reacquire device %d after resume: %v", d.Index, rerr)
+				}
+			} else {
+				metrics, err = d.GetMetrics()
+			}
+			resumed = false
+		}
+		if err != nil {
+			collect.SetAttr("error", err.Error())
+			collect.End()
+			span.End()
+			failures++
+			if state != "lost" && errors.Is(err, nvmlError(nvml.ERROR_GPU_IS_LOST)) {
+				state = "lost"
+			} else if state == "" && failures >= p.failureThreshold {
+				state = "degraded"
+			} else {
+				<-ticker.C
+				continue
+			}
+			log.Printf("Device %d %s after %d failed polls: %v", d.Index, state, failures, err)
+			p.events <- newDeviceEvent(state, d, err)
+			ticker.Reset(p.degradedInterval)
+			<-ticker.C
+			continue
+		}
+		if state != "" {
+			// A lost GPU only comes back after a reset
+			event := "recovered"
+			if state == "lost" {
+				event = "reset"
+			}
+			log.Printf("Device %d %s", d.Index, event)
+			p.events <- newDeviceEvent(event, d, nil)
+			ticker.Reset(interval * time.Duration(backoff))
+			state = ""
+		}
+		failures = 0
+		resumed = false
+		seq++
+		sample := Sample{Index: d.Index, UUID: d.UUID, Epoch: epoch, Seq: seq, Timestamp: now, TraceID: span.TraceID(), Metrics: metrics, span: span}
+		if p.burst != nil {
+			burst := collectBurst(d, *p.burst, metrics)
+			sample.Burst = &burst
+		}
+		if p.monotonic {
+			sample.Monotonic = now.Sub(processStart).Nanoseconds()
+			if !prev.IsZero() {
+				sample.Interval = now.Sub(prev).Nanoseconds()
+			}
+		}
+		if !prev.IsZero() {
+			if jump := clockJump(prev, now, suspended); jump != 0 {
+				log.Printf("Wall clock jumped by %v between samples of device %d", jump, d.Index)
+				sample.ClockJump = jump.Nanoseconds()
+			}
+		}
+		prev, prevBoot = now, boot
+		if suspended != 0 {
+			// Counters kept running or were reset while suspended, so the rates since the
+			// previous sample are meaningless. Start over and report none this time.
+			sample.Suspended = suspended.Nanoseconds()
+			p.host.Reset()
+			p.storage.Reset()
+			p.rdma.Reset()
+		}
+		if extended != (gpumon.ExtendedOptions{}) {
+			extendedMetrics, err := d.GetExtendedMetrics(extended)
+			if err != nil {
+				log.Printf("Unable to get extended metrics for device %d: %v", d.Index, err)
+			}
+			sample.Extended = &extendedMetrics
+		}
+		if caps.MIG {
+			// Whole-GPU utilization is meaningless in MIG mode, report every slice
+			if sample.MIG, err = migMetrics(d, migUtilization); err != nil {
+				log.Printf("Unable to get MIG metrics for device %d: %v", d.Index, err)
+			}
+		}
+		if p.host != nil {
+			hostMetrics, err := p.host.Collect()
+			if err != nil {
+				log.Printf("Unable to get host metrics: %v", err)
+			} else {
+				sample.Host = &hostMetrics
+			}
+		}
+		if p.storage != nil && caps.PcieThroughput {
+			storageMetrics, err := p.storage.Collect(d, metrics.GpuUsage)
+			if err != nil {
+				log.Printf("Unable to get storage metrics for device %d: %v", d.Index, err)
+			} else {
+				sample.Storage = &storageMetrics
+			}
+		}
+		if p.rdma != nil {
+			sample.RDMA = p.rdma.Collect()
+		}
+		if p.risk != nil {
+			risk := p.risk.Collect(d)
+			sample.Risk = &risk
+		}
+		if p.saturation != nil {
+			saturation := p.saturation.Observe(d.Index, metrics, now)
+			sample.Saturation = &saturation
+		}
+		if p.states != nil {
+			var pstate *int
+			if sample.Extended != nil {
+				pstate = sample.Extended.PState
+			}
+			states := p.states.Observe(d.Index, metrics.GpuUsage, pstate, now)
+			sample.TimeInState = &states
+		}
+		if p.clocks != nil && sample.Extended != nil {
+			if stability, ok := p.clocks.Observe(d.Index, metrics.GpuUsage, *sample.Extended, now); ok {
+				sample.ClockStability = &stability
+			}
+		}
+		if p.tenants != nil && caps.Processes {
+			pids, err := d.GetProcessIDs()
+			if err != nil {
+				log.Printf("Unable to get processes for device %d: %v", d.Index, err)
+			} else {
+				sample.Tenant = strings.Join(p.tenants.Tenants(pids), ",")
+			}
+		}
+		sample.Pods = p.pods.Pods(d.UUID)
+		if p.compute && caps.Processes {
+			count, err := d.GetComputeProcessCount()
+			if err != nil {
+				log.Printf("Unable to get compute processes for device %d: %v", d.Index, err)
+			} else {
+				sample.ComputeProcesses = &count
+			}
+		}
+		if (p.processes || p.experiments != nil || p.jobs != nil) && caps.Processes {
+			processes, err := d.GetProcesses()
+			if err != nil {
+				log.Printf("Unable to get processes for device %d: %v", d.Index, err)
+			} else {
+				if p.processes {
+					sample.Processes = processMetrics(d, processes, processesSince)
+					processesSince = now
+				}
+				if p.experiments != nil {
+					sample.Runs = p.experiments.Runs(processes)
+				}
+				if p.jobs != nil {
+					sample.Jobs = p.jobs.Jobs(processes)
+				}
+			}
+		}
+		for _, scraper := range p.inference {
+			if !scraper.Matches(d) {
+				continue
+			}
+			if rates, ok := scraper.Rates(metrics.GpuUsage); ok {
+				if sample.Inference == nil {
+					sample.Inference = make(map[string]InferenceMetrics)
+				}
+				sample.Inference[scraper.cfg.Name] = rates
+			}
+		}
+		sample.Labels = p.labels(d)
+		collect.End()
+		p.samples <- sample
+		if b := p.cpu.Backoff(); b != backoff {
+			backoff = b
+			ticker.Reset(interval * time.Duration(backoff))
+		}
+		<-ticker.C
 	}
-	return uint(temp), nil
 }
 
-func (d Device) GetPower() (float32, error) {
-	power, ret := d.Handle.GetPowerUsage()
-	if ret != nvml.SUCCESS {
-		return 0, d.deviceHandleErrorString(ret)
+// labels merges the labels of the run context file with the device's annotations, which take
+// precedence.
+func (p poller) labels(d Device) map[string]string {
+	context := p.context.Labels()
+	annotated := p.annotations.Labels(d)
+	if len(context) == 0 {
+		return annotated
 	}
-	actual := float32(power) / 1000.0
-	return actual, nil
+	labels := maps.Clone(context)
+	maps.Copy(labels, annotated)
+	return labels
+}
+
+// extendedOptions drops the extended metric groups the device does not support.
+func extendedOptions(opts gpumon.ExtendedOptions, caps Capabilities) gpumon.ExtendedOptions {
+	opts.Clocks = opts.Clocks && caps.Clocks
+	opts.Fan = opts.Fan && caps.FanSpeed
+	opts.PCIe = opts.PCIe && caps.PcieThroughput
+	opts.ECC = opts.ECC && caps.ECC
+	opts.Encoder = opts.Encoder && caps.Encoder
+	opts.Throttle = opts.Throttle && caps.Throttle
+	opts.Display = opts.Display && caps.Display
+	return opts
 }
 
-func (d Device) GetUtilization() (uint, float32, float32, error) {
-	memory, ret := d.Handle.GetMemoryInfo()
-	if ret != nvml.SUCCESS {
-		return 0, 0.0, 0.0, d.deviceHandleErrorString(ret)
+// newDevices enumerates the devices of the backend again and returns those matching the filter
+// that are not known yet, e.g. hot-plugged ones, with their logical index. A known device that
+// was reset keeps its UUID and is picked up again by its poller.
+func newDevices(backend gpumon.Backend, deviceMap *DeviceMap, filter []string, known []Device) []Device {
+	found, err := backend.Devices()
+	if err != nil {
+		log.Printf("Unable to enumerate devices: %v", err)
+		return nil
 	}
-	total := float32(memory.Total) / (1 << 30)
-	used := float32(memory.Used) / (1 << 30)
+	deviceMap.Assign(found)
+	return slices.DeleteFunc(found, func(d Device) bool {
+		if len(filter) > 0 && !matchDevice(filter, d) {
+			return true
+		}
+		return slices.ContainsFunc(known, func(k Device) bool { return k.UUID == d.UUID })
+	})
+}
 
-	util, ret := d.Handle.GetUtilizationRates()
-	if ret != nvml.SUCCESS {
-		return 0, 0.0, 0.0, d.deviceHandleErrorString(ret)
+func backendNames() []string {
+	names := make([]string, 0, len(gpumon.Backends))
+	for _, b := range gpumon.Backends {
+		names = append(names, b.Name())
 	}
-	return uint(util.Gpu), total, used, nil
+	return names
 }
 
-func (d Device) GetMetrics() (Metrics, error) {
-	temp, err := d.GetTemperature()
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate-interconnect":
+			os.Exit(validateInterconnect(os.Args[2:]))
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		case "capabilities":
+			os.Exit(capabilitiesCommand(os.Args[2:]))
+		case "npd":
+			os.Exit(npdCommand(os.Args[2:]))
+		case "test":
+			os.Exit(testCommand(os.Args[2:]))
+		case "snapshot":
+			os.Exit(snapshotCommand(os.Args[2:]))
+		case "query":
+			os.Exit(queryCommand(os.Args[2:]))
+		case "device-map":
+			os.Exit(deviceMapCommand(os.Args[2:]))
+		case "diff":
+			os.Exit(diffCommand(os.Args[2:]))
+		case "version":
+			os.Exit(versionCommand(os.Args[2:]))
+		case "self-update":
+			os.Exit(selfUpdateCommand(os.Args[2:]))
+		case "doctor":
+			os.Exit(doctorCommand(os.Args[2:]))
+		case "report":
+			os.Exit(reportCommand(os.Args[2:]))
+		}
+	}
+
+	// Every flag can also be set from the environment, for containers without a shell
+	configPath := flag.String("config", os.Getenv("GPUMON_CONFIG"), "path to a JSON config file, or s3://bucket/key or ssm:/parameter ($GPUMON_CONFIG)")
+	configPollEnv, err := time.ParseDuration(os.Getenv("GPUMON_CONFIG_POLL"))
 	if err != nil {
-		return Metrics{}, err
+		configPollEnv = time.Minute
+	}
+	configPoll := flag.Duration("config-poll", configPollEnv, "how often a remote config is polled for changes ($GPUMON_CONFIG_POLL)")
+	profile := flag.String("profile", os.Getenv("GPUMON_PROFILE"), "preset to start the config from: "+strings.Join(profileNames(), ", ")+" ($GPUMON_PROFILE)")
+	healthAddr := flag.String("health", os.Getenv("GPUMON_HEALTH"), "address to serve /healthz and the local API on, e.g. :8080 ($GPUMON_HEALTH)")
+	prometheusAddr := flag.String("prometheus-listen", os.Getenv("GPUMON_PROMETHEUS_LISTEN"), "address to serve Prometheus metrics on, e.g. :9400 ($GPUMON_PROMETHEUS_LISTEN)")
+	readOnlyEnv, _ := strconv.ParseBool(os.Getenv("GPUMON_READ_ONLY"))
+	flag.BoolVar(&readOnly, "read-only", readOnlyEnv, "never change GPU state, disables power caps and schedules ($GPUMON_READ_ONLY)")
+	requireFIPSEnv, _ := strconv.ParseBool(os.Getenv("GPUMON_FIPS"))
+	requireFIPS := flag.Bool("fips", requireFIPSEnv, "refuse to start unless built with the FIPS crypto module ($GPUMON_FIPS)")
+	offlineEnv, _ := strconv.ParseBool(os.Getenv("GPUMON_OFFLINE"))
+	flag.BoolVar(&offline, "offline", offlineEnv, "never connect off the host, for air-gapped sites, only local sinks are used ($GPUMON_OFFLINE)")
+	var overrides ConfigFlags
+	flag.StringVar(&overrides.Interval, "interval", os.Getenv("GPUMON_INTERVAL"), "poll interval, e.g. 5s ($GPUMON_INTERVAL)")
+	flag.StringVar(&overrides.Devices, "devices", os.Getenv("GPUMON_DEVICES"), "comma separated indexes or UUIDs of the devices to monitor, all by default ($GPUMON_DEVICES)")
+	flag.StringVar(&overrides.Format, "format", os.Getenv("GPUMON_FORMAT"), "stdout format, json or csv ($GPUMON_FORMAT)")
+	flag.StringVar(&overrides.Publishers, "publishers", os.Getenv("GPUMON_PUBLISHERS"), "comma separated publishers: "+strings.Join(publishers, ", ")+" ($GPUMON_PUBLISHERS)")
+	flag.StringVar(&overrides.Namespace, "namespace", os.Getenv("GPUMON_NAMESPACE"), "CloudWatch namespace ($GPUMON_NAMESPACE)")
+	flag.StringVar(&overrides.Resolution, "resolution", os.Getenv("GPUMON_RESOLUTION"), "CloudWatch storage resolution in seconds, 1 or 60 ($GPUMON_RESOLUTION)")
+	backendName := flag.String("backend", os.Getenv("GPUMON_BACKEND"), "GPU backend, "+strings.Join(backendNames(), " or ")+", picked automatically by default ($GPUMON_BACKEND)")
+	noCloudwatchEnv, _ := strconv.ParseBool(os.Getenv("GPUMON_NO_CLOUDWATCH"))
+	flag.BoolVar(&overrides.NoCloudwatch, "no-cloudwatch", noCloudwatchEnv, "do not publish to CloudWatch, e.g. for local testing ($GPUMON_NO_CLOUDWATCH)")
+	// gen and package need the flags above, so they are dispatched here instead of with the
+	// other commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gen":
+			os.Exit(genCommand(flag.CommandLine, os.Args[2:]))
+		case "package":
+			os.Exit(packageCommand(flag.CommandLine, os.Args[2:]))
+		}
+	}
+	flag.Parse()
+
+	// A changed remote config restarts the agent in place, after the same cleanup as a signal
+	var restart atomic.Bool
+	defer func() {
+		if !restart.Load() {
+			return
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Unable to restart: %v", err)
+		}
+		log.Printf("Restarting to apply the changed config")
+		log.Fatalf("Unable to restart: %v", syscall.Exec(exe, os.Args, os.Environ()))
+	}()
+	// SIGINT and SIGTERM cancel ctx, the main loop then flushes the publishers and returns so
+	// the deferred cleanup runs
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(signalCtx)
+	defer cancel()
+
+	if *requireFIPS && !fipsBuild {
+		log.Fatalf("Unable to start in FIPS mode: the binary was not built with GOEXPERIMENT=boringcrypto")
+	}
+	if fipsBuild {
+		log.Printf("FIPS mode, using the FIPS crypto module and AWS FIPS endpoints")
 	}
-	power, err := d.GetPower()
+	enforceOffline()
+	if offline && isRemoteConfig(*configPath) {
+		log.Fatalf("Unable to load config: %s is remote and the agent is offline", *configPath)
+	}
+	cfg, err := LoadConfig(*configPath, *profile)
 	if err != nil {
-		return Metrics{}, err
+		log.Fatalf("Unable to load config: %v", err)
+	}
+	if err := cfg.Override(overrides); err != nil {
+		log.Fatalf("Unable to load config: %v", err)
+	}
+	if offline {
+		log.Printf("Offline mode, nothing connects off the host")
+		applyOffline(&cfg)
 	}
-	gpu, totalMemory, usedMemory, err := d.GetUtilization()
+	if len(cfg.enabledFeatures) > 0 {
+		log.Printf("Enabled features: %s", strings.Join(cfg.enabledFeatures, ", "))
+	}
+	if cfg.Identity != nil {
+		identity = ResolveIdentity(ctx, *cfg.Identity)
+	}
+
+	backend, devices, err := gpumon.Open(*backendName)
 	if err != nil {
-		return Metrics{}, err
+		log.Fatalf("Unable to load GPU backend: %v", err)
+	}
+	var deviceMap *DeviceMap
+	if cfg.DeviceMap != "" {
+		if deviceMap, err = LoadDeviceMap(cfg.DeviceMap); err != nil {
+			log.Fatalf("Unable to load device map: %v", err)
+		}
+	}
+	if backend != nil {
+		log.Printf("Using the %s backend", backend.Name())
+		// Logical indexes apply before the filter, so it matches the indexes that are exported
+		deviceMap.Assign(devices)
+		defer func() {
+			if err := backend.Shutdown(); err != nil {
+				log.Fatalf("Unable to shutdown GPU backend: %v", err)
+			}
+		}()
+		if len(cfg.DeviceFilter) > 0 {
+			devices = slices.DeleteFunc(devices, func(d Device) bool { return !matchDevice(cfg.DeviceFilter, d) })
+		}
+	} else {
+		log.Printf("No GPU driver with devices found, running without GPUs")
+	}
+	if len(devices) == 0 {
+		// Keep running so fleet tooling sees a healthy agent reporting zero devices
+		log.Printf("No devices found")
+	}
+
+	// Each device is polled on its own interval and reports back on a shared channel
+	samples := make(chan Sample)
+	var tracer *Tracer
+	if cfg.Tracing != nil {
+		tracer = NewTracer(*cfg.Tracing)
+	}
+	events := make(chan DeviceEvent)
+	p := poller{
+		extended:         cfg.Extended,
+		tracer:           tracer,
+		monotonic:        cfg.Monotonic,
+		samples:          samples,
+		events:           events,
+		failureThreshold: cfg.FailureThreshold,
+		degradedInterval: cfg.DegradedInterval.Duration,
+	}
+	if cfg.Host {
+		p.host = NewHostCollector()
+	}
+	if cfg.Storage {
+		p.storage = NewStorageCollector()
+	}
+	if cfg.RDMA {
+		p.rdma = NewRDMACollector()
+	}
+	if cfg.Risk {
+		p.risk = NewRiskCollector()
+	}
+	if cfg.Saturation != nil {
+		p.saturation = NewSaturationTracker(*cfg.Saturation)
+	}
+	if cfg.TimeInState != nil {
+		p.states = NewTimeInStateTracker(*cfg.TimeInState)
+	}
+	if cfg.ClockStability != nil {
+		p.clocks = NewClockStabilityTracker(*cfg.ClockStability)
+	}
+	p.burst = cfg.Burst
+	if cfg.Tenant != nil {
+		p.tenants, err = NewTenantResolver(*cfg.Tenant)
+		if err != nil {
+			log.Fatalf("Unable to configure tenant detection: %v", err)
+		}
+	}
+	if cfg.Kubernetes != nil {
+		p.pods = NewPodResolver(*cfg.Kubernetes)
+	}
+	if cfg.Experiments {
+		p.experiments = NewExperimentResolver()
+	}
+	if cfg.Jobs {
+		p.jobs = NewJobResolver()
+	}
+	// Per-process CloudWatch metrics are built from the processes in samples
+	p.processes = cfg.Processes || (cfg.Cloudwatch.Processes && slices.Contains(cfg.Publishers, "cloudwatch"))
+	p.compute = cfg.ComputeProcesses
+	for _, ic := range cfg.Inference {
+		scraper := NewInferenceScraper(ic)
+		go scraper.Run(cfg.Interval.Duration)
+		p.inference = append(p.inference, scraper)
+	}
+	if cfg.ContextFile != "" {
+		p.context = NewRunContext(cfg.ContextFile)
+		go p.context.Watch()
+	}
+	auth, err := NewAuthorizer(cfg.APITokens)
+	if err != nil {
+		log.Fatalf("Unable to load API tokens: %v", err)
+	}
+	annotations := make(chan Annotation)
+	if cfg.Annotations != nil {
+		p.annotations = NewAnnotations(*cfg.Annotations, annotations)
+		go serveAnnotations(cfg.Annotations.Listen, p.annotations, auth)
+	}
+	var cpuTicks <-chan time.Time
+	if cfg.CPUBudget > 0 {
+		p.cpu = NewCPUGuard(cfg.CPUBudget)
+		cpuTicker := time.NewTicker(cpuCheckInterval)
+		defer cpuTicker.Stop()
+		cpuTicks = cpuTicker.C
+	}
+	var profiler *NVMLProfiler
+	var profileTicks <-chan time.Time
+	if cfg.ProfileNVML.Duration > 0 {
+		profiler = NewNVMLProfiler()
+		for i := range devices {
+			if devices[i].Handle == nil {
+				continue
+			}
+			devices[i].Handle = profiledDevice{Device: devices[i].Handle, profiler: profiler}
+		}
+		profileTicker := time.NewTicker(cfg.ProfileNVML.Duration)
+		defer profileTicker.Stop()
+		profileTicks = profileTicker.C
+	}
+	// startPolling probes the device and polls it in the background, also for the devices
+	// found by a rescan
+	startPolling := func(device Device) {
+		caps := ProbeCapabilities(device)
+		if p.storage != nil && !caps.PcieThroughput {
+			log.Printf("Device %d does not report PCIe throughput, skipping storage metrics", device.Index)
+		}
+		if extendedOptions(p.extended, caps) != p.extended {
+			log.Printf("Device %d does not support every enabled extended metric, skipping the unsupported ones", device.Index)
+		}
+		if p.tenants != nil && !caps.Processes {
+			log.Printf("Device %d does not report its processes, skipping tenant detection", device.Index)
+		}
+		if p.compute && !caps.Processes {
+			log.Printf("Device %d does not report its processes, skipping compute process counts", device.Index)
+		}
+		if (p.processes || p.experiments != nil || p.jobs != nil) && !caps.Processes {
+			log.Printf("Device %d does not report its processes, skipping process metrics, experiment runs and jobs", device.Index)
+		}
+		go p.poll(device, cfg.IntervalFor(device), caps)
+	}
+	maxInterval := cfg.Interval.Duration
+	for _, device := range devices {
+		maxInterval = max(maxInterval, cfg.IntervalFor(device))
+		startPolling(device)
 	}
-	return Metrics{Temperature: temp, Power: power, GpuUsage: gpu, MemoryTotal: totalMemory, MemoryUsed: usedMemory}, nil
-}
 
-func (m Metrics) PublishCloudwatchMetrics(ctx context.Context, client *cloudwatch.Client, instanceID string, instanceType string, resolution int32, namespace string) error {
-	// Define the dimensions for the metric data
-	dimensions := []types.Dimension{
-		{
-			Name:  aws.String("InstancesId"),
-			Value: aws.String(instanceID),
-		},
-		{
-			Name:  aws.String("InstanceType"),
-			Value: aws.String(instanceType),
-		},
+	out := output{relabel: new(atomic.Pointer[Relabeler]), tracer: tracer, stdout: slices.Contains(cfg.Publishers, "stdout")}
+	if out.stdout && cfg.Format == "csv" {
+		out.csv = csv.NewWriter(os.Stdout)
+		out.csv.Write(csvHeader)
+		out.csv.Flush()
+	}
+	out.derived, err = NewDeriver(cfg.Derived)
+	if err != nil {
+		log.Fatalf("Unable to load derived metrics: %v", err)
+	}
+	relabeler, err := NewRelabeler(cfg.Relabel)
+	if err != nil {
+		log.Fatalf("Unable to load relabel rules: %v", err)
+	}
+	out.relabel.Store(relabeler)
+	if isRemoteConfig(*configPath) {
+		remote, err := NewRemoteConfig(ctx, *configPath)
+		if err != nil {
+			log.Fatalf("Unable to load remote config: %v", err)
+		}
+		go watchRemoteConfig(ctx, remote, *profile, *configPoll, out.relabel, func() {
+			restart.Store(true)
+			cancel()
+		})
+	} else if *configPath != "" {
+		go watchRelabel(*configPath, *profile, out.relabel)
+	}
+	for _, pc := range cfg.Plugins {
+		plugin, err := LoadPlugin(pc)
+		if err != nil {
+			log.Fatalf("Unable to load plugin: %v", err)
+		}
+		out.plugins = append(out.plugins, plugin)
+	}
+	if cfg.Exec != nil {
+		out.exec = NewExecSink(*cfg.Exec)
+		go out.exec.Run()
+	}
+	for _, wc := range cfg.Webhooks {
+		webhook := NewWebhook(wc)
+		go webhook.Run()
+		out.webhooks = append(out.webhooks, webhook)
+	}
+	for _, sc := range cfg.SNS {
+		topic, err := NewSNSTopic(ctx, sc)
+		if err != nil {
+			log.Fatalf("Unable to start SNS publisher: %v", err)
+		}
+		go topic.Run()
+		out.topics = append(out.topics, topic)
+	}
+	for _, device := range devices {
+		out.event(newDeviceEvent("discovered", device, nil))
 	}
 
-	// Define the metric data to be published
-	metricData := []types.MetricDatum{
-		{
-			MetricName:        aws.String("GPU Usage"),
-			Dimensions:        dimensions,
-			Unit:              types.StandardUnitPercent,
-			StorageResolution: aws.Int32(resolution),
-			Value:             aws.Float64(float64(m.GpuUsage)),
-		},
-		{
-			MetricName: aws.String("Memory Used"),
-			Dimensions: dimensions,
-			// TODO: Double check the units reported by the NVML library
-			Unit:              types.StandardUnitMegabytes,
-			StorageResolution: aws.Int32(resolution),
-			Value:             aws.Float64(float64(m.MemoryUsed)),
-		},
-		{
-			MetricName:        aws.String("Temperature (C)"),
-			Dimensions:        dimensions,
-			Unit:              types.StandardUnitNone,
-			StorageResolution: aws.Int32(resolution),
-			Value:             aws.Float64(float64(m.Temperature)),
-		},
-		{
-			MetricName:        aws.String("Power (W)"),
-			Dimensions:        dimensions,
-			Unit:              types.StandardUnitNone,
-			StorageResolution: aws.Int32(resolution),
-			Value:             aws.Float64(float64(m.Power)),
-		},
+	// flushing tracks the publishers, which flush once more after ctx is cancelled, and the
+	// NVML event watcher
+	var flushing sync.WaitGroup
+	// The limiters are built once so the exporters share the global bucket
+	limiters := NewLimiters(cfg.RateLimits)
+	var cw *CloudwatchPublisher
+	if slices.Contains(cfg.Publishers, "cloudwatch") {
+		cw, err = NewCloudwatchPublisher(ctx, cfg.Cloudwatch, limiters.For("cloudwatch"), tracer)
+		if errors.Is(err, errNoRegion) {
+			// Hosts outside AWS keep working with the other publishers
+			log.Printf("Not publishing to CloudWatch: %v", err)
+		} else if err != nil {
+			log.Fatalf("Unable to start CloudWatch publisher: %v", err)
+		} else {
+			flushing.Add(1)
+			go func() {
+				defer flushing.Done()
+				cw.Run(ctx)
+			}()
+		}
+	}
+	var otlp *OTLPPublisher
+	if slices.Contains(cfg.Publishers, "otlp") {
+		if otlp, err = NewOTLPPublisher(*cfg.OTLP, limiters.For("otlp"), tracer); err != nil {
+			log.Fatalf("Unable to start OTLP publisher: %v", err)
+		}
+		flushing.Add(1)
+		go func() {
+			defer flushing.Done()
+			otlp.Run(ctx)
+		}()
+	}
+	var influx *InfluxPublisher
+	if slices.Contains(cfg.Publishers, "influx") {
+		if influx, err = NewInfluxPublisher(*cfg.Influx, limiters.For("influx"), tracer); err != nil {
+			log.Fatalf("Unable to start InfluxDB publisher: %v", err)
+		}
+		flushing.Add(1)
+		go func() {
+			defer flushing.Done()
+			influx.Run(ctx)
+		}()
+	}
+	if cfg.NVMLEvents && backend != nil && backend.Name() == "nvml" {
+		watcher, err := gpumon.NewEventWatcher()
+		if err != nil {
+			log.Fatalf("Unable to watch NVML events: %v", err)
+		}
+		for _, device := range devices {
+			if err := watcher.Register(device); err != nil {
+				log.Printf("Device %d does not report NVML events: %v", device.Index, err)
+			}
+		}
+		flushing.Add(1)
+		go func() {
+			defer flushing.Done()
+			watchNVMLEvents(ctx, watcher, events)
+		}()
+	}
+	var prometheus *PrometheusExporter
+	if *prometheusAddr != "" {
+		prometheus = NewPrometheusExporter()
+		go servePrometheus(*prometheusAddr, prometheus)
+	}
+	if cfg.Registration != nil {
+		if *prometheusAddr == "" {
+			log.Printf("Ignoring the service registration, it needs -prometheus-listen")
+		} else if registration, err := NewRegistration(*cfg.Registration, *prometheusAddr, devices); err != nil {
+			log.Printf("Unable to register the Prometheus endpoint: %v", err)
+		} else {
+			flushing.Add(1)
+			go func() {
+				defer flushing.Done()
+				registration.Run(ctx)
+			}()
+		}
+	}
+	var health *Health
+	var api *MetricsAPI
+	if *healthAddr != "" || cfg.Deadman != nil {
+		health = NewHealth(len(devices), maxInterval)
 	}
-	input := &cloudwatch.PutMetricDataInput{
-		MetricData: metricData,
-		Namespace:  aws.String(namespace),
+	if *healthAddr != "" {
+		api = NewMetricsAPI(cfg.History)
+		go serveHealth(*healthAddr, health, api, auth)
+	}
+	var deadman *DeadmanSwitch
+	if cfg.Deadman != nil {
+		deadman = NewDeadmanSwitch(*cfg.Deadman)
+		go deadman.Run()
 	}
 
-	// Publish the metrics to CloudWatch
-	_, err := client.PutMetricData(ctx, input)
+	if cfg.Audit != nil {
+		if auditLog, err = NewAuditLog(*cfg.Audit); err != nil {
+			log.Fatalf("Unable to start audit log: %v", err)
+		}
+	}
+	if readOnly {
+		log.Printf("Read-only mode, GPU state will not be changed")
+		for i := range cfg.EnergyBudgets {
+			if cfg.EnergyBudgets[i].PowerCap != 0 {
+				log.Printf("Ignoring the power cap of energy budget %s in read-only mode", cfg.EnergyBudgets[i].Name)
+				cfg.EnergyBudgets[i].PowerCap = 0
+			}
+		}
+		if len(cfg.PowerSchedule) > 0 {
+			log.Printf("Ignoring the power schedule in read-only mode")
+			cfg.PowerSchedule = nil
+		}
+	}
+	budgets := NewEnergyBudgets(cfg.EnergyBudgets, devices)
+	alerts, err := NewAlerts(cfg.Alerts, cfg.DefaultAlerts)
 	if err != nil {
-		return fmt.Errorf("Unable to publish metrics to CloudWatch: %v", err)
+		log.Fatalf("Unable to load alerts: %v", err)
+	}
+	for _, device := range devices {
+		alerts.Discover(device)
+	}
+	if len(cfg.PowerSchedule) > 0 {
+		scheduler, err := NewPowerScheduler(cfg.PowerSchedule, devices, events)
+		if err != nil {
+			log.Fatalf("Unable to load power schedule: %v", err)
+		}
+		go scheduler.Run()
 	}
 
-	return nil
+	// Group aggregates are computed from the latest sample of each member on the default interval
+	groups := NewGroups(cfg.Groups, devices)
+	latest := make(map[int]Sample, len(devices))
+	agentVersion := buildInfo().Version
+	ticker := time.NewTicker(cfg.Interval.Duration)
+	defer ticker.Stop()
+	var rescanTicks <-chan time.Time
+	if backend != nil && cfg.Rescan.Duration > 0 {
+		rescanTicker := time.NewTicker(cfg.Rescan.Duration)
+		defer rescanTicker.Stop()
+		rescanTicks = rescanTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Shutting down, flushing publishers")
+			flushing.Wait()
+			return
+		case sample := <-samples:
+			latest[sample.Index] = sample
+			// The rules run once so every sink exports the same result
+			if exported, ok := out.transform(sample); ok {
+				prometheus.Observe(exported)
+				api.Observe(exported)
+				cw.Send(exported)
+				otlp.Send(exported)
+				influx.Send(exported)
+				out.emit(exported, exported.span)
+			} else {
+				sample.span.End()
+			}
+			for _, budget := range budgets {
+				for _, event := range budget.Observe(sample) {
+					out.emit(event, nil)
+				}
+			}
+			for _, event := range alerts.Observe(sample) {
+				out.event(event)
+			}
+			if health != nil {
+				health.Observe(time.Now())
+			}
+		case event := <-events:
+			if event.Event == "lost" {
+				prometheus.Forget(event.Index)
+				api.Forget(event.Index)
+				// The device drops out of the group aggregates until it reports again
+				delete(latest, event.Index)
+			}
+			prometheus.ObserveEvent(event)
+			cw.SendEvent(event)
+			out.event(event)
+		case annotation := <-annotations:
+			out.emit(annotation, nil)
+		case <-cpuTicks:
+			if status, changed := p.cpu.Check(); changed {
+				out.emit(status, nil)
+			}
+		case <-profileTicks:
+			out.emit(profiler.Report(), nil)
+		case <-rescanTicks:
+			for _, device := range newDevices(backend, deviceMap, cfg.DeviceFilter, devices) {
+				log.Printf("Device %d (%s) appeared, polling it", device.Index, device.UUID)
+				if profiler != nil && device.Handle != nil {
+					device.Handle = profiledDevice{Device: device.Handle, profiler: profiler}
+				}
+				startPolling(device)
+				alerts.Discover(device)
+				for _, budget := range budgets {
+					budget.Discover(device)
+				}
+				devices = append(devices, device)
+				out.event(newDeviceEvent("discovered", device, nil))
+			}
+			health.SetDevices(len(devices))
+			// Membership is matched again, MIG slices may have been created since
+			groups = NewGroups(cfg.Groups, devices)
+		case now := <-ticker.C:
+			if cfg.Heartbeat {
+				heartbeat := newHeartbeat(agentVersion, len(devices), now)
+				prometheus.ObserveHeartbeat(heartbeat)
+				cw.SendHeartbeat(heartbeat)
+				otlp.SendHeartbeat(heartbeat)
+				influx.SendHeartbeat(heartbeat)
+				out.emit(heartbeat, nil)
+			}
+			if deadman != nil {
+				deadman.Check(now, !health.Stale())
+			}
+			for _, group := range groups {
+				if agg, ok := group.Aggregate(latest, now); ok {
+					span := out.tracer.Start("group")
+					span.SetAttr("group", agg.Group)
+					prometheus.ObserveGroup(agg)
+					cw.SendGroup(agg)
+					otlp.SendGroup(agg)
+					influx.SendGroup(agg)
+					out.emit(agg, span)
+				}
+			}
+		}
+	}
 }
 
-func main() {
-	// We setup a signal handler to catch SIGINT and SIGTERM signals
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		os.Exit(1)
-	}()
+// output writes samples and group aggregates to stdout and every configured sink after
+// adding derived metrics and passing them through the relabel rules and plugins.
+type output struct {
+	derived  *Deriver
+	relabel  *atomic.Pointer[Relabeler]
+	plugins  []*Plugin
+	exec     *ExecSink
+	webhooks []*Webhook
+	topics   []*SNSTopic
+	tracer   *Tracer
+	stdout   bool
+	// csv writes device samples to stdout as CSV rows instead of JSON, other records are skipped
+	csv *csv.Writer
+}
 
-	ctx := context.Background()
-	// We initialize the AWS config
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		log.Fatalf("Unable to load AWS config: %v", err)
+// event emits a device lifecycle event and posts it to the webhooks and SNS topics.
+func (o output) event(e DeviceEvent) {
+	o.emit(e, nil)
+	for _, webhook := range o.webhooks {
+		webhook.Send(e)
 	}
-	cw := cloudwatch.NewFromConfig(cfg)
+	for _, topic := range o.topics {
+		topic.Send(e)
+	}
+}
 
-	ret := nvml.Init()
-	if ret != nvml.SUCCESS {
-		log.Fatalf("Unable to initialize NVML: %v", nvml.ErrorString(ret))
+// emit writes v and ends its trace span. Samples were transformed before, other records pass
+// through the derived metrics and relabel rules here.
+func (o output) emit(v any, span *Span) {
+	defer span.End()
+	_, isSample := v.(Sample)
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Fatalf("Unable to marshal metrics to JSON: %v", err)
 	}
-	defer func() {
-		ret := nvml.Shutdown()
-		if ret != nvml.SUCCESS {
-			log.Fatalf("Unable to shutdown NVML: %v", nvml.ErrorString(ret))
+	if !isSample {
+		record, ok := o.apply(data, span)
+		if !ok {
+			return
 		}
-	}()
+		if record != nil {
+			if data, err = json.Marshal(record); err != nil {
+				log.Fatalf("Unable to marshal metrics to JSON: %v", err)
+			}
+		}
+	}
+	for _, plugin := range o.plugins {
+		pluginSpan := span.Child("plugin")
+		pluginSpan.SetAttr("plugin", plugin.path)
+		processed, err := plugin.Process(data)
+		pluginSpan.End()
+		if err != nil {
+			// A broken plugin should not cost us the sample, pass it on unchanged
+			log.Printf("Unable to process record: %v", err)
+			continue
+		}
+		if processed == nil {
+			return
+		}
+		data = processed
+	}
+	if o.stdout {
+		stdout := span.Child("stdout")
+		o.write(data)
+		stdout.End()
+	}
+	if o.exec != nil {
+		execSpan := span.Child("exec")
+		o.exec.Send(data)
+		execSpan.End()
+	}
+}
 
-	device, err := GetDevice(0)
-	if err != nil {
-		log.Fatalf("Unable to get device: %v", err)
+// apply decodes a record and adds the derived metrics before running the relabel rules on it.
+// It returns a nil record when there are no rules, and false when a rule drops the record.
+func (o output) apply(data []byte, span *Span) (map[string]any, bool) {
+	relabel := o.relabel.Load()
+	if len(o.derived.metrics) == 0 && len(relabel.rules) == 0 {
+		return nil, true
 	}
+	transform := span.Child("transform")
+	defer transform.End()
+	var record map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&record); err != nil {
+		log.Fatalf("Unable to decode record: %v", err)
+	}
+	o.derived.Apply(record)
+	if !relabel.Apply(record) {
+		transform.SetAttr("dropped", "true")
+		return nil, false
+	}
+	return record, true
+}
 
-	for {
-		metrics, err := device.GetMetrics()
-		if err != nil {
-			log.Fatalf("Unable to get metrics: %v", err)
+// transform applies the derived metrics and relabel rules to a sample before it fans out to
+// the sinks. The sinks get the sample decoded from the resulting record, so dropped objects
+// are nil and replaced labels such as uuid or tenant take their new value, with the metric
+// fields the rules removed in dropped and the derived metrics in derived. The index keeps
+// identifying the device. It returns false when a rule drops the sample.
+func (o output) transform(s Sample) (Sample, bool) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Fatalf("Unable to marshal metrics to JSON: %v", err)
+	}
+	record, ok := o.apply(data, s.span)
+	if !ok || record == nil {
+		return s, ok
+	}
+	if data, err = json.Marshal(record); err != nil {
+		log.Fatalf("Unable to marshal metrics to JSON: %v", err)
+	}
+	var exported Sample
+	// A label rewritten to a value of another type, e.g. a non-numeric index, keeps its zero
+	// value, the record still carries it for stdout
+	json.Unmarshal(data, &exported)
+	exported.Index, exported.span, exported.record = s.Index, s.span, record
+	// JSON drops the monotonic reading the sinks re-anchor buffered samples with after a
+	// clock jump, keep it unless a rule rewrote the timestamp
+	if exported.Timestamp.Equal(s.Timestamp) {
+		exported.Timestamp = s.Timestamp
+	}
+	for _, m := range o.derived.metrics {
+		if value, ok := recordNumber(record, m.name); ok {
+			exported.derived = append(exported.derived, derivedValue{m.name, value})
 		}
-		jsonMetrics, err := json.Marshal(metrics)
-		if err != nil {
-			log.Fatalf("Unable to marshal metrics to JSON: %v", err)
+	}
+	for _, field := range sampleMetrics {
+		if _, ok := record[field]; !ok {
+			if exported.dropped == nil {
+				exported.dropped = make(map[string]bool)
+			}
+			exported.dropped[field] = true
+		}
+	}
+	return exported, true
+}
+
+// sampleMetrics are the metric fields every sample carries.
+var sampleMetrics = []string{"temperature", "power", "gpu_usage", "memory_total", "memory_used", "memory_used_percent"}
+
+// csvHeader names the columns of the CSV format.
+var csvHeader = []string{"timestamp", "index", "uuid", "temperature", "power", "gpu_usage", "memory_total", "memory_used", "memory_used_percent"}
+
+// write prints the record to stdout in the configured format.
+func (o output) write(data []byte) {
+	if o.csv == nil {
+		fmt.Println(string(data))
+		return
+	}
+	var record map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&record); err != nil {
+		log.Fatalf("Unable to decode record: %v", err)
+	}
+	if _, ok := record["temperature"]; !ok {
+		return
+	}
+	row := make([]string, len(csvHeader))
+	for i, column := range csvHeader {
+		if v, ok := record[column]; ok {
+			row[i] = fmt.Sprint(v)
 		}
-		fmt.Println(string(jsonMetrics))
-		// Sleep for 5 seconds
-		time.Sleep(time.Second * 5)
 	}
+	o.csv.Write(row)
+	o.csv.Flush()
 }
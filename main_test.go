@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransformTimestamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		derived []DerivedConfig
+		relabel []RelabelConfig
+	}{
+		{
+			name:    "derived metric",
+			derived: []DerivedConfig{{Name: "memory_free", Expr: "memory_total - memory_used"}},
+		},
+		{
+			name:    "relabel rule",
+			relabel: []RelabelConfig{{SourceLabels: []string{"uuid"}, Regex: "GPU-(.*)", TargetLabel: "serial"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			derived, err := NewDeriver(tt.derived)
+			if err != nil {
+				t.Fatal(err)
+			}
+			relabeler, err := NewRelabeler(tt.relabel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o := output{derived: derived, relabel: &atomic.Pointer[Relabeler]{}}
+			o.relabel.Store(relabeler)
+			s := Sample{UUID: "GPU-1", Timestamp: time.Now()}
+			s.MemoryTotal, s.MemoryUsed = 80, 20
+			exported, ok := o.transform(s)
+			if !ok {
+				t.Fatal("transform dropped the sample")
+			}
+			if exported.record == nil {
+				t.Fatal("transform did not run the rules")
+			}
+			// A test cannot step the wall clock, so check the timestamp keeps the monotonic
+			// reading reanchor corrects a clock jump with. Round(0) strips it, == compares it.
+			if exported.Timestamp != s.Timestamp || exported.Timestamp == exported.Timestamp.Round(0) {
+				t.Fatalf("timestamp = %v, want %v with its monotonic reading", exported.Timestamp, s.Timestamp)
+			}
+			now := time.Now()
+			if got, want := reanchor(exported.Timestamp, now), reanchor(s.Timestamp, now); got != want {
+				t.Errorf("reanchor = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// MigMetrics are the metrics of a MIG slice. GpuUsage is the SM utilization of its GPU
+// instance, only measured on GPUs with GPM and from the second sample on.
+type MigMetrics struct {
+	GPUInstanceID     int      `json:"gpu_instance_id"`
+	ComputeInstanceID int      `json:"compute_instance_id"`
+	UUID              string   `json:"uuid"`
+	Profile           string   `json:"profile"`
+	MemoryTotal       float32  `json:"memory_total"`
+	MemoryUsed        float32  `json:"memory_used"`
+	GpuUsage          *float64 `json:"gpu_usage,omitempty"`
+}
+
+// migMetrics reads every MIG slice of the device, none when MIG mode is disabled. Without a
+// utilization tracker only memory is reported.
+func migMetrics(d Device, utilization *gpumon.MigUtilization) ([]MigMetrics, error) {
+	devices, err := d.GetMigDevices()
+	if err != nil || len(devices) == 0 {
+		return nil, err
+	}
+	var usage map[int]float64
+	if utilization != nil {
+		ids := make([]int, len(devices))
+		for i, m := range devices {
+			ids[i] = m.GPUInstanceID
+		}
+		if usage, err = utilization.Measure(d, ids); err != nil {
+			return nil, err
+		}
+	}
+	metrics := make([]MigMetrics, 0, len(devices))
+	for _, m := range devices {
+		total, used, err := m.GetMemory()
+		if err != nil {
+			return nil, err
+		}
+		mm := MigMetrics{
+			GPUInstanceID:     m.GPUInstanceID,
+			ComputeInstanceID: m.ComputeInstanceID,
+			UUID:              m.UUID,
+			Profile:           m.Profile,
+			MemoryTotal:       total,
+			MemoryUsed:        used,
+		}
+		if u, ok := usage[m.GPUInstanceID]; ok {
+			mm.GpuUsage = &u
+		}
+		metrics = append(metrics, mm)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// Exit codes of the node-problem-detector custom plugin protocol.
+const (
+	npdOK      = 0
+	npdNonOK   = 1
+	npdUnknown = 2
+)
+
+// npdMaxMessage keeps messages within NPD's default max_output_length.
+const npdMaxMessage = 80
+
+var xidPattern = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F:.]+)\): (\d+)`)
+
+// npdCommand implements the npd subcommand, a node-problem-detector custom plugin. It prints
+// one line describing the problem and exits with the plugin protocol's status code.
+func npdCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go npd lost|ecc|xid [flags]")
+		return npdUnknown
+	}
+	fs := flag.NewFlagSet("npd "+args[0], flag.ContinueOnError)
+	expect := fs.Int("expect", 0, "lost: number of GPUs the node should have")
+	since := fs.Duration("since", 5*time.Minute, "xid: how far back to search the kernel log")
+	if err := fs.Parse(args[1:]); err != nil {
+		return npdUnknown
+	}
+
+	var status int
+	var message string
+	switch args[0] {
+	case "lost":
+		status, message = npdLost(*expect)
+	case "ecc":
+		status, message = npdECC()
+	case "xid":
+		status, message = npdXid(*since)
+	default:
+		status, message = npdUnknown, fmt.Sprintf("unknown check %q", args[0])
+	}
+	if len(message) > npdMaxMessage {
+		message = message[:npdMaxMessage]
+	}
+	fmt.Println(message)
+	return status
+}
+
+// npdDevices initializes NVML for a check, the returned function shuts it down.
+func npdDevices() ([]Device, func(), error) {
+	loaded, err := gpumon.Init()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !loaded {
+		return nil, func() {}, nil
+	}
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		nvml.Shutdown()
+		return nil, nil, nvmlError(ret)
+	}
+	devices := make([]Device, 0, count)
+	for i := 0; i < count; i++ {
+		handle, ret := nvml.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			// Keep the index so a lost GPU is still checked and reported
+			devices = append(devices, Device{Index: i})
+			continue
+		}
+		uuid, _ := handle.GetUUID()
+		devices = append(devices, Device{Index: i, UUID: uuid, Handle: handle})
+	}
+	return devices, func() { nvml.Shutdown() }, nil
+}
+
+func npdLost(expect int) (int, string) {
+	devices, shutdown, err := npdDevices()
+	if err != nil {
+		return npdUnknown, err.Error()
+	}
+	defer shutdown()
+	var lost []string
+	for _, d := range devices {
+		if d.Handle == nil {
+			lost = append(lost, strconv.Itoa(d.Index))
+			continue
+		}
+		if _, err := d.GetTemperature(); errors.Is(err, nvmlError(nvml.ERROR_GPU_IS_LOST)) {
+			lost = append(lost, strconv.Itoa(d.Index))
+		}
+	}
+	if len(lost) > 0 {
+		return npdNonOK, "GPU " + strings.Join(lost, ",") + " fell off the bus"
+	}
+	if len(devices) < expect {
+		return npdNonOK, fmt.Sprintf("found %d of %d GPUs", len(devices), expect)
+	}
+	return npdOK, "all GPUs are reachable"
+}
+
+func npdECC() (int, string) {
+	devices, shutdown, err := npdDevices()
+	if err != nil {
+		return npdUnknown, err.Error()
+	}
+	defer shutdown()
+	var failing []string
+	for _, d := range devices {
+		if d.Handle == nil {
+			continue
+		}
+		count, ret := d.Handle.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.VOLATILE_ECC)
+		if ret == nvml.SUCCESS && count > 0 {
+			failing = append(failing, fmt.Sprintf("GPU %d: %d", d.Index, count))
+		}
+	}
+	if len(failing) > 0 {
+		return npdNonOK, "uncorrectable ECC errors " + strings.Join(failing, ", ")
+	}
+	return npdOK, "no uncorrectable ECC errors"
+}
+
+// npdXid searches the kernel log for Xid errors reported by the NVIDIA driver since the given
+// time. Reading /dev/kmsg needs the same privileges as dmesg.
+func npdXid(since time.Duration) (int, string) {
+	// os.File would park on the runtime poller once the log is drained, a raw non-blocking
+	// descriptor returns EAGAIN instead
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return npdUnknown, fmt.Sprintf("unable to read kernel log: %v", err)
+	}
+	defer syscall.Close(fd)
+	// Record timestamps are microseconds since boot, which is what /proc/uptime counts too
+	uptime, err := bootTime()
+	if err != nil {
+		return npdUnknown, err.Error()
+	}
+	cutoff := uptime - since
+
+	var xids []string
+	buf := make([]byte, 8192)
+	for {
+		// Every read returns one record
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EPIPE {
+			// The record was overwritten while reading, continue with the next one
+			continue
+		}
+		if err != nil || n <= 0 {
+			break
+		}
+		line := string(buf[:n])
+		// prefix;message where prefix is priority,sequence,timestamp,flags
+		prefix, message, ok := strings.Cut(line, ";")
+		fields := strings.Split(prefix, ",")
+		if !ok || len(fields) < 3 {
+			continue
+		}
+		usec, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || time.Duration(usec)*time.Microsecond < cutoff {
+			continue
+		}
+		if match := xidPattern.FindStringSubmatch(message); match != nil {
+			xids = append(xids, "Xid "+match[2]+" on "+match[1])
+		}
+	}
+	if len(xids) > 0 {
+		return npdNonOK, strings.Join(xids, ", ")
+	}
+	return npdOK, "no Xid errors"
+}
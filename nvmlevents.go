@@ -0,0 +1,73 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// nvmlEvents are the device events reported from NVML event notifications.
+var nvmlEvents = []string{gpumon.EventXid, gpumon.EventDoubleBitECC, gpumon.EventSingleBitECC, gpumon.EventPowerSourceChange, gpumon.EventSlowdown, gpumon.EventSlowdownCleared}
+
+// xidDescriptions explain the Xid errors that most often need action.
+var xidDescriptions = map[uint64]string{
+	13:  "graphics engine exception",
+	31:  "GPU memory page fault",
+	43:  "GPU stopped processing",
+	45:  "preemptive cleanup, due to previous errors",
+	48:  "double bit ECC error",
+	61:  "internal micro-controller breakpoint",
+	62:  "internal micro-controller halt",
+	63:  "ECC page retirement or row remapping recording event",
+	64:  "ECC page retirement or row remapper recording failure",
+	74:  "NVLink error",
+	79:  "GPU has fallen off the bus",
+	92:  "high single-bit ECC error rate",
+	94:  "contained ECC error",
+	95:  "uncontained ECC error",
+	119: "GSP RPC timeout",
+	120: "GSP error",
+}
+
+// watchNVMLEvents sends the events of the watcher until ctx is cancelled, then frees it.
+func watchNVMLEvents(ctx context.Context, w *gpumon.EventWatcher, events chan<- DeviceEvent) {
+	defer w.Close()
+	for ctx.Err() == nil {
+		e, ok, err := w.Wait(time.Second)
+		if err != nil {
+			log.Printf("Unable to wait for NVML events: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		event := newDeviceEvent(e.Type, Device{Index: e.Index, UUID: e.UUID}, nil)
+		subject := alertSubject(Device{Index: e.Index})
+		switch e.Type {
+		case gpumon.EventXid:
+			event.Xid = e.Xid
+			event.Description = xidDescriptions[e.Xid]
+			log.Printf("Xid %d on %s: %s", e.Xid, subject, cmp.Or(event.Description, "unknown error"))
+		case gpumon.EventSlowdown:
+			event.Reasons = e.Reasons
+			log.Printf("Clocks of %s slowed down by %s", subject, strings.Join(e.Reasons, ", "))
+		default:
+			log.Printf("NVML reported %s on %s", strings.ReplaceAll(e.Type, "_", " "), subject)
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// isNVMLEvent reports whether the event came from NVML event notifications.
+func isNVMLEvent(e DeviceEvent) bool {
+	return slices.Contains(nvmlEvents, e.Event)
+}
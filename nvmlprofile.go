@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// NVMLProfiler measures the time spent in the NVML calls made while polling, to find the
+// metrics worth disabling on slow or virtualized platforms.
+type NVMLProfiler struct {
+	mu    sync.Mutex
+	calls map[string]*NVMLCallStats
+}
+
+// NVMLCallStats summarizes the calls of one NVML function since the previous report.
+type NVMLCallStats struct {
+	Calls   uint64  `json:"calls"`
+	TotalMs float64 `json:"total_ms"`
+	AvgUs   float64 `json:"avg_us"`
+	MaxUs   float64 `json:"max_us"`
+}
+
+// NVMLProfile is the report emitted every profiling interval.
+type NVMLProfile struct {
+	Epoch     int64                    `json:"epoch"`
+	Timestamp time.Time                `json:"timestamp"`
+	NVMLCalls map[string]NVMLCallStats `json:"nvml_calls"`
+}
+
+func NewNVMLProfiler() *NVMLProfiler {
+	return &NVMLProfiler{calls: make(map[string]*NVMLCallStats)}
+}
+
+func (p *NVMLProfiler) observe(name string, start time.Time) {
+	us := float64(time.Since(start).Nanoseconds()) / 1e3
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats, ok := p.calls[name]
+	if !ok {
+		stats = &NVMLCallStats{}
+		p.calls[name] = stats
+	}
+	stats.Calls++
+	stats.TotalMs += us / 1e3
+	stats.MaxUs = max(stats.MaxUs, us)
+}
+
+// Report returns the statistics collected since the previous report and starts over.
+func (p *NVMLProfiler) Report() NVMLProfile {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	profile := NVMLProfile{Epoch: epoch, Timestamp: time.Now(), NVMLCalls: make(map[string]NVMLCallStats, len(p.calls))}
+	for name, stats := range p.calls {
+		stats.AvgUs = stats.TotalMs * 1e3 / float64(stats.Calls)
+		profile.NVMLCalls[name] = *stats
+	}
+	p.calls = make(map[string]*NVMLCallStats)
+	return profile
+}
+
+// profiledDevice times the NVML calls made by the collectors, everything else is passed
+// through untimed.
+type profiledDevice struct {
+	nvml.Device
+	profiler *NVMLProfiler
+}
+
+// Rewrap keeps profiling a device whose handle was reacquired.
+func (d profiledDevice) Rewrap(handle nvml.Device) nvml.Device {
+	d.Device = handle
+	return d
+}
+
+func (d profiledDevice) GetTemperature(sensor nvml.TemperatureSensors) (uint32, nvml.Return) {
+	defer d.profiler.observe("GetTemperature", time.Now())
+	return d.Device.GetTemperature(sensor)
+}
+
+func (d profiledDevice) GetPowerUsage() (uint32, nvml.Return) {
+	defer d.profiler.observe("GetPowerUsage", time.Now())
+	return d.Device.GetPowerUsage()
+}
+
+func (d profiledDevice) GetMemoryInfo() (nvml.Memory, nvml.Return) {
+	defer d.profiler.observe("GetMemoryInfo", time.Now())
+	return d.Device.GetMemoryInfo()
+}
+
+func (d profiledDevice) GetUtilizationRates() (nvml.Utilization, nvml.Return) {
+	defer d.profiler.observe("GetUtilizationRates", time.Now())
+	return d.Device.GetUtilizationRates()
+}
+
+func (d profiledDevice) GetPcieThroughput(counter nvml.PcieUtilCounter) (uint32, nvml.Return) {
+	defer d.profiler.observe("GetPcieThroughput", time.Now())
+	return d.Device.GetPcieThroughput(counter)
+}
+
+func (d profiledDevice) GetComputeRunningProcesses() ([]nvml.ProcessInfo, nvml.Return) {
+	defer d.profiler.observe("GetComputeRunningProcesses", time.Now())
+	return d.Device.GetComputeRunningProcesses()
+}
+
+func (d profiledDevice) GetGraphicsRunningProcesses() ([]nvml.ProcessInfo, nvml.Return) {
+	defer d.profiler.observe("GetGraphicsRunningProcesses", time.Now())
+	return d.Device.GetGraphicsRunningProcesses()
+}
+
+func (d profiledDevice) GetTotalEccErrors(errorType nvml.MemoryErrorType, counterType nvml.EccCounterType) (uint64, nvml.Return) {
+	defer d.profiler.observe("GetTotalEccErrors", time.Now())
+	return d.Device.GetTotalEccErrors(errorType, counterType)
+}
+
+func (d profiledDevice) GetRemappedRows() (int, int, bool, bool, nvml.Return) {
+	defer d.profiler.observe("GetRemappedRows", time.Now())
+	return d.Device.GetRemappedRows()
+}
+
+func (d profiledDevice) GetRetiredPages(cause nvml.PageRetirementCause) ([]uint64, nvml.Return) {
+	defer d.profiler.observe("GetRetiredPages", time.Now())
+	return d.Device.GetRetiredPages(cause)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// offline is set once at startup, before the config is loaded. An offline agent makes no
+// connection off the host: no cloud or instance metadata lookups, and only local sinks.
+var offline bool
+
+// applyOffline removes everything from the config that would connect off the host, logging
+// what it ignores. Endpoints on the loopback interface are kept, e.g. a local collector.
+func applyOffline(cfg *Config) {
+	cfg.Publishers = slices.DeleteFunc(slices.Clone(cfg.Publishers), func(p string) bool {
+		var keep bool
+		switch p {
+		case "cloudwatch":
+			// EMF records on stdout are the only CloudWatch output not calling AWS
+			keep = cfg.Cloudwatch.Output == "emf" && cfg.Cloudwatch.EMF == nil
+		case "otlp":
+			keep = loopbackURL(cfg.OTLP.Endpoint)
+		case "influx":
+			keep = cfg.Influx.File != nil || loopbackURL(cfg.Influx.URL)
+		default:
+			keep = true
+		}
+		if !keep {
+			log.Printf("Ignoring the %s publisher in offline mode", p)
+		}
+		return !keep
+	})
+	cfg.Webhooks = slices.DeleteFunc(cfg.Webhooks, func(wc WebhookConfig) bool {
+		if loopbackURL(wc.URL) {
+			return false
+		}
+		log.Printf("Ignoring the webhook to %s in offline mode", wc.URL)
+		return true
+	})
+	if len(cfg.SNS) > 0 {
+		log.Printf("Ignoring the SNS topics in offline mode")
+		cfg.SNS = nil
+	}
+	if cfg.Deadman != nil && (!loopbackURL(cfg.Deadman.URL) || (cfg.Deadman.FailURL != "" && !loopbackURL(cfg.Deadman.FailURL))) {
+		log.Printf("Ignoring the dead man's switch in offline mode")
+		cfg.Deadman = nil
+	}
+	if rc := cfg.Registration; rc != nil {
+		if rc.Consul != nil && !loopbackURL(rc.Consul.URL) {
+			log.Printf("Ignoring the Consul registration in offline mode")
+			rc.Consul = nil
+		}
+		if rc.Etcd != nil && !loopbackURL(rc.Etcd.URL) {
+			log.Printf("Ignoring the etcd registration in offline mode")
+			rc.Etcd = nil
+		}
+		if rc.Consul == nil && rc.Etcd == nil {
+			cfg.Registration = nil
+		}
+	}
+	if cfg.Audit != nil && cfg.Audit.Loki != nil && !loopbackURL(cfg.Audit.Loki.URL) {
+		log.Printf("Ignoring the Loki audit log in offline mode")
+		cfg.Audit.Loki = nil
+	}
+	if cfg.Tracing != nil && cfg.Tracing.Endpoint != "" && !loopbackURL(cfg.Tracing.Endpoint) {
+		log.Printf("Ignoring the tracing endpoint in offline mode, slow cycles are still logged")
+		cfg.Tracing.Endpoint = ""
+	}
+	cfg.Inference = slices.DeleteFunc(cfg.Inference, func(ic InferenceConfig) bool {
+		if loopbackURL(ic.URL) {
+			return false
+		}
+		log.Printf("Ignoring inference server %s in offline mode", ic.Name)
+		return true
+	})
+}
+
+// enforceOffline makes the default HTTP transport refuse connections off the host, so a
+// client the config filtering missed fails instead of leaking. It is called once at startup
+// before any client is built.
+func enforceOffline() {
+	if !offline {
+		return
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refuseRemote}
+	http.DefaultTransport.(*http.Transport).DialContext = dialer.DialContext
+}
+
+// refuseRemote is a dialer control refusing every address but the loopback interface. It
+// runs after name resolution, so host names resolving off the host are refused too.
+func refuseRemote(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("refusing to connect to %s in offline mode", address)
+	}
+	return nil
+}
+
+// offlineAWSClient is the HTTP client of the AWS SDK clients, refusing connections off the
+// host when the agent is offline.
+func offlineAWSClient() aws.HTTPClient {
+	return awshttp.NewBuildableClient().WithDialerOptions(func(d *net.Dialer) { d.Control = refuseRemote })
+}
+
+// newIMDSClient returns an instance metadata client requiring IMDSv2 session tokens, built
+// from awsCfg when set, or nil offline. Every lookup of the instance metadata goes through it.
+func newIMDSClient(awsCfg *aws.Config) *imds.Client {
+	if offline {
+		return nil
+	}
+	if awsCfg == nil {
+		return imds.New(imds.Options{EnableFallback: aws.FalseTernary})
+	}
+	return imds.NewFromConfig(*awsCfg, func(o *imds.Options) { o.EnableFallback = aws.FalseTernary })
+}
+
+// loopbackURL reports whether the URL points to this host.
+func loopbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestLoopbackURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"http://localhost:4318/v1/metrics", true},
+		{"http://127.0.0.1:8086", true},
+		{"http://127.8.9.10", true},
+		{"http://[::1]:9090", true},
+		{"https://otel.example.com:4318", false},
+		{"http://10.0.0.1:8086", false},
+		{"http://[::]:9090", false},
+		// Only the host counts, not a loopback-looking user or path
+		{"http://localhost@example.com/", false},
+		{"http://example.com/localhost", false},
+		{"localhost:4318", false},
+		{"", false},
+		{"http://%zz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := loopbackURL(tt.url); got != tt.want {
+				t.Errorf("loopbackURL(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const otlpQueueSize = 1000
+
+// otlpTuning sends up to 1000 samples per request every 10s, one request at a time, and
+// retries failed requests for a minute.
+var otlpTuning = SinkTuning{FlushSize: 1000, FlushInterval: Duration{10 * time.Second}, MaxInFlight: 1, MaxRetry: Duration{time.Minute}}
+
+// OTLPConfig publishes samples as OTLP/JSON metrics to Endpoint, e.g.
+// http://localhost:4318/v1/metrics on an OpenTelemetry Collector.
+type OTLPConfig struct {
+	Endpoint string `json:"endpoint"`
+	// Protocol is http/json, the only one supported, gRPC and http/protobuf are rejected
+	Protocol string            `json:"protocol"`
+	Headers  map[string]string `json:"headers"`
+	Timeout  Duration          `json:"timeout"`
+	TLS      *OTLPTLSConfig    `json:"tls"`
+	// Compression gzips request bodies
+	Compression *CompressionConfig `json:"compression"`
+	// Tuning overrides how samples are batched and retried
+	Tuning SinkTuning `json:"tuning"`
+}
+
+// OTLPTLSConfig verifies the collector with CAFile instead of the system roots and
+// authenticates with a client certificate when CertFile and KeyFile are set.
+type OTLPTLSConfig struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// otlpMetric is a gauge published for every device, named after the OpenTelemetry hardware
+// semantic conventions.
+type otlpMetric struct {
+	name string
+	// field is the sample field the gauge exports
+	field string
+	unit  string
+	value func(Sample) float64
+}
+
+var otlpMetrics = []otlpMetric{
+	{"gpu.utilization", "gpu_usage", "1", func(s Sample) float64 { return float64(s.GpuUsage) / 100 }},
+	{"gpu.memory.used", "memory_used", "By", func(s Sample) float64 { return float64(s.MemoryUsed) * (1 << 30) }},
+	{"gpu.memory.limit", "memory_total", "By", func(s Sample) float64 { return float64(s.MemoryTotal) * (1 << 30) }},
+	{"gpu.memory.utilization", "memory_used_percent", "1", func(s Sample) float64 { return float64(s.MemoryUsedPercent) / 100 }},
+	{"gpu.temperature", "temperature", "Cel", func(s Sample) float64 { return float64(s.Temperature) }},
+	{"gpu.power.usage", "power", "W", func(s Sample) float64 { return float64(s.Power) }},
+}
+
+// otlpGroupMetrics are the gauges published for every group, named like the device ones.
+var otlpGroupMetrics = []struct {
+	name  string
+	unit  string
+	value func(GroupSample) float64
+}{
+	{"gpu.group.devices", "{gpu}", func(g GroupSample) float64 { return float64(g.Devices) }},
+	{"gpu.group.utilization", "1", func(g GroupSample) float64 { return float64(g.GpuUsage) / 100 }},
+	{"gpu.group.memory.used", "By", func(g GroupSample) float64 { return float64(g.MemoryUsed) * (1 << 30) }},
+	{"gpu.group.memory.limit", "By", func(g GroupSample) float64 { return float64(g.MemoryTotal) * (1 << 30) }},
+	{"gpu.group.memory.utilization", "1", func(g GroupSample) float64 { return float64(g.MemoryUsedPercent) / 100 }},
+	{"gpu.group.temperature.max", "Cel", func(g GroupSample) float64 { return float64(g.Temperature) }},
+	{"gpu.group.power.usage", "W", func(g GroupSample) float64 { return float64(g.Power) }},
+}
+
+// OTLPPublisher batches samples and posts them to the collector in the background.
+type OTLPPublisher struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	limiter  *RateLimiter
+	tracer   *Tracer
+	compress *compressor
+	tuning   SinkTuning
+	host     []otlpAttribute
+	queue    chan Sample
+	// heartbeats are published as gpumon.heartbeat on a resource of the host alone
+	heartbeats chan Heartbeat
+	// groups are published on the resource of the host too, with a gpumon.group attribute
+	groups chan GroupSample
+}
+
+func NewOTLPPublisher(cfg OTLPConfig, limiter *RateLimiter, tracer *Tracer) (*OTLPPublisher, error) {
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.TLS != nil {
+		tlsConfig, err := otlpTLSConfig(*cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	attrs, _ := instanceAttributes(context.Background(), newIMDSClient(nil))
+	return &OTLPPublisher{
+		endpoint: cfg.Endpoint,
+		headers:  cfg.Headers,
+		client:   &http.Client{Timeout: timeout, Transport: transport},
+		limiter:  limiter,
+		tracer:   tracer,
+		compress: newCompressor(cfg.Compression),
+		tuning:   cfg.Tuning.withDefaults(otlpTuning),
+		host: []otlpAttribute{
+			otlpString("service.name", "gpumon-go"),
+			otlpString("host.name", hostName()),
+			otlpString("host.id", attrs["instance_id"]),
+			otlpString("host.type", attrs["instance_type"]),
+		},
+		queue:      make(chan Sample, otlpQueueSize),
+		heartbeats: make(chan Heartbeat, otlpQueueSize),
+		groups:     make(chan GroupSample, otlpQueueSize),
+	}, nil
+}
+
+func otlpTLSConfig(cfg OTLPTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read otlp ca_file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("otlp ca_file %s contains no certificates", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load otlp client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// Send queues the sample for the next flush without blocking the caller.
+func (p *OTLPPublisher) Send(s Sample) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.queue <- s:
+	default:
+		log.Printf("OTLP collector %s is not keeping up, dropped sample of device %d", p.endpoint, s.Index)
+	}
+}
+
+// SendHeartbeat queues the heartbeat for the next flush without blocking the caller.
+func (p *OTLPPublisher) SendHeartbeat(h Heartbeat) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.heartbeats <- h:
+	default:
+		log.Printf("OTLP collector %s is not keeping up, dropped heartbeat", p.endpoint)
+	}
+}
+
+// SendGroup queues the group aggregate for the next flush without blocking the caller.
+func (p *OTLPPublisher) SendGroup(g GroupSample) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.groups <- g:
+	default:
+		log.Printf("OTLP collector %s is not keeping up, dropped aggregate of group %s", p.endpoint, g.Group)
+	}
+}
+
+// Run posts the queued samples, heartbeats and group aggregates on every flush, and as soon as a full request
+// is queued. Failed requests are retried on the next flushes. When ctx is cancelled it posts
+// the ones queued so far one last time, within shutdownTimeout, and returns.
+func (p *OTLPPublisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.tuning.FlushInterval.Duration)
+	defer ticker.Stop()
+	var batch []Sample
+	var heartbeats []Heartbeat
+	var groups []GroupSample
+	var pending []pendingRequest
+	for {
+		select {
+		case s := <-p.queue:
+			batch = append(batch, s)
+			if len(batch) >= p.tuning.FlushSize {
+				pending = p.flush(context.Background(), batch, heartbeats, groups, pending)
+				batch, heartbeats, groups = nil, nil, nil
+			}
+		case h := <-p.heartbeats:
+			heartbeats = append(heartbeats, h)
+		case g := <-p.groups:
+			groups = append(groups, g)
+		case <-ticker.C:
+			pending = p.flush(context.Background(), batch, heartbeats, groups, pending)
+			batch, heartbeats, groups = nil, nil, nil
+		case <-ctx.Done():
+			for len(p.queue) > 0 {
+				batch = append(batch, <-p.queue)
+			}
+			for len(p.heartbeats) > 0 {
+				heartbeats = append(heartbeats, <-p.heartbeats)
+			}
+			for len(p.groups) > 0 {
+				groups = append(groups, <-p.groups)
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if pending = p.flush(flushCtx, batch, heartbeats, groups, pending); len(pending) > 0 {
+				log.Printf("Dropped %d requests %s did not accept before shutdown", len(pending), p.endpoint)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// flush posts the batch in requests of at most FlushSize samples, the first of which carries
+// the heartbeats and group aggregates, along with the pending requests. It returns the
+// requests to retry.
+func (p *OTLPPublisher) flush(ctx context.Context, batch []Sample, heartbeats []Heartbeat, groups []GroupSample, pending []pendingRequest) []pendingRequest {
+	if len(batch) == 0 && len(heartbeats) == 0 && len(groups) == 0 && len(pending) == 0 {
+		return nil
+	}
+	var bodies [][]byte
+	for start := 0; start == 0 || start < len(batch); start += p.tuning.FlushSize {
+		chunk := batch[start:min(start+p.tuning.FlushSize, len(batch))]
+		var payload map[string]any
+		if start == 0 {
+			payload = p.otlpPayload(chunk, heartbeats, groups, exporterStats.Snapshot())
+		} else {
+			payload = p.otlpPayload(chunk, nil, nil, nil)
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Unable to marshal OTLP payload: %v", err)
+			continue
+		}
+		bodies = append(bodies, body)
+	}
+	span := p.tracer.Start("otlp flush")
+	span.SetAttr("samples", strconv.Itoa(len(batch)))
+	span.SetAttr("pending", strconv.Itoa(len(pending)))
+	defer span.End()
+	retry, expired, err := p.tuning.sendRequests(pending, bodies, span, "otlp export", func(body []byte, attempt *Span) error {
+		return p.post(ctx, body, attempt)
+	})
+	span.SetError(err)
+	exporterStats.Record("otlp", err)
+	if err != nil {
+		log.Printf("Unable to export to %s, %d requests to retry: %v", p.endpoint, len(retry), err)
+	}
+	if expired > 0 {
+		log.Printf("Dropped %d requests %s did not accept for %v", expired, p.endpoint, p.tuning.MaxRetry.Duration)
+	}
+	return retry
+}
+
+// otlpPayload builds an ExportMetricsServiceRequest with one resource per GPU, identified by
+// its UUID next to the host attributes, and per pod set the GPU was allocated to. Heartbeats go on a resource of the host with the
+// agent version, next to the group aggregates and the cumulative publishes of the exporters.
+func (p *OTLPPublisher) otlpPayload(batch []Sample, heartbeats []Heartbeat, groups []GroupSample, exporters []ExporterStatus) map[string]any {
+	var keys []string
+	byDevice := make(map[string][]Sample)
+	for _, s := range batch {
+		namespace, pod, container := podLabels(s.Pods)
+		key := strings.Join([]string{s.UUID, namespace, pod, container}, "\x00")
+		if _, ok := byDevice[key]; !ok {
+			keys = append(keys, key)
+		}
+		byDevice[key] = append(byDevice[key], s)
+	}
+	resources := make([]any, 0, len(keys))
+	for _, key := range keys {
+		samples := byDevice[key]
+		metrics := make([]any, 0, len(otlpMetrics))
+		for _, m := range otlpMetrics {
+			points := make([]any, 0, len(samples))
+			for _, s := range samples {
+				if !s.exports(m.field) {
+					continue
+				}
+				points = append(points, map[string]any{
+					"timeUnixNano": strconv.FormatInt(s.Timestamp.UnixNano(), 10),
+					"asDouble":     m.value(s),
+				})
+			}
+			if len(points) > 0 {
+				metrics = append(metrics, map[string]any{"name": m.name, "unit": m.unit, "gauge": map[string]any{"dataPoints": points}})
+			}
+		}
+		var derived []string
+		points := make(map[string][]any)
+		for _, s := range samples {
+			for _, d := range s.derived {
+				if _, ok := points[d.name]; !ok {
+					derived = append(derived, d.name)
+				}
+				points[d.name] = append(points[d.name], map[string]any{
+					"timeUnixNano": strconv.FormatInt(s.Timestamp.UnixNano(), 10),
+					"asDouble":     d.value,
+				})
+			}
+		}
+		for _, name := range derived {
+			metrics = append(metrics, map[string]any{"name": name, "gauge": map[string]any{"dataPoints": points[name]}})
+		}
+		var counts []any
+		for _, s := range samples {
+			if s.ComputeProcesses != nil {
+				counts = append(counts, map[string]any{
+					"timeUnixNano": strconv.FormatInt(s.Timestamp.UnixNano(), 10),
+					"asInt":        strconv.Itoa(*s.ComputeProcesses),
+				})
+			}
+		}
+		if len(counts) > 0 {
+			metrics = append(metrics, map[string]any{"name": "gpu.compute.processes", "unit": "{process}", "gauge": map[string]any{"dataPoints": counts}})
+		}
+		var sessions []any
+		for _, s := range samples {
+			if s.Extended != nil && s.Extended.EncoderStats != nil {
+				sessions = append(sessions, map[string]any{
+					"timeUnixNano": strconv.FormatInt(s.Timestamp.UnixNano(), 10),
+					"asInt":        strconv.Itoa(s.Extended.EncoderStats.Sessions),
+				})
+			}
+		}
+		if len(sessions) > 0 {
+			metrics = append(metrics, map[string]any{"name": "gpu.encoder.sessions", "unit": "{session}", "gauge": map[string]any{"dataPoints": sessions}})
+		}
+		attrs := append(p.host[:len(p.host):len(p.host)],
+			otlpString("gpu.uuid", samples[0].UUID),
+			otlpString("gpu.index", strconv.Itoa(samples[0].Index)))
+		if ext := samples[0].Extended; ext != nil && ext.Display != nil {
+			attrs = append(attrs, otlpString("gpu.mode", ext.Display.Mode))
+		}
+		if pods := samples[0].Pods; len(pods) > 0 {
+			namespace, pod, container := podLabels(pods)
+			attrs = append(attrs,
+				otlpString("k8s.namespace.name", namespace),
+				otlpString("k8s.pod.name", pod),
+				otlpString("k8s.container.name", container))
+		}
+		resources = append(resources, map[string]any{
+			"resource": map[string]any{"attributes": attrs},
+			"scopeMetrics": []any{map[string]any{
+				"scope":   map[string]string{"name": "gpumon-go"},
+				"metrics": metrics,
+			}},
+		})
+	}
+	var hostMetrics []any
+	attrs := p.host[:len(p.host):len(p.host)]
+	if len(heartbeats) > 0 {
+		points := make([]any, 0, len(heartbeats))
+		for _, h := range heartbeats {
+			points = append(points, map[string]any{
+				"timeUnixNano": strconv.FormatInt(h.Timestamp.UnixNano(), 10),
+				"asInt":        strconv.Itoa(h.Heartbeat),
+			})
+		}
+		attrs = append(attrs, otlpString("service.version", heartbeats[len(heartbeats)-1].Version))
+		hostMetrics = append(hostMetrics, map[string]any{"name": "gpumon.heartbeat", "unit": "1", "gauge": map[string]any{"dataPoints": points}})
+	}
+	if len(groups) > 0 {
+		for _, m := range otlpGroupMetrics {
+			points := make([]any, 0, len(groups))
+			for _, g := range groups {
+				points = append(points, map[string]any{
+					"attributes":   []otlpAttribute{otlpString("gpumon.group", g.Group)},
+					"timeUnixNano": strconv.FormatInt(g.Timestamp.UnixNano(), 10),
+					"asDouble":     m.value(g),
+				})
+			}
+			hostMetrics = append(hostMetrics, map[string]any{"name": m.name, "unit": m.unit, "gauge": map[string]any{"dataPoints": points}})
+		}
+	}
+	if len(exporters) > 0 {
+		now := strconv.FormatInt(time.Now().UnixNano(), 10)
+		start := strconv.FormatInt(processStart.UnixNano(), 10)
+		points := make([]any, 0, 2*len(exporters))
+		for _, e := range exporters {
+			for _, count := range []struct {
+				result string
+				value  uint64
+			}{{"success", e.Successes}, {"failure", e.Failures}} {
+				points = append(points, map[string]any{
+					"attributes":        []otlpAttribute{otlpString("exporter", e.Exporter), otlpString("result", count.result)},
+					"startTimeUnixNano": start,
+					"timeUnixNano":      now,
+					"asInt":             strconv.FormatUint(count.value, 10),
+				})
+			}
+		}
+		// Temporality 2 is cumulative
+		hostMetrics = append(hostMetrics, map[string]any{"name": "gpumon.exporter.publishes", "unit": "{publish}", "sum": map[string]any{
+			"dataPoints": points, "aggregationTemporality": 2, "isMonotonic": true,
+		}})
+	}
+	if len(hostMetrics) > 0 {
+		resources = append(resources, map[string]any{
+			"resource": map[string]any{"attributes": attrs},
+			"scopeMetrics": []any{map[string]any{
+				"scope":   map[string]string{"name": "gpumon-go"},
+				"metrics": hostMetrics,
+			}},
+		})
+	}
+	return map[string]any{"resourceMetrics": resources}
+}
+
+func (p *OTLPPublisher) post(ctx context.Context, body []byte, span *Span) error {
+	if err := p.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	req, err := p.compress.newRequest(ctx, p.endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	span.SetAttr("http.status_code", strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// packageUser is the system user the service runs as.
+const packageUser = "gpumon"
+
+// serviceTemplate is the systemd unit of the agent. Root is only needed for power limits and
+// for reading the environment of other users' processes, so the agent runs unprivileged.
+var serviceTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=gpumon-go GPU metrics agent
+Documentation=man:gpumon-go(1)
+After=network-online.target nvidia-persistenced.service
+Wants=network-online.target
+
+[Service]
+User={{.User}}
+Group={{.User}}
+Environment=GPUMON_CONFIG={{.ConfigPath}}
+EnvironmentFile=-/etc/default/gpumon-go
+ExecStart={{.BinaryPath}}
+Restart=on-failure
+RestartSec=5s
+NoNewPrivileges=true
+ProtectSystem=full
+ProtectHome=true
+PrivateTmp=true
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+var postinstallTemplate = template.Must(template.New("postinstall").Parse(`#!/bin/sh
+set -e
+if ! getent passwd {{.User}} >/dev/null; then
+	useradd --system --no-create-home --home-dir /nonexistent --shell /usr/sbin/nologin {{.User}}
+fi
+# GPU device nodes are usually group video on distributions that restrict them
+if getent group video >/dev/null; then
+	usermod -a -G video {{.User}}
+fi
+if [ -d /run/systemd/system ]; then
+	systemctl daemon-reload
+	systemctl enable --now gpumon-go.service
+fi
+`))
+
+var preremoveTemplate = template.Must(template.New("preremove").Parse(`#!/bin/sh
+set -e
+if [ -d /run/systemd/system ]; then
+	systemctl disable --now gpumon-go.service || true
+fi
+`))
+
+// nfpmTemplate describes the .deb and .rpm packages for nfpm, referencing the files written
+// next to it.
+var nfpmTemplate = template.Must(template.New("nfpm").Parse(`name: gpumon-go
+arch: {{.Arch}}
+platform: linux
+version: {{.Version}}
+section: admin
+maintainer: gpumon-go maintainers
+description: Reports NVIDIA and AMD GPU metrics to stdout, CloudWatch and other sinks.
+homepage: https://github.com/ethanholz/gpumon-go
+contents:
+  - src: {{.Binary}}
+    dst: {{.BinaryPath}}
+    file_info:
+      mode: 0755
+  - src: gpumon-go.service
+    dst: /usr/lib/systemd/system/gpumon-go.service
+  - src: config.json
+    dst: {{.ConfigPath}}
+    type: config|noreplace
+  - src: gpumon-go.1
+    dst: /usr/share/man/man1/gpumon-go.1
+  - src: gpumon-go.bash
+    dst: /usr/share/bash-completion/completions/gpumon-go
+  - src: _gpumon-go
+    dst: /usr/share/zsh/vendor-completions/_gpumon-go
+  - src: gpumon-go.fish
+    dst: /usr/share/fish/vendor_completions.d/gpumon-go.fish
+scripts:
+  postinstall: postinstall.sh
+  preremove: preremove.sh
+`))
+
+type packageSpec struct {
+	User       string
+	Arch       string
+	Version    string
+	Binary     string
+	BinaryPath string
+	ConfigPath string
+}
+
+// packageCommand implements the package subcommand and returns the exit code. It writes the
+// systemd unit, default config, install scripts, completions, man page and an nfpm config
+// into a directory, from which nfpm builds the .deb and .rpm packages.
+func packageCommand(flags *flag.FlagSet, args []string) int {
+	fs := flag.NewFlagSet("package", flag.ExitOnError)
+	dir := fs.String("dir", "dist/package", "directory to write the package files into")
+	version := fs.String("version", "0.0.0", "package version")
+	arch := fs.String("arch", "amd64", "package architecture, amd64 or arm64")
+	binary := fs.String("binary", "", "agent binary to package, relative to -dir where nfpm runs, ../gpumon-go-linux-<arch> by default")
+	fs.Parse(args)
+	if *binary == "" {
+		*binary = "../gpumon-go-linux-" + *arch
+	}
+
+	spec := packageSpec{
+		User:       packageUser,
+		Arch:       *arch,
+		Version:    strings.TrimPrefix(*version, "v"),
+		Binary:     *binary,
+		BinaryPath: "/usr/bin/gpumon-go",
+		ConfigPath: "/etc/gpumon-go/config.json",
+	}
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatalf("Unable to create %s: %v", *dir, err)
+	}
+	// The packaged config spells out the main defaults so users see where to start
+	defaults := DefaultConfig()
+	cfg, err := json.MarshalIndent(map[string]any{"interval": defaults.Interval, "publishers": defaults.Publishers}, "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to marshal config to JSON: %v", err)
+	}
+	files := []struct {
+		name  string
+		mode  os.FileMode
+		write func(io.Writer) error
+	}{
+		{"gpumon-go.service", 0o644, func(w io.Writer) error { return serviceTemplate.Execute(w, spec) }},
+		{"postinstall.sh", 0o755, func(w io.Writer) error { return postinstallTemplate.Execute(w, spec) }},
+		{"preremove.sh", 0o755, func(w io.Writer) error { return preremoveTemplate.Execute(w, spec) }},
+		{"nfpm.yaml", 0o644, func(w io.Writer) error { return nfpmTemplate.Execute(w, spec) }},
+		{"config.json", 0o644, func(w io.Writer) error { _, err := fmt.Fprintf(w, "%s\n", cfg); return err }},
+		{"gpumon-go.1", 0o644, func(w io.Writer) error { genMan(w, flags); return nil }},
+		{"gpumon-go.bash", 0o644, func(w io.Writer) error { genBash(w, flags); return nil }},
+		{"_gpumon-go", 0o644, func(w io.Writer) error { genZsh(w, flags); return nil }},
+		{"gpumon-go.fish", 0o644, func(w io.Writer) error { genFish(w, flags); return nil }},
+	}
+	for _, file := range files {
+		f, err := os.OpenFile(filepath.Join(*dir, file.name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.mode)
+		if err != nil {
+			log.Fatalf("Unable to create %s: %v", file.name, err)
+		}
+		if err := file.write(f); err != nil {
+			log.Fatalf("Unable to write %s: %v", file.name, err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Unable to write %s: %v", file.name, err)
+		}
+	}
+	return 0
+}
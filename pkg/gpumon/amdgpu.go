@@ -0,0 +1,154 @@
+package gpumon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// amdVendorID is the PCI vendor ID of AMD.
+const amdVendorID = "0x1002"
+
+// drmCardPattern matches the DRM card directories, skipping connectors such as card0-DP-1.
+var drmCardPattern = regexp.MustCompile(`^card(\d+)$`)
+
+// AMDGPUBackend reads AMD GPUs from the amdgpu driver's sysfs files, so it needs neither
+// ROCm nor cgo.
+type AMDGPUBackend struct {
+	sysRoot string
+}
+
+func NewAMDGPUBackend() *AMDGPUBackend {
+	return &AMDGPUBackend{sysRoot: "/sys"}
+}
+
+func (b *AMDGPUBackend) Name() string {
+	return "amdgpu"
+}
+
+// Init reports whether the amdgpu driver is loaded.
+func (b *AMDGPUBackend) Init() (bool, error) {
+	_, err := os.Stat(filepath.Join(b.sysRoot, "module", "amdgpu"))
+	return err == nil, nil
+}
+
+// Devices returns the AMD GPUs in the order of their DRM card numbers. The UUID is the
+// board's unique ID, or its PCI address on boards without one.
+func (b *AMDGPUBackend) Devices() ([]Device, error) {
+	entries, err := os.ReadDir(filepath.Join(b.sysRoot, "class", "drm"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list DRM devices: %v", err)
+	}
+	var cards []int
+	for _, entry := range entries {
+		if match := drmCardPattern.FindStringSubmatch(entry.Name()); match != nil {
+			card, _ := strconv.Atoi(match[1])
+			cards = append(cards, card)
+		}
+	}
+	slices.Sort(cards)
+	var devices []Device
+	for _, card := range cards {
+		dir := filepath.Join(b.sysRoot, "class", "drm", "card"+strconv.Itoa(card), "device")
+		if vendor, _ := readSysfs(dir, "vendor"); vendor != amdVendorID {
+			continue
+		}
+		// Render-only or display-only functions have no busy percent
+		if _, err := readSysfs(dir, "gpu_busy_percent"); err != nil {
+			continue
+		}
+		uuid, err := readSysfs(dir, "unique_id")
+		if err != nil || uuid == "" {
+			target, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				return nil, fmt.Errorf("unable to resolve card%d: %v", card, err)
+			}
+			uuid = filepath.Base(target)
+		}
+		devices = append(devices, Device{Index: len(devices), UUID: "AMD-" + uuid, Sensors: amdgpuSensors{dir: dir}})
+	}
+	return devices, nil
+}
+
+func (b *AMDGPUBackend) Shutdown() error {
+	return nil
+}
+
+// amdgpuSensors reads a card's metrics from its sysfs device directory and hwmon.
+type amdgpuSensors struct {
+	dir string
+}
+
+func (s amdgpuSensors) Name() (string, error) {
+	return readSysfs(s.dir, "product_name")
+}
+
+func (s amdgpuSensors) Temperature() (uint, error) {
+	// temp1 is the edge sensor, in millidegrees
+	millis, err := s.hwmon("temp1_input")
+	if err != nil {
+		return 0, err
+	}
+	return uint(millis / 1000), nil
+}
+
+func (s amdgpuSensors) Power() (float32, error) {
+	// Older boards report the average, newer ones the current power, in microwatts
+	micros, err := s.hwmon("power1_average")
+	if err != nil {
+		micros, err = s.hwmon("power1_input")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return float32(micros) / 1e6, nil
+}
+
+func (s amdgpuSensors) Utilization() (uint, float32, float32, error) {
+	busy, err := readSysfsInt(s.dir, "gpu_busy_percent")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	total, err := readSysfsInt(s.dir, "mem_info_vram_total")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	used, err := readSysfsInt(s.dir, "mem_info_vram_used")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return uint(busy), float32(total) / (1 << 30), float32(used) / (1 << 30), nil
+}
+
+// hwmon reads a value of the card's hardware monitor, whose number is assigned at boot.
+func (s amdgpuSensors) hwmon(name string) (int64, error) {
+	dirs, _ := filepath.Glob(filepath.Join(s.dir, "hwmon", "hwmon*"))
+	if len(dirs) == 0 {
+		return 0, fmt.Errorf("no hwmon found in %s", s.dir)
+	}
+	return readSysfsInt(dirs[0], name)
+}
+
+func readSysfs(dir, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSysfsInt(dir, name string) (int64, error) {
+	value, err := readSysfs(dir, name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s: %v", filepath.Join(dir, name), err)
+	}
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package gpumon
+
+import (
+	"fmt"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// Backend discovers the GPUs of one vendor.
+type Backend interface {
+	Name() string
+	// Init loads the backend and returns false without an error when the host has no driver
+	// for it
+	Init() (bool, error)
+	Devices() ([]Device, error)
+	Shutdown() error
+}
+
+// Backends are tried in order when the backend is selected automatically, except for the
+// simulated one.
+var Backends = []Backend{NVMLBackend{}, NewAMDGPUBackend(), NewSimBackend(2, "")}
+
+// NVMLBackend reads NVIDIA GPUs through NVML.
+type NVMLBackend struct{}
+
+func (NVMLBackend) Name() string {
+	return "nvml"
+}
+
+func (NVMLBackend) Init() (bool, error) {
+	return Init()
+}
+
+func (NVMLBackend) Devices() ([]Device, error) {
+	return GetDevices()
+}
+
+func (NVMLBackend) Shutdown() error {
+	if ret := nvml.Shutdown(); ret != nvml.SUCCESS {
+		return fmt.Errorf("unable to shutdown NVML: %v", nvml.ErrorString(ret))
+	}
+	return nil
+}
+
+// Open initializes the named backend and returns its devices. With "" or "auto" the first
+// backend that finds devices is used. It returns a nil backend when no driver is loaded,
+// callers that got a backend shut it down when done.
+func Open(name string) (Backend, []Device, error) {
+	auto := name == "" || name == "auto"
+	known := auto
+	for _, b := range Backends {
+		if (!auto && b.Name() != name) || (auto && b.Name() == "sim") {
+			continue
+		}
+		known = true
+		loaded, err := b.Init()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !loaded {
+			continue
+		}
+		devices, err := b.Devices()
+		if err != nil {
+			b.Shutdown()
+			return nil, nil, err
+		}
+		if len(devices) == 0 && auto {
+			b.Shutdown()
+			continue
+		}
+		return b, devices, nil
+	}
+	if !known {
+		return nil, nil, fmt.Errorf("unknown backend %q", name)
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,88 @@
+package gpumon
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Reading is the result of collecting one device. Err is set instead of the metrics when the
+// device could not be read.
+type Reading struct {
+	Index     int       `json:"index"`
+	UUID      string    `json:"uuid"`
+	Timestamp time.Time `json:"timestamp"`
+	Metrics
+	Err error `json:"-"`
+}
+
+// Collector reads every device at once. It keeps no schedule of its own, call Collect on
+// whatever schedule the embedding program uses.
+type Collector struct {
+	devices []Device
+}
+
+func NewCollector(devices []Device) *Collector {
+	return &Collector{devices: devices}
+}
+
+// Devices returns the devices read by the collector.
+func (c *Collector) Devices() []Device {
+	return c.devices
+}
+
+// Collect reads the devices in parallel and returns one reading per device in the order of
+// Devices. A failing device does not affect the others.
+func (c *Collector) Collect() []Reading {
+	readings := make([]Reading, len(c.devices))
+	var wg sync.WaitGroup
+	for i, d := range c.devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := Reading{Index: d.Index, UUID: d.UUID, Timestamp: time.Now()}
+			r.Metrics, r.Err = d.GetMetrics()
+			readings[i] = r
+		}()
+	}
+	wg.Wait()
+	return readings
+}
+
+// Publisher sends readings somewhere, e.g. a metrics backend.
+type Publisher interface {
+	Publish(ctx context.Context, readings []Reading) error
+}
+
+// PublisherFunc adapts a function to the Publisher interface.
+type PublisherFunc func(ctx context.Context, readings []Reading) error
+
+func (f PublisherFunc) Publish(ctx context.Context, readings []Reading) error {
+	return f(ctx, readings)
+}
+
+// JSONPublisher writes every successful reading as a line of JSON.
+type JSONPublisher struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONPublisher(w io.Writer) *JSONPublisher {
+	return &JSONPublisher{enc: json.NewEncoder(w)}
+}
+
+func (p *JSONPublisher) Publish(ctx context.Context, readings []Reading) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, r := range readings {
+		if r.Err != nil {
+			continue
+		}
+		if err := p.enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+// Package gpumon reads GPU metrics through NVML. It is the collection core of the gpumon-go
+// agent and can be embedded in other programs, which drive the Collector on their own
+// schedule and hand its readings to a Publisher.
+package gpumon
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// Device is a GPU found by a backend. NVML devices have a Handle, devices of other backends
+// read their metrics through Sensors and report the NVML-only features as unsupported.
+type Device struct {
+	Index   int
+	UUID    string
+	Handle  nvml.Device
+	Sensors Sensors
+}
+
+// Sensors reads the core metrics of a device that is not managed by NVML.
+type Sensors interface {
+	Name() (string, error)
+	Temperature() (uint, error)
+	// Power is in watts
+	Power() (float32, error)
+	// Utilization returns the GPU busy percent and the total and used memory in GiB
+	Utilization() (uint, float32, float32, error)
+}
+
+// errNotSupported is returned by the NVML-only methods of devices without a Handle.
+var errNotSupported = Error(nvml.ERROR_NOT_SUPPORTED)
+
+type Metrics struct {
+	Temperature uint    `json:"temperature"`
+	Power       float32 `json:"power"`
+	GpuUsage    uint    `json:"gpu_usage"`
+	MemoryTotal float32 `json:"memory_total"`
+	MemoryUsed  float32 `json:"memory_used"`
+	// MemoryUsedPercent is MemoryUsed of MemoryTotal, zero when the total is unknown
+	MemoryUsedPercent float32 `json:"memory_used_percent"`
+}
+
+func (m Metrics) String() string {
+	return fmt.Sprintf("%d,%.2f,%d,%.1f,%.2f", m.Temperature, m.Power, m.GpuUsage, m.MemoryTotal, m.MemoryUsed)
+}
+
+// Error keeps the NVML return code so callers can tell e.g. a lost GPU from other failures
+// with errors.Is(err, gpumon.Error(nvml.ERROR_GPU_IS_LOST)).
+type Error nvml.Return
+
+func (e Error) Error() string {
+	return nvml.ErrorString(nvml.Return(e))
+}
+
+// Init loads libnvidia-ml.so at runtime and initializes it. It returns false without an
+// error when the host has no NVIDIA driver, so the same binary runs on hosts without GPUs.
+// Callers that got true shut NVML down with nvml.Shutdown.
+func Init() (bool, error) {
+	ret := nvml.Init()
+	switch ret {
+	case nvml.SUCCESS:
+		return true, nil
+	case nvml.ERROR_LIBRARY_NOT_FOUND, nvml.ERROR_DRIVER_NOT_LOADED:
+		return false, nil
+	}
+	return false, fmt.Errorf("unable to initialize NVML: %v", nvml.ErrorString(ret))
+}
+
+func GetDevice(index int) (Device, error) {
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return Device{}, fmt.Errorf("unable to get device count: %v", nvml.ErrorString(ret))
+	}
+	if index < 0 || index >= count {
+		return Device{}, fmt.Errorf("device index %d out of range", index)
+	}
+	device, ret := nvml.DeviceGetHandleByIndex(index)
+	if ret != nvml.SUCCESS {
+		return Device{}, fmt.Errorf("unable to get device at index %d: %v", index, nvml.ErrorString(ret))
+	}
+	uuid, ret := device.GetUUID()
+	if ret != nvml.SUCCESS {
+		return Device{}, fmt.Errorf("unable to get uuid of device at index %d: %v", index, nvml.ErrorString(ret))
+	}
+	return Device{Index: index, UUID: uuid, Handle: device}, nil
+}
+
+func GetDevices() ([]Device, error) {
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("unable to get device count: %v", nvml.ErrorString(ret))
+	}
+	devices := make([]Device, 0, count)
+	for i := 0; i < count; i++ {
+		device, err := GetDevice(i)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// HandleWrapper is implemented by handles that decorate an NVML device, e.g. to time its
+// calls. Rewrap returns the same decoration around another handle.
+type HandleWrapper interface {
+	nvml.Device
+	Rewrap(nvml.Device) nvml.Device
+}
+
+// Reacquire looks the device handle up again by UUID, e.g. after a suspend invalidated it, and
+// initializes NVML again if the driver was unloaded meanwhile. A wrapped handle stays wrapped.
+func (d *Device) Reacquire() error {
+	if d.Handle == nil {
+		return nil
+	}
+	handle, ret := nvml.DeviceGetHandleByUUID(d.UUID)
+	if ret == nvml.ERROR_UNINITIALIZED {
+		if ret = nvml.Init(); ret != nvml.SUCCESS {
+			return fmt.Errorf("unable to initialize NVML: %v", nvml.ErrorString(ret))
+		}
+		handle, ret = nvml.DeviceGetHandleByUUID(d.UUID)
+	}
+	if ret != nvml.SUCCESS {
+		return fmt.Errorf("unable to get device %s: %v", d.UUID, nvml.ErrorString(ret))
+	}
+	if wrapper, ok := d.Handle.(HandleWrapper); ok {
+		d.Handle = wrapper.Rewrap(handle)
+		return nil
+	}
+	d.Handle = handle
+	return nil
+}
+
+func (d Device) GetTemperature() (uint, error) {
+	if d.Sensors != nil {
+		return d.Sensors.Temperature()
+	}
+	temp, ret := d.Handle.GetTemperature(nvml.TEMPERATURE_GPU)
+	if ret != nvml.SUCCESS {
+		return 0, Error(ret)
+	}
+	return uint(temp), nil
+}
+
+func (d Device) GetPower() (float32, error) {
+	if d.Sensors != nil {
+		return d.Sensors.Power()
+	}
+	power, ret := d.Handle.GetPowerUsage()
+	if ret != nvml.SUCCESS {
+		return 0, Error(ret)
+	}
+	actual := float32(power) / 1000.0
+	return actual, nil
+}
+
+// GetPowerLimit returns the power management limit in watts.
+func (d Device) GetPowerLimit() (float64, error) {
+	if d.Handle == nil {
+		return 0, errNotSupported
+	}
+	limit, ret := d.Handle.GetPowerManagementLimit()
+	if ret != nvml.SUCCESS {
+		return 0, Error(ret)
+	}
+	return float64(limit) / 1000, nil
+}
+
+// GetDefaultPowerLimit returns the board's default power management limit in watts.
+func (d Device) GetDefaultPowerLimit() (float64, error) {
+	if d.Handle == nil {
+		return 0, errNotSupported
+	}
+	limit, ret := d.Handle.GetPowerManagementDefaultLimit()
+	if ret != nvml.SUCCESS {
+		return 0, Error(ret)
+	}
+	return float64(limit) / 1000, nil
+}
+
+// SetPowerLimit sets the power management limit in watts, which needs root.
+func (d Device) SetPowerLimit(watts float64) error {
+	if d.Handle == nil {
+		return errNotSupported
+	}
+	if ret := d.Handle.SetPowerManagementLimit(uint32(watts * 1000)); ret != nvml.SUCCESS {
+		return Error(ret)
+	}
+	return nil
+}
+
+func (d Device) GetUtilization() (uint, float32, float32, error) {
+	if d.Sensors != nil {
+		return d.Sensors.Utilization()
+	}
+	memory, ret := d.Handle.GetMemoryInfo()
+	if ret != nvml.SUCCESS {
+		return 0, 0.0, 0.0, Error(ret)
+	}
+	total := float32(memory.Total) / (1 << 30)
+	used := float32(memory.Used) / (1 << 30)
+
+	util, ret := d.Handle.GetUtilizationRates()
+	if ret == nvml.ERROR_NOT_SUPPORTED && d.MigEnabled() {
+		// Whole-GPU utilization is not available in MIG mode, only per slice
+		return 0, total, used, nil
+	}
+	if ret != nvml.SUCCESS {
+		return 0, 0.0, 0.0, Error(ret)
+	}
+	return uint(util.Gpu), total, used, nil
+}
+
+// GetPcieThroughput returns the PCIe receive and transmit rates in bytes per second.
+func (d Device) GetPcieThroughput() (float64, float64, error) {
+	if d.Handle == nil {
+		return 0, 0, errNotSupported
+	}
+	rx, ret := d.Handle.GetPcieThroughput(nvml.PCIE_UTIL_RX_BYTES)
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	tx, ret := d.Handle.GetPcieThroughput(nvml.PCIE_UTIL_TX_BYTES)
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	// NVML reports KB/s
+	return float64(rx) * 1024, float64(tx) * 1024, nil
+}
+
+// GetProcessIDs returns the PIDs of the compute and graphics processes using the device.
+func (d Device) GetProcessIDs() ([]uint32, error) {
+	if d.Handle == nil {
+		return nil, errNotSupported
+	}
+	compute, ret := d.Handle.GetComputeRunningProcesses()
+	if ret != nvml.SUCCESS {
+		return nil, Error(ret)
+	}
+	graphics, ret := d.Handle.GetGraphicsRunningProcesses()
+	if ret != nvml.SUCCESS && ret != nvml.ERROR_NOT_SUPPORTED {
+		return nil, Error(ret)
+	}
+	pids := make([]uint32, 0, len(compute)+len(graphics))
+	for _, p := range append(compute, graphics...) {
+		pids = append(pids, p.Pid)
+	}
+	return pids, nil
+}
+
+// GetComputeProcessCount returns how many processes hold a compute context on the device.
+// It is cheaper than GetProcesses, which also looks up names and memory.
+func (d Device) GetComputeProcessCount() (int, error) {
+	if d.Handle == nil {
+		return 0, errNotSupported
+	}
+	compute, ret := d.Handle.GetComputeRunningProcesses()
+	if ret != nvml.SUCCESS {
+		return 0, Error(ret)
+	}
+	return len(compute), nil
+}
+
+// Process is a process using the device. Name is its command name, empty when it exited.
+// MemoryUsed is in GiB, zero when the driver does not report it, e.g. inside a container.
+type Process struct {
+	PID        uint32
+	Name       string
+	MemoryUsed float32
+}
+
+// GetProcesses returns the compute and graphics processes using the device.
+func (d Device) GetProcesses() ([]Process, error) {
+	if d.Handle == nil {
+		return nil, errNotSupported
+	}
+	compute, ret := d.Handle.GetComputeRunningProcesses()
+	if ret != nvml.SUCCESS {
+		return nil, Error(ret)
+	}
+	graphics, ret := d.Handle.GetGraphicsRunningProcesses()
+	if ret != nvml.SUCCESS && ret != nvml.ERROR_NOT_SUPPORTED {
+		return nil, Error(ret)
+	}
+	processes := make([]Process, 0, len(compute)+len(graphics))
+	for _, p := range append(compute, graphics...) {
+		process := Process{PID: p.Pid, Name: processName(p.Pid)}
+		if p.UsedGpuMemory != uint64(math.MaxUint64) {
+			process.MemoryUsed = float32(p.UsedGpuMemory) / (1 << 30)
+		}
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+// GetProcessUtilization returns the SM utilization percent of each process from the latest
+// sample NVML took after since. Processes without a sample since then are missing.
+func (d Device) GetProcessUtilization(since time.Time) (map[uint32]uint, error) {
+	if d.Handle == nil {
+		return nil, errNotSupported
+	}
+	var lastSeen uint64
+	if !since.IsZero() {
+		lastSeen = uint64(since.UnixMicro())
+	}
+	samples, ret := d.Handle.GetProcessUtilization(lastSeen)
+	if ret == nvml.ERROR_NOT_FOUND {
+		return nil, nil
+	}
+	if ret != nvml.SUCCESS {
+		return nil, Error(ret)
+	}
+	utilization := make(map[uint32]uint, len(samples))
+	latest := make(map[uint32]uint64, len(samples))
+	for _, s := range samples {
+		if s.TimeStamp >= latest[s.Pid] {
+			latest[s.Pid] = s.TimeStamp
+			utilization[s.Pid] = uint(s.SmUtil)
+		}
+	}
+	return utilization, nil
+}
+
+// processName returns the command name of a process, "" when it exited.
+func processName(pid uint32) string {
+	comm, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(int(pid)), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+func (d Device) GetMetrics() (Metrics, error) {
+	temp, err := d.GetTemperature()
+	if err != nil {
+		return Metrics{}, err
+	}
+	power, err := d.GetPower()
+	if err != nil {
+		return Metrics{}, err
+	}
+	gpu, totalMemory, usedMemory, err := d.GetUtilization()
+	if err != nil {
+		return Metrics{}, err
+	}
+	m := Metrics{Temperature: temp, Power: power, GpuUsage: gpu, MemoryTotal: totalMemory, MemoryUsed: usedMemory}
+	if totalMemory > 0 {
+		m.MemoryUsedPercent = usedMemory / totalMemory * 100
+	}
+	return m, nil
+}
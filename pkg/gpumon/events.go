@@ -0,0 +1,155 @@
+package gpumon
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// Types of the events an EventWatcher reports.
+const (
+	EventXid               = "xid"
+	EventDoubleBitECC      = "double_bit_ecc"
+	EventSingleBitECC      = "single_bit_ecc"
+	EventPowerSourceChange = "power_source_change"
+	// EventSlowdown is reported when the thermal or power slowdowns throttling the clocks
+	// change, and EventSlowdownCleared once none is active any more
+	EventSlowdown        = "slowdown"
+	EventSlowdownCleared = "slowdown_cleared"
+)
+
+// watchedEvents are the NVML event types an EventWatcher registers for. Clock changes are
+// only reported when they change the active slowdowns.
+const watchedEvents = nvml.EventTypeXidCriticalError | nvml.EventTypeDoubleBitEccError |
+	nvml.EventTypeSingleBitEccError | nvml.EventTypePowerSourceChange | nvml.EventTypeClock
+
+// slowdownReasons are the clock event reasons reported as slowdowns, by name.
+var slowdownReasons = []struct {
+	mask uint64
+	name string
+}{
+	{nvml.ClocksThrottleReasonHwSlowdown, "hw_slowdown"},
+	{nvml.ClocksThrottleReasonHwThermalSlowdown, "hw_thermal_slowdown"},
+	{nvml.ClocksThrottleReasonHwPowerBrakeSlowdown, "hw_power_brake_slowdown"},
+	{nvml.ClocksEventReasonSwThermalSlowdown, "sw_thermal_slowdown"},
+}
+
+// Event is a critical event of a device. Index is -1 for Xid errors NVML does not attribute
+// to a device.
+type Event struct {
+	Index int
+	UUID  string
+	Type  string
+	// Xid is the error code of xid events
+	Xid uint64
+	// Reasons are the active slowdowns of slowdown events
+	Reasons []string
+}
+
+// EventWatcher receives NVML event notifications, e.g. Xid errors, instead of polling for
+// them. It is not safe for concurrent use.
+type EventWatcher struct {
+	set     nvml.EventSet
+	devices map[string]Device
+	// slowdowns are the active slowdown reasons of every device, by UUID
+	slowdowns map[string]uint64
+}
+
+func NewEventWatcher() (*EventWatcher, error) {
+	set, ret := nvml.EventSetCreate()
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("unable to create event set: %v", nvml.ErrorString(ret))
+	}
+	return &EventWatcher{set: set, devices: make(map[string]Device), slowdowns: make(map[string]uint64)}, nil
+}
+
+// Register watches the events the device supports. It returns an error that matches
+// ERROR_NOT_SUPPORTED when the device supports none of them.
+func (w *EventWatcher) Register(d Device) error {
+	if d.Handle == nil {
+		return errNotSupported
+	}
+	supported, ret := d.Handle.GetSupportedEventTypes()
+	if ret != nvml.SUCCESS {
+		return Error(ret)
+	}
+	types := supported & watchedEvents
+	if types == 0 {
+		return errNotSupported
+	}
+	if ret := d.Handle.RegisterEvents(types, w.set); ret != nvml.SUCCESS {
+		return Error(ret)
+	}
+	w.devices[d.UUID] = d
+	return nil
+}
+
+// Wait waits up to timeout for the next event and returns false when there was none.
+func (w *EventWatcher) Wait(timeout time.Duration) (Event, bool, error) {
+	data, ret := w.set.Wait(uint32(timeout.Milliseconds()))
+	if ret == nvml.ERROR_TIMEOUT {
+		return Event{}, false, nil
+	}
+	if ret != nvml.SUCCESS {
+		return Event{}, false, Error(ret)
+	}
+	e := Event{Index: -1}
+	var d Device
+	if data.Device != nil {
+		uuid, _ := data.Device.GetUUID()
+		d = w.devices[uuid]
+		e.Index, e.UUID = d.Index, d.UUID
+	}
+	switch data.EventType {
+	case nvml.EventTypeXidCriticalError:
+		e.Type, e.Xid = EventXid, data.EventData
+	case nvml.EventTypeDoubleBitEccError:
+		e.Type = EventDoubleBitECC
+	case nvml.EventTypeSingleBitEccError:
+		e.Type = EventSingleBitECC
+	case nvml.EventTypePowerSourceChange:
+		e.Type = EventPowerSourceChange
+	case nvml.EventTypeClock:
+		if d.Handle == nil {
+			return Event{}, false, nil
+		}
+		return w.slowdown(d)
+	default:
+		return Event{}, false, nil
+	}
+	return e, true, nil
+}
+
+// slowdown reports the device's slowdowns if they changed since the last clock event.
+func (w *EventWatcher) slowdown(d Device) (Event, bool, error) {
+	reasons, ret := d.Handle.GetCurrentClocksEventReasons()
+	if ret != nvml.SUCCESS {
+		return Event{}, false, Error(ret)
+	}
+	var active uint64
+	var names []string
+	for _, r := range slowdownReasons {
+		if reasons&r.mask != 0 {
+			active |= r.mask
+			names = append(names, r.name)
+		}
+	}
+	if active == w.slowdowns[d.UUID] {
+		return Event{}, false, nil
+	}
+	w.slowdowns[d.UUID] = active
+	e := Event{Index: d.Index, UUID: d.UUID, Type: EventSlowdown, Reasons: names}
+	if active == 0 {
+		e.Type = EventSlowdownCleared
+	}
+	return e, true, nil
+}
+
+// Close frees the event set.
+func (w *EventWatcher) Close() error {
+	if ret := w.set.Free(); ret != nvml.SUCCESS {
+		return Error(ret)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package gpumon
+
+import (
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// ExtendedOptions selects the extended metrics to read. Some of the queries are slow or not
+// supported by every board, so each group is enabled on its own.
+type ExtendedOptions struct {
+	Clocks  bool `json:"clocks"`
+	Fan     bool `json:"fan"`
+	PCIe    bool `json:"pcie"`
+	ECC     bool `json:"ecc"`
+	Encoder bool `json:"encoder"`
+	// Throttle reads the performance state and the reasons the clocks are held down
+	Throttle bool `json:"throttle"`
+	// Display reads whether a display is attached and if the GPU is used for graphics
+	Display bool `json:"display"`
+}
+
+// ExtendedMetrics are the NVML metrics beyond the core set. Fields are nil when their group
+// is disabled or the device does not support it.
+type ExtendedMetrics struct {
+	// Clocks are in MHz
+	SMClock     *uint32 `json:"sm_clock,omitempty"`
+	MemoryClock *uint32 `json:"memory_clock,omitempty"`
+	// FanSpeed is the percent of the maximum speed of the first fan
+	FanSpeed *uint32 `json:"fan_speed,omitempty"`
+	// PCIe throughput is in bytes per second
+	PcieRx       *float64   `json:"pcie_rx_bytes_per_second,omitempty"`
+	PcieTx       *float64   `json:"pcie_tx_bytes_per_second,omitempty"`
+	ECC          *ECCErrors `json:"ecc,omitempty"`
+	EncoderUsage *uint32    `json:"encoder_usage,omitempty"`
+	DecoderUsage *uint32    `json:"decoder_usage,omitempty"`
+	// EncoderStats are read with the encoder group, on boards that report encoder sessions
+	EncoderStats *EncoderStats `json:"encoder_stats,omitempty"`
+	// PState is the performance state, from 0 for maximum performance to 15 for minimum
+	PState *int `json:"pstate,omitempty"`
+	// ThrottleMask is the NVML bitmask of the active clock throttle reasons, and
+	// ThrottleReasons are their names
+	ThrottleMask    *uint64  `json:"throttle_mask,omitempty"`
+	ThrottleReasons []string `json:"throttle_reasons,omitempty"`
+	Display         *Display `json:"display,omitempty"`
+}
+
+// ThrottleReasonNames are the names of the clock throttle reasons, in the order of their bits.
+var ThrottleReasonNames = []string{
+	"gpu_idle", "applications_clocks_setting", "sw_power_cap", "hw_slowdown", "sync_boost",
+	"sw_thermal_slowdown", "hw_thermal_slowdown", "hw_power_brake_slowdown", "display_clock_setting",
+}
+
+// ThrottleReasons returns the names of the reasons set in an NVML throttle reasons bitmask.
+func ThrottleReasons(mask uint64) []string {
+	var names []string
+	for i, name := range ThrottleReasonNames {
+		if mask&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ECCErrors are the device memory error counts since the driver loaded (volatile) and over
+// the lifetime of the board (aggregate).
+type ECCErrors struct {
+	VolatileCorrected    uint64 `json:"volatile_corrected"`
+	VolatileUncorrected  uint64 `json:"volatile_uncorrected"`
+	AggregateCorrected   uint64 `json:"aggregate_corrected"`
+	AggregateUncorrected uint64 `json:"aggregate_uncorrected"`
+}
+
+// GetClocks returns the current SM and memory clocks in MHz.
+func (d Device) GetClocks() (uint32, uint32, error) {
+	if d.Handle == nil {
+		return 0, 0, errNotSupported
+	}
+	sm, ret := d.Handle.GetClockInfo(nvml.CLOCK_SM)
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	mem, ret := d.Handle.GetClockInfo(nvml.CLOCK_MEM)
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	return sm, mem, nil
+}
+
+// GetFanSpeed returns the speed of the first fan in percent of its maximum.
+func (d Device) GetFanSpeed() (uint32, error) {
+	if d.Handle == nil {
+		return 0, errNotSupported
+	}
+	speed, ret := d.Handle.GetFanSpeed()
+	if ret != nvml.SUCCESS {
+		return 0, Error(ret)
+	}
+	return speed, nil
+}
+
+// GetECCErrors returns the corrected and uncorrected memory error counts.
+func (d Device) GetECCErrors() (ECCErrors, error) {
+	if d.Handle == nil {
+		return ECCErrors{}, errNotSupported
+	}
+	var errs ECCErrors
+	counters := []struct {
+		count   *uint64
+		errType nvml.MemoryErrorType
+		counter nvml.EccCounterType
+	}{
+		{&errs.VolatileCorrected, nvml.MEMORY_ERROR_TYPE_CORRECTED, nvml.VOLATILE_ECC},
+		{&errs.VolatileUncorrected, nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.VOLATILE_ECC},
+		{&errs.AggregateCorrected, nvml.MEMORY_ERROR_TYPE_CORRECTED, nvml.AGGREGATE_ECC},
+		{&errs.AggregateUncorrected, nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.AGGREGATE_ECC},
+	}
+	for _, c := range counters {
+		count, ret := d.Handle.GetTotalEccErrors(c.errType, c.counter)
+		if ret != nvml.SUCCESS {
+			return ECCErrors{}, Error(ret)
+		}
+		*c.count = count
+	}
+	return errs, nil
+}
+
+// GetCodecUtilization returns the encoder and decoder utilization in percent.
+func (d Device) GetCodecUtilization() (uint32, uint32, error) {
+	if d.Handle == nil {
+		return 0, 0, errNotSupported
+	}
+	encoder, _, ret := d.Handle.GetEncoderUtilization()
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	decoder, _, ret := d.Handle.GetDecoderUtilization()
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	return encoder, decoder, nil
+}
+
+// EncoderStats are the active encoder sessions of a device and their average frame rate and
+// latency. The averages are zero without sessions.
+type EncoderStats struct {
+	Sessions int    `json:"sessions"`
+	FPS      uint32 `json:"average_fps"`
+	// Latency is in microseconds
+	Latency uint32 `json:"average_latency_us"`
+}
+
+// GetEncoderStats returns the encoder session count, average FPS and latency of all sessions.
+func (d Device) GetEncoderStats() (EncoderStats, error) {
+	if d.Handle == nil {
+		return EncoderStats{}, errNotSupported
+	}
+	sessions, fps, latency, ret := d.Handle.GetEncoderStats()
+	if ret != nvml.SUCCESS {
+		return EncoderStats{}, Error(ret)
+	}
+	return EncoderStats{Sessions: sessions, FPS: fps, Latency: latency}, nil
+}
+
+// Display tells workstation and VDI GPUs, which drive displays, from compute GPUs.
+type Display struct {
+	// Attached is true when a display is connected to one of the device's outputs
+	Attached bool `json:"attached"`
+	// Active is true when a display is initialized on the device, even a virtual one
+	Active bool `json:"active"`
+	// DriverModel is wddm, tcc or unknown for a newer model, only Windows drivers report it
+	DriverModel string `json:"driver_model,omitempty"`
+	// Mode is graphics or compute
+	Mode string `json:"mode"`
+}
+
+// GetDisplay returns the display state of the device. The mode follows the driver model where
+// it is wddm or tcc, elsewhere a device with an active display is in graphics use. A field
+// that cannot be read is left false, only when neither display query works is it an error.
+func (d Device) GetDisplay() (Display, error) {
+	if d.Handle == nil {
+		return Display{}, errNotSupported
+	}
+	attached, attachedRet := d.Handle.GetDisplayMode()
+	active, activeRet := d.Handle.GetDisplayActive()
+	if attachedRet != nvml.SUCCESS && activeRet != nvml.SUCCESS {
+		return Display{}, Error(attachedRet)
+	}
+	display := Display{
+		Attached: attachedRet == nvml.SUCCESS && attached == nvml.FEATURE_ENABLED,
+		Active:   activeRet == nvml.SUCCESS && active == nvml.FEATURE_ENABLED,
+		Mode:     "compute",
+	}
+	model, _, ret := d.Handle.GetDriverModel()
+	switch {
+	case ret == nvml.SUCCESS && model == nvml.DRIVER_WDDM:
+		display.DriverModel, display.Mode = "wddm", "graphics"
+	case ret == nvml.SUCCESS && model == nvml.DRIVER_WDM:
+		// WDM is what NVML calls the TCC driver model
+		display.DriverModel = "tcc"
+	default:
+		if ret == nvml.SUCCESS {
+			display.DriverModel = "unknown"
+		}
+		if display.Active {
+			display.Mode = "graphics"
+		}
+	}
+	return display, nil
+}
+
+// GetPerformanceState returns the performance state and the bitmask of the reasons the clocks
+// are throttled.
+func (d Device) GetPerformanceState() (int, uint64, error) {
+	if d.Handle == nil {
+		return 0, 0, errNotSupported
+	}
+	pstate, ret := d.Handle.GetPerformanceState()
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	if pstate == nvml.PSTATE_UNKNOWN {
+		return 0, 0, errNotSupported
+	}
+	reasons, ret := d.Handle.GetCurrentClocksEventReasons()
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	return int(pstate), reasons, nil
+}
+
+// GetExtendedMetrics reads the selected groups. A group the device does not support is left
+// out, the first other failure is returned next to the groups read successfully.
+func (d Device) GetExtendedMetrics(opts ExtendedOptions) (ExtendedMetrics, error) {
+	var m ExtendedMetrics
+	var first error
+	check := func(err error) bool {
+		if err == nil {
+			return true
+		}
+		if err != errNotSupported && first == nil {
+			first = err
+		}
+		return false
+	}
+	if opts.Clocks {
+		sm, mem, err := d.GetClocks()
+		if check(err) {
+			m.SMClock, m.MemoryClock = &sm, &mem
+		}
+	}
+	if opts.Fan {
+		speed, err := d.GetFanSpeed()
+		if check(err) {
+			m.FanSpeed = &speed
+		}
+	}
+	if opts.PCIe {
+		rx, tx, err := d.GetPcieThroughput()
+		if check(err) {
+			m.PcieRx, m.PcieTx = &rx, &tx
+		}
+	}
+	if opts.ECC {
+		errs, err := d.GetECCErrors()
+		if check(err) {
+			m.ECC = &errs
+		}
+	}
+	if opts.Encoder {
+		encoder, decoder, err := d.GetCodecUtilization()
+		if check(err) {
+			m.EncoderUsage, m.DecoderUsage = &encoder, &decoder
+		}
+		stats, err := d.GetEncoderStats()
+		if check(err) {
+			m.EncoderStats = &stats
+		}
+	}
+	if opts.Throttle {
+		pstate, reasons, err := d.GetPerformanceState()
+		if check(err) {
+			m.PState, m.ThrottleMask = &pstate, &reasons
+			m.ThrottleReasons = ThrottleReasons(reasons)
+		}
+	}
+	if opts.Display {
+		display, err := d.GetDisplay()
+		if check(err) {
+			m.Display = &display
+		}
+	}
+	return m, first
+}
@@ -0,0 +1,130 @@
+package gpumon
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// MigDevice is a slice of a GPU in MIG mode, a compute instance within a GPU instance.
+type MigDevice struct {
+	GPUInstanceID     int
+	ComputeInstanceID int
+	UUID              string
+	// Profile is the profile the slice was created with, e.g. 1g.10gb
+	Profile string
+	Handle  nvml.Device
+}
+
+// MigEnabled reports whether MIG mode is currently enabled on the device.
+func (d Device) MigEnabled() bool {
+	if d.Handle == nil {
+		return false
+	}
+	current, _, ret := d.Handle.GetMigMode()
+	return ret == nvml.SUCCESS && current == nvml.DEVICE_MIG_ENABLE
+}
+
+// GetMigDevices returns the MIG devices of the GPU, none when MIG mode is disabled.
+func (d Device) GetMigDevices() ([]MigDevice, error) {
+	if !d.MigEnabled() {
+		return nil, nil
+	}
+	count, ret := d.Handle.GetMaxMigDeviceCount()
+	if ret != nvml.SUCCESS {
+		return nil, Error(ret)
+	}
+	var devices []MigDevice
+	for i := 0; i < count; i++ {
+		handle, ret := d.Handle.GetMigDeviceHandleByIndex(i)
+		if ret == nvml.ERROR_NOT_FOUND {
+			// Slots without a compute instance
+			continue
+		}
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("unable to get MIG device %d: %v", i, nvml.ErrorString(ret))
+		}
+		m := MigDevice{Handle: handle}
+		if m.GPUInstanceID, ret = handle.GetGpuInstanceId(); ret != nvml.SUCCESS {
+			return nil, Error(ret)
+		}
+		if m.ComputeInstanceID, ret = handle.GetComputeInstanceId(); ret != nvml.SUCCESS {
+			return nil, Error(ret)
+		}
+		if m.UUID, ret = handle.GetUUID(); ret != nvml.SUCCESS {
+			return nil, Error(ret)
+		}
+		name, _ := handle.GetName()
+		m.Profile = migProfile(name)
+		devices = append(devices, m)
+	}
+	return devices, nil
+}
+
+// migProfile takes the profile from a MIG device name such as
+// "NVIDIA A100-SXM4-40GB MIG 1g.5gb", "" when the name has none.
+func migProfile(name string) string {
+	_, profile, _ := strings.Cut(name, "MIG ")
+	return profile
+}
+
+// GetMemory returns the total and used memory of the slice in GiB.
+func (m MigDevice) GetMemory() (float32, float32, error) {
+	memory, ret := m.Handle.GetMemoryInfo()
+	if ret != nvml.SUCCESS {
+		return 0, 0, Error(ret)
+	}
+	return float32(memory.Total) / (1 << 30), float32(memory.Used) / (1 << 30), nil
+}
+
+// MigUtilization measures the SM utilization of the GPU instances of a device through GPM,
+// which needs Hopper or newer. It keeps the previous sample of every GPU instance, so an
+// instance is only measured from the second call on.
+type MigUtilization struct {
+	samples map[int]nvml.GpmSample
+}
+
+func NewMigUtilization() *MigUtilization {
+	return &MigUtilization{samples: make(map[int]nvml.GpmSample)}
+}
+
+// Measure returns the SM utilization percent of each of the GPU instances since the previous
+// call.
+func (u *MigUtilization) Measure(d Device, gpuInstanceIDs []int) (map[int]float64, error) {
+	// Instances destroyed since the previous call
+	for id, sample := range u.samples {
+		if !slices.Contains(gpuInstanceIDs, id) {
+			sample.Free()
+			delete(u.samples, id)
+		}
+	}
+	utilization := make(map[int]float64, len(gpuInstanceIDs))
+	for _, id := range gpuInstanceIDs {
+		sample, ret := nvml.GpmSampleAlloc()
+		if ret != nvml.SUCCESS {
+			return nil, Error(ret)
+		}
+		if ret := d.Handle.GpmMigSampleGet(id, sample); ret != nvml.SUCCESS {
+			sample.Free()
+			return nil, Error(ret)
+		}
+		prev, ok := u.samples[id]
+		u.samples[id] = sample
+		if !ok {
+			continue
+		}
+		metrics := nvml.GpmMetricsGetType{NumMetrics: 1, Sample1: prev, Sample2: sample}
+		metrics.Metrics[0].MetricId = uint32(nvml.GPM_METRIC_SM_UTIL)
+		ret = nvml.GpmMetricsGet(&metrics)
+		prev.Free()
+		if ret != nvml.SUCCESS {
+			return nil, Error(ret)
+		}
+		if metrics.Metrics[0].NvmlReturn == uint32(nvml.SUCCESS) {
+			utilization[id] = metrics.Metrics[0].Value
+		}
+	}
+	return utilization, nil
+}
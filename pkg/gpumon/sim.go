@@ -0,0 +1,77 @@
+package gpumon
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// simPeriod is how long the simulated load takes to go from idle to busy and back.
+const simPeriod = time.Minute
+
+// SimBackend simulates GPUs under a load that rises and falls, for testing exporters without
+// hardware. It is never picked automatically, only by its name "sim".
+type SimBackend struct {
+	// Count is the number of devices
+	Count int
+	// ID is part of the UUIDs, so separate runs report separate devices
+	ID    string
+	start time.Time
+}
+
+func NewSimBackend(count int, id string) *SimBackend {
+	return &SimBackend{Count: count, ID: id, start: time.Now()}
+}
+
+func (b *SimBackend) Name() string {
+	return "sim"
+}
+
+func (b *SimBackend) Init() (bool, error) {
+	return true, nil
+}
+
+// Devices returns the simulated devices, each a phase apart in the load.
+func (b *SimBackend) Devices() ([]Device, error) {
+	devices := make([]Device, 0, b.Count)
+	for i := 0; i < b.Count; i++ {
+		uuid := fmt.Sprintf("SIM-%d", i)
+		if b.ID != "" {
+			uuid = fmt.Sprintf("SIM-%s-%d", b.ID, i)
+		}
+		devices = append(devices, Device{Index: i, UUID: uuid, Sensors: simSensors{start: b.start, phase: float64(i)}})
+	}
+	return devices, nil
+}
+
+func (b *SimBackend) Shutdown() error {
+	return nil
+}
+
+// simSensors derive every metric from the utilization, so they stay consistent.
+type simSensors struct {
+	start time.Time
+	phase float64
+}
+
+func (s simSensors) usage() float64 {
+	angle := 2*math.Pi*time.Since(s.start).Seconds()/simPeriod.Seconds() + s.phase
+	return math.Round(50 + 50*math.Sin(angle))
+}
+
+func (s simSensors) Name() (string, error) {
+	return "Simulated GPU", nil
+}
+
+func (s simSensors) Temperature() (uint, error) {
+	return uint(35 + s.usage()/2), nil
+}
+
+func (s simSensors) Power() (float32, error) {
+	return float32(60 + 3.4*s.usage()), nil
+}
+
+func (s simSensors) Utilization() (uint, float32, float32, error) {
+	usage := s.usage()
+	return uint(usage), 80, float32(80 * 0.9 * usage / 100), nil
+}
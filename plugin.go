@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const (
+	defaultPluginTimeout     = 100 * time.Millisecond
+	defaultPluginMemoryLimit = 64
+)
+
+// Plugin runs a sandboxed WASM module over every emitted record. The module exports its
+// memory and two functions:
+//
+//	gpumon_alloc(size u32) -> u32             returns a buffer for the JSON record
+//	gpumon_process(ptr u32, len u32) -> u64   returns the output as ptr<<32 | len
+//
+// A zero output length drops the record. The module only sees the host through WASI with
+// stdout and stderr redirected to stderr and the directories mounted in its config.
+type Plugin struct {
+	mu       sync.Mutex
+	path     string
+	timeout  time.Duration
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	config   wazero.ModuleConfig
+	module   api.Module
+	alloc    api.Function
+	process  api.Function
+}
+
+func LoadPlugin(cfg PluginConfig) (*Plugin, error) {
+	ctx := context.Background()
+	wasm, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read plugin: %v", err)
+	}
+	memoryLimit := cfg.MemoryLimit
+	if memoryLimit == 0 {
+		memoryLimit = defaultPluginMemoryLimit
+	}
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultPluginTimeout
+	}
+
+	// Closing on context cancellation is what enforces the per-record timeout
+	runtimeConfig := wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(uint32(memoryLimit) * 16)
+	runtime := wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("unable to instantiate WASI: %v", err)
+	}
+	compiled, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("unable to compile plugin %s: %v", cfg.Path, err)
+	}
+
+	fsConfig := wazero.NewFSConfig()
+	for guest, host := range cfg.Mounts {
+		fsConfig = fsConfig.WithDirMount(host, guest)
+	}
+	// Reactor modules built by TinyGo or Rust need _initialize, _start would run a command's main
+	moduleConfig := wazero.NewModuleConfig().
+		WithStartFunctions("_initialize").
+		WithStdout(os.Stderr).
+		WithStderr(os.Stderr).
+		WithFSConfig(fsConfig).
+		WithSysWalltime().
+		WithSysNanotime()
+
+	p := &Plugin{path: cfg.Path, timeout: timeout, runtime: runtime, compiled: compiled, config: moduleConfig}
+	if err := p.instantiate(ctx); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Plugin) instantiate(ctx context.Context) error {
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, p.config)
+	if err != nil {
+		return fmt.Errorf("unable to instantiate plugin %s: %v", p.path, err)
+	}
+	alloc := module.ExportedFunction("gpumon_alloc")
+	process := module.ExportedFunction("gpumon_process")
+	if alloc == nil || process == nil || module.Memory() == nil {
+		module.Close(ctx)
+		return fmt.Errorf("plugin %s must export memory, gpumon_alloc and gpumon_process", p.path)
+	}
+	p.module, p.alloc, p.process = module, alloc, process
+	return nil
+}
+
+// Process passes a JSON record through the plugin and returns nil when the plugin drops it.
+// After a failure or timeout the module is instantiated again on the next call.
+func (p *Plugin) Process(data []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.module == nil {
+		if err := p.instantiate(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	out, err := p.call(ctx, data)
+	if err != nil {
+		p.module.Close(context.Background())
+		p.module = nil
+		return nil, fmt.Errorf("plugin %s: %v", p.path, err)
+	}
+	return out, nil
+}
+
+func (p *Plugin) call(ctx context.Context, data []byte) ([]byte, error) {
+	res, err := p.alloc.Call(ctx, uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !p.module.Memory().Write(ptr, data) {
+		return nil, fmt.Errorf("gpumon_alloc returned an out of range buffer")
+	}
+	res, err = p.process.Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	if outLen == 0 {
+		return nil, nil
+	}
+	out, ok := p.module.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("gpumon_process returned an out of range buffer")
+	}
+	// The view is only valid until the next call into the module
+	return bytes.Clone(out), nil
+}
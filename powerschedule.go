@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// PowerScheduleConfig caps the power of matching devices, all by default, to PowerLimit watts
+// for Duration every time Cron fires, e.g. {"cron": "0 17 * * 1-5", "duration": "4h"} for
+// weekday peak tariffs. Outside every window devices run at their default limit.
+type PowerScheduleConfig struct {
+	Name       string   `json:"name"`
+	Cron       string   `json:"cron"`
+	Duration   Duration `json:"duration"`
+	PowerLimit float64  `json:"power_limit"`
+	Match      []string `json:"match"`
+}
+
+type powerWindow struct {
+	PowerScheduleConfig
+	schedule *cronSchedule
+}
+
+// PowerScheduler applies the scheduled power limits every minute.
+type PowerScheduler struct {
+	windows []powerWindow
+	devices []Device
+	events  chan<- DeviceEvent
+	// applied is the window currently applied to each device, "" for the default limit
+	applied map[int]string
+}
+
+func NewPowerScheduler(configs []PowerScheduleConfig, devices []Device, events chan<- DeviceEvent) (*PowerScheduler, error) {
+	s := &PowerScheduler{devices: devices, events: events, applied: make(map[int]string)}
+	for i, pc := range configs {
+		schedule, err := parseCron(pc.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("power_schedule[%d]: invalid cron %q: %v", i, pc.Cron, err)
+		}
+		s.windows = append(s.windows, powerWindow{PowerScheduleConfig: pc, schedule: schedule})
+	}
+	return s, nil
+}
+
+// Run applies the schedule at the start of every minute. It never returns.
+func (s *PowerScheduler) Run() {
+	for {
+		s.apply(time.Now())
+		time.Sleep(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)))
+	}
+}
+
+// active returns the first window covering the device at now.
+func (s *PowerScheduler) active(d Device, now time.Time) *powerWindow {
+	for i, w := range s.windows {
+		if len(w.Match) > 0 && !matchDevice(w.Match, d) {
+			continue
+		}
+		if _, ok := w.schedule.activeSince(now, w.Duration.Duration); ok {
+			return &s.windows[i]
+		}
+	}
+	return nil
+}
+
+func (s *PowerScheduler) apply(now time.Time) {
+	for _, d := range s.devices {
+		w := s.active(d, now)
+		name := ""
+		if w != nil {
+			name = w.Name
+		}
+		applied, ok := s.applied[d.Index]
+		if !ok && w == nil {
+			// Limits set by hand are left alone until a window has been applied
+			s.applied[d.Index] = ""
+			continue
+		}
+		if ok && applied == name {
+			continue
+		}
+
+		event := newDeviceEvent("power_limit_applied", d, nil)
+		event.Schedule = name
+		var err error
+		if w != nil {
+			event.PowerLimit = w.PowerLimit
+			err = setPowerLimit(d, w.PowerLimit, "power_schedule "+name)
+		} else {
+			// The board default is restored rather than the limit found at startup, which
+			// may still be a cap left behind by an earlier run
+			event.Event = "power_limit_restored"
+			if event.PowerLimit, err = d.GetDefaultPowerLimit(); err == nil {
+				err = setPowerLimit(d, event.PowerLimit, "power_schedule")
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to set power limit of device %d: %v", d.Index, err)
+			event.Error = err.Error()
+		} else {
+			log.Printf("Set power limit of device %d to %.0f W (%s)", d.Index, event.PowerLimit, event.Event)
+		}
+		// A failed change is retried on the next minute
+		if err == nil {
+			s.applied[d.Index] = name
+		}
+		s.events <- event
+	}
+}
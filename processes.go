@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// ProcessMetrics is the GPU usage of one process. SMUtilization is missing when the device
+// does not report per-process utilization or took no sample of the process since the
+// previous poll.
+type ProcessMetrics struct {
+	PID           uint32  `json:"pid"`
+	Name          string  `json:"name"`
+	MemoryUsed    float32 `json:"memory_used"`
+	SMUtilization *uint   `json:"sm_utilization,omitempty"`
+}
+
+// processMetrics combines the processes on the device with their SM utilization since the
+// previous poll.
+func processMetrics(d Device, processes []gpumon.Process, since time.Time) []ProcessMetrics {
+	utilization, _ := d.GetProcessUtilization(since)
+	metrics := make([]ProcessMetrics, 0, len(processes))
+	for _, p := range processes {
+		m := ProcessMetrics{PID: p.PID, Name: p.Name, MemoryUsed: p.MemoryUsed}
+		if sm, ok := utilization[p.PID]; ok {
+			m.SMUtilization = &sm
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
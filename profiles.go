@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// profiles are presets for common deployments. A config file loaded with a profile starts
+// from the preset and overrides it key by key.
+var profiles = map[string]func() Config{
+	// minimal keeps the agent cheap on hosts that only need coarse utilization data
+	"minimal": func() Config {
+		cfg := DefaultConfig()
+		cfg.Interval = Duration{30 * time.Second}
+		cfg.Relabel = []RelabelConfig{{Action: "drop_metrics", Regex: "memory_total"}}
+		return cfg
+	},
+	// hpc adds the host and fabric context needed to debug multi-node training
+	"hpc": func() Config {
+		cfg := DefaultConfig()
+		cfg.Interval = Duration{10 * time.Second}
+		cfg.Host = true
+		cfg.Storage = true
+		cfg.RDMA = true
+		cfg.Monotonic = true
+		cfg.Groups = []GroupConfig{{Name: "node", Match: []string{"*"}}}
+		return cfg
+	},
+	// inference samples quickly for autoscaling on memory pressure and utilization
+	"inference": func() Config {
+		cfg := DefaultConfig()
+		cfg.Interval = Duration{2 * time.Second}
+		cfg.Host = true
+		return cfg
+	},
+	// burn-in samples every second with precise timing to validate new hardware under load
+	"burn-in": func() Config {
+		cfg := DefaultConfig()
+		cfg.Interval = Duration{time.Second}
+		cfg.Monotonic = true
+		cfg.Derived = []DerivedConfig{{Name: "power_efficiency", Expr: "gpu_usage / power"}}
+		return cfg
+	},
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ProfileConfig returns the preset config of the named profile, or the defaults when name is empty.
+func ProfileConfig(name string) (Config, error) {
+	if name == "" {
+		return DefaultConfig(), nil
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown profile %q, available profiles are %s", name, strings.Join(profileNames(), ", "))
+	}
+	return profile(), nil
+}
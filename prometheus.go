@@ -0,0 +1,441 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// prometheusMetric describes a gauge exported for every device.
+type prometheusMetric struct {
+	name string
+	// field is the sample field the gauge exports
+	field string
+	help  string
+	value func(Sample) float64
+}
+
+var prometheusMetrics = []prometheusMetric{
+	{"gpumon_temperature_celsius", "temperature", "GPU temperature in degrees Celsius.", func(s Sample) float64 { return float64(s.Temperature) }},
+	{"gpumon_power_watts", "power", "GPU power draw in watts.", func(s Sample) float64 { return float64(s.Power) }},
+	{"gpumon_gpu_utilization_percent", "gpu_usage", "Percent of time a kernel was running on the GPU.", func(s Sample) float64 { return float64(s.GpuUsage) }},
+	{"gpumon_memory_total_bytes", "memory_total", "Total GPU memory in bytes.", func(s Sample) float64 { return float64(s.MemoryTotal) * (1 << 30) }},
+	{"gpumon_memory_used_bytes", "memory_used", "Used GPU memory in bytes.", func(s Sample) float64 { return float64(s.MemoryUsed) * (1 << 30) }},
+	{"gpumon_memory_used_percent", "memory_used_percent", "Percent of GPU memory in use.", func(s Sample) float64 { return float64(s.MemoryUsedPercent) }},
+}
+
+// PrometheusExporter serves the latest sample of every device on /metrics in the Prometheus
+// text format.
+type PrometheusExporter struct {
+	mu     sync.Mutex
+	latest map[int]Sample
+	// events counts the NVML events of every device, they outlive lost devices
+	events map[prometheusEvent]int
+	// heartbeat is the latest heartbeat, nil until the first or when heartbeats are disabled
+	heartbeat *Heartbeat
+	// states are the health states of every device seen, they outlive lost devices
+	states map[int]prometheusState
+	// groups are the latest aggregate of every group
+	groups map[string]GroupSample
+}
+
+// prometheusState is the health of a device, healthy, degraded or lost.
+type prometheusState struct {
+	uuid  string
+	state string
+}
+
+// prometheusStates are the values of the state label of gpumon_device_state.
+var prometheusStates = []string{"healthy", "degraded", "lost"}
+
+// prometheusEvent identifies a counter of NVML events, Xid is only set for xid events.
+type prometheusEvent struct {
+	index int
+	uuid  string
+	event string
+	xid   uint64
+}
+
+func NewPrometheusExporter() *PrometheusExporter {
+	return &PrometheusExporter{latest: make(map[int]Sample), events: make(map[prometheusEvent]int), states: make(map[int]prometheusState), groups: make(map[string]GroupSample)}
+}
+
+// ObserveGroup replaces the previous aggregate of the group.
+func (e *PrometheusExporter) ObserveGroup(g GroupSample) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.groups[g.Group] = g
+}
+
+// ObserveHeartbeat replaces the previous heartbeat.
+func (e *PrometheusExporter) ObserveHeartbeat(h Heartbeat) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.heartbeat = &h
+}
+
+// ObserveEvent counts NVML events and tracks the health of devices from the degraded, lost,
+// recovered and reset events. Other events are ignored.
+func (e *PrometheusExporter) ObserveEvent(event DeviceEvent) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch event.Event {
+	case "degraded", "lost":
+		e.states[event.Index] = prometheusState{uuid: event.UUID, state: event.Event}
+	case "recovered", "reset":
+		e.states[event.Index] = prometheusState{uuid: event.UUID, state: "healthy"}
+	}
+	if isNVMLEvent(event) {
+		e.events[prometheusEvent{index: event.Index, uuid: event.UUID, event: event.Event, xid: event.Xid}]++
+	}
+}
+
+// Observe replaces the device's previous sample.
+func (e *PrometheusExporter) Observe(s Sample) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.latest[s.Index] = s
+	e.states[s.Index] = prometheusState{uuid: s.UUID, state: "healthy"}
+}
+
+// Forget stops exporting a device, e.g. one that fell off the bus, so its last values do not
+// linger.
+func (e *PrometheusExporter) Forget(index int) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.latest, index)
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	samples := make([]Sample, 0, len(e.latest))
+	for _, s := range e.latest {
+		samples = append(samples, s)
+	}
+	events := prometheusEventText(e.events)
+	states := prometheusStateText(e.states)
+	groups := prometheusGroupText(e.groups)
+	heartbeat := e.heartbeat
+	e.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(prometheusText(samples))
+	w.Write(events)
+	w.Write(states)
+	w.Write(groups)
+	if heartbeat != nil {
+		fmt.Fprintf(w, "# HELP gpumon_heartbeat Always 1 while the agent runs.\n# TYPE gpumon_heartbeat gauge\ngpumon_heartbeat{version=\"%s\"} %d\n", prometheusEscape(heartbeat.Version), heartbeat.Heartbeat)
+	}
+	_, err := w.Write(prometheusExporterText(exporterStats.Snapshot()))
+	exporterStats.Record("prometheus", err)
+}
+
+// prometheusExporterText renders the publishes of every exporter, e.g. CloudWatch requests,
+// and when each last succeeded. The families are left out until an exporter published.
+func prometheusExporterText(statuses []ExporterStatus) []byte {
+	if len(statuses) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("# HELP gpumon_exporter_publishes_total Publishes of the exporters by result, scrapes for prometheus.\n# TYPE gpumon_exporter_publishes_total counter\n")
+	for _, e := range statuses {
+		fmt.Fprintf(&b, "gpumon_exporter_publishes_total{exporter=\"%s\",result=\"success\"} %d\n", e.Exporter, e.Successes)
+		fmt.Fprintf(&b, "gpumon_exporter_publishes_total{exporter=\"%s\",result=\"failure\"} %d\n", e.Exporter, e.Failures)
+	}
+	b.WriteString("# HELP gpumon_exporter_last_success_timestamp_seconds When the exporter last published successfully.\n# TYPE gpumon_exporter_last_success_timestamp_seconds gauge\n")
+	for _, e := range statuses {
+		if !e.LastSuccess.IsZero() {
+			fmt.Fprintf(&b, "gpumon_exporter_last_success_timestamp_seconds{exporter=\"%s\"} %d\n", e.Exporter, e.LastSuccess.Unix())
+		}
+	}
+	return []byte(b.String())
+}
+
+// prometheusStateText renders the health of every device as 1 for its current state and 0
+// for the others.
+func prometheusStateText(states map[int]prometheusState) []byte {
+	if len(states) == 0 {
+		return nil
+	}
+	indexes := make([]int, 0, len(states))
+	for index := range states {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+	var b strings.Builder
+	b.WriteString("# HELP gpumon_device_state Health of the GPU, 1 for its current state.\n# TYPE gpumon_device_state gauge\n")
+	for _, index := range indexes {
+		s := states[index]
+		for _, state := range prometheusStates {
+			value := 0
+			if s.state == state {
+				value = 1
+			}
+			fmt.Fprintf(&b, "gpumon_device_state{gpu=\"%d\",uuid=\"%s\",state=\"%s\"} %d\n", index, prometheusEscape(s.uuid), state, value)
+		}
+	}
+	return []byte(b.String())
+}
+
+// prometheusGroupMetrics are the gauges exported for every group.
+var prometheusGroupMetrics = []struct {
+	name  string
+	help  string
+	value func(GroupSample) float64
+}{
+	{"gpumon_group_devices", "Members of the group that reported a sample.", func(g GroupSample) float64 { return float64(g.Devices) }},
+	{"gpumon_group_temperature_max_celsius", "Highest GPU temperature of the group in degrees Celsius.", func(g GroupSample) float64 { return float64(g.Temperature) }},
+	{"gpumon_group_power_watts", "Total power draw of the group in watts.", func(g GroupSample) float64 { return float64(g.Power) }},
+	{"gpumon_group_gpu_utilization_percent", "Average GPU utilization of the group in percent.", func(g GroupSample) float64 { return float64(g.GpuUsage) }},
+	{"gpumon_group_memory_total_bytes", "Total GPU memory of the group in bytes.", func(g GroupSample) float64 { return float64(g.MemoryTotal) * (1 << 30) }},
+	{"gpumon_group_memory_used_bytes", "Used GPU memory of the group in bytes.", func(g GroupSample) float64 { return float64(g.MemoryUsed) * (1 << 30) }},
+	{"gpumon_group_memory_used_percent", "Percent of the group's GPU memory in use.", func(g GroupSample) float64 { return float64(g.MemoryUsedPercent) }},
+}
+
+// prometheusGroupText renders the aggregates of the groups, left out until a group reported.
+func prometheusGroupText(groups map[string]GroupSample) []byte {
+	if len(groups) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var b strings.Builder
+	for _, m := range prometheusGroupMetrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, name := range names {
+			fmt.Fprintf(&b, "%s{group=\"%s\"} %s\n", m.name, prometheusEscape(name), strconv.FormatFloat(m.value(groups[name]), 'g', -1, 64))
+		}
+	}
+	return []byte(b.String())
+}
+
+// prometheusEventText renders the event counters, Xid errors separately by their code. The
+// families are left out until there is an event.
+func prometheusEventText(events map[prometheusEvent]int) []byte {
+	keys := make([]prometheusEvent, 0, len(events))
+	for k := range events {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b prometheusEvent) int {
+		return cmp.Or(a.index-b.index, strings.Compare(a.event, b.event), cmp.Compare(a.xid, b.xid))
+	})
+	var xids, others strings.Builder
+	for _, k := range keys {
+		if k.event == "xid" {
+			fmt.Fprintf(&xids, "gpumon_xid_errors_total{gpu=\"%d\",uuid=\"%s\",xid=\"%d\"} %d\n", k.index, prometheusEscape(k.uuid), k.xid, events[k])
+		} else {
+			fmt.Fprintf(&others, "gpumon_events_total{gpu=\"%d\",uuid=\"%s\",event=\"%s\"} %d\n", k.index, prometheusEscape(k.uuid), k.event, events[k])
+		}
+	}
+	var b strings.Builder
+	if xids.Len() > 0 {
+		b.WriteString("# HELP gpumon_xid_errors_total Xid errors reported by NVML.\n# TYPE gpumon_xid_errors_total counter\n")
+		b.WriteString(xids.String())
+	}
+	if others.Len() > 0 {
+		b.WriteString("# HELP gpumon_events_total ECC, power source and clock slowdown events reported by NVML.\n# TYPE gpumon_events_total counter\n")
+		b.WriteString(others.String())
+	}
+	return []byte(b.String())
+}
+
+// prometheusText renders the samples in the Prometheus text format, ordered by device.
+func prometheusText(samples []Sample) []byte {
+	samples = slices.Clone(samples)
+	slices.SortFunc(samples, func(a, b Sample) int { return a.Index - b.Index })
+	var b strings.Builder
+	for _, m := range prometheusMetrics {
+		exported := slices.DeleteFunc(slices.Clone(samples), func(s Sample) bool { return !s.exports(m.field) })
+		if len(exported) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, s := range exported {
+			fmt.Fprintf(&b, "%s{%s} %s\n", m.name, prometheusLabels(s), strconv.FormatFloat(m.value(s), 'g', -1, 64))
+		}
+	}
+	// Derived metrics are gauges named after them, in the order they are defined
+	var derived []string
+	for _, s := range samples {
+		for _, d := range s.derived {
+			if !slices.Contains(derived, d.name) {
+				derived = append(derived, d.name)
+			}
+		}
+	}
+	for _, name := range derived {
+		fmt.Fprintf(&b, "# HELP gpumon_%s Derived metric %s.\n# TYPE gpumon_%s gauge\n", name, name, name)
+		for _, s := range samples {
+			for _, d := range s.derived {
+				if d.name == name {
+					fmt.Fprintf(&b, "gpumon_%s{%s} %s\n", name, prometheusLabels(s), strconv.FormatFloat(d.value, 'g', -1, 64))
+				}
+			}
+		}
+	}
+	// Compute processes are only counted when enabled
+	counted := slices.DeleteFunc(slices.Clone(samples), func(s Sample) bool { return s.ComputeProcesses == nil })
+	if len(counted) > 0 {
+		b.WriteString("# HELP gpumon_compute_processes Number of processes with a CUDA context on the GPU.\n# TYPE gpumon_compute_processes gauge\n")
+		for _, s := range counted {
+			fmt.Fprintf(&b, "gpumon_compute_processes{%s} %d\n", prometheusLabels(s), *s.ComputeProcesses)
+		}
+	}
+	// Performance states and throttle reasons are only read with the throttle extended group
+	throttled := slices.DeleteFunc(slices.Clone(samples), func(s Sample) bool { return s.Extended == nil || s.Extended.PState == nil })
+	if len(throttled) > 0 {
+		b.WriteString("# HELP gpumon_performance_state GPU performance state, from 0 for maximum performance to 15 for minimum.\n# TYPE gpumon_performance_state gauge\n")
+		for _, s := range throttled {
+			fmt.Fprintf(&b, "gpumon_performance_state{%s} %d\n", prometheusLabels(s), *s.Extended.PState)
+		}
+		b.WriteString("# HELP gpumon_clock_throttle_reason Whether the reason is holding the GPU clocks down, 1 or 0.\n# TYPE gpumon_clock_throttle_reason gauge\n")
+		for _, s := range throttled {
+			for i, reason := range gpumon.ThrottleReasonNames {
+				fmt.Fprintf(&b, "gpumon_clock_throttle_reason{%s,reason=\"%s\"} %d\n", prometheusLabels(s), reason, *s.Extended.ThrottleMask>>i&1)
+			}
+		}
+	}
+	// Encoder stats are only read with the encoder extended group
+	encoding := slices.DeleteFunc(slices.Clone(samples), func(s Sample) bool { return s.Extended == nil || s.Extended.EncoderStats == nil })
+	if len(encoding) > 0 {
+		b.WriteString("# HELP gpumon_encoder_sessions Number of active encoder sessions.\n# TYPE gpumon_encoder_sessions gauge\n")
+		for _, s := range encoding {
+			fmt.Fprintf(&b, "gpumon_encoder_sessions{%s} %d\n", prometheusLabels(s), s.Extended.EncoderStats.Sessions)
+		}
+		b.WriteString("# HELP gpumon_encoder_fps Average frame rate of the active encoder sessions.\n# TYPE gpumon_encoder_fps gauge\n")
+		for _, s := range encoding {
+			fmt.Fprintf(&b, "gpumon_encoder_fps{%s} %d\n", prometheusLabels(s), s.Extended.EncoderStats.FPS)
+		}
+		b.WriteString("# HELP gpumon_encoder_latency_seconds Average latency of the active encoder sessions in seconds.\n# TYPE gpumon_encoder_latency_seconds gauge\n")
+		for _, s := range encoding {
+			fmt.Fprintf(&b, "gpumon_encoder_latency_seconds{%s} %s\n", prometheusLabels(s), strconv.FormatFloat(float64(s.Extended.EncoderStats.Latency)/1e6, 'g', -1, 64))
+		}
+	}
+	// Displays are only read with the display extended group
+	displays := slices.DeleteFunc(slices.Clone(samples), func(s Sample) bool { return s.Extended == nil || s.Extended.Display == nil })
+	if len(displays) > 0 {
+		b.WriteString("# HELP gpumon_display_attached Whether a display is connected to the GPU, 1 or 0.\n# TYPE gpumon_display_attached gauge\n")
+		for _, s := range displays {
+			fmt.Fprintf(&b, "gpumon_display_attached{%s} %d\n", prometheusLabels(s), prometheusBool(s.Extended.Display.Attached))
+		}
+		b.WriteString("# HELP gpumon_display_active Whether a display is initialized on the GPU, 1 or 0.\n# TYPE gpumon_display_active gauge\n")
+		for _, s := range displays {
+			fmt.Fprintf(&b, "gpumon_display_active{%s} %d\n", prometheusLabels(s), prometheusBool(s.Extended.Display.Active))
+		}
+		b.WriteString("# HELP gpumon_gpu_mode Whether the GPU is used for graphics or compute, 1 for its current mode.\n# TYPE gpumon_gpu_mode gauge\n")
+		for _, s := range displays {
+			for _, mode := range []string{"graphics", "compute"} {
+				fmt.Fprintf(&b, "gpumon_gpu_mode{%s,mode=\"%s\"} %d\n", prometheusLabels(s), mode, prometheusBool(s.Extended.Display.Mode == mode))
+			}
+		}
+	}
+	tracked := slices.DeleteFunc(slices.Clone(samples), func(s Sample) bool { return s.TimeInState == nil })
+	if len(tracked) > 0 {
+		b.WriteString("# HELP gpumon_utilization_band_seconds Seconds the GPU spent in the utilization band within the time in state window.\n# TYPE gpumon_utilization_band_seconds gauge\n")
+		for _, s := range tracked {
+			for _, band := range utilizationBands {
+				fmt.Fprintf(&b, "gpumon_utilization_band_seconds{%s,band=\"%s\"} %s\n", prometheusLabels(s), band.name, strconv.FormatFloat(s.TimeInState.Utilization[band.name], 'g', -1, 64))
+			}
+		}
+		var pstates strings.Builder
+		for _, s := range tracked {
+			for _, pstate := range s.TimeInState.pstateNames() {
+				fmt.Fprintf(&pstates, "gpumon_pstate_seconds{%s,pstate=\"%s\"} %s\n", prometheusLabels(s), pstate, strconv.FormatFloat(s.TimeInState.PStates[pstate], 'g', -1, 64))
+			}
+		}
+		if pstates.Len() > 0 {
+			b.WriteString("# HELP gpumon_pstate_seconds Seconds the GPU spent in the performance state within the time in state window.\n# TYPE gpumon_pstate_seconds gauge\n")
+			b.WriteString(pstates.String())
+		}
+	}
+	scored := slices.DeleteFunc(slices.Clone(samples), func(s Sample) bool { return s.ClockStability == nil })
+	if len(scored) > 0 {
+		b.WriteString("# HELP gpumon_clock_stability_score Stability of the SM clock while busy, 100 for a steady unthrottled clock.\n# TYPE gpumon_clock_stability_score gauge\n")
+		for _, s := range scored {
+			fmt.Fprintf(&b, "gpumon_clock_stability_score{%s} %s\n", prometheusLabels(s), strconv.FormatFloat(s.ClockStability.Score, 'g', -1, 64))
+		}
+	}
+	bursts := slices.DeleteFunc(slices.Clone(samples), func(s Sample) bool { return s.Burst == nil })
+	if len(bursts) > 0 {
+		b.WriteString("# HELP gpumon_burst_power_watts Minimum, maximum and average power of the readings within the poll.\n# TYPE gpumon_burst_power_watts gauge\n")
+		for _, s := range bursts {
+			writeBurstStats(&b, "gpumon_burst_power_watts", prometheusLabels(s), s.Burst.Power)
+		}
+		b.WriteString("# HELP gpumon_burst_gpu_utilization_percent Minimum, maximum and average GPU utilization of the readings within the poll.\n# TYPE gpumon_burst_gpu_utilization_percent gauge\n")
+		for _, s := range bursts {
+			writeBurstStats(&b, "gpumon_burst_gpu_utilization_percent", prometheusLabels(s), s.Burst.GpuUsage)
+		}
+	}
+	fmt.Fprintf(&b, "# HELP gpumon_devices Number of GPUs being exported.\n# TYPE gpumon_devices gauge\ngpumon_devices %d\n", len(samples))
+	return []byte(b.String())
+}
+
+// writeBurstStats writes the min, max and avg series of a burst metric.
+func writeBurstStats(b *strings.Builder, name, labels string, stats BurstStats) {
+	for _, stat := range []struct {
+		name  string
+		value float64
+	}{{"min", stats.Min}, {"max", stats.Max}, {"avg", stats.Avg}} {
+		fmt.Fprintf(b, "%s{%s,stat=\"%s\"} %s\n", name, labels, stat.name, strconv.FormatFloat(stat.value, 'g', -1, 64))
+	}
+}
+
+// prometheusLabels renders the labels identifying the device of a sample.
+func prometheusLabels(s Sample) string {
+	return fmt.Sprintf("gpu=\"%d\",uuid=\"%s\"%s", s.Index, prometheusEscape(s.UUID), prometheusPodLabels(s.Pods))
+}
+
+// prometheusPodLabels renders the namespace, pod and container labels of an allocated GPU.
+func prometheusPodLabels(pods []PodAllocation) string {
+	if len(pods) == 0 {
+		return ""
+	}
+	namespace, pod, container := podLabels(pods)
+	return fmt.Sprintf(",namespace=\"%s\",pod=\"%s\",container=\"%s\"", prometheusEscape(namespace), prometheusEscape(pod), prometheusEscape(container))
+}
+
+// prometheusEscape escapes a label value for the text format.
+func prometheusEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// prometheusBool renders a flag as 1 or 0.
+func prometheusBool(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// servePrometheus serves /metrics on addr. It never returns.
+func servePrometheus(addr string, e *PrometheusExporter) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	log.Fatalf("Unable to serve Prometheus metrics: %v", server.ListenAndServe())
+}
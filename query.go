@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// Exit codes of the query subcommand, so scripts can tell a failed read from a missing GPU.
+const (
+	queryOK        = 0
+	queryFailed    = 1
+	queryUsage     = 2
+	queryNoDevices = 3
+)
+
+// queryCommand implements the query subcommand. It prints one sample of every selected device
+// and exits, or with -watch keeps printing them until interrupted.
+func queryCommand(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	format := fs.String("format", "table", "output format: json, csv or table")
+	devicesFlag := fs.String("devices", "", "comma separated indexes or UUID patterns of the devices to query, all by default")
+	backendName := fs.String("backend", "", "GPU backend, "+strings.Join(backendNames(), " or ")+", picked automatically by default")
+	watch := fs.Duration("watch", 0, "query again every interval until interrupted, e.g. 2s")
+	fs.Parse(args)
+	if !slices.Contains([]string{"json", "csv", "table"}, *format) {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go query [-format json|csv|table] [-devices 0,1] [-watch 2s]")
+		return queryUsage
+	}
+	var filter []string
+	if *devicesFlag != "" {
+		filter = strings.Split(*devicesFlag, ",")
+		if err := validatePatterns(filter); err != nil {
+			log.Printf("Invalid -devices: %v", err)
+			return queryUsage
+		}
+	}
+
+	backend, devices, err := gpumon.Open(*backendName)
+	if err != nil {
+		log.Printf("Unable to load GPU backend: %v", err)
+		return queryNoDevices
+	}
+	if backend != nil {
+		defer backend.Shutdown()
+	}
+	if len(filter) > 0 {
+		devices = slices.DeleteFunc(devices, func(d Device) bool { return !matchDevice(filter, d) })
+	}
+	if len(devices) == 0 {
+		log.Printf("No devices found")
+		return queryNoDevices
+	}
+
+	out := output{}
+	if *format == "csv" {
+		out.csv = csv.NewWriter(os.Stdout)
+		out.csv.Write(csvHeader)
+		out.csv.Flush()
+	}
+	if *watch <= 0 {
+		return printQuery(out, *format, devices, 1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(*watch)
+	defer ticker.Stop()
+	for seq := uint64(1); ; seq++ {
+		if *format == "table" {
+			// Redraw the table in place like watch(1)
+			fmt.Print("\x1b[H\x1b[2J")
+		}
+		code := printQuery(out, *format, devices, seq)
+		select {
+		case <-ctx.Done():
+			return code
+		case <-ticker.C:
+		}
+	}
+}
+
+// printQuery prints a sample of every device and returns queryFailed if one of them could not
+// be read.
+func printQuery(out output, format string, devices []Device, seq uint64) int {
+	code := queryOK
+	var samples []Sample
+	for _, d := range devices {
+		metrics, err := d.GetMetrics()
+		if err != nil {
+			log.Printf("Unable to get metrics for device %d: %v", d.Index, err)
+			code = queryFailed
+			continue
+		}
+		samples = append(samples, Sample{Index: d.Index, UUID: d.UUID, Epoch: epoch, Seq: seq, Timestamp: time.Now(), Metrics: metrics})
+	}
+	if format == "table" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "GPU\tUUID\tTEMP\tPOWER\tUTIL\tMEMORY")
+		for _, s := range samples {
+			fmt.Fprintf(w, "%d\t%s\t%dC\t%.1fW\t%d%%\t%.1f/%.1f GiB\n", s.Index, s.UUID, s.Temperature, s.Power, s.GpuUsage, s.MemoryUsed, s.MemoryTotal)
+		}
+		w.Flush()
+		return code
+	}
+	for _, s := range samples {
+		data, err := json.Marshal(s)
+		if err != nil {
+			log.Printf("Unable to marshal sample to JSON: %v", err)
+			return queryFailed
+		}
+		out.write(data)
+	}
+	return code
+}
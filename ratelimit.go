@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket. A limiter created with a parent also waits on the parent,
+// which is how per-exporter limits share the global budget. A nil RateLimiter never blocks.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	parent *RateLimiter
+}
+
+// NewRateLimiter allows rate calls per second on average and bursts of up to burst calls.
+func NewRateLimiter(rate float64, burst int, parent *RateLimiter) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now(), parent: parent}
+}
+
+// Wait blocks until a call is allowed or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.parent.Wait(ctx); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// Reserve the token up front so concurrent callers queue behind each other
+	l.tokens--
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// rateLimitedExporters are the exporters whose calls wait on their rate_limits.exporters entry.
+var rateLimitedExporters = []string{"cloudwatch", "otlp", "influx"}
+
+// Limiters holds the configured rate limiters, built once so every exporter shares the same
+// global bucket.
+type Limiters struct {
+	global    *RateLimiter
+	exporters map[string]*RateLimiter
+}
+
+func NewLimiters(rc RateLimitsConfig) Limiters {
+	l := Limiters{exporters: make(map[string]*RateLimiter, len(rc.Exporters))}
+	if rc.Global != nil {
+		l.global = NewRateLimiter(rc.Global.Rate, rc.Global.Burst, nil)
+	}
+	for name, limit := range rc.Exporters {
+		l.exporters[name] = NewRateLimiter(limit.Rate, limit.Burst, l.global)
+	}
+	return l
+}
+
+// For returns the limiter of the named exporter, falling back to the global limiter.
+// It returns nil when neither limit is configured.
+func (l Limiters) For(exporter string) *RateLimiter {
+	if limiter, ok := l.exporters[exporter]; ok {
+		return limiter
+	}
+	return l.global
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retransmitCounters are the hw_counters that count retransmissions on EFA and mlx5 devices.
+var retransmitCounters = []string{"retrans_pkts", "local_ack_timeout_err", "rnr_nak_retry_err", "packet_seq_err"}
+
+// RDMAPort holds per-second rates of an InfiniBand/EFA port.
+type RDMAPort struct {
+	RxBytes     float64 `json:"rx_bytes_per_second"`
+	TxBytes     float64 `json:"tx_bytes_per_second"`
+	Retransmits float64 `json:"retransmits"`
+}
+
+type rdmaCounters struct {
+	rx      uint64
+	tx      uint64
+	retrans uint64
+}
+
+// RDMACollector reads the RDMA NIC counters from /sys/class/infiniband and is shared between
+// the device pollers in the same way as HostCollector.
+type RDMACollector struct {
+	mu      sync.Mutex
+	last    time.Time
+	cached  map[string]RDMAPort
+	prev    map[string]rdmaCounters
+	sysRoot string
+}
+
+func NewRDMACollector() *RDMACollector {
+	return &RDMACollector{sysRoot: "/sys"}
+}
+
+// Collect returns the rates for every port keyed by "device/port", e.g. "rdmap16s27/1".
+func (r *RDMACollector) Collect() map[string]RDMAPort {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if !r.last.IsZero() && now.Sub(r.last) < hostMinInterval {
+		return r.cached
+	}
+	counters := r.readCounters()
+	ports := make(map[string]RDMAPort, len(counters))
+	if !r.last.IsZero() {
+		elapsed := now.Sub(r.last).Seconds()
+		for name, cur := range counters {
+			prev, ok := r.prev[name]
+			// The counters restart when the driver reloads or a port is reset, that interval
+			// has no rate
+			if !ok || cur.rx < prev.rx || cur.tx < prev.tx || cur.retrans < prev.retrans {
+				continue
+			}
+			ports[name] = RDMAPort{
+				RxBytes:     float64(cur.rx-prev.rx) / elapsed,
+				TxBytes:     float64(cur.tx-prev.tx) / elapsed,
+				Retransmits: float64(cur.retrans-prev.retrans) / elapsed,
+			}
+		}
+	}
+	r.last = now
+	r.prev = counters
+	r.cached = ports
+	return ports
+}
+
+// Reset drops the previous counters, so the next collection reports no rates.
+func (r *RDMACollector) Reset() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = time.Time{}
+}
+
+func (r *RDMACollector) readCounters() map[string]rdmaCounters {
+	portDirs, _ := filepath.Glob(filepath.Join(r.sysRoot, "class", "infiniband", "*", "ports", "*"))
+	counters := make(map[string]rdmaCounters, len(portDirs))
+	for _, dir := range portDirs {
+		device := filepath.Base(filepath.Dir(filepath.Dir(dir)))
+		name := device + "/" + filepath.Base(dir)
+
+		var c rdmaCounters
+		// EFA only exposes byte counts in hw_counters, the standard port counters are in 4 byte words
+		if rx, ok := readCounter(filepath.Join(dir, "hw_counters", "rx_bytes")); ok {
+			c.rx = rx
+			c.tx, _ = readCounter(filepath.Join(dir, "hw_counters", "tx_bytes"))
+		} else {
+			rx, _ := readCounter(filepath.Join(dir, "counters", "port_rcv_data"))
+			tx, _ := readCounter(filepath.Join(dir, "counters", "port_xmit_data"))
+			c.rx, c.tx = rx*4, tx*4
+		}
+		for _, counter := range retransmitCounters {
+			v, _ := readCounter(filepath.Join(dir, "hw_counters", counter))
+			c.retrans += v
+		}
+		counters[name] = c
+	}
+	return counters
+}
+
+func readCounter(name string) (uint64, bool) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
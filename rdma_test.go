@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRDMACollectorCollect(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur rdmaCounters
+		want      bool
+	}{
+		{name: "counters advanced", prev: rdmaCounters{1000, 2000, 1}, cur: rdmaCounters{5000, 6000, 3}, want: true},
+		{name: "counters unchanged", prev: rdmaCounters{1000, 2000, 1}, cur: rdmaCounters{1000, 2000, 1}, want: true},
+		{name: "rx went backwards", prev: rdmaCounters{1000, 2000, 1}, cur: rdmaCounters{10, 6000, 3}},
+		{name: "tx went backwards", prev: rdmaCounters{1000, 2000, 1}, cur: rdmaCounters{5000, 20, 3}},
+		{name: "retransmits went backwards", prev: rdmaCounters{1000, 2000, 5}, cur: rdmaCounters{5000, 6000, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "class", "infiniband", "efa0", "ports", "1", "hw_counters")
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for name, v := range map[string]uint64{"rx_bytes": tt.cur.rx, "tx_bytes": tt.cur.tx, "retrans_pkts": tt.cur.retrans} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(strconv.FormatUint(v, 10)), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := &RDMACollector{
+				sysRoot: root,
+				last:    time.Now().Add(-time.Second),
+				prev:    map[string]rdmaCounters{"efa0/1": tt.prev},
+			}
+			port, ok := r.Collect()["efa0/1"]
+			if ok != tt.want {
+				t.Fatalf("Collect() reported %+v, %v, want %v", port, ok, tt.want)
+			}
+			if port.RxBytes < 0 || port.TxBytes < 0 || port.Retransmits < 0 || port.RxBytes > 4000*1.1 {
+				t.Errorf("Collect() = %+v", port)
+			}
+		})
+	}
+}
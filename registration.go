@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registrationRetry is how long a failed registration waits before it is tried again.
+const registrationRetry = 30 * time.Second
+
+// RegistrationConfig registers the Prometheus endpoint in Consul or etcd, so service
+// discovery picks up new GPU nodes. Address is advertised instead of the host name.
+type RegistrationConfig struct {
+	Address string        `json:"address"`
+	Consul  *ConsulConfig `json:"consul"`
+	Etcd    *EtcdConfig   `json:"etcd"`
+	Timeout Duration      `json:"timeout"`
+}
+
+// ConsulConfig registers the endpoint as Service (default gpumon) with the Consul agent at
+// URL, with an HTTP check of /metrics.
+type ConsulConfig struct {
+	URL     string `json:"url"`
+	Token   string `json:"token"`
+	Service string `json:"service"`
+}
+
+// EtcdConfig puts the endpoint under Prefix (default /gpumon/targets/) through the JSON
+// gateway of etcd at URL, on a lease of TTL (default 30s) that the agent keeps alive.
+type EtcdConfig struct {
+	URL    string   `json:"url"`
+	Prefix string   `json:"prefix"`
+	TTL    Duration `json:"ttl"`
+}
+
+// Registration keeps the endpoint registered while the agent runs and removes it on shutdown.
+type Registration struct {
+	cfg    RegistrationConfig
+	client *http.Client
+	id     string
+	host   string
+	port   int
+	// labels carry the GPU metadata, tags and meta in Consul and labels in etcd
+	labels map[string]string
+}
+
+// NewRegistration registers the Prometheus endpoint listening on addr, tagged with the
+// models and count of the devices.
+func NewRegistration(cfg RegistrationConfig, addr string, devices []Device) (*Registration, error) {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portText)
+	}
+	switch {
+	case cfg.Address != "":
+		host = cfg.Address
+	case host == "" || net.ParseIP(host).IsUnspecified():
+		host = hostName()
+	}
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	var models []string
+	for _, d := range devices {
+		if model := deviceModel(d); model != "" && !slices.Contains(models, model) {
+			models = append(models, model)
+		}
+	}
+	return &Registration{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+		id:     "gpumon-" + hostName(),
+		host:   host,
+		port:   port,
+		labels: map[string]string{
+			"gpu_count": strconv.Itoa(len(devices)),
+			"gpu_model": strings.Join(models, ","),
+			"version":   buildInfo().Version,
+		},
+	}, nil
+}
+
+// Run registers the endpoint, retrying until it succeeds, and keeps the etcd lease alive.
+// Once ctx is cancelled it deregisters and returns.
+func (r *Registration) Run(ctx context.Context) {
+	// Without Consul there is nothing to register but the etcd key
+	registered := r.cfg.Consul == nil
+	var lease string
+	for {
+		var err error
+		if !registered {
+			if err = r.register(ctx); err == nil {
+				registered = true
+			} else {
+				log.Printf("Unable to register the Prometheus endpoint in Consul: %v", err)
+			}
+		}
+		if r.cfg.Etcd != nil {
+			if lease == "" {
+				lease, err = r.putEtcd(ctx)
+			} else if err = r.keepAlive(ctx, lease); err != nil {
+				// Put the key again on a new lease, the old one may have expired
+				lease = ""
+			}
+			if err != nil {
+				log.Printf("Unable to register the Prometheus endpoint in etcd: %v", err)
+			}
+		}
+		wait := registrationRetry
+		if r.cfg.Etcd != nil && lease != "" {
+			wait = r.etcdTTL() / 3
+		} else if registered {
+			wait = -1
+		}
+		var tick <-chan time.Time
+		if wait > 0 {
+			tick = time.After(wait)
+		}
+		select {
+		case <-tick:
+		case <-ctx.Done():
+			r.deregister(registered, lease)
+			return
+		}
+	}
+}
+
+func (r *Registration) deregister(registered bool, lease string) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if registered && r.cfg.Consul != nil {
+		if err := r.consulCall(ctx, "/v1/agent/service/deregister/"+r.id, nil); err != nil {
+			log.Printf("Unable to deregister from Consul: %v", err)
+		}
+	}
+	if lease != "" {
+		if err := r.etcdCall(ctx, "/v3/lease/revoke", map[string]string{"ID": lease}, nil); err != nil {
+			log.Printf("Unable to deregister from etcd: %v", err)
+		}
+	}
+}
+
+// register registers the service with Consul.
+func (r *Registration) register(ctx context.Context) error {
+	service := r.cfg.Consul.Service
+	if service == "" {
+		service = "gpumon"
+	}
+	tags := make([]string, 0, len(r.labels))
+	for k, v := range r.labels {
+		tags = append(tags, k+"="+v)
+	}
+	slices.Sort(tags)
+	return r.consulCall(ctx, "/v1/agent/service/register", map[string]any{
+		"ID":      r.id,
+		"Name":    service,
+		"Address": r.host,
+		"Port":    r.port,
+		"Tags":    tags,
+		"Meta":    r.labels,
+		"Check": map[string]string{
+			"HTTP":                           "http://" + net.JoinHostPort(r.host, strconv.Itoa(r.port)) + "/metrics",
+			"Interval":                       "30s",
+			"DeregisterCriticalServiceAfter": "10m",
+		},
+	})
+}
+
+func (r *Registration) consulCall(ctx context.Context, path string, body any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(r.cfg.Consul.URL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if r.cfg.Consul.Token != "" {
+		req.Header.Set("X-Consul-Token", r.cfg.Consul.Token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *Registration) etcdTTL() time.Duration {
+	if ttl := r.cfg.Etcd.TTL.Duration; ttl > 0 {
+		return ttl
+	}
+	return 30 * time.Second
+}
+
+// putEtcd grants a lease and puts the endpoint as a Prometheus target group on it. It
+// returns the lease ID.
+func (r *Registration) putEtcd(ctx context.Context) (string, error) {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := r.etcdCall(ctx, "/v3/lease/grant", map[string]string{"TTL": strconv.Itoa(int(r.etcdTTL().Seconds()))}, &grant); err != nil {
+		return "", err
+	}
+	prefix := r.cfg.Etcd.Prefix
+	if prefix == "" {
+		prefix = "/gpumon/targets/"
+	}
+	value, err := json.Marshal(map[string]any{
+		"targets": []string{net.JoinHostPort(r.host, strconv.Itoa(r.port))},
+		"labels":  r.labels,
+	})
+	if err != nil {
+		return "", err
+	}
+	err = r.etcdCall(ctx, "/v3/kv/put", map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(prefix + r.id)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": grant.ID,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	return grant.ID, nil
+}
+
+// keepAlive renews the lease, an expired lease comes back without a TTL.
+func (r *Registration) keepAlive(ctx context.Context, lease string) error {
+	var renewed struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := r.etcdCall(ctx, "/v3/lease/keepalive", map[string]string{"ID": lease}, &renewed); err != nil {
+		return err
+	}
+	if renewed.Result.TTL == "" || renewed.Result.TTL == "0" {
+		return fmt.Errorf("lease %s expired", lease)
+	}
+	return nil
+}
+
+func (r *Registration) etcdCall(ctx context.Context, path string, body, result any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(r.cfg.Etcd.URL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
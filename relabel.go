@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// relabelCheckInterval is how often the config file is checked for changes to the rules.
+const relabelCheckInterval = 10 * time.Second
+
+// RelabelConfig follows Prometheus relabel_configs. Labels are the top level fields of a
+// record, so source_labels can refer to e.g. "uuid", "index" or "group".
+//
+// Actions:
+//   - replace (default): join source_labels with separator, match regex and write the
+//     expanded replacement to target_label. An empty result removes target_label.
+//   - keep / drop: keep or drop the whole record when the joined value matches regex.
+//   - drop_metrics: remove every top level field whose name matches regex.
+type RelabelConfig struct {
+	SourceLabels []string `json:"source_labels"`
+	Separator    *string  `json:"separator"`
+	Regex        string   `json:"regex"`
+	TargetLabel  string   `json:"target_label"`
+	Replacement  *string  `json:"replacement"`
+	Action       string   `json:"action"`
+}
+
+type relabelRule struct {
+	RelabelConfig
+	re          *regexp.Regexp
+	separator   string
+	replacement string
+}
+
+type Relabeler struct {
+	rules []relabelRule
+}
+
+func NewRelabeler(configs []RelabelConfig) (*Relabeler, error) {
+	r := &Relabeler{}
+	for i, rc := range configs {
+		rule := relabelRule{RelabelConfig: rc, separator: ";", replacement: "$1"}
+		if rc.Separator != nil {
+			rule.separator = *rc.Separator
+		}
+		if rc.Replacement != nil {
+			rule.replacement = *rc.Replacement
+		}
+		if rule.Action == "" {
+			rule.Action = "replace"
+		}
+		regex := rc.Regex
+		if regex == "" {
+			regex = "(.*)"
+		}
+		re, err := regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel[%d]: invalid regex: %v", i, err)
+		}
+		rule.re = re
+		switch rule.Action {
+		case "replace":
+			if rule.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel[%d]: replace requires target_label", i)
+			}
+		case "keep", "drop":
+			if len(rule.SourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel[%d]: %s requires source_labels", i, rule.Action)
+			}
+		case "drop_metrics":
+			if rc.Regex == "" {
+				return nil, fmt.Errorf("relabel[%d]: drop_metrics requires regex", i)
+			}
+		default:
+			return nil, fmt.Errorf("relabel[%d]: unknown action %q", i, rule.Action)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// Apply rewrites a decoded JSON record in place and returns false when a rule drops it.
+func (r *Relabeler) Apply(record map[string]any) bool {
+	for _, rule := range r.rules {
+		values := make([]string, len(rule.SourceLabels))
+		for i, label := range rule.SourceLabels {
+			values[i] = labelValue(record[label])
+		}
+		value := strings.Join(values, rule.separator)
+
+		switch rule.Action {
+		case "replace":
+			match := rule.re.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			result := rule.re.ExpandString(nil, rule.replacement, value, match)
+			if len(result) == 0 {
+				delete(record, rule.TargetLabel)
+			} else {
+				record[rule.TargetLabel] = string(result)
+			}
+		case "keep":
+			if !rule.re.MatchString(value) {
+				return false
+			}
+		case "drop":
+			if rule.re.MatchString(value) {
+				return false
+			}
+		case "drop_metrics":
+			for key := range record {
+				if rule.re.MatchString(key) {
+					delete(record, key)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// labelValue formats scalar fields as label values, objects and arrays have none.
+func labelValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
+
+// watchRelabel reloads the relabel rules into current when the config file changes or the
+// agent receives SIGHUP. Invalid configs are logged and the previous rules stay active.
+func watchRelabel(name string, profile string, current *atomic.Pointer[Relabeler]) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(relabelCheckInterval)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	if info, err := os.Stat(name); err == nil {
+		lastMod = info.ModTime()
+	}
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(name)
+			if err != nil || info.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+		}
+		cfg, err := LoadConfig(name, profile)
+		if err != nil {
+			log.Printf("Unable to reload relabel rules: %v", err)
+			continue
+		}
+		relabeler, err := NewRelabeler(cfg.Relabel)
+		if err != nil {
+			log.Printf("Unable to reload relabel rules: %v", err)
+			continue
+		}
+		current.Store(relabeler)
+		log.Printf("Reloaded %d relabel rules from %s", len(cfg.Relabel), name)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRelabelerApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []RelabelConfig
+		record  string
+		want    string
+		dropped bool
+	}{
+		{
+			name:    "replace with capture group",
+			configs: []RelabelConfig{{SourceLabels: []string{"uuid"}, Regex: "GPU-([0-9a-f]+)-.*", TargetLabel: "serial"}},
+			record:  `{"uuid": "GPU-0a1b-2c3d", "index": 0}`,
+			want:    `{"uuid": "GPU-0a1b-2c3d", "index": 0, "serial": "0a1b"}`,
+		},
+		{
+			name:    "replace joins the sources with the separator",
+			configs: []RelabelConfig{{SourceLabels: []string{"index", "group"}, Separator: ptr("/"), TargetLabel: "slot"}},
+			record:  `{"index": 3, "group": "rack-1"}`,
+			want:    `{"index": 3, "group": "rack-1", "slot": "3/rack-1"}`,
+		},
+		{
+			name:    "replace without a match leaves the record",
+			configs: []RelabelConfig{{SourceLabels: []string{"uuid"}, Regex: "MIG-.*", TargetLabel: "mig", Replacement: ptr("true")}},
+			record:  `{"uuid": "GPU-1"}`,
+			want:    `{"uuid": "GPU-1"}`,
+		},
+		{
+			name:    "empty replacement removes the target",
+			configs: []RelabelConfig{{SourceLabels: []string{"uuid"}, TargetLabel: "pod", Replacement: ptr("")}},
+			record:  `{"uuid": "GPU-1", "pod": "train-0"}`,
+			want:    `{"uuid": "GPU-1"}`,
+		},
+		{
+			name:    "keep a matching record",
+			configs: []RelabelConfig{{Action: "keep", SourceLabels: []string{"index"}, Regex: "[01]"}},
+			record:  `{"index": 1}`,
+			want:    `{"index": 1}`,
+		},
+		{
+			name:    "keep drops others",
+			configs: []RelabelConfig{{Action: "keep", SourceLabels: []string{"index"}, Regex: "[01]"}},
+			record:  `{"index": 12}`,
+			dropped: true,
+		},
+		{
+			name:    "drop anchors the regex",
+			configs: []RelabelConfig{{Action: "drop", SourceLabels: []string{"group"}, Regex: "test"}},
+			record:  `{"group": "test-nodes"}`,
+			want:    `{"group": "test-nodes"}`,
+		},
+		{
+			name:    "drop a matching boolean",
+			configs: []RelabelConfig{{Action: "drop", SourceLabels: []string{"heartbeat_only"}, Regex: "true"}},
+			record:  `{"heartbeat_only": true}`,
+			dropped: true,
+		},
+		{
+			name:    "drop_metrics removes matching fields",
+			configs: []RelabelConfig{{Action: "drop_metrics", Regex: "memory_.*"}},
+			record:  `{"index": 0, "memory_used": 1.5, "memory_total": 80, "power": 70}`,
+			want:    `{"index": 0, "power": 70}`,
+		},
+		{
+			name: "rules apply in order",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"index"}, TargetLabel: "team", Replacement: ptr("ml")},
+				{Action: "keep", SourceLabels: []string{"team"}, Regex: "ml"},
+			},
+			record: `{"index": 0}`,
+			want:   `{"index": 0, "team": "ml"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRelabeler(tt.configs)
+			if err != nil {
+				t.Fatalf("NewRelabeler() error = %v", err)
+			}
+			record := decodeRecord(t, tt.record)
+			if kept := r.Apply(record); kept == tt.dropped {
+				t.Fatalf("Apply() = %v, want %v", kept, !tt.dropped)
+			}
+			if tt.dropped {
+				return
+			}
+			if want := decodeRecord(t, tt.want); !reflect.DeepEqual(record, want) {
+				t.Errorf("Apply() record = %v, want %v", record, want)
+			}
+		})
+	}
+}
+
+func TestNewRelabelerErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RelabelConfig
+	}{
+		{name: "invalid regex", config: RelabelConfig{Regex: "(", TargetLabel: "x"}},
+		{name: "replace without target", config: RelabelConfig{SourceLabels: []string{"uuid"}}},
+		{name: "keep without sources", config: RelabelConfig{Action: "keep", Regex: "x"}},
+		{name: "drop_metrics without regex", config: RelabelConfig{Action: "drop_metrics"}},
+		{name: "unknown action", config: RelabelConfig{Action: "hashmod"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRelabeler([]RelabelConfig{tt.config}); err == nil {
+				t.Errorf("NewRelabeler() succeeded, want an error")
+			}
+		})
+	}
+}
+
+// decodeRecord decodes a record the way the output does, with numbers kept as json.Number.
+func decodeRecord(t *testing.T, data string) map[string]any {
+	t.Helper()
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var record map[string]any
+	if err := dec.Decode(&record); err != nil {
+		t.Fatalf("unable to decode %s: %v", data, err)
+	}
+	return record
+}
+
+func ptr[T any](v T) *T { return &v }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// isRemoteConfig reports whether the config path names an S3 object (s3://bucket/key) or an
+// SSM parameter (ssm:/name) instead of a file.
+func isRemoteConfig(name string) bool {
+	return strings.HasPrefix(name, "s3://") || strings.HasPrefix(name, "ssm:")
+}
+
+// RemoteConfig fetches the config from S3 or the SSM Parameter Store with the AWS credentials
+// of the environment, so a fleet can be reconfigured centrally.
+type RemoteConfig struct {
+	source string
+	api    *awsAPI
+}
+
+// NewRemoteConfig loads the AWS config, falling back to the region of the instance.
+func NewRemoteConfig(ctx context.Context, source string) (*RemoteConfig, error) {
+	awsCfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %v", err)
+	}
+	if awsCfg.Region == "" {
+		_, awsCfg.Region = instanceAttributes(ctx, newIMDSClient(&awsCfg))
+	}
+	if awsCfg.Region == "" {
+		return nil, errNoRegion
+	}
+	return &RemoteConfig{source: source, api: newAWSAPI(awsCfg)}, nil
+}
+
+// Fetch returns the config and its version, the S3 ETag or the SSM parameter version.
+func (r *RemoteConfig) Fetch(ctx context.Context) ([]byte, string, error) {
+	if name, ok := strings.CutPrefix(r.source, "ssm:"); ok {
+		return r.fetchParameter(ctx, name)
+	}
+	return r.fetchObject(ctx, strings.TrimPrefix(r.source, "s3://"))
+}
+
+func (r *RemoteConfig) fetchObject(ctx context.Context, path string) ([]byte, string, error) {
+	bucket, key, ok := strings.Cut(path, "/")
+	if !ok || bucket == "" || key == "" {
+		return nil, "", fmt.Errorf("invalid S3 URL %s, expected s3://bucket/key", r.source)
+	}
+	escaped := (&url.URL{Path: "/" + key}).EscapedPath()
+	region := r.api.cfg.Region
+	endpoint := strings.TrimSuffix(r.api.endpoint("s3", region), "/") + "/" + bucket + escaped
+	// Bucket names with dots do not match the wildcard certificate and configured endpoints
+	// may not resolve bucket subdomains, they keep path style
+	if _, configured := r.api.configuredEndpoint("s3"); !configured && !strings.Contains(bucket, ".") {
+		service := "s3"
+		if fipsBuild {
+			service = "s3-fips"
+		}
+		endpoint = "https://" + bucket + "." + service + "." + region + "." + awsDNSSuffix(region) + escaped
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	body, resp, err := r.api.do(req, nil, "s3", region, func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to fetch %s: %v", r.source, err)
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+func (r *RemoteConfig) fetchParameter(ctx context.Context, name string) ([]byte, string, error) {
+	payload, err := json.Marshal(map[string]any{"Name": name, "WithDecryption": true})
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.api.endpoint("ssm", r.api.cfg.Region), bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonSSM.GetParameter")
+	body, _, err := r.api.do(req, payload, "ssm", r.api.cfg.Region)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to fetch %s: %v", r.source, err)
+	}
+	var out struct {
+		Parameter struct {
+			Value   string `json:"Value"`
+			Version int64  `json:"Version"`
+		} `json:"Parameter"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, "", fmt.Errorf("invalid GetParameter response: %v", err)
+	}
+	return []byte(out.Parameter.Value), fmt.Sprint(out.Parameter.Version), nil
+}
+
+// watchRemoteConfig polls the remote config every interval. Changed relabel rules are applied
+// in place like those of a local file, any other change calls restart since the rest of the
+// config is only read at startup. Feature flags only count by their effect on this host.
+func watchRemoteConfig(ctx context.Context, remote *RemoteConfig, profile string, interval time.Duration, current *atomic.Pointer[Relabeler], restart func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var version string
+	// raw is the last fetched config text and loaded its fingerprint
+	var raw, loaded []byte
+	for ; ; <-ticker.C {
+		data, v, err := remote.Fetch(ctx)
+		if err != nil {
+			log.Printf("Unable to poll remote config: %v", err)
+			continue
+		}
+		if loaded != nil && (v == version || bytes.Equal(data, raw)) {
+			continue
+		}
+		cfg, err := parseConfig(data, profile, remote.source)
+		if err != nil {
+			log.Printf("Ignoring changed remote config: %v", err)
+			continue
+		}
+		fingerprint, err := configFingerprint(data, cfg)
+		if err != nil {
+			log.Printf("Ignoring changed remote config: %v", err)
+			continue
+		}
+		version, raw = v, data
+		if loaded == nil {
+			loaded = fingerprint
+			continue
+		}
+		if !bytes.Equal(fingerprint, loaded) {
+			log.Printf("Remote config %s changed to version %s", remote.source, version)
+			restart()
+			return
+		}
+		relabeler, err := NewRelabeler(cfg.Relabel)
+		if err != nil {
+			log.Printf("Unable to reload relabel rules: %v", err)
+			continue
+		}
+		current.Store(relabeler)
+		log.Printf("Reloaded %d relabel rules from %s", len(cfg.Relabel), remote.source)
+	}
+}
+
+// configFingerprint returns the config text a change of which needs a restart: all of it but
+// the relabel rules, which apply in place, and of the feature flags only the config of those
+// enabled on this host. Comparing the fetched text rather than the decoded config keeps
+// defaults and state filled in while loading from looking like changes. The text is compared
+// with environment variables expanded, as unquoted placeholders are not JSON before.
+func configFingerprint(data []byte, cfg Config) ([]byte, error) {
+	data, err := expandEnv(data)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "relabel")
+	delete(fields, "features")
+	var enabled []map[string]any
+	for _, fc := range cfg.Features {
+		if slices.Contains(cfg.enabledFeatures, fc.Name) {
+			enabled = append(enabled, fc.Config)
+		}
+	}
+	if len(enabled) > 0 {
+		features, err := json.Marshal(enabled)
+		if err != nil {
+			return nil, err
+		}
+		fields["features"] = features
+	}
+	// Marshaling sorts the keys and compacts the values
+	return json.Marshal(fields)
+}
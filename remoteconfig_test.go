@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConfigFingerprint(t *testing.T) {
+	t.Setenv("GPUMON_TEST_BUDGET", "2.5")
+	base := `{"cpu_budget": ${GPUMON_TEST_BUDGET}, "host": true, "relabel": []}`
+	tests := []struct {
+		name    string
+		data    string
+		changed bool
+	}{
+		{name: "same text", data: base},
+		{name: "reformatted", data: `{"relabel": [], "host": true, "cpu_budget": ${GPUMON_TEST_BUDGET}}`},
+		{name: "placeholder expands to the same value", data: `{"cpu_budget": 2.5, "host": true, "relabel": []}`},
+		{name: "relabel rules apply in place", data: `{"cpu_budget": ${GPUMON_TEST_BUDGET}, "host": true, "relabel": [{"target_label": "a", "replacement": "b"}]}`},
+		{name: "setting changed", data: `{"cpu_budget": ${GPUMON_TEST_BUDGET}, "host": false, "relabel": []}`, changed: true},
+		{name: "placeholder changed", data: `{"cpu_budget": ${GPUMON_TEST_UNSET:-5}, "host": true, "relabel": []}`, changed: true},
+	}
+	want, err := configFingerprint([]byte(base), Config{})
+	if err != nil {
+		t.Fatalf("configFingerprint() error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := configFingerprint([]byte(tt.data), Config{})
+			if err != nil {
+				t.Fatalf("configFingerprint() error = %v", err)
+			}
+			if changed := !bytes.Equal(got, want); changed != tt.changed {
+				t.Errorf("configFingerprint() = %s, base %s, changed = %v, want %v", got, want, changed, tt.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chargebackGroups are the keys GPU time can be billed to.
+var chargebackGroups = []string{"tenant", "user", "job"}
+
+// reportSample is the part of a sample the reports use, read back from the history.
+type reportSample struct {
+	// device identifies the GPU across hosts, its UUID or else the host and index
+	device      string
+	index       int
+	uuid        string
+	timestamp   time.Time
+	temperature float64
+	power       float64
+	gpuUsage    float64
+	memoryUsed  float64
+	memoryTotal float64
+	// tenant, user and job are who the GPU time is billed to
+	tenant, user, job string
+}
+
+// group returns the value of the chargeback key groupBy.
+func (s reportSample) group(groupBy string) string {
+	switch groupBy {
+	case "tenant":
+		return s.tenant
+	case "user":
+		return s.user
+	}
+	return s.job
+}
+
+// chargebackKeys returns who a sample's GPU time is billed to: its tenant, else the Kubernetes
+// namespace, the user label, and the job, else the pods.
+func chargebackKeys(s Sample) (tenant, user, job string) {
+	namespace, pod, _ := podLabels(s.Pods)
+	return cmp.Or(s.Tenant, namespace), s.Labels["user"], cmp.Or(sampleJob(s), pod)
+}
+
+// sampleJob returns the job label of a sample, else the jobs found owning the processes on
+// the GPU, comma separated.
+func sampleJob(s Sample) string {
+	if job := s.Labels["job"]; job != "" {
+		return job
+	}
+	var jobs []string
+	for _, j := range s.Jobs {
+		if j.Job != "" && !slices.Contains(jobs, j.Job) {
+			jobs = append(jobs, j.Job)
+		}
+	}
+	return strings.Join(jobs, ",")
+}
+
+// reportSource reads the samples of a report from the line protocol files of the influx file
+// sink, or from the history a running agent keeps for /api/v1/metrics.
+type reportSource struct {
+	influx string
+	url    string
+	token  string
+	since  time.Duration
+}
+
+func (r *reportSource) flags(fs *flag.FlagSet, since time.Duration) {
+	fs.StringVar(&r.influx, "influx", "", "line protocol file of the influx file sink, the files rotated next to it are read as well")
+	fs.StringVar(&r.url, "url", "", "address of an agent serving /api/v1/metrics with history, e.g. http://localhost:8080")
+	fs.StringVar(&r.token, "token", os.Getenv("GPUMON_API_TOKEN"), "bearer token for -url ($GPUMON_API_TOKEN)")
+	fs.DurationVar(&r.since, "since", since, "how far back the report goes, all of the history with 0")
+}
+
+// load returns the samples taken since r.since before now, ordered by device and time.
+func (r *reportSource) load(now time.Time) ([]reportSample, error) {
+	var samples []reportSample
+	var err error
+	switch {
+	case r.influx != "" && r.url != "":
+		return nil, fmt.Errorf("-influx and -url cannot be combined")
+	case r.influx != "":
+		samples, err = readInfluxHistory(r.influx)
+	case r.url != "":
+		samples, err = fetchAPIHistory(r.url, r.token)
+	default:
+		return nil, fmt.Errorf("one of -influx or -url must be set")
+	}
+	if err != nil {
+		return nil, err
+	}
+	from := now.Add(-r.since)
+	samples = slices.DeleteFunc(samples, func(s reportSample) bool {
+		return (r.since > 0 && s.timestamp.Before(from)) || s.timestamp.After(now)
+	})
+	slices.SortStableFunc(samples, func(a, b reportSample) int {
+		return cmp.Or(strings.Compare(a.device, b.device), a.timestamp.Compare(b.timestamp))
+	})
+	return samples, nil
+}
+
+// readInfluxHistory reads the gpumon points of the line protocol file at path and of the files
+// rotated next to it. Lines that cannot be parsed, e.g. one cut short by a full disk, are
+// skipped.
+func readInfluxHistory(path string) ([]reportSample, error) {
+	files, err := filepath.Glob(path + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var samples []reportSample
+	for _, name := range append(files, path) {
+		f, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) && name == path && len(files) > 0 {
+			// The file is only created again on the next write after a rotation
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s: %v", name, err)
+		}
+		skipped := 0
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "gpumon,") {
+				continue
+			}
+			s, err := parseInfluxSample(line)
+			if err != nil {
+				skipped++
+				continue
+			}
+			samples = append(samples, s)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", name, err)
+		}
+		if skipped > 0 {
+			log.Printf("Skipped %d lines of %s that are not valid line protocol", skipped, name)
+		}
+	}
+	return samples, nil
+}
+
+// parseInfluxSample parses a gpumon point as written by InfluxPublisher.appendSample.
+func parseInfluxSample(line string) (reportSample, error) {
+	series, rest, ok := cutInflux(line, ' ')
+	if !ok {
+		return reportSample{}, fmt.Errorf("missing fields")
+	}
+	// Field values never end in an unquoted space, so the timestamp follows the last one
+	i := strings.LastIndexByte(rest, ' ')
+	if i < 0 {
+		return reportSample{}, fmt.Errorf("missing timestamp")
+	}
+	nanos, err := strconv.ParseInt(rest[i+1:], 10, 64)
+	if err != nil {
+		return reportSample{}, fmt.Errorf("invalid timestamp: %v", err)
+	}
+	tags := make(map[string]string)
+	_, series, _ = cutInflux(series, ',')
+	for series != "" {
+		var tag string
+		tag, series, _ = cutInflux(series, ',')
+		key, value, _ := cutInflux(tag, '=')
+		tags[key] = unescapeInflux(value)
+	}
+	fields := make(map[string]float64)
+	for _, field := range splitInfluxFields(rest[:i]) {
+		key, value, _ := strings.Cut(field, "=")
+		if v, err := strconv.ParseFloat(strings.TrimSuffix(value, "i"), 64); err == nil {
+			fields[key] = v
+		}
+	}
+	index, err := strconv.Atoi(tags["gpu"])
+	if err != nil {
+		return reportSample{}, fmt.Errorf("invalid gpu tag: %v", err)
+	}
+	return reportSample{
+		device:      cmp.Or(tags["uuid"], tags["host"]+"/"+tags["gpu"]),
+		index:       index,
+		uuid:        tags["uuid"],
+		timestamp:   time.Unix(0, nanos),
+		temperature: fields["temperature"],
+		power:       fields["power"],
+		gpuUsage:    fields["gpu_usage"],
+		memoryUsed:  fields["memory_used"],
+		memoryTotal: fields["memory_total"],
+		tenant:      cmp.Or(tags["tenant"], tags["namespace"]),
+		user:        tags["user"],
+		job:         cmp.Or(tags["job"], tags["pod"]),
+	}, nil
+}
+
+// cutInflux slices s around the first sep that is not escaped with a backslash.
+func cutInflux(s string, sep byte) (before, after string, found bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// splitInfluxFields splits the field set at the commas outside of quoted string values.
+func splitInfluxFields(s string) []string {
+	var fields []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ',' && !quoted:
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(fields, s[start:])
+}
+
+// unescapeInflux reverses influxEscaper, line breaks stay spaces.
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// fetchAPIHistory reads the samples a running agent keeps of every device.
+func fetchAPIHistory(url, token string) ([]reportSample, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(url, "/")+"/api/v1/metrics?history=true", nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch history: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch history: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch history: %s", resp.Status)
+	}
+	var devices []apiMetrics
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		return nil, fmt.Errorf("unable to decode history: %v", err)
+	}
+	var samples []reportSample
+	for _, d := range devices {
+		history := d.History
+		if len(history) == 0 {
+			history = []Sample{d.Latest}
+		}
+		for _, s := range history {
+			tenant, user, job := chargebackKeys(s)
+			samples = append(samples, reportSample{
+				device:      cmp.Or(s.UUID, strconv.Itoa(s.Index)),
+				index:       s.Index,
+				uuid:        s.UUID,
+				timestamp:   s.Timestamp,
+				temperature: float64(s.Temperature),
+				power:       float64(s.Power),
+				gpuUsage:    float64(s.GpuUsage),
+				memoryUsed:  float64(s.MemoryUsed),
+				memoryTotal: float64(s.MemoryTotal),
+				tenant:      tenant,
+				user:        user,
+				job:         job,
+			})
+		}
+	}
+	return samples, nil
+}
+
+// reportCommand implements the report subcommand and returns the exit code.
+func reportCommand(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "chargeback":
+			return chargebackCommand(args[1:])
+		case "utilization":
+			return utilizationCommand(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "usage: gpumon-go report chargeback|utilization [flags]")
+	return 2
+}
+
+// chargebackRow is the GPU time billed to one group. Memory is in GiB like memory_used.
+type chargebackRow struct {
+	Group         string  `json:"group"`
+	Devices       int     `json:"devices"`
+	GPUHours      float64 `json:"gpu_hours"`
+	BusyGPUHours  float64 `json:"busy_gpu_hours"`
+	MemoryGBHours float64 `json:"memory_gb_hours"`
+}
+
+// chargebackReport is the JSON form of the report.
+type chargebackReport struct {
+	GroupBy string          `json:"group_by"`
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	Groups  []chargebackRow `json:"groups"`
+}
+
+func chargebackCommand(args []string) int {
+	fs := flag.NewFlagSet("report chargeback", flag.ExitOnError)
+	var source reportSource
+	source.flags(fs, 720*time.Hour)
+	groupBy := fs.String("group-by", "tenant", "what GPU time is billed to: "+strings.Join(chargebackGroups, ", "))
+	format := fs.String("format", "csv", "output format: csv, json or html")
+	maxGap := fs.Duration("max-gap", 5*time.Minute, "longest time between two samples of a GPU that is billed, longer gaps are not")
+	fs.Parse(args)
+	if !slices.Contains(chargebackGroups, *groupBy) || !slices.Contains([]string{"csv", "json", "html"}, *format) || *maxGap <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go report chargeback (-influx file | -url address) [-since 720h] [-group-by tenant|user|job] [-format csv|json|html]")
+		return 2
+	}
+	now := time.Now()
+	samples, err := source.load(now)
+	if err != nil {
+		log.Printf("Unable to load history: %v", err)
+		return 1
+	}
+	report := chargebackReport{GroupBy: *groupBy, To: now, Groups: chargeback(samples, *groupBy, *maxGap)}
+	if len(samples) > 0 {
+		report.From = slices.MinFunc(samples, func(a, b reportSample) int { return a.timestamp.Compare(b.timestamp) }).timestamp
+	}
+	if err := writeChargeback(os.Stdout, report, *format); err != nil {
+		log.Printf("Unable to write report: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// chargeback bills the time until each device's next sample to the group of the sample,
+// samples ordered by device and time. Gaps longer than maxGap, e.g. while the agent was not
+// running, are not billed. Time without a group is billed to "unassigned". The groups are
+// ordered by GPU hours, the most first.
+func chargeback(samples []reportSample, groupBy string, maxGap time.Duration) []chargebackRow {
+	rows := make(map[string]*chargebackRow)
+	devices := make(map[string]map[string]bool)
+	for i := 0; i+1 < len(samples); i++ {
+		s, next := samples[i], samples[i+1]
+		elapsed := next.timestamp.Sub(s.timestamp)
+		if next.device != s.device || elapsed <= 0 || elapsed > maxGap {
+			continue
+		}
+		group := cmp.Or(s.group(groupBy), "unassigned")
+		row, ok := rows[group]
+		if !ok {
+			row = &chargebackRow{Group: group}
+			rows[group] = row
+			devices[group] = make(map[string]bool)
+		}
+		hours := elapsed.Hours()
+		row.GPUHours += hours
+		row.BusyGPUHours += hours * s.gpuUsage / 100
+		row.MemoryGBHours += hours * s.memoryUsed
+		devices[group][s.device] = true
+	}
+	report := make([]chargebackRow, 0, len(rows))
+	for group, row := range rows {
+		row.Devices = len(devices[group])
+		report = append(report, *row)
+	}
+	slices.SortFunc(report, func(a, b chargebackRow) int {
+		return cmp.Or(cmp.Compare(b.GPUHours, a.GPUHours), strings.Compare(a.Group, b.Group))
+	})
+	return report
+}
+
+var chargebackHTML = template.Must(template.New("chargeback").Funcs(template.FuncMap{"hours": formatHours}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GPU chargeback by {{.GroupBy}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.4em 1em; }
+td.number { text-align: right; font-variant-numeric: tabular-nums; }
+</style>
+</head>
+<body>
+<h1>GPU chargeback by {{.GroupBy}}</h1>
+<p>{{.From.Format "2006-01-02 15:04 MST"}} to {{.To.Format "2006-01-02 15:04 MST"}}</p>
+<table>
+<tr><th>{{.GroupBy}}</th><th>GPUs</th><th>GPU hours</th><th>Busy GPU hours</th><th>Memory GiB hours</th></tr>
+{{range .Groups}}<tr><td>{{.Group}}</td><td class="number">{{.Devices}}</td><td class="number">{{hours .GPUHours}}</td><td class="number">{{hours .BusyGPUHours}}</td><td class="number">{{hours .MemoryGBHours}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func formatHours(hours float64) string {
+	return strconv.FormatFloat(hours, 'f', 3, 64)
+}
+
+// writeChargeback writes the report as CSV with a header row, JSON or a standalone HTML page.
+func writeChargeback(w io.Writer, report chargebackReport, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "html":
+		return chargebackHTML.Execute(w, report)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{report.GroupBy, "devices", "gpu_hours", "busy_gpu_hours", "memory_gb_hours"})
+	for _, row := range report.Groups {
+		cw.Write([]string{row.Group, strconv.Itoa(row.Devices), formatHours(row.GPUHours), formatHours(row.BusyGPUHours), formatHours(row.MemoryGBHours)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// The charts of the utilization report are chartWidth by chartHeight pixels, the samples are
+// averaged into one point per pixel column.
+const (
+	chartWidth  = 720
+	chartHeight = 120
+)
+
+// utilizationCharts are the metrics charted for every GPU. A zero max scales the chart to
+// the peak.
+var utilizationCharts = []struct {
+	title string
+	unit  string
+	max   float64
+	value func(reportSample) float64
+}{
+	{"GPU utilization", "%", 100, func(s reportSample) float64 { return s.gpuUsage }},
+	{"Memory used", "%", 100, reportSample.memoryPercent},
+	{"Power", "W", 0, func(s reportSample) float64 { return s.power }},
+	{"Temperature", "°C", 0, func(s reportSample) float64 { return s.temperature }},
+}
+
+func (s reportSample) memoryPercent() float64 {
+	if s.memoryTotal == 0 {
+		return 0
+	}
+	return 100 * s.memoryUsed / s.memoryTotal
+}
+
+// utilizationReport summarizes every GPU over a time range.
+type utilizationReport struct {
+	From    time.Time
+	To      time.Time
+	Devices []deviceUtilization
+}
+
+// deviceUtilization summarizes one GPU. The averages are weighted by the time until the next
+// sample, so a changed poll interval does not skew them.
+type deviceUtilization struct {
+	Index          int
+	UUID           string
+	Hours          float64
+	GpuUsageAvg    float64
+	GpuUsageMax    float64
+	MemoryUsedAvg  float64
+	PowerAvg       float64
+	EnergyKWh      float64
+	TemperatureMax float64
+	// IdlePercent is the share of the time the GPU was not used at all
+	IdlePercent float64
+	Charts      []utilizationChart
+}
+
+// utilizationChart holds the SVG polylines of a metric, split where there are no samples.
+type utilizationChart struct {
+	Title string
+	Unit  string
+	Max   float64
+	Lines []string
+}
+
+func utilizationCommand(args []string) int {
+	fs := flag.NewFlagSet("report utilization", flag.ExitOnError)
+	var source reportSource
+	source.flags(fs, 24*time.Hour)
+	devicesFlag := fs.String("devices", "", "comma separated indexes or UUID patterns of the devices to report on, all by default")
+	maxGap := fs.Duration("max-gap", 5*time.Minute, "longest time between two samples of a GPU that is charted as a line, longer gaps are left blank")
+	fs.Parse(args)
+	if *maxGap <= 0 {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go report utilization (-influx file | -url address) [-since 24h] [-devices 0,1] > report.html")
+		return 2
+	}
+	var filter []string
+	if *devicesFlag != "" {
+		filter = strings.Split(*devicesFlag, ",")
+		if err := validatePatterns(filter); err != nil {
+			log.Printf("Invalid -devices: %v", err)
+			return 2
+		}
+	}
+	now := time.Now()
+	samples, err := source.load(now)
+	if err != nil {
+		log.Printf("Unable to load history: %v", err)
+		return 1
+	}
+	if len(filter) > 0 {
+		samples = slices.DeleteFunc(samples, func(s reportSample) bool {
+			return !matchDevice(filter, Device{Index: s.index, UUID: s.uuid})
+		})
+	}
+	if len(samples) == 0 {
+		log.Printf("No samples found")
+		return 1
+	}
+	report := utilizationReport{From: now.Add(-source.since), To: now}
+	if source.since <= 0 {
+		// Chart all of the history rather than up to now
+		byTime := func(a, b reportSample) int { return a.timestamp.Compare(b.timestamp) }
+		report.From, report.To = slices.MinFunc(samples, byTime).timestamp, slices.MaxFunc(samples, byTime).timestamp
+	}
+	report.Devices = utilization(samples, report.From, report.To, *maxGap)
+	if err := utilizationHTML.Execute(os.Stdout, report); err != nil {
+		log.Printf("Unable to write report: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// utilization summarizes the samples, ordered by device and time, of every GPU from from to
+// to. Gaps longer than maxGap do not count towards the averages.
+func utilization(samples []reportSample, from, to time.Time, maxGap time.Duration) []deviceUtilization {
+	var devices []deviceUtilization
+	for start := 0; start < len(samples); {
+		end := start + 1
+		for end < len(samples) && samples[end].device == samples[start].device {
+			end++
+		}
+		devices = append(devices, summarizeDevice(samples[start:end], from, to, maxGap))
+		start = end
+	}
+	slices.SortFunc(devices, func(a, b deviceUtilization) int {
+		return cmp.Or(cmp.Compare(a.Index, b.Index), strings.Compare(a.UUID, b.UUID))
+	})
+	return devices
+}
+
+func summarizeDevice(samples []reportSample, from, to time.Time, maxGap time.Duration) deviceUtilization {
+	d := deviceUtilization{Index: samples[0].index, UUID: samples[0].uuid}
+	var weights []float64
+	var total, idle float64
+	for i, s := range samples {
+		var hours float64
+		if i+1 < len(samples) {
+			if elapsed := samples[i+1].timestamp.Sub(s.timestamp); elapsed > 0 && elapsed <= maxGap {
+				hours = elapsed.Hours()
+			}
+		}
+		weights = append(weights, hours)
+		total += hours
+		d.EnergyKWh += s.power * hours / 1000
+		if s.gpuUsage == 0 {
+			idle += hours
+		}
+		d.GpuUsageMax = max(d.GpuUsageMax, s.gpuUsage)
+		d.TemperatureMax = max(d.TemperatureMax, s.temperature)
+	}
+	d.Hours = total
+	if total == 0 {
+		// A single sample or only gaps, every sample counts the same
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = float64(len(weights))
+	}
+	for i, s := range samples {
+		w := weights[i] / total
+		d.GpuUsageAvg += s.gpuUsage * w
+		d.MemoryUsedAvg += s.memoryPercent() * w
+		d.PowerAvg += s.power * w
+	}
+	if d.Hours > 0 {
+		d.IdlePercent = 100 * idle / d.Hours
+	}
+	for _, c := range utilizationCharts {
+		peak := c.max
+		if peak == 0 {
+			for _, s := range samples {
+				peak = max(peak, c.value(s))
+			}
+		}
+		d.Charts = append(d.Charts, utilizationChart{
+			Title: c.title,
+			Unit:  c.unit,
+			Max:   peak,
+			Lines: chartLines(samples, c.value, peak, from, to, maxGap),
+		})
+	}
+	return d
+}
+
+// chartLines averages the values of the samples into one point per pixel column and returns
+// them as SVG polyline points, starting a new line after a gap longer than maxGap.
+func chartLines(samples []reportSample, value func(reportSample) float64, peak float64, from, to time.Time, maxGap time.Duration) []string {
+	span := to.Sub(from)
+	if span <= 0 || peak <= 0 {
+		return nil
+	}
+	var lines []string
+	var line strings.Builder
+	column, sum, n := -1, 0.0, 0
+	point := func() {
+		if n == 0 {
+			return
+		}
+		y := chartHeight * (1 - min(sum/float64(n)/peak, 1))
+		fmt.Fprintf(&line, "%d,%.1f ", column, y)
+	}
+	for i, s := range samples {
+		if s.timestamp.Before(from) || s.timestamp.After(to) {
+			continue
+		}
+		x := min(int(float64(chartWidth)*float64(s.timestamp.Sub(from))/float64(span)), chartWidth)
+		if i > 0 && s.timestamp.Sub(samples[i-1].timestamp) > maxGap {
+			point()
+			lines = append(lines, strings.TrimSpace(line.String()))
+			line.Reset()
+			column, sum, n = -1, 0, 0
+		}
+		if x != column {
+			point()
+			column, sum, n = x, 0, 0
+		}
+		sum += value(s)
+		n++
+	}
+	point()
+	lines = append(lines, strings.TrimSpace(line.String()))
+	return slices.DeleteFunc(lines, func(l string) bool { return l == "" })
+}
+
+var utilizationHTML = template.Must(template.New("utilization").Funcs(template.FuncMap{
+	"round":  func(v float64) string { return strconv.FormatFloat(v, 'f', 1, 64) },
+	"hours":  formatHours,
+	"width":  func() int { return chartWidth },
+	"height": func() int { return chartHeight },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GPU utilization</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.4em 1em; text-align: right; font-variant-numeric: tabular-nums; }
+th:first-child, td:first-child { text-align: left; }
+.device { margin-bottom: 2em; }
+.charts { display: flex; flex-wrap: wrap; gap: 1em; }
+.chart h3 { font-size: 0.9em; margin: 0.5em 0; font-weight: normal; }
+svg { background: #f7f7f7; }
+polyline { fill: none; stroke: #3b6fb6; stroke-width: 1.5; stroke-linecap: round; }
+@media print { .device { break-inside: avoid; } }
+</style>
+</head>
+<body>
+<h1>GPU utilization</h1>
+<p>{{.From.Format "2006-01-02 15:04 MST"}} to {{.To.Format "2006-01-02 15:04 MST"}}</p>
+<table>
+<tr><th>GPU</th><th>Hours</th><th>Utilization avg</th><th>Utilization max</th><th>Idle</th><th>Memory used avg</th><th>Power avg</th><th>Energy</th><th>Temperature max</th></tr>
+{{range .Devices}}<tr><td>{{.Index}} {{.UUID}}</td><td>{{hours .Hours}}</td><td>{{round .GpuUsageAvg}}%</td><td>{{round .GpuUsageMax}}%</td><td>{{round .IdlePercent}}%</td><td>{{round .MemoryUsedAvg}}%</td><td>{{round .PowerAvg}} W</td><td>{{hours .EnergyKWh}} kWh</td><td>{{round .TemperatureMax}} °C</td></tr>
+{{end}}</table>
+{{range .Devices}}<div class="device">
+<h2>GPU {{.Index}} {{.UUID}}</h2>
+<div class="charts">
+{{range .Charts}}<div class="chart">
+<h3>{{.Title}}, 0 to {{round .Max}} {{.Unit}}</h3>
+<svg width="{{width}}" height="{{height}}" viewBox="0 0 {{width}} {{height}}">{{range .Lines}}<polyline points="{{.}}"/>{{end}}</svg>
+</div>
+{{end}}</div>
+</div>
+{{end}}</body>
+</html>
+`))
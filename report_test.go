@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+func TestParseInfluxSample(t *testing.T) {
+	labeled := fixtureSamples()[0]
+	labeled.Tenant = "team a"
+	labeled.Labels = map[string]string{"user": `alice\`, "job": "run=42,lr"}
+	shared := fixtureSamples()[1]
+	shared.Pods = []PodAllocation{{Namespace: "ml", Pod: "train-0", Container: "main"}}
+	jobs := fixtureSamples()[1]
+	jobs.Pods = shared.Pods
+	jobs.Jobs = []JobProcess{{PID: 1, Job: "bert"}, {PID: 2, Job: "bert"}, {PID: 3, Job: "gpt"}, {PID: 4}}
+	display := fixtureSamples()[0]
+	display.Extended = &ExtendedMetrics{Display: &gpumon.Display{Mode: "compute"}}
+	tests := []struct {
+		name   string
+		sample Sample
+		want   reportSample
+	}{
+		{
+			name:   "labels",
+			sample: labeled,
+			want:   reportSample{device: labeled.UUID, uuid: labeled.UUID, timestamp: fixtureTime, temperature: 54, power: 231.5, gpuUsage: 97, memoryUsed: 61.25, memoryTotal: 79.6, tenant: "team a", user: `alice\`, job: "run=42,lr"},
+		},
+		{
+			name:   "pods",
+			sample: shared,
+			want:   reportSample{device: shared.UUID, index: 1, uuid: shared.UUID, timestamp: fixtureTime, temperature: 38, power: 61.75, memoryUsed: 0.5, memoryTotal: 79.6, tenant: "ml", job: "train-0"},
+		},
+		{
+			name:   "detected jobs",
+			sample: jobs,
+			want:   reportSample{device: jobs.UUID, index: 1, uuid: jobs.UUID, timestamp: fixtureTime, temperature: 38, power: 61.75, memoryUsed: 0.5, memoryTotal: 79.6, tenant: "ml", job: "bert,gpt"},
+		},
+		{
+			name:   "string fields",
+			sample: display,
+			want:   reportSample{device: display.UUID, uuid: display.UUID, timestamp: fixtureTime, temperature: 54, power: 231.5, gpuUsage: 97, memoryUsed: 61.25, memoryTotal: 79.6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			(&InfluxPublisher{host: "node 1"}).appendSample(&b, tt.sample)
+			got, err := parseInfluxSample(string(bytes.TrimSuffix(b.Bytes(), []byte("\n"))))
+			if err != nil {
+				t.Fatalf("parseInfluxSample(%q) error = %v", b.String(), err)
+			}
+			if !got.timestamp.Equal(tt.want.timestamp) {
+				t.Errorf("timestamp = %v, want %v", got.timestamp, tt.want.timestamp)
+			}
+			got.timestamp = tt.want.timestamp
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseInfluxSample(%q) = %+v, want %+v", b.String(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChargeback(t *testing.T) {
+	at := func(minutes int) time.Time { return fixtureTime.Add(time.Duration(minutes) * time.Minute) }
+	samples := []reportSample{
+		{device: "GPU-0", timestamp: at(0), gpuUsage: 100, memoryUsed: 10, tenant: "a"},
+		{device: "GPU-0", timestamp: at(30), gpuUsage: 50, memoryUsed: 20, tenant: "a"},
+		{device: "GPU-0", timestamp: at(60), gpuUsage: 0, memoryUsed: 0},
+		// The agent was down for longer than the maximum gap
+		{device: "GPU-0", timestamp: at(90)},
+		{device: "GPU-0", timestamp: at(200), tenant: "a"},
+		{device: "GPU-1", timestamp: at(0), gpuUsage: 100, memoryUsed: 40, tenant: "b"},
+		{device: "GPU-1", timestamp: at(60), gpuUsage: 100, memoryUsed: 40, tenant: "b"},
+	}
+	tests := []struct {
+		name   string
+		maxGap time.Duration
+		want   []chargebackRow
+	}{
+		{
+			name:   "gaps are not billed",
+			maxGap: 30 * time.Minute,
+			want: []chargebackRow{
+				{Group: "a", Devices: 1, GPUHours: 1, BusyGPUHours: 0.75, MemoryGBHours: 15},
+				{Group: "unassigned", Devices: 1, GPUHours: 0.5},
+			},
+		},
+		{
+			name:   "hourly samples",
+			maxGap: 100 * time.Minute,
+			want: []chargebackRow{
+				{Group: "a", Devices: 1, GPUHours: 1, BusyGPUHours: 0.75, MemoryGBHours: 15},
+				{Group: "b", Devices: 1, GPUHours: 1, BusyGPUHours: 1, MemoryGBHours: 40},
+				{Group: "unassigned", Devices: 1, GPUHours: 0.5},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chargeback(samples, "tenant", tt.maxGap); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chargeback() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeDevice(t *testing.T) {
+	at := func(minutes int) time.Time { return fixtureTime.Add(time.Duration(minutes) * time.Minute) }
+	tests := []struct {
+		name    string
+		samples []reportSample
+		want    deviceUtilization
+	}{
+		{
+			name: "weighted by time",
+			samples: []reportSample{
+				{timestamp: at(0), gpuUsage: 100, power: 300, memoryUsed: 40, memoryTotal: 80, temperature: 70},
+				{timestamp: at(15), gpuUsage: 0, power: 100, memoryUsed: 0, memoryTotal: 80, temperature: 40},
+				{timestamp: at(60), gpuUsage: 50, power: 200, memoryUsed: 80, memoryTotal: 80, temperature: 50},
+			},
+			want: deviceUtilization{Hours: 1, GpuUsageAvg: 25, GpuUsageMax: 100, MemoryUsedAvg: 12.5, PowerAvg: 150, EnergyKWh: 0.15, TemperatureMax: 70, IdlePercent: 75},
+		},
+		{
+			name: "gaps are left out",
+			samples: []reportSample{
+				{timestamp: at(0), gpuUsage: 100, power: 300, memoryTotal: 80},
+				{timestamp: at(30), gpuUsage: 0, power: 100, memoryTotal: 80},
+				{timestamp: at(600), gpuUsage: 0, power: 100, memoryTotal: 80},
+			},
+			want: deviceUtilization{Hours: 0.5, GpuUsageAvg: 100, GpuUsageMax: 100, PowerAvg: 300, EnergyKWh: 0.15},
+		},
+		{
+			name:    "single sample",
+			samples: []reportSample{{timestamp: at(0), gpuUsage: 40, power: 120, memoryUsed: 20, memoryTotal: 80, temperature: 45}},
+			want:    deviceUtilization{GpuUsageAvg: 40, GpuUsageMax: 40, MemoryUsedAvg: 25, PowerAvg: 120, TemperatureMax: 45},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := summarizeDevice(tt.samples, at(0), at(60), time.Hour)
+			if len(got.Charts) != len(utilizationCharts) {
+				t.Errorf("summarizeDevice() has %d charts, want %d", len(got.Charts), len(utilizationCharts))
+			}
+			got.Charts = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("summarizeDevice() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChartLines(t *testing.T) {
+	from := fixtureTime
+	at := func(d time.Duration, usage float64) reportSample {
+		return reportSample{timestamp: from.Add(d), gpuUsage: usage}
+	}
+	tests := []struct {
+		name    string
+		samples []reportSample
+		want    []string
+	}{
+		{name: "no samples"},
+		{name: "one point per column", samples: []reportSample{at(0, 100), at(time.Second, 50), at(2*time.Minute, 0)}, want: []string{"0,30.0 12,120.0"}},
+		{name: "split at gaps", samples: []reportSample{at(0, 50), at(time.Minute, 50), at(90*time.Minute, 100), at(2*time.Hour, 100)}, want: []string{"0,60.0 6,60.0", "540,0.0", "720,0.0"}},
+		{name: "peak clamps", samples: []reportSample{at(0, 250)}, want: []string{"0,0.0"}},
+		{name: "outside the range", samples: []reportSample{at(-time.Hour, 50), at(3*time.Hour, 50)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := chartLines(tt.samples, func(s reportSample) float64 { return s.gpuUsage }, 100, from, from.Add(2*time.Hour), 5*time.Minute)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("chartLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+// riskMinInterval limits how often the error counters are read, they change slowly.
+const riskMinInterval = time.Minute
+
+// Weights of the failure risk factors, they add up to 1.
+const (
+	riskWeightRetired     = 0.35
+	riskWeightPending     = 0.2
+	riskWeightUncorrected = 0.3
+	riskWeightCorrected   = 0.15
+)
+
+// Counts at which a factor reaches its full weight.
+const (
+	// Drivers retire up to 64 pages, Ampere and later remap up to 8 rows per bank
+	riskRetiredLimit     = 60
+	riskUncorrectedLimit = 10
+	// Corrected errors per hour
+	riskCorrectedLimit = 100
+)
+
+// FailureRisk scores how likely a GPU is to fail from 0 (healthy) to 1, together with the
+// contribution of each factor so the score can be explained.
+type FailureRisk struct {
+	Score             float64 `json:"score"`
+	RetiredPages      float64 `json:"retired_pages"`
+	PendingRetirement float64 `json:"pending_retirement"`
+	UncorrectedECC    float64 `json:"uncorrected_ecc"`
+	CorrectedECCRate  float64 `json:"corrected_ecc_rate"`
+}
+
+type riskState struct {
+	last      time.Time
+	cached    FailureRisk
+	start     time.Time
+	corrected uint64
+}
+
+// RiskCollector scores devices from their memory error counters. The corrected error rate is
+// measured since the agent started, there is no history before that.
+type RiskCollector struct {
+	mu      sync.Mutex
+	devices map[int]*riskState
+}
+
+func NewRiskCollector() *RiskCollector {
+	return &RiskCollector{devices: make(map[int]*riskState)}
+}
+
+// Collect returns the failure risk of the device. Counters the device does not support do not
+// add to the score.
+func (c *RiskCollector) Collect(d Device) FailureRisk {
+	if d.Handle == nil {
+		return FailureRisk{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	state, ok := c.devices[d.Index]
+	if !ok {
+		state = &riskState{start: now}
+		state.corrected, _ = d.Handle.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_CORRECTED, nvml.AGGREGATE_ECC)
+		c.devices[d.Index] = state
+	} else if now.Sub(state.last) < riskMinInterval {
+		return state.cached
+	}
+	state.last = now
+
+	var risk FailureRisk
+	retired, pending := retiredMemory(d)
+	risk.RetiredPages = riskWeightRetired * math.Min(float64(retired)/riskRetiredLimit, 1)
+	if pending {
+		risk.PendingRetirement = riskWeightPending
+	}
+	if count, ret := d.Handle.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.AGGREGATE_ECC); ret == nvml.SUCCESS {
+		risk.UncorrectedECC = riskWeightUncorrected * math.Min(float64(count)/riskUncorrectedLimit, 1)
+	}
+	if count, ret := d.Handle.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_CORRECTED, nvml.AGGREGATE_ECC); ret == nvml.SUCCESS && count > state.corrected {
+		// Measure over at least an hour so a burst right after startup is not extrapolated
+		hours := math.Max(now.Sub(state.start).Hours(), 1)
+		rate := float64(count-state.corrected) / hours
+		risk.CorrectedECCRate = riskWeightCorrected * math.Min(rate/riskCorrectedLimit, 1)
+	}
+	risk.Score = risk.RetiredPages + risk.PendingRetirement + risk.UncorrectedECC + risk.CorrectedECCRate
+	state.cached = risk
+	return risk
+}
+
+// retiredMemory returns how many pages were retired or rows remapped and whether one is
+// pending until the next reset. Ampere and later remap rows instead of retiring pages.
+func retiredMemory(d Device) (int, bool) {
+	corrected, uncorrected, pending, failed, ret := d.Handle.GetRemappedRows()
+	if ret == nvml.SUCCESS {
+		if failed {
+			// No spare rows are left, the next error cannot be repaired
+			return riskRetiredLimit, pending
+		}
+		return corrected + uncorrected, pending
+	}
+	retired := 0
+	for _, cause := range []nvml.PageRetirementCause{nvml.PAGE_RETIREMENT_CAUSE_MULTIPLE_SINGLE_BIT_ECC_ERRORS, nvml.PAGE_RETIREMENT_CAUSE_DOUBLE_BIT_ECC_ERROR} {
+		if pages, ret := d.Handle.GetRetiredPages(cause); ret == nvml.SUCCESS {
+			retired += len(pages)
+		}
+	}
+	state, ret := d.Handle.GetRetiredPagesPendingStatus()
+	return retired, ret == nvml.SUCCESS && state == nvml.FEATURE_ENABLED
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// runContextCheckInterval is how often the context file is checked for changes.
+const runContextCheckInterval = 5 * time.Second
+
+// RunContext holds the labels declared by workloads in a context file, e.g.
+// {"run_id": "42", "experiment": "lr-sweep"}. Its keys label every sample while the file
+// exists.
+type RunContext struct {
+	path   string
+	labels atomic.Pointer[map[string]string]
+}
+
+func NewRunContext(path string) *RunContext {
+	c := &RunContext{path: path}
+	c.load()
+	return c
+}
+
+// Labels returns the current labels, which must not be modified.
+func (c *RunContext) Labels() map[string]string {
+	if c == nil {
+		return nil
+	}
+	if labels := c.labels.Load(); labels != nil {
+		return *labels
+	}
+	return nil
+}
+
+// Watch reloads the file whenever it changes, appears or disappears. It never returns.
+func (c *RunContext) Watch() {
+	var lastMod time.Time
+	if info, err := os.Stat(c.path); err == nil {
+		lastMod = info.ModTime()
+	}
+	ticker := time.NewTicker(runContextCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var mod time.Time
+		if info, err := os.Stat(c.path); err == nil {
+			mod = info.ModTime()
+		}
+		if mod.Equal(lastMod) {
+			continue
+		}
+		if c.load() {
+			lastMod = mod
+		}
+	}
+}
+
+// load reads the file and reports whether it succeeded. On failure the previous labels are
+// kept and the file is read again on the next check, the workload may be rewriting it.
+func (c *RunContext) load() bool {
+	labels, err := readRunContext(c.path)
+	if err != nil {
+		log.Printf("Unable to read run context: %v", err)
+		return false
+	}
+	c.labels.Store(&labels)
+	return true
+}
+
+// readRunContext reads the labels from a JSON object of strings, numbers and booleans. A
+// missing file means no labels.
+func readRunContext(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	labels := make(map[string]string, len(fields))
+	for key, value := range fields {
+		switch v := value.(type) {
+		case string:
+			labels[key] = v
+		case float64:
+			labels[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			labels[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", path, key)
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadRunContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		content *string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "missing file", content: nil, want: nil},
+		{
+			name:    "strings, numbers and booleans",
+			content: ptr(`{"job": "llama-70b", "step": 1200, "lr": 0.0003, "eval": false}`),
+			want:    map[string]string{"job": "llama-70b", "step": "1200", "lr": "0.0003", "eval": "false"},
+		},
+		{name: "large numbers are not in exponent form", content: ptr(`{"tokens": 12000000000}`), want: map[string]string{"tokens": "12000000000"}},
+		{name: "empty object", content: ptr(`{}`), want: map[string]string{}},
+		{name: "nested object", content: ptr(`{"job": {"name": "x"}}`), wantErr: true},
+		{name: "null", content: ptr(`{"job": null}`), wantErr: true},
+		{name: "not an object", content: ptr(`["job"]`), wantErr: true},
+		{name: "partially written", content: ptr(`{"job": "lla`), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "context.json")
+			if tt.content != nil {
+				if err := os.WriteFile(path, []byte(*tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := readRunContext(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readRunContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("readRunContext() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
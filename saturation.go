@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SaturationConfig computes the saturation headroom of every device over a sliding Window
+// (default 5m) from the Percentile (default 95) of its utilization.
+type SaturationConfig struct {
+	Window     Duration `json:"window"`
+	Percentile float64  `json:"percentile"`
+}
+
+// Saturation is how far a device is from saturation, as an autoscaler input. Utilization is the
+// configured percentile over the window and MemoryPressure the peak percent of memory used.
+// Headroom is 100 minus the larger of the two, so whichever saturates first decides.
+type Saturation struct {
+	Percentile     float64 `json:"percentile"`
+	Utilization    float64 `json:"utilization"`
+	MemoryPressure float64 `json:"memory_pressure"`
+	Headroom       float64 `json:"headroom"`
+}
+
+type saturationPoint struct {
+	at          time.Time
+	utilization float64
+	memory      float64
+}
+
+// SaturationTracker keeps the window of every device. It is shared by the pollers.
+type SaturationTracker struct {
+	window     time.Duration
+	percentile float64
+
+	mu      sync.Mutex
+	devices map[int][]saturationPoint
+}
+
+func NewSaturationTracker(cfg SaturationConfig) *SaturationTracker {
+	t := &SaturationTracker{window: cfg.Window.Duration, percentile: cfg.Percentile, devices: make(map[int][]saturationPoint)}
+	if t.window == 0 {
+		t.window = 5 * time.Minute
+	}
+	if t.percentile == 0 {
+		t.percentile = 95
+	}
+	return t
+}
+
+// Observe adds the metrics collected at now to the device's window and returns its headroom.
+func (t *SaturationTracker) Observe(index int, m Metrics, now time.Time) Saturation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	point := saturationPoint{at: now, utilization: float64(m.GpuUsage), memory: float64(m.MemoryUsedPercent)}
+	points := append(t.devices[index], point)
+	points = slices.DeleteFunc(points, func(p saturationPoint) bool { return now.Sub(p.at) > t.window })
+	t.devices[index] = points
+
+	utilization := make([]float64, len(points))
+	h := Saturation{Percentile: t.percentile}
+	for i, p := range points {
+		utilization[i] = p.utilization
+		h.MemoryPressure = math.Max(h.MemoryPressure, p.memory)
+	}
+	slices.Sort(utilization)
+	// Nearest rank, so the result is always an observed value
+	rank := int(math.Ceil(t.percentile/100*float64(len(utilization)))) - 1
+	h.Utilization = utilization[max(rank, 0)]
+	h.Headroom = 100 - math.Max(h.Utilization, h.MemoryPressure)
+	return h
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+var durationType = reflect.TypeOf(Duration{})
+
+// ConfigSchema generates the JSON Schema of the config file from the Config struct.
+func ConfigSchema() map[string]any {
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = schemaDraft
+	schema["title"] = "gpumon-go config"
+	// Allow config files to point editors at the schema
+	schema["properties"].(map[string]any)["$schema"] = map[string]any{"type": "string"}
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	if t == durationType {
+		// Everything time.ParseDuration accepts, including a bare "0" and a sign
+		return map[string]any{
+			"type":    "string",
+			"pattern": `^[-+]?(0|(([0-9]+(\.[0-9]*)?|\.[0-9]+)(ns|us|µs|μs|ms|s|m|h))+)$`,
+		}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]any)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = typeSchema(field.Type)
+		}
+		// Unknown keys are ignored by the agent, rejecting them here catches typos in CI
+		return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+	}
+	return map[string]any{}
+}
+
+// configCommand implements the config subcommand and returns the exit code.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "schema" {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go config schema")
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ConfigSchema()); err != nil {
+		log.Fatalf("Unable to marshal schema to JSON: %v", err)
+	}
+	return 0
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// updateChecksums lists the SHA-256 of every release asset in sha256sum format
+	updateChecksums = "checksums.txt"
+	// updateSignature is the base64 ed25519 signature of updateChecksums
+	updateSignature = "checksums.txt.sig"
+	// updateMaxSize bounds every download
+	updateMaxSize = 256 << 20
+)
+
+// updatePublicKey verifies the signature of release checksums. Release builds embed it with
+// -ldflags "-X main.updatePublicKey=<base64 DER>", without a key updates are refused unless
+// -insecure-skip-signature is given.
+var updatePublicKey = ""
+
+// updateRelease is a release found at an update source, with the download URLs of its assets.
+type updateRelease struct {
+	Version string
+	assets  map[string]string
+}
+
+// selfUpdateCommand implements the self-update subcommand and returns the exit code.
+func selfUpdateCommand(args []string) int {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	source := fs.String("source", "github:ethanholz/gpumon-go", "where releases are published, github:<owner>/<repo> or a base URL, e.g. an S3 bucket, holding latest and <version>/<asset>")
+	target := fs.String("version", "", "version to install, the latest release by default")
+	keyFile := fs.String("public-key", "", "PEM file with the ed25519 key the checksums are signed with, overrides the built-in key")
+	check := fs.Bool("check", false, "only report whether an update is available")
+	force := fs.Bool("force", false, "install even if the version is already running")
+	rollback := fs.Bool("rollback", false, "restore the binary replaced by the previous update")
+	insecure := fs.Bool("insecure-skip-signature", false, "install without verifying the checksums signature when there is no public key")
+	fs.Parse(args)
+	if fipsBuild {
+		log.Printf("Self-update is not available in FIPS builds, release signatures use ed25519 outside the FIPS module")
+		return 1
+	}
+
+	path, err := os.Executable()
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		log.Fatalf("Unable to find the running binary: %v", err)
+	}
+	if *rollback {
+		if err := restoreBinary(path); err != nil {
+			log.Fatalf("Unable to roll back: %v", err)
+		}
+		fmt.Printf("Restored the previous binary at %s\n", path)
+		return 0
+	}
+
+	key, err := updateKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Unable to load the update public key: %v", err)
+	}
+	client := &http.Client{Timeout: 5 * time.Minute}
+	release, err := findRelease(client, *source, *target)
+	if err != nil {
+		log.Fatalf("Unable to find release: %v", err)
+	}
+	current := buildInfo().Version
+	if strings.TrimPrefix(release.Version, "v") == strings.TrimPrefix(current, "v") && !*force {
+		fmt.Printf("gpumon-go %s is up to date\n", current)
+		return 0
+	}
+	if *check {
+		fmt.Printf("gpumon-go %s is available, running %s\n", release.Version, current)
+		return 0
+	}
+
+	if key == nil && !*insecure {
+		log.Printf("Refusing to install %s without a public key to verify its signature, pass -public-key or -insecure-skip-signature", release.Version)
+		return 1
+	}
+
+	asset := "gpumon-go-" + runtime.GOOS + "-" + runtime.GOARCH
+	binary, err := downloadRelease(client, release, asset, key)
+	if err != nil {
+		log.Fatalf("Unable to download %s %s: %v", asset, release.Version, err)
+	}
+	if err := replaceBinary(path, binary); err != nil {
+		log.Fatalf("Unable to update %s: %v", path, err)
+	}
+	fmt.Printf("Updated %s from %s to %s, restart the agent to run it\n", path, current, release.Version)
+	return 0
+}
+
+// updateKey returns the key from the PEM file, or the built-in key, nil without either.
+func updateKey(file string) (ed25519.PublicKey, error) {
+	var der []byte
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", file)
+		}
+		der = block.Bytes
+	case updatePublicKey != "":
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(updatePublicKey); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ed25519 key, got %T", parsed)
+	}
+	return key, nil
+}
+
+// findRelease looks up the version, the latest when empty, at the source.
+func findRelease(client *http.Client, source, version string) (updateRelease, error) {
+	if repo, ok := strings.CutPrefix(source, "github:"); ok {
+		return githubRelease(client, repo, version)
+	}
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		return updateRelease{}, fmt.Errorf("unknown source %q, expected github:<owner>/<repo> or a URL", source)
+	}
+	base := strings.TrimSuffix(source, "/")
+	if version == "" {
+		latest, err := fetch(client, base+"/latest")
+		if err != nil {
+			return updateRelease{}, err
+		}
+		version = strings.TrimSpace(string(latest))
+	}
+	release := updateRelease{Version: version, assets: make(map[string]string)}
+	for _, name := range []string{updateChecksums, updateSignature, "gpumon-go-" + runtime.GOOS + "-" + runtime.GOARCH} {
+		release.assets[name] = base + "/" + version + "/" + name
+	}
+	return release, nil
+}
+
+func githubRelease(client *http.Client, repo, version string) (updateRelease, error) {
+	url := "https://api.github.com/repos/" + repo + "/releases/latest"
+	if version != "" {
+		url = "https://api.github.com/repos/" + repo + "/releases/tags/" + version
+	}
+	data, err := fetch(client, url)
+	if err != nil {
+		return updateRelease{}, err
+	}
+	var r struct {
+		TagName string `json:"tag_name"`
+		Assets  []struct {
+			Name string `json:"name"`
+			URL  string `json:"browser_download_url"`
+		} `json:"assets"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return updateRelease{}, fmt.Errorf("invalid release from %s: %v", url, err)
+	}
+	release := updateRelease{Version: r.TagName, assets: make(map[string]string, len(r.Assets))}
+	for _, a := range r.Assets {
+		release.assets[a.Name] = a.URL
+	}
+	return release, nil
+}
+
+// downloadRelease downloads the asset and verifies it against the release checksums, whose
+// signature is verified first when there is a key.
+func downloadRelease(client *http.Client, release updateRelease, asset string, key ed25519.PublicKey) ([]byte, error) {
+	download := func(name string) ([]byte, error) {
+		url, ok := release.assets[name]
+		if !ok {
+			return nil, fmt.Errorf("release has no %s", name)
+		}
+		return fetch(client, url)
+	}
+	checksums, err := download(updateChecksums)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		encoded, err := download(updateSignature)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", updateSignature, err)
+		}
+		if !ed25519.Verify(key, checksums, signature) {
+			return nil, errors.New("checksums signature does not match the public key")
+		}
+	}
+	want, err := releaseChecksum(checksums, asset)
+	if err != nil {
+		return nil, err
+	}
+	binary, err := download(asset)
+	if err != nil {
+		return nil, err
+	}
+	if got := sha256.Sum256(binary); hex.EncodeToString(got[:]) != want {
+		return nil, fmt.Errorf("checksum of %s does not match", asset)
+	}
+	return binary, nil
+}
+
+// releaseChecksum finds the SHA-256 of name in sha256sum output.
+func releaseChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		sum, file, ok := strings.Cut(scanner.Text(), " ")
+		// Binary mode marks the file name with a star
+		if ok && strings.TrimPrefix(strings.TrimSpace(file), "*") == name {
+			return strings.ToLower(sum), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no checksum for %s", updateChecksums, name)
+}
+
+func fetch(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, updateMaxSize))
+}
+
+// restoreBinary puts back the binary kept by the previous update, once it is known to run.
+func restoreBinary(path string) error {
+	backup := path + ".old"
+	info, err := os.Stat(backup)
+	if err != nil {
+		return fmt.Errorf("no previous binary: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", backup)
+	}
+	if err := exec.Command(backup, "version").Run(); err != nil {
+		return fmt.Errorf("previous binary does not run: %v", err)
+	}
+	return os.Rename(backup, path)
+}
+
+// replaceBinary atomically replaces the binary at path. The new binary has to run before and
+// after the swap, otherwise the previous one is restored. The previous binary is kept next
+// to path with an .old suffix for -rollback.
+func replaceBinary(path string, binary []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gpumon-go-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := exec.Command(tmp.Name(), "version").Run(); err != nil {
+		return fmt.Errorf("new binary does not run: %v", err)
+	}
+	// A hard link keeps the previous binary at path until the rename replaces it
+	backup := path + ".old"
+	if err := os.Remove(backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(path, backup); err != nil {
+		return fmt.Errorf("unable to back up the previous binary: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err := exec.Command(path, "version").Run(); err != nil {
+		if rerr := os.Rename(backup, path); rerr != nil {
+			return fmt.Errorf("new binary does not run: %v, and restoring the previous one failed: %v", err, rerr)
+		}
+		return fmt.Errorf("new binary does not run, restored the previous one: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestReleaseChecksum(t *testing.T) {
+	checksums := []byte(`9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08  gpumon-go-linux-amd64
+60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752 *gpumon-go-linux-arm64
+not a checksum line
+`)
+	tests := []struct {
+		name    string
+		asset   string
+		want    string
+		wantErr bool
+	}{
+		{name: "text mode, lowercased", asset: "gpumon-go-linux-amd64", want: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+		{name: "binary mode", asset: "gpumon-go-linux-arm64", want: "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752"},
+		{name: "prefix of a listed name", asset: "gpumon-go-linux", wantErr: true},
+		{name: "missing", asset: "gpumon-go-darwin-arm64", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := releaseChecksum(checksums, tt.asset)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("releaseChecksum() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("releaseChecksum() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+	"github.com/ethanholz/gpumon-go/pkg/gpumon"
+)
+
+// Snapshot captures the configuration and state of every GPU, e.g. before and after
+// maintenance, to be compared with the diff subcommand.
+type Snapshot struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Driver    string           `json:"driver_version,omitempty"`
+	CUDA      int              `json:"cuda_version,omitempty"`
+	Devices   []DeviceSnapshot `json:"devices"`
+}
+
+// DeviceSnapshot holds the state of one GPU, fields the device does not support are omitted.
+type DeviceSnapshot struct {
+	Index          int     `json:"index"`
+	UUID           string  `json:"uuid"`
+	Name           string  `json:"name,omitempty"`
+	VBIOS          string  `json:"vbios_version,omitempty"`
+	SMClock        uint32  `json:"sm_clock,omitempty"`
+	MemoryClock    uint32  `json:"memory_clock,omitempty"`
+	MaxSMClock     uint32  `json:"max_sm_clock,omitempty"`
+	MaxMemoryClock uint32  `json:"max_memory_clock,omitempty"`
+	PowerLimit     float64 `json:"power_limit,omitempty"`
+	CorrectedECC   uint64  `json:"corrected_ecc"`
+	UncorrectedECC uint64  `json:"uncorrected_ecc"`
+	RetiredPages   int     `json:"retired_pages"`
+	Metrics
+}
+
+func TakeSnapshot(devices []Device) Snapshot {
+	s := Snapshot{Timestamp: time.Now(), Devices: []DeviceSnapshot{}}
+	for _, d := range devices {
+		ds := DeviceSnapshot{Index: d.Index, UUID: d.UUID}
+		ds.Name, _ = d.Handle.GetName()
+		ds.VBIOS, _ = d.Handle.GetVbiosVersion()
+		ds.SMClock, _ = d.Handle.GetClockInfo(nvml.CLOCK_SM)
+		ds.MemoryClock, _ = d.Handle.GetClockInfo(nvml.CLOCK_MEM)
+		ds.MaxSMClock, _ = d.Handle.GetMaxClockInfo(nvml.CLOCK_SM)
+		ds.MaxMemoryClock, _ = d.Handle.GetMaxClockInfo(nvml.CLOCK_MEM)
+		ds.PowerLimit, _ = d.GetPowerLimit()
+		ds.CorrectedECC, _ = d.Handle.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_CORRECTED, nvml.AGGREGATE_ECC)
+		ds.UncorrectedECC, _ = d.Handle.GetTotalEccErrors(nvml.MEMORY_ERROR_TYPE_UNCORRECTED, nvml.AGGREGATE_ECC)
+		ds.RetiredPages, _ = retiredMemory(d)
+		if metrics, err := d.GetMetrics(); err == nil {
+			ds.Metrics = metrics
+		}
+		s.Devices = append(s.Devices, ds)
+	}
+	return s
+}
+
+// snapshotCommand implements the snapshot subcommand and returns the exit code.
+func snapshotCommand(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	output := fs.String("o", "", "file to write the snapshot to, stdout by default")
+	fs.Parse(args)
+
+	loaded, err := gpumon.Init()
+	if err != nil {
+		log.Fatalf("Unable to load NVML: %v", err)
+	}
+	var devices []Device
+	if loaded {
+		defer nvml.Shutdown()
+		if devices, err = gpumon.GetDevices(); err != nil {
+			log.Fatalf("Unable to get devices: %v", err)
+		}
+	}
+	snapshot := TakeSnapshot(devices)
+	if loaded {
+		snapshot.Driver, _ = nvml.SystemGetDriverVersion()
+		snapshot.CUDA, _ = nvml.SystemGetCudaDriverVersion()
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to marshal snapshot to JSON: %v", err)
+	}
+	data = append(data, '\n')
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		log.Fatalf("Unable to write snapshot: %v", err)
+	}
+	return 0
+}
+
+// diffIgnored are fields that differ between any two captures.
+var diffIgnored = []string{"timestamp", "epoch", "seq", "monotonic_ns", "interval_ns", "clock_jump_ns", "suspended_ns", "trace_id"}
+
+// diffCounters are fields where any change matters, matched as substrings of the field name.
+var diffCounters = []string{"ecc", "retired", "version"}
+
+// diffCommand implements the diff subcommand. Like diff(1) it exits with 1 when the inputs
+// differ significantly.
+func diffCommand(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 0.1, "relative change below which numbers are considered equal")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: gpumon-go diff [-threshold 0.1] before.json after.json")
+		return 2
+	}
+	before, err := loadCapture(fs.Arg(0))
+	if err != nil {
+		log.Printf("Unable to read %s: %v", fs.Arg(0), err)
+		return 2
+	}
+	after, err := loadCapture(fs.Arg(1))
+	if err != nil {
+		log.Printf("Unable to read %s: %v", fs.Arg(1), err)
+		return 2
+	}
+
+	var keys []string
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tFIELD\tBEFORE\tAFTER\tCHANGE")
+	changed := false
+	for _, key := range keys {
+		b, a := before[key], after[key]
+		if b == nil || a == nil {
+			change := "added"
+			if a == nil {
+				change = "removed"
+			}
+			fmt.Fprintf(w, "%s\t-\t\t\t%s\n", key, change)
+			changed = true
+			continue
+		}
+		var fields []string
+		for field := range b {
+			fields = append(fields, field)
+		}
+		for field := range a {
+			if _, ok := b[field]; !ok {
+				fields = append(fields, field)
+			}
+		}
+		slices.Sort(fields)
+		for _, field := range fields {
+			if change, ok := compareField(field, b[field], a[field], *threshold); ok {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key, field, formatValue(b[field]), formatValue(a[field]), change)
+				changed = true
+			}
+		}
+	}
+	w.Flush()
+	if changed {
+		return 1
+	}
+	return 0
+}
+
+// compareField describes a significant change of a field, nil values mean it is missing.
+func compareField(field string, before, after any, threshold float64) (string, bool) {
+	switch {
+	case before == nil && after == nil:
+		return "", false
+	case before == nil:
+		return "added", true
+	case after == nil:
+		return "removed", true
+	}
+	b, bok := before.(float64)
+	a, aok := after.(float64)
+	if !bok || !aok {
+		if fmt.Sprint(before) == fmt.Sprint(after) {
+			return "", false
+		}
+		return "changed", true
+	}
+	if a == b {
+		return "", false
+	}
+	for _, counter := range diffCounters {
+		if strings.Contains(field, counter) {
+			return fmt.Sprintf("%+g", a-b), true
+		}
+	}
+	if math.Abs(a-b) <= threshold*math.Max(math.Abs(a), math.Abs(b)) {
+		return "", false
+	}
+	if b == 0 {
+		return fmt.Sprintf("%+g", a-b), true
+	}
+	return fmt.Sprintf("%+.1f%%", (a-b)/math.Abs(b)*100), true
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "-"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// loadCapture reads a snapshot or NDJSON agent output into flattened fields keyed by device,
+// group or "system". Of several samples of a device the last one is used and events are
+// skipped.
+func loadCapture(name string) (map[string]map[string]any, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	capture := make(map[string]map[string]any)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var record map[string]any
+		if err := dec.Decode(&record); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		records := []map[string]any{record}
+		// A snapshot, group samples count their devices instead
+		if devices, ok := record["devices"].([]any); ok {
+			delete(record, "devices")
+			capture["system"] = flatten(record)
+			records = records[:0]
+			for _, d := range devices {
+				if d, ok := d.(map[string]any); ok {
+					records = append(records, d)
+				}
+			}
+		}
+		for _, r := range records {
+			if _, ok := r["event"]; ok {
+				continue
+			}
+			capture[captureKey(r)] = flatten(r)
+		}
+	}
+	return capture, nil
+}
+
+func captureKey(record map[string]any) string {
+	if group, ok := record["group"].(string); ok {
+		return "group " + group
+	}
+	if uuid, ok := record["uuid"].(string); ok && uuid != "" {
+		return uuid
+	}
+	return "GPU " + formatValue(record["index"])
+}
+
+// flatten turns nested objects into dotted field names and drops the ignored fields.
+func flatten(record map[string]any) map[string]any {
+	fields := make(map[string]any)
+	var walk func(prefix string, v map[string]any)
+	walk = func(prefix string, v map[string]any) {
+		for key, value := range v {
+			if prefix == "" && slices.Contains(diffIgnored, key) {
+				continue
+			}
+			if nested, ok := value.(map[string]any); ok {
+				walk(prefix+key+".", nested)
+				continue
+			}
+			fields[prefix+key] = value
+		}
+	}
+	walk("", record)
+	return fields
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// snsMaxSubject is the longest subject SNS accepts.
+const snsMaxSubject = 100
+
+// SNSConfig publishes device lifecycle events, e.g. alerts, to an SNS topic. Events limits the
+// events sent, all of them by default.
+type SNSConfig struct {
+	TopicARN string   `json:"topic_arn"`
+	Events   []string `json:"events"`
+}
+
+// SNSTopic publishes events in the background and retries failed publishes with backoff like
+// webhooks. Every message carries the event name as the event attribute, so subscriptions
+// can filter on it.
+type SNSTopic struct {
+	topic  string
+	events []string
+	host   string
+	client *sns.Client
+	queue  chan DeviceEvent
+}
+
+func NewSNSTopic(ctx context.Context, cfg SNSConfig) (*SNSTopic, error) {
+	topic, err := arn.Parse(cfg.TopicARN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic ARN %s: %v", cfg.TopicARN, err)
+	}
+	awsCfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %v", err)
+	}
+	// The SDK resolves the endpoint in the partition of the topic's region, or from
+	// AWS_ENDPOINT_URL_SNS
+	awsCfg.Region = topic.Region
+	return &SNSTopic{
+		topic:  cfg.TopicARN,
+		events: cfg.Events,
+		host:   hostName(),
+		client: sns.NewFromConfig(awsCfg),
+		queue:  make(chan DeviceEvent, webhookQueueSize),
+	}, nil
+}
+
+// Send queues the event if the topic subscribes to it, without blocking the caller.
+func (t *SNSTopic) Send(e DeviceEvent) {
+	if len(t.events) > 0 && !slices.Contains(t.events, e.Event) {
+		return
+	}
+	select {
+	case t.queue <- e:
+	default:
+		log.Printf("SNS topic %s is not keeping up, dropped %s event of device %d", t.topic, e.Event, e.Index)
+	}
+}
+
+// Run publishes queued events. It never returns.
+func (t *SNSTopic) Run() {
+	for e := range t.queue {
+		var err error
+		for attempt := 0; attempt < webhookAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = t.publish(e); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to publish %s event of device %d to %s: %v", e.Event, e.Index, t.topic, err)
+		}
+	}
+}
+
+func (t *SNSTopic) publish(e DeviceEvent) error {
+	message, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = t.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(t.topic),
+		Subject:  aws.String(t.subject(e)),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"event": {DataType: aws.String("String"), StringValue: aws.String(e.Event)},
+		},
+	})
+	return err
+}
+
+// subject summarizes the event for email subscriptions, e.g.
+// "gpumon-go alert_firing temperature on node-1 GPU 0".
+func (t *SNSTopic) subject(e DeviceEvent) string {
+	subject := "gpumon-go " + e.Event
+	if e.Alert != "" {
+		subject += " " + e.Alert
+	}
+	subject += " on " + t.host
+	if e.Index != alertNode {
+		subject += fmt.Sprintf(" GPU %d", e.Index)
+	}
+	if len(subject) > snsMaxSubject {
+		subject = subject[:snsMaxSubject]
+	}
+	return subject
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// statisticSets accumulates datums into one CloudWatch statistic set per metric, dimensions
+// and window, so a window of samples costs a single datum.
+type statisticSets struct {
+	sets map[string]*statisticSet
+	// keys are the open sets in the order they were started, so flushes keep that order
+	keys []string
+}
+
+type statisticSet struct {
+	datum types.MetricDatum
+	end   time.Time
+}
+
+func newStatisticSets() *statisticSets {
+	return &statisticSets{sets: make(map[string]*statisticSet)}
+}
+
+// Add adds the value, or statistic set, of the datum to the set of the window its timestamp
+// falls in. Windows are aligned to the wall clock, e.g. to the minute.
+func (a *statisticSets) Add(d types.MetricDatum, window time.Duration) {
+	ts := aws.ToTime(d.Timestamp)
+	// Adding keeps the monotonic reading of ts, so the start is re-anchored like the sample
+	start := ts.Add(-ts.Sub(ts.Truncate(window)))
+	var key strings.Builder
+	key.WriteString(start.Round(0).Format(time.RFC3339Nano))
+	key.WriteString("\x00" + aws.ToString(d.MetricName))
+	for _, dim := range d.Dimensions {
+		key.WriteString("\x00" + aws.ToString(dim.Name) + "=" + aws.ToString(dim.Value))
+	}
+	add := d.StatisticValues
+	if add == nil {
+		value := aws.ToFloat64(d.Value)
+		add = &types.StatisticSet{Minimum: aws.Float64(value), Maximum: aws.Float64(value), Sum: aws.Float64(value), SampleCount: aws.Float64(1)}
+	}
+	set, ok := a.sets[key.String()]
+	if !ok {
+		d.Timestamp = aws.Time(start)
+		d.Value = nil
+		d.StatisticValues = &types.StatisticSet{
+			Minimum:     aws.Float64(*add.Minimum),
+			Maximum:     aws.Float64(*add.Maximum),
+			Sum:         aws.Float64(*add.Sum),
+			SampleCount: aws.Float64(*add.SampleCount),
+		}
+		a.sets[key.String()] = &statisticSet{datum: d, end: start.Add(window)}
+		a.keys = append(a.keys, key.String())
+		return
+	}
+	s := set.datum.StatisticValues
+	s.Minimum = aws.Float64(min(*s.Minimum, *add.Minimum))
+	s.Maximum = aws.Float64(max(*s.Maximum, *add.Maximum))
+	s.Sum = aws.Float64(*s.Sum + *add.Sum)
+	s.SampleCount = aws.Float64(*s.SampleCount + *add.SampleCount)
+}
+
+// Flush removes and returns the sets of the windows that ended by now, or all of them.
+func (a *statisticSets) Flush(now time.Time, all bool) []types.MetricDatum {
+	var data []types.MetricDatum
+	open := a.keys[:0]
+	for _, key := range a.keys {
+		set := a.sets[key]
+		if !all && now.Before(set.end) {
+			open = append(open, key)
+			continue
+		}
+		data = append(data, set.datum)
+		delete(a.sets, key)
+	}
+	a.keys = open
+	return data
+}
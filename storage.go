@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageMetrics correlates the GPU's PCIe traffic with NVMe reads to spot input pipelines
+// that cannot keep the GPU fed.
+type StorageMetrics struct {
+	PcieRx    float64            `json:"pcie_rx_bytes_per_second"`
+	PcieTx    float64            `json:"pcie_tx_bytes_per_second"`
+	NVMeRead  map[string]float64 `json:"nvme_read_bytes_per_second,omitempty"`
+	NVMeBusy  map[string]float32 `json:"nvme_busy,omitempty"`
+	Saturated float32            `json:"loader_saturation"`
+}
+
+type diskCounters struct {
+	sectorsRead uint64
+	ioTicks     uint64
+}
+
+type nvmeStats struct {
+	read map[string]float64
+	busy map[string]float32
+}
+
+// StorageCollector turns the NVMe block device counters into per-second rates. It is shared
+// between the device pollers in the same way as HostCollector.
+type StorageCollector struct {
+	mu      sync.Mutex
+	last    time.Time
+	cached  nvmeStats
+	prev    map[string]diskCounters
+	sysRoot string
+}
+
+func NewStorageCollector() *StorageCollector {
+	return &StorageCollector{sysRoot: "/sys"}
+}
+
+// Collect combines the device's PCIe throughput with the current NVMe rates.
+func (s *StorageCollector) Collect(d Device, gpuUsage uint) (StorageMetrics, error) {
+	rx, tx, err := d.GetPcieThroughput()
+	if err != nil {
+		return StorageMetrics{}, err
+	}
+	stats, err := s.nvme()
+	if err != nil {
+		return StorageMetrics{}, err
+	}
+	metrics := StorageMetrics{PcieRx: rx, PcieTx: tx, NVMeRead: stats.read, NVMeBusy: stats.busy}
+	metrics.Saturated = loaderSaturation(stats.busy, gpuUsage)
+	return metrics, nil
+}
+
+// Reset drops the previous NVMe counters, so the next collection reports no rates.
+func (s *StorageCollector) Reset() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = time.Time{}
+}
+
+// loaderSaturation is high when the busiest drive is close to fully utilized while the GPU
+// sits idle, which is the signature of a storage-bound data loader. It ranges from 0 to 100.
+func loaderSaturation(busy map[string]float32, gpuUsage uint) float32 {
+	var busiest float32
+	for _, b := range busy {
+		busiest = max(busiest, b)
+	}
+	idle := 1 - float32(min(gpuUsage, 100))/100
+	return busiest * idle
+}
+
+func (s *StorageCollector) nvme() (nvmeStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if !s.last.IsZero() && now.Sub(s.last) < hostMinInterval {
+		return s.cached, nil
+	}
+	counters, err := s.readCounters()
+	if err != nil {
+		return nvmeStats{}, err
+	}
+	stats := nvmeStats{read: make(map[string]float64), busy: make(map[string]float32)}
+	if !s.last.IsZero() {
+		elapsed := now.Sub(s.last)
+		for name, cur := range counters {
+			prev, ok := s.prev[name]
+			// The counters restart when a drive is re-attached, that interval has no rate
+			if !ok || cur.sectorsRead < prev.sectorsRead || cur.ioTicks < prev.ioTicks {
+				continue
+			}
+			stats.read[name] = float64(cur.sectorsRead-prev.sectorsRead) * 512 / elapsed.Seconds()
+			busy := 100 * float32(cur.ioTicks-prev.ioTicks) / float32(elapsed.Milliseconds())
+			stats.busy[name] = min(busy, 100)
+		}
+	}
+	s.last = now
+	s.prev = counters
+	s.cached = stats
+	return stats, nil
+}
+
+// readCounters parses /sys/block/nvme*/stat, see Documentation/block/stat.rst for the layout.
+func (s *StorageCollector) readCounters() (map[string]diskCounters, error) {
+	matches, err := filepath.Glob(filepath.Join(s.sysRoot, "block", "nvme*", "stat"))
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]diskCounters, len(matches))
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read block device stats: %v", err)
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) < 10 {
+			continue
+		}
+		sectors, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		ticks, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(filepath.Dir(match))
+		counters[name] = diskCounters{sectorsRead: sectors, ioTicks: ticks}
+	}
+	return counters, nil
+}
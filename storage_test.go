@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorageCollectorNVMe(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur diskCounters
+		want      bool
+	}{
+		{name: "counters advanced", prev: diskCounters{1000, 100}, cur: diskCounters{3000, 600}, want: true},
+		{name: "counters unchanged", prev: diskCounters{1000, 100}, cur: diskCounters{1000, 100}, want: true},
+		{name: "sectors went backwards", prev: diskCounters{1000, 100}, cur: diskCounters{10, 600}},
+		{name: "ticks went backwards", prev: diskCounters{1000, 100}, cur: diskCounters{3000, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "block", "nvme0n1")
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			stat := fmt.Sprintf("0 0 %d 0 0 0 0 0 0 %d 0\n", tt.cur.sectorsRead, tt.cur.ioTicks)
+			if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s := &StorageCollector{
+				sysRoot: root,
+				last:    time.Now().Add(-time.Second),
+				prev:    map[string]diskCounters{"nvme0n1": tt.prev},
+			}
+			stats, err := s.nvme()
+			if err != nil {
+				t.Fatalf("nvme() error = %v", err)
+			}
+			read, ok := stats.read["nvme0n1"]
+			if ok != tt.want {
+				t.Fatalf("nvme() read = %v, reported %v, want %v", stats.read, ok, tt.want)
+			}
+			if ok && (read < 0 || read > 2000*512*1.1) {
+				t.Errorf("nvme() read = %v bytes per second", read)
+			}
+			if busy := stats.busy["nvme0n1"]; busy < 0 || busy > 100 {
+				t.Errorf("nvme() busy = %v, want 0 to 100", busy)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultTenantRegex recognizes systemd user slices, Kubernetes pods and Docker containers.
+// The first non-empty capture group becomes the tenant.
+const defaultTenantRegex = `user-(\d+)\.slice|pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})|docker[-/]([0-9a-f]{12})`
+
+// TenantConfig selects how processes on a GPU are attributed to tenants. Source is "cgroup"
+// (default), where Regex is matched against the process cgroup path, or "userns", where the
+// tenant is the host UID its user namespace maps root to, or its own UID outside a namespace.
+type TenantConfig struct {
+	Source string `json:"source"`
+	Regex  string `json:"regex"`
+}
+
+// TenantResolver attributes the processes running on a device to tenants.
+type TenantResolver struct {
+	source   string
+	re       *regexp.Regexp
+	procRoot string
+}
+
+func NewTenantResolver(cfg TenantConfig) (*TenantResolver, error) {
+	source := cfg.Source
+	if source == "" {
+		source = "cgroup"
+	}
+	if source != "cgroup" && source != "userns" {
+		return nil, fmt.Errorf("tenant: unknown source %q", cfg.Source)
+	}
+	regex := cfg.Regex
+	if regex == "" {
+		regex = defaultTenantRegex
+	}
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return nil, fmt.Errorf("tenant: invalid regex: %v", err)
+	}
+	return &TenantResolver{source: source, re: re, procRoot: "/proc"}, nil
+}
+
+// Tenants returns the sorted, distinct tenants of the given processes. Processes that exited
+// or cannot be attributed are skipped.
+func (t *TenantResolver) Tenants(pids []uint32) []string {
+	var tenants []string
+	for _, pid := range pids {
+		var tenant string
+		if t.source == "userns" {
+			tenant = t.userNamespaceTenant(pid)
+		} else {
+			tenant = t.cgroupTenant(pid)
+		}
+		if tenant != "" && !slices.Contains(tenants, tenant) {
+			tenants = append(tenants, tenant)
+		}
+	}
+	slices.Sort(tenants)
+	return tenants
+}
+
+func (t *TenantResolver) cgroupTenant(pid uint32) string {
+	f, err := os.Open(filepath.Join(t.procRoot, strconv.Itoa(int(pid)), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controllers:path, cgroup v2 has a single line with ID 0
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		match := t.re.FindStringSubmatch(parts[2])
+		if match == nil {
+			continue
+		}
+		if len(match) == 1 {
+			return match[0]
+		}
+		for _, group := range match[1:] {
+			if group != "" {
+				return group
+			}
+		}
+	}
+	return ""
+}
+
+func (t *TenantResolver) userNamespaceTenant(pid uint32) string {
+	dir := filepath.Join(t.procRoot, strconv.Itoa(int(pid)))
+	data, err := os.ReadFile(filepath.Join(dir, "uid_map"))
+	if err != nil {
+		return ""
+	}
+	// inside-ID outside-ID length, the initial namespace maps the whole range onto itself
+	fields := strings.Fields(string(data))
+	if len(fields) >= 3 && !(fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295") {
+		return "userns:" + fields[1]
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return ""
+	}
+	// /proc/<pid> is owned by the effective UID of the process
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return "uid:" + strconv.Itoa(int(stat.Uid))
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAlertsConfig turns on the built-in thermal and power alerts, with the thresholds of
+// each GPU's model. Models adds or overrides thresholds, keyed by a part of the model name
+// such as "T4" or "H100", and For is how long a threshold has to be crossed (default 5m).
+type DefaultAlertsConfig struct {
+	Models map[string]GPUEnvelope `json:"models"`
+	For    Duration               `json:"for"`
+}
+
+// GPUEnvelope is the temperature in °C and the power in watts a GPU model should stay
+// within. A zero value turns its alert off.
+type GPUEnvelope struct {
+	Temperature float64 `json:"temperature"`
+	Power       float64 `json:"power"`
+}
+
+// gpuEnvelopes are the built-in thresholds, the slowdown temperature and the board power of
+// each model. The first model the device name contains applies, so variants come first.
+var gpuEnvelopes = []struct {
+	model    string
+	envelope GPUEnvelope
+}{
+	{"H200", GPUEnvelope{Temperature: 87, Power: 700}},
+	{"H100 PCIe", GPUEnvelope{Temperature: 87, Power: 350}},
+	{"H100 NVL", GPUEnvelope{Temperature: 87, Power: 400}},
+	{"H100", GPUEnvelope{Temperature: 87, Power: 700}},
+	{"A100-PCIE", GPUEnvelope{Temperature: 85, Power: 300}},
+	{"A100", GPUEnvelope{Temperature: 85, Power: 400}},
+	{"A10G", GPUEnvelope{Temperature: 85, Power: 300}},
+	{"A10", GPUEnvelope{Temperature: 85, Power: 150}},
+	{"L40S", GPUEnvelope{Temperature: 85, Power: 350}},
+	{"L40", GPUEnvelope{Temperature: 85, Power: 300}},
+	{"L4", GPUEnvelope{Temperature: 85, Power: 72}},
+	{"T4", GPUEnvelope{Temperature: 85, Power: 70}},
+	{"V100", GPUEnvelope{Temperature: 85, Power: 300}},
+}
+
+// The default alerts are named after what they watch, an alert of the same name in the
+// alerts config replaces them.
+const (
+	defaultTemperatureAlert = "gpu_temperature_high"
+	defaultPowerAlert       = "gpu_power_high"
+)
+
+func (c *DefaultAlertsConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.For.Duration < 0 {
+		return fmt.Errorf("default_alerts: for must not be negative")
+	}
+	for model, e := range c.Models {
+		if model == "" {
+			return fmt.Errorf("default_alerts: model must not be empty")
+		}
+		if e.Temperature < 0 || e.Power < 0 {
+			return fmt.Errorf("default_alerts: thresholds of %s must not be negative", model)
+		}
+	}
+	return nil
+}
+
+// envelope returns the thresholds of the model, the configured ones before the built-in
+// ones and longer model names before shorter ones.
+func (c *DefaultAlertsConfig) envelope(model string) (string, GPUEnvelope, bool) {
+	keys := make([]string, 0, len(c.Models))
+	for k := range c.Models {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(b), len(a)), strings.Compare(a, b))
+	})
+	for _, k := range keys {
+		if strings.Contains(model, k) {
+			return k, c.Models[k], true
+		}
+	}
+	for _, e := range gpuEnvelopes {
+		if strings.Contains(model, e.model) {
+			return e.model, e.envelope, true
+		}
+	}
+	return "", GPUEnvelope{}, false
+}
+
+// Discover adds the device to the default alerts of its model. The alerts of every model
+// are separate rules, matching their devices by UUID.
+func (a *Alerts) Discover(d Device) {
+	if a == nil || a.defaults == nil {
+		return
+	}
+	name, envelope, ok := a.defaults.envelope(deviceModel(d))
+	if !ok {
+		log.Printf("Device %d has no default alert thresholds for its model", d.Index)
+		return
+	}
+	wait := a.defaults.For.Duration
+	if wait == 0 {
+		wait = 5 * time.Minute
+	}
+	id := d.UUID
+	if id == "" {
+		id = strconv.Itoa(d.Index)
+	}
+	for _, ac := range []AlertConfig{
+		{Name: defaultTemperatureAlert, Expr: "temperature", Above: &envelope.Temperature, For: Duration{wait}},
+		{Name: defaultPowerAlert, Expr: "power", Above: &envelope.Power, For: Duration{wait}},
+	} {
+		if *ac.Above == 0 || a.configured(ac.Name) {
+			continue
+		}
+		i := slices.IndexFunc(a.rules, func(r *alertRule) bool {
+			return r.builtin && r.Name == ac.Name && *r.Above == *ac.Above
+		})
+		if i < 0 {
+			e, _ := parseExpr(ac.Expr)
+			a.rules = append(a.rules, &alertRule{AlertConfig: ac, expr: e, states: make(map[int]*alertState), values: make(map[int]float64), builtin: true})
+			i = len(a.rules) - 1
+		}
+		a.rules[i].Match = append(a.rules[i].Match, id)
+	}
+	log.Printf("Device %d uses the default alert thresholds of %s: %g°C and %gW", d.Index, name, envelope.Temperature, envelope.Power)
+}
+
+// configured reports whether the alerts config has an alert of that name.
+func (a *Alerts) configured(name string) bool {
+	return slices.ContainsFunc(a.rules, func(r *alertRule) bool { return !r.builtin && r.Name == name })
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TimeInStateConfig tracks how long every device spent in each utilization band and
+// performance state over a sliding Window (default 5m).
+type TimeInStateConfig struct {
+	Window Duration `json:"window"`
+}
+
+// utilizationBands are the utilization bands by name, a band holds the utilization below its
+// limit and at or above the limit of the previous one.
+var utilizationBands = []struct {
+	name  string
+	below uint
+}{
+	{"idle", 1},
+	{"low", 30},
+	{"medium", 70},
+	{"high", 101},
+}
+
+// TimeInState is the seconds a device spent in each utilization band and, with the throttle
+// extended group, each performance state within the window.
+type TimeInState struct {
+	Utilization map[string]float64 `json:"utilization"`
+	PStates     map[string]float64 `json:"pstates,omitempty"`
+}
+
+// stateSegment is a stretch of time between two polls, in the states of the first.
+type stateSegment struct {
+	start, end time.Time
+	band       string
+	pstate     string
+}
+
+type deviceStates struct {
+	last     time.Time
+	band     string
+	pstate   string
+	segments []stateSegment
+}
+
+// TimeInStateTracker keeps the window of every device. It is shared by the pollers.
+type TimeInStateTracker struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	devices map[int]*deviceStates
+}
+
+func NewTimeInStateTracker(cfg TimeInStateConfig) *TimeInStateTracker {
+	t := &TimeInStateTracker{window: cfg.Window.Duration, devices: make(map[int]*deviceStates)}
+	if t.window == 0 {
+		t.window = 5 * time.Minute
+	}
+	return t
+}
+
+// utilizationBand returns the name of the band the utilization falls in.
+func utilizationBand(usage uint) string {
+	for _, b := range utilizationBands {
+		if usage < b.below {
+			return b.name
+		}
+	}
+	return utilizationBands[len(utilizationBands)-1].name
+}
+
+// Observe records the states of the device at now, pstate is nil when it is not read, and
+// returns the time spent in each state within the window. The time since the previous poll
+// counts towards the states seen then.
+func (t *TimeInStateTracker) Observe(index int, usage uint, pstate *int, now time.Time) TimeInState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.devices[index]
+	if !ok {
+		d = &deviceStates{}
+		t.devices[index] = d
+	}
+	if !d.last.IsZero() && now.After(d.last) {
+		d.segments = append(d.segments, stateSegment{start: d.last, end: now, band: d.band, pstate: d.pstate})
+	}
+	d.last, d.band, d.pstate = now, utilizationBand(usage), ""
+	if pstate != nil {
+		d.pstate = "P" + strconv.Itoa(*pstate)
+	}
+	start := now.Add(-t.window)
+	d.segments = slices.DeleteFunc(d.segments, func(s stateSegment) bool { return !s.end.After(start) })
+
+	states := TimeInState{Utilization: make(map[string]float64, len(utilizationBands))}
+	for _, b := range utilizationBands {
+		states.Utilization[b.name] = 0
+	}
+	for _, s := range d.segments {
+		seconds := s.end.Sub(maxTime(s.start, start)).Seconds()
+		states.Utilization[s.band] += seconds
+		if s.pstate != "" {
+			if states.PStates == nil {
+				states.PStates = make(map[string]float64)
+			}
+			states.PStates[s.pstate] += seconds
+		}
+	}
+	return states
+}
+
+// pstateNames returns the performance states the device spent time in, from P0.
+func (s TimeInState) pstateNames() []string {
+	names := make([]string, 0, len(s.PStates))
+	for name := range s.PStates {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		x, _ := strconv.Atoi(a[1:])
+		y, _ := strconv.Atoi(b[1:])
+		return x - y
+	})
+	return names
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
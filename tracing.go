@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceQueueSize     = 4096
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// TracingConfig traces every collect and export cycle. Spans are sent as OTLP/JSON to
+// Endpoint, e.g. http://localhost:4318/v1/traces, and cycles slower than Slow are logged
+// with the time spent in each stage.
+type TracingConfig struct {
+	Endpoint string   `json:"endpoint"`
+	Slow     Duration `json:"slow"`
+}
+
+// Tracer records spans and exports them in the background. A nil Tracer starts nil spans,
+// which record nothing.
+type Tracer struct {
+	endpoint string
+	slow     time.Duration
+	client   *http.Client
+	queue    chan *Span
+}
+
+func NewTracer(cfg TracingConfig) *Tracer {
+	t := &Tracer{endpoint: cfg.Endpoint, slow: cfg.Slow.Duration, client: &http.Client{Timeout: 10 * time.Second}}
+	if t.endpoint != "" {
+		t.queue = make(chan *Span, traceQueueSize)
+		go t.export()
+	}
+	return t
+}
+
+// Span is a timed stage of a cycle. All methods are safe to call on a nil Span.
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	status  *otlpStatus
+	root    *Span
+	// mu guards children, the spans of one cycle may end concurrently, e.g. parallel requests
+	mu       sync.Mutex
+	children []*Span
+}
+
+// Start begins the root span of a new trace.
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, start: time.Now()}
+	randomID(s.traceID[:])
+	randomID(s.id[:])
+	s.root = s
+	return s
+}
+
+// Child begins a span nested under s.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{tracer: s.tracer, traceID: s.traceID, parent: s.id, name: name, start: time.Now(), root: s.root}
+	randomID(c.id[:])
+	return c
+}
+
+// SetAttr annotates the span.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+// SetError sets the status of the span, an error or OK when err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.status = &otlpStatus{Code: 2, Message: err.Error()}
+		return
+	}
+	s.status = &otlpStatus{Code: 1}
+}
+
+// TraceID returns the hex trace ID that ties a record to its spans, or "" without tracing.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// End finishes the span. Ending the root span logs the cycle when it was slow.
+func (s *Span) End() {
+	if s == nil || !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	if s.root != s {
+		s.root.mu.Lock()
+		s.root.children = append(s.root.children, s)
+		s.root.mu.Unlock()
+	} else if t := s.tracer; t.slow > 0 && s.end.Sub(s.start) > t.slow {
+		s.mu.Lock()
+		stages := make([]string, len(s.children))
+		for i, c := range s.children {
+			stages[i] = fmt.Sprintf("%s %v", c.name, c.end.Sub(c.start))
+		}
+		s.mu.Unlock()
+		log.Printf("Slow %s cycle %s took %v: %s", s.name, s.TraceID(), s.end.Sub(s.start), strings.Join(stages, ", "))
+	}
+	if s.tracer.queue != nil {
+		select {
+		case s.tracer.queue <- s:
+		default:
+			// Tracing must never hold up the samples, spans are dropped when the exporter lags
+		}
+	}
+}
+
+func randomID(b []byte) {
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+}
+
+// export batches finished spans and posts them to the OTLP endpoint.
+func (t *Tracer) export() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.post(batch); err != nil {
+			log.Printf("Unable to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+// otlpStatus is the status of a span, Code 1 is OK and 2 an error.
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+func (t *Tracer) post(batch []*Span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan{
+			TraceID: s.TraceID(),
+			SpanID:  hex.EncodeToString(s.id[:]),
+			Name:    s.name,
+			// SPAN_KIND_INTERNAL
+			Kind:   1,
+			Start:  strconv.FormatInt(s.start.UnixNano(), 10),
+			End:    strconv.FormatInt(s.end.UnixNano(), 10),
+			Status: s.status,
+		}
+		if s.root != s {
+			spans[i].ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for k, v := range s.attrs {
+			spans[i].Attributes = append(spans[i].Attributes, otlpAttribute{Key: k, Value: map[string]string{"stringValue": v}})
+		}
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: map[string]string{"stringValue": "gpumon-go"}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "gpumon-go"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SinkTuning tunes how an exporter batches and sends its data. Zero fields use the defaults
+// of the exporter.
+type SinkTuning struct {
+	// FlushSize is the most items, samples or CloudWatch datums, sent in one request. A flush
+	// starts early once that many are queued.
+	FlushSize int `json:"flush_size"`
+	// FlushInterval is how often the queued items are sent
+	FlushInterval Duration `json:"flush_interval"`
+	// MaxInFlight is how many requests of a flush are sent at the same time
+	MaxInFlight int `json:"max_in_flight"`
+	// MaxRetry is how long failed items are retried before they are dropped
+	MaxRetry Duration `json:"max_retry"`
+}
+
+// withDefaults fills the zero fields from defaults.
+func (t SinkTuning) withDefaults(defaults SinkTuning) SinkTuning {
+	if t.FlushSize == 0 {
+		t.FlushSize = defaults.FlushSize
+	}
+	if t.FlushInterval.Duration == 0 {
+		t.FlushInterval = defaults.FlushInterval
+	}
+	if t.MaxInFlight == 0 {
+		t.MaxInFlight = defaults.MaxInFlight
+	}
+	if t.MaxRetry.Duration == 0 {
+		t.MaxRetry = defaults.MaxRetry
+	}
+	return t
+}
+
+// validate checks that no field is negative, name is the config key of the exporter.
+func (t SinkTuning) validate(name string) error {
+	if t.FlushSize < 0 || t.FlushInterval.Duration < 0 || t.MaxInFlight < 0 || t.MaxRetry.Duration < 0 {
+		return fmt.Errorf("%s: tuning flush_size, flush_interval, max_in_flight and max_retry must not be negative", name)
+	}
+	return nil
+}
+
+// sendConcurrently calls send for each of n requests, at most inFlight at the same time, and
+// returns their errors by request.
+func sendConcurrently(n, inFlight int, send func(i int) error) []error {
+	errs := make([]error, n)
+	slots := make(chan struct{}, max(inFlight, 1))
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = send(i)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// pendingRequest is the body of a failed request, retried on the next flushes until
+// MaxRetry after its first failure.
+type pendingRequest struct {
+	body     []byte
+	failedAt time.Time
+	// retries counts the flushes the request failed in
+	retries int
+}
+
+// sendRequests posts the pending requests and then bodies, MaxInFlight at a time. Every
+// request is traced as a child span name of span, with how often it was retried and its
+// status. It returns the failed requests to retry on the next flush, how many expired and
+// were dropped, and the first error.
+func (t SinkTuning) sendRequests(pending []pendingRequest, bodies [][]byte, span *Span, name string, post func(body []byte, attempt *Span) error) ([]pendingRequest, int, error) {
+	requests := slices.Clone(pending)
+	for _, body := range bodies {
+		requests = append(requests, pendingRequest{body: body})
+	}
+	errs := sendConcurrently(len(requests), t.MaxInFlight, func(i int) error {
+		attempt := span.Child(name)
+		attempt.SetAttr("retry", strconv.Itoa(requests[i].retries))
+		attempt.SetAttr("bytes", strconv.Itoa(len(requests[i].body)))
+		err := post(requests[i].body, attempt)
+		attempt.SetError(err)
+		attempt.End()
+		return err
+	})
+	now := time.Now()
+	var retry []pendingRequest
+	expired := 0
+	var firstErr error
+	for i, r := range requests {
+		if errs[i] == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = errs[i]
+		}
+		if r.failedAt.IsZero() {
+			r.failedAt = now
+		}
+		if now.Sub(r.failedAt) >= t.MaxRetry.Duration {
+			expired++
+			continue
+		}
+		r.retries++
+		retry = append(retry, r)
+	}
+	return retry, expired, firstErr
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Build information, set by packagers with e.g.
+// -ldflags "-X main.version=1.2.0 -X main.commit=abc123 -X main.date=2024-01-02T03:04:05Z".
+// Builds from a git checkout fill in the commit and date themselves.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// BuildInfo describes the binary for fleet inventory tooling.
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	Date      string   `json:"date,omitempty"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Backends  []string `json:"backends"`
+	// FIPS is set in builds using the FIPS 140 validated crypto module
+	FIPS bool `json:"fips"`
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Backends:  backendNames(),
+		FIPS:      fipsBuild,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	// go install records the module version
+	if info.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = s.Value
+		case s.Key == "vcs.time" && info.Date == "":
+			info.Date = s.Value
+		}
+	}
+	return info
+}
+
+// versionCommand implements the version subcommand and returns the exit code.
+func versionCommand(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "print the build information as JSON")
+	fs.Parse(args)
+
+	info := buildInfo()
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			log.Fatalf("Unable to marshal build information to JSON: %v", err)
+		}
+		return 0
+	}
+	fmt.Printf("gpumon-go %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Printf("commit: %s\n", info.Commit)
+	}
+	if info.Date != "" {
+		fmt.Printf("built: %s\n", info.Date)
+	}
+	fmt.Printf("go: %s %s\n", info.GoVersion, info.Platform)
+	fmt.Printf("backends: %s\n", strings.Join(info.Backends, ", "))
+	if info.FIPS {
+		fmt.Println("fips: yes")
+	}
+	return 0
+}
+
+// serveVersion serves the build information as JSON.
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildInfo())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	webhookQueueSize = 100
+	webhookAttempts  = 3
+)
+
+// deviceEvents are the device events a webhook can subscribe to.
+var deviceEvents = []string{"discovered", "degraded", "lost", "recovered", "reset", "power_limit_applied", "power_limit_restored", "alert_firing", "alert_resolved",
+	"xid", "double_bit_ecc", "single_bit_ecc", "power_source_change", "slowdown", "slowdown_cleared"}
+
+// WebhookConfig posts device lifecycle events as JSON to URL. Events limits the events sent,
+// all of them by default.
+type WebhookConfig struct {
+	URL     string            `json:"url"`
+	Events  []string          `json:"events"`
+	Headers map[string]string `json:"headers"`
+	Timeout Duration          `json:"timeout"`
+	// Compression gzips the posted events
+	Compression *CompressionConfig `json:"compression"`
+}
+
+// Webhook delivers events in the background and retries failed deliveries with backoff.
+type Webhook struct {
+	url      string
+	events   []string
+	headers  map[string]string
+	client   *http.Client
+	compress *compressor
+	queue    chan DeviceEvent
+}
+
+func NewWebhook(cfg WebhookConfig) *Webhook {
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &Webhook{
+		url:      cfg.URL,
+		events:   cfg.Events,
+		headers:  cfg.Headers,
+		client:   &http.Client{Timeout: timeout},
+		compress: newCompressor(cfg.Compression),
+		queue:    make(chan DeviceEvent, webhookQueueSize),
+	}
+}
+
+// Send queues the event if the webhook subscribes to it, without blocking the caller.
+func (w *Webhook) Send(e DeviceEvent) {
+	if len(w.events) > 0 && !slices.Contains(w.events, e.Event) {
+		return
+	}
+	select {
+	case w.queue <- e:
+	default:
+		log.Printf("Webhook %s is not keeping up, dropped %s event of device %d", w.url, e.Event, e.Index)
+	}
+}
+
+// Run delivers queued events. It never returns.
+func (w *Webhook) Run() {
+	for e := range w.queue {
+		var err error
+		for attempt := 0; attempt < webhookAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = w.post(e); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to deliver %s event of device %d to %s: %v", e.Event, e.Index, w.url, err)
+		}
+	}
+}
+
+func (w *Webhook) post(e DeviceEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := w.compress.newRequest(context.Background(), w.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}